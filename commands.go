@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"pebble-dev/rebblestore-api/rebbleHandlers"
+
+	"github.com/gorilla/handlers"
+)
+
+// Exit codes of the commands
+const (
+	exitSuccess = 0
+	// exitFailure means the command failed
+	exitFailure = 1
+	// exitUsage means the command line is invalid
+	exitUsage = 2
+	// exitDatabase means the database could not be opened or migrated
+	exitDatabase = 3
+	// exitProblems means `check` found problems in the catalog, or that
+	// `import-archive` skipped files
+	exitProblems = 4
+)
+
+// command is a subcommand of rebblestore-api. Its output goes to stdout, and
+// its progress is logged to logger (stderr).
+type command struct {
+	// args are the names of the arguments of the command
+	args        []string
+	description string
+	run         func(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int
+}
+
+// commands are the subcommands of rebblestore-api, serve is the default one
+var commands = map[string]command{
+	"serve":          {nil, "Start the API server on port 8080", serve},
+	"import-archive": {[]string{"<dir|tar.gz>"}, "Import the Pebble app store archive, exits with 4 if files were skipped", importArchive},
+	"diff-archive":   {[]string{"<dir|tar.gz>"}, "Compare the Pebble app store archive to the catalog, and apply the changes selected with --apply", diffArchive},
+	"rebuild-images": {nil, "Download the screenshots of the apps into PebbleImages/", rebuildImages},
+	"export":         {nil, "Write the catalog as JSON, in the format of the test fixtures", export},
+	"check":          {nil, "Look for problems in the catalog, exits with 4 if there are any", check},
+	"stats":          {nil, "Write statistics about the catalog as JSON", stats},
+}
+
+// commandNames is the order in which the commands are listed in the usage
+var commandNames = []string{"serve", "import-archive", "diff-archive", "rebuild-images", "export", "check", "stats"}
+
+// diffApply are the categories of changes applied by diff-archive, separated
+// by commas
+var diffApply string
+
+// commandsUsage describes the commands
+func commandsUsage(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range commandNames {
+		usage := name
+		for _, arg := range commands[name].args {
+			usage += " " + arg
+		}
+		fmt.Fprintf(w, "  %-30s %s\n", usage, commands[name].description)
+	}
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func serve(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	// The jobs of the previous run can't be running anymore
+	err := context.Database.InterruptJobs()
+	if err != nil {
+		logger.Print("Could not interrupt the jobs: ", err)
+		return exitDatabase
+	}
+
+	r := rebbleHandlers.Handlers(context)
+	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
+	http.Handle("/", r)
+	err = http.ListenAndServe(":8080", loggedRouter)
+	logger.Print(err)
+	return exitFailure
+}
+
+func importArchive(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	report, err := rebbleHandlers.ImportArchive(context.Database, args[0], logger)
+	if err != nil {
+		logger.Print("Could not import the archive: ", err)
+		return exitFailure
+	}
+
+	err = writeJSON(stdout, report)
+	if err != nil {
+		logger.Print(err)
+		return exitFailure
+	}
+	if report.Skipped > 0 {
+		logger.Printf("Skipped %d files, see the report for the reasons", report.Skipped)
+		return exitProblems
+	}
+
+	return exitSuccess
+}
+
+func diffArchive(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	apply, err := rebbleHandlers.ParseDiffCategories(diffApply)
+	if err != nil {
+		logger.Print(err)
+		return exitUsage
+	}
+
+	diff, err := rebbleHandlers.DiffArchive(context.Database, args[0], apply, logger)
+	if err != nil {
+		logger.Print("Could not compare the archive: ", err)
+		return exitFailure
+	}
+
+	err = writeJSON(stdout, diff)
+	if err != nil {
+		logger.Print(err)
+		return exitFailure
+	}
+	for _, line := range diff.Summary() {
+		logger.Print(line)
+	}
+
+	return exitSuccess
+}
+
+func rebuildImages(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	err := rebbleHandlers.RebuildImages(context.Database, "PebbleImages", logger)
+	if err != nil {
+		logger.Print("Could not rebuild the images: ", err)
+		return exitFailure
+	}
+
+	return exitSuccess
+}
+
+func export(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	catalog, err := context.Database.ExportCatalog()
+	if err != nil {
+		logger.Print("Could not export the catalog: ", err)
+		return exitFailure
+	}
+
+	err = writeJSON(stdout, catalog)
+	if err != nil {
+		logger.Print(err)
+		return exitFailure
+	}
+	logger.Printf("Exported %d apps", len(catalog.Apps))
+
+	return exitSuccess
+}
+
+func check(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	problems, err := rebbleHandlers.CheckCatalog(context.Database, "PebbleImages")
+	if err != nil {
+		logger.Print("Could not check the catalog: ", err)
+		return exitFailure
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, problem)
+	}
+	if len(problems) > 0 {
+		logger.Printf("Found %d problems", len(problems))
+		return exitProblems
+	}
+
+	logger.Print("No problem found")
+	return exitSuccess
+}
+
+func stats(context *rebbleHandlers.HandlerContext, args []string, stdout io.Writer, logger *log.Logger) int {
+	catalogStats, err := rebbleHandlers.GetCatalogStats(context.Database)
+	if err != nil {
+		logger.Print("Could not compute the statistics: ", err)
+		return exitFailure
+	}
+
+	err = writeJSON(stdout, catalogStats)
+	if err != nil {
+		logger.Print(err)
+		return exitFailure
+	}
+
+	return exitSuccess
+}
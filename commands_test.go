@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"pebble-dev/rebblestore-api/db"
+	"pebble-dev/rebblestore-api/rebbleHandlers"
+)
+
+func TestCommands(t *testing.T) {
+	context := &rebbleHandlers.HandlerContext{Database: db.NewMemoryStore()}
+	logger := log.New(ioutil.Discard, "", 0)
+	run := func(name string, args []string, code int) string {
+		var stdout bytes.Buffer
+		c := commands[name].run(context, args, &stdout, logger)
+		if c != code {
+			t.Fatalf("%s: expected exit code %d, got %d", name, code, c)
+		}
+		return stdout.String()
+	}
+
+	run("import-archive", []string{"does-not-exist"}, exitFailure)
+	var report rebbleHandlers.ImportReport
+	err := json.Unmarshal([]byte(run("import-archive", []string{"rebbleHandlers/testdata/archive"}, exitSuccess)), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 3 {
+		t.Errorf("expected 3 imported apps, got %+v", report)
+	}
+
+	var diff rebbleHandlers.CatalogDiff
+	err = json.Unmarshal([]byte(run("diff-archive", []string{"rebbleHandlers/testdata/archive"}, exitSuccess)), &diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("expected no change, got %+v", diff)
+	}
+	diffApply = "everything"
+	run("diff-archive", []string{"rebbleHandlers/testdata/archive"}, exitUsage)
+	diffApply = ""
+
+	var catalog db.Fixture
+	err = json.Unmarshal([]byte(run("export", nil, exitSuccess)), &catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Apps) != 3 {
+		t.Errorf("expected 3 exported apps, got %d", len(catalog.Apps))
+	}
+
+	var stats rebbleHandlers.CatalogStats
+	err = json.Unmarshal([]byte(run("stats", nil, exitSuccess)), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Apps != 3 || stats.Authors != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if problems := run("check", nil, exitSuccess); problems != "" {
+		t.Errorf("expected no problem, got %s", problems)
+	}
+	err = context.Database.ImportCatalog(nil, []db.RebbleCollection{{Id: "empty", Name: "Empty"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := run("check", nil, exitProblems); !strings.Contains(problems, "Collection empty (Empty) has no app") {
+		t.Errorf("unexpected problems %s", problems)
+	}
+}
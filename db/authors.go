@@ -0,0 +1,269 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// AuthorIds are the author IDs given by the previous imports, so that the next
+// import gives the same IDs to the same developers
+type AuthorIds struct {
+	// Developers maps the developer IDs of the Pebble app store to author IDs
+	Developers map[string]int
+	// Names maps the names of the authors that have no developer ID (those
+	// imported before developer IDs were tracked) to their lowest ID
+	Names map[string]int
+	// Last is the highest author ID ever given, including renumbered ones
+	Last int
+}
+
+// GetAuthorIds returns the author IDs given by the previous imports
+func (handler Handler) GetAuthorIds() (AuthorIds, error) {
+	ids := AuthorIds{
+		Developers: make(map[string]int),
+		Names:      make(map[string]int),
+	}
+
+	rows, err := handler.query("SELECT developer_id, author_id FROM author_developers")
+	if err != nil {
+		return AuthorIds{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var developerId string
+		var authorId int
+		err = rows.Scan(&developerId, &authorId)
+		if err != nil {
+			return AuthorIds{}, err
+		}
+		ids.Developers[developerId] = authorId
+	}
+	if err = rows.Err(); err != nil {
+		return AuthorIds{}, err
+	}
+
+	rows, err = handler.query(`
+		SELECT CAST(id AS integer), name FROM authors
+		WHERE NOT EXISTS (SELECT 1 FROM author_developers WHERE author_developers.author_id = authors.id)
+		ORDER BY CAST(id AS integer)
+	`)
+	if err != nil {
+		return AuthorIds{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return AuthorIds{}, err
+		}
+		if _, ok := ids.Names[name]; !ok {
+			ids.Names[name] = id
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return AuthorIds{}, err
+	}
+
+	// The IDs of the authors table are text in SQLite
+	err = handler.queryRow(`
+		SELECT COALESCE(MAX(id), 0) FROM (
+			SELECT CAST(id AS integer) AS id FROM authors
+			UNION ALL SELECT old_id FROM author_redirects
+		) AS ids
+	`).Scan(&ids.Last)
+	if err != nil {
+		return AuthorIds{}, err
+	}
+
+	return ids, nil
+}
+
+// GetAuthorRedirect returns the ID that the author id was renumbered to, or 0 if
+// it wasn't renumbered
+func (handler Handler) GetAuthorRedirect(id int) (int, error) {
+	var authorId int
+	err := handler.queryRow("SELECT author_id FROM author_redirects WHERE old_id=?", id).Scan(&authorId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return authorId, err
+}
+
+// insertAuthor inserts or updates an author, along with its developer ID. An
+// author ID that was renumbered before and is given again stops being
+// redirected.
+func insertAuthor(tx *Tx, author RebbleAuthor) error {
+	_, err := tx.Exec("INSERT INTO authors(id, name) VALUES(?, ?) ON CONFLICT(id) DO UPDATE SET name=excluded.name", author.Id, author.Name)
+	if err != nil {
+		return err
+	}
+
+	if author.DeveloperId != "" {
+		_, err = tx.Exec("INSERT INTO author_developers(developer_id, author_id) VALUES(?, ?) ON CONFLICT(developer_id) DO UPDATE SET author_id=excluded.author_id", author.DeveloperId, author.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM author_redirects WHERE old_id=?", author.Id)
+	return err
+}
+
+// movedAuthors records the authors whose apps were given to another author by
+// an import, indexed by the previous author ID. When the apps of an author
+// went to several authors, the lowest ID is kept so that imports are
+// deterministic.
+type movedAuthors map[int]int
+
+// add records that an app of author from now belongs to author to
+func (moved movedAuthors) add(from int, to int) {
+	if from == to {
+		return
+	}
+	if previous, ok := moved[from]; !ok || to < previous {
+		moved[from] = to
+	}
+}
+
+// sortedIds returns the previous author IDs in order
+func (moved movedAuthors) sortedIds() []int {
+	ids := make([]int, 0, len(moved))
+	for id := range moved {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// redirectAuthors replaces the authors that were renumbered by an import with a
+// redirect to their new ID. An author was renumbered when all its apps moved
+// to another author, and no developer has its ID.
+func redirectAuthors(tx *Tx, moved movedAuthors) error {
+	for _, from := range moved.sortedIds() {
+		var used bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM apps WHERE author_id=?)
+				OR EXISTS (SELECT 1 FROM author_developers WHERE author_id=?)
+		`, from, from).Scan(&used)
+		if err != nil {
+			return err
+		}
+		if used {
+			continue
+		}
+
+		to := moved[from]
+		_, err = tx.Exec("INSERT INTO author_redirects(old_id, author_id) VALUES(?, ?) ON CONFLICT(old_id) DO UPDATE SET author_id=excluded.author_id", from, to)
+		if err != nil {
+			return err
+		}
+		// Earlier redirects to the renumbered author follow it
+		_, err = tx.Exec("UPDATE author_redirects SET author_id=? WHERE author_id=?", to, from)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM authors WHERE id=?", from)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAuthorIds returns the author IDs given by the previous imports
+func (store *MemoryStore) GetAuthorIds() (AuthorIds, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	ids := AuthorIds{
+		Developers: make(map[string]int),
+		Names:      make(map[string]int),
+	}
+	mapped := make(map[int]bool)
+	for developerId, authorId := range store.developers {
+		ids.Developers[developerId] = authorId
+		mapped[authorId] = true
+	}
+	for id, author := range store.authors {
+		if id > ids.Last {
+			ids.Last = id
+		}
+		if mapped[id] {
+			continue
+		}
+		if existing, ok := ids.Names[author.Name]; !ok || id < existing {
+			ids.Names[author.Name] = id
+		}
+	}
+	for id := range store.authorRedirects {
+		if id > ids.Last {
+			ids.Last = id
+		}
+	}
+
+	return ids, nil
+}
+
+// GetAuthorRedirect returns the ID that the author id was renumbered to, or 0 if
+// it wasn't renumbered
+func (store *MemoryStore) GetAuthorRedirect(id int) (int, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.authorRedirects[id], nil
+}
+
+// insertAuthor behaves like the function of the same name for databases. The
+// store must be locked for writing.
+func (store *MemoryStore) insertAuthor(author RebbleAuthor) {
+	store.authors[author.Id] = RebbleAuthor{Id: author.Id, Name: author.Name}
+	if author.DeveloperId != "" {
+		store.developers[author.DeveloperId] = author.Id
+	}
+	delete(store.authorRedirects, author.Id)
+}
+
+// redirectAuthors behaves like the function of the same name for databases.
+// The store must be locked for writing.
+func (store *MemoryStore) redirectAuthors(moved movedAuthors) {
+	used := make(map[int]bool)
+	for _, app := range store.apps {
+		used[app.Author.Id] = true
+	}
+	for _, authorId := range store.developers {
+		used[authorId] = true
+	}
+
+	for _, from := range moved.sortedIds() {
+		if used[from] {
+			continue
+		}
+
+		to := moved[from]
+		store.authorRedirects[from] = to
+		for id, authorId := range store.authorRedirects {
+			if authorId == from {
+				store.authorRedirects[id] = to
+			}
+		}
+		delete(store.authors, from)
+	}
+}
+
+// developerIds returns the developer ID of each author that has one. The store
+// must be locked for reading.
+func (store *MemoryStore) developerIds() map[int]string {
+	developerIds := make(map[int]string)
+	for developerId, authorId := range store.developers {
+		if existing, ok := developerIds[authorId]; !ok || developerId < existing {
+			developerIds[authorId] = developerId
+		}
+	}
+
+	return developerIds
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuthorIds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Authors imported before developer IDs were tracked are known by name
+		err = store.ImportCatalog(testCatalog())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := store.GetAuthorIds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := AuthorIds{
+			Developers: map[string]int{},
+			Names:      map[string]int{"Ada Watchmaker": 1, "Pebble Technology": 2},
+			Last:       2,
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("expected %+v, got %+v", expected, ids)
+		}
+
+		// The apps of author 2 now belong to a new author, 2 is renumbered
+		_, collections, apps, versions := testCatalog()
+		authors := []RebbleAuthor{
+			{Id: 1, Name: "Ada Watchmaker", DeveloperId: "dev-ada"},
+			{Id: 3, Name: "Pebble Technology Corp", DeveloperId: "dev-pebble"},
+		}
+		apps[1].Author = authors[1]
+		err = store.ImportCatalog(authors, collections, apps, versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err = store.GetAuthorIds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = AuthorIds{
+			Developers: map[string]int{"dev-ada": 1, "dev-pebble": 3},
+			Names:      map[string]int{},
+			Last:       3,
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("expected %+v, got %+v", expected, ids)
+		}
+
+		for id, redirect := range map[int]int{1: 0, 2: 3, 3: 0} {
+			to, err := store.GetAuthorRedirect(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if to != redirect {
+				t.Errorf("expected author %d to be redirected to %d, got %d", id, redirect, to)
+			}
+		}
+		_, err = store.GetAuthor(2)
+		if err == nil {
+			t.Error("expected the renumbered author to be removed")
+		}
+
+		catalog, err := store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(catalog.Authors, authors) {
+			t.Errorf("expected authors %+v, got %+v", authors, catalog.Authors)
+		}
+
+		// An author moving to another developer's ID is not renumbered, and an
+		// ID given again is no longer redirected
+		apps[1].Author = RebbleAuthor{Id: 2, Name: "Pebble Technology", DeveloperId: "dev-pebble-2"}
+		err = store.ImportCatalog([]RebbleAuthor{apps[1].Author}, collections, apps[1:], versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, redirect := range map[int]int{2: 0, 3: 0} {
+			to, err := store.GetAuthorRedirect(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if to != redirect {
+				t.Errorf("expected author %d to be redirected to %d, got %d", id, redirect, to)
+			}
+		}
+		_, err = store.GetAuthor(3)
+		if err != nil {
+			t.Errorf("expected author 3 to be kept: %v", err)
+		}
+	})
+}
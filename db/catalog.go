@@ -0,0 +1,611 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// insertAppRelations (re)writes the platforms, screenshots and versions of an
+// app. Any existing rows for the app are replaced.
+func insertAppRelations(tx *Tx, appId string, platforms []string, screenshots []RebbleScreenshotsPlatform, versions []RebbleVersion) error {
+	for _, table := range []string{"app_platforms", "app_screenshots", "app_versions"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE app_id=?", appId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, platform := range platforms {
+		_, err := tx.Exec("INSERT INTO app_platforms(app_id, platform) VALUES(?, ?) ON CONFLICT DO NOTHING", appId, platform)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := insertAppScreenshots(tx, appId, screenshots)
+	if err != nil {
+		return err
+	}
+
+	for i, version := range versions {
+		_, err := tx.Exec("INSERT INTO app_versions(app_id, position, number, release_date, description) VALUES(?, ?, ?, ?, ?)", appId, i, version.Number, version.ReleaseDate.UnixNano(), version.Description)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertAppScreenshots writes the screenshots of an app, numbering them in
+// order across all platforms
+func insertAppScreenshots(tx *Tx, appId string, screenshots []RebbleScreenshotsPlatform) error {
+	position := 0
+	for _, platform := range screenshots {
+		for _, url := range platform.Screenshots {
+			_, err := tx.Exec("INSERT INTO app_screenshots(app_id, platform, position, url) VALUES(?, ?, ?, ?)", appId, platform.Platform, position, url)
+			if err != nil {
+				return err
+			}
+			position++
+		}
+	}
+
+	return nil
+}
+
+// appDetailColumns are the columns of the details of an app that are stored
+// as JSON
+const appDetailColumns = "capabilities, companions, icons, banners, list_images, hardware_images"
+
+// appDetails returns pointers to the details of app that are stored as JSON, in
+// the order of appDetailColumns
+func appDetails(app *RebbleApplication) []interface{} {
+	return []interface{}{&app.AppInfo.Capabilities, &app.AppInfo.Companions, &app.Assets.Icons, &app.Assets.Banners, &app.Assets.ListImages, &app.Assets.HardwareImages}
+}
+
+// encodeAppDetails encodes the details of app that are stored as JSON, in the
+// order of appDetailColumns
+func encodeAppDetails(app RebbleApplication) ([]interface{}, error) {
+	columns := make([]interface{}, 0)
+	for _, detail := range appDetails(&app) {
+		data, err := json.Marshal(detail)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, string(data))
+	}
+
+	return columns, nil
+}
+
+// decodeAppDetails decodes the details of app stored as JSON, in the order of
+// appDetailColumns. Missing lists and maps are decoded as empty ones.
+func decodeAppDetails(app *RebbleApplication, columns []string) error {
+	app.AppInfo.Capabilities = nil
+	app.AppInfo.Companions = RebbleCompanions{}
+	app.Assets.Icons = nil
+	app.Assets.Banners = nil
+	app.Assets.ListImages = nil
+	app.Assets.HardwareImages = nil
+
+	for i, detail := range appDetails(app) {
+		err := json.Unmarshal([]byte(columns[i]), detail)
+		if err != nil {
+			return err
+		}
+	}
+
+	if app.AppInfo.Capabilities == nil {
+		app.AppInfo.Capabilities = make([]string, 0)
+	}
+	if app.Assets.Icons == nil {
+		app.Assets.Icons = make(map[string]string)
+	}
+	if app.Assets.Banners == nil {
+		app.Assets.Banners = make([]map[string]string, 0)
+	}
+	if app.Assets.ListImages == nil {
+		app.Assets.ListImages = make(map[string]string)
+	}
+	if app.Assets.HardwareImages == nil {
+		app.Assets.HardwareImages = make(map[string]RebbleHardwareImages)
+	}
+
+	return nil
+}
+
+// ImportCatalog inserts or updates authors, collections and apps (along with
+// their versions, indexed by app ID) from the Pebble App Store archive, in a
+// single transaction. Rows that are not part of the import, and columns that
+// are not derived from the archive, are left untouched, except for authors
+// that were renumbered: they are replaced by a redirect to their new ID. The
+// hearts of the archive are only used for new apps, the store keeps counting
+// them afterwards.
+func (handler Handler) ImportCatalog(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = importCatalog(tx, authors, collections, apps, versions)
+	if err != nil {
+		return err
+	}
+
+	err = reindexSearch(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CatalogChanges are changes to the catalog made at once by
+// ApplyCatalogChanges
+type CatalogChanges struct {
+	Authors     []RebbleAuthor
+	Collections []RebbleCollection
+	// Apps are written along with their versions and original records,
+	// indexed by app ID
+	Apps     []RebbleApplication
+	Versions map[string][]RebbleVersion
+	Sources  map[string][]json.RawMessage
+	// Removed are the IDs of the apps to delete
+	Removed []string
+}
+
+// ApplyCatalogChanges imports authors, collections and apps like
+// ImportCatalog, sets the original records of apps like SetAppSources and
+// deletes apps like DeleteApps, in a single transaction
+func (handler Handler) ApplyCatalogChanges(changes CatalogChanges) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = importCatalog(tx, changes.Authors, changes.Collections, changes.Apps, changes.Versions)
+	if err != nil {
+		return err
+	}
+
+	err = setAppSources(tx, changes.Sources)
+	if err != nil {
+		return err
+	}
+
+	err = deleteApps(tx, changes.Removed)
+	if err != nil {
+		return err
+	}
+
+	err = reindexSearch(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ImportCatalogBatch imports a part of the catalog like ImportCatalog, in a
+// single transaction, but leaves the search index as it is. It is meant for
+// large imports, which call Reindex once the last batch is imported.
+func (handler Handler) ImportCatalogBatch(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = importCatalog(tx, authors, collections, apps, versions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Reindex rebuilds the search index, after imports made with
+// ImportCatalogBatch
+func (handler Handler) Reindex() error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = reindexSearch(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// importCatalog writes authors, collections and apps for ImportCatalog and
+// ImportCatalogBatch
+func importCatalog(tx *Tx, authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error {
+	for _, author := range authors {
+		err := insertAuthor(tx, author)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, collection := range collections {
+		// New collections are added after the others (the WHERE clause
+		// tells SQLite that ON CONFLICT is not a join constraint), and the
+		// collections edited by hand keep their name and color
+		_, err := tx.Exec(`
+			INSERT INTO collections(id, name, color, position)
+			SELECT ?, ?, ?, COALESCE(MAX(position), -1) + 1 FROM collections WHERE 1=1
+			ON CONFLICT(id) DO UPDATE SET name=excluded.name, color=excluded.color
+			WHERE collections.curated=0
+		`, collection.Id, collection.Name, collection.Color)
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO apps(id, uuid, name, author_id, description, thumbs_up, type, published_date, pbw_url, rebble_ready, updated, version, release_id, release_notes, js_md5, js_version, support_url, author_url, source_url, banner_url, icon_url, doomsday_backup, ` + appDetailColumns + `)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			uuid=excluded.uuid, name=excluded.name, author_id=excluded.author_id, description=excluded.description,
+			type=excluded.type, published_date=excluded.published_date,
+			pbw_url=excluded.pbw_url, updated=excluded.updated, version=excluded.version,
+			release_id=excluded.release_id, release_notes=excluded.release_notes,
+			js_md5=excluded.js_md5, js_version=excluded.js_version,
+			author_url=excluded.author_url, source_url=excluded.source_url,
+			banner_url=excluded.banner_url, icon_url=excluded.icon_url,
+			capabilities=excluded.capabilities, companions=excluded.companions,
+			icons=excluded.icons, banners=excluded.banners, list_images=excluded.list_images,
+			hardware_images=excluded.hardware_images
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	moved := make(movedAuthors)
+	for _, app := range apps {
+		details, err := encodeAppDetails(app)
+		if err != nil {
+			return err
+		}
+		// author_id is nullable, an app without author has no author to redirect
+		var authorId sql.NullInt64
+		err = tx.QueryRow("SELECT author_id FROM apps WHERE id=?", app.Id).Scan(&authorId)
+		if err == nil && authorId.Valid {
+			moved.add(int(authorId.Int64), app.Author.Id)
+		} else if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		_, err = stmt.Exec(append([]interface{}{app.Id, app.Uuid, app.Name, app.Author.Id, app.Description, app.ThumbsUp, app.Type, app.Published.UnixNano(), app.AppInfo.PbwUrl, app.AppInfo.RebbleReady, app.AppInfo.Updated.UnixNano(), app.AppInfo.Version, app.AppInfo.ReleaseId, app.AppInfo.ReleaseNotes, app.AppInfo.JsMd5, app.AppInfo.JsVersion, app.AppInfo.SupportUrl, app.AppInfo.AuthorUrl, app.AppInfo.SourceUrl, app.Assets.Banner, app.Assets.Icon, app.DoomsdayBackup}, details...)...)
+		if err != nil {
+			return err
+		}
+
+		// Collection membership mirrors the tags of the app, but apps that
+		// were added to other collections by hand stay there, and apps keep
+		// their place in the collections.
+		tagIds, err := queryIds(tx, "SELECT collection_id FROM app_tags WHERE app_id=?", app.Id)
+		if err != nil {
+			return err
+		}
+		for _, tagId := range tagIds {
+			tagged := false
+			for _, tag := range app.AppInfo.Tags {
+				tagged = tagged || tag.Id == tagId
+			}
+			if !tagged {
+				_, err = tx.Exec("DELETE FROM collection_apps WHERE collection_id=? AND app_id=?", tagId, app.Id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		_, err = tx.Exec("DELETE FROM app_tags WHERE app_id=?", app.Id)
+		if err != nil {
+			return err
+		}
+		for _, tag := range app.AppInfo.Tags {
+			_, err = tx.Exec("INSERT INTO app_tags(app_id, collection_id) VALUES(?, ?) ON CONFLICT DO NOTHING", app.Id, tag.Id)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO collection_apps(collection_id, app_id, position)
+				SELECT ?, ?, COALESCE(MAX(position), -1) + 1 FROM collection_apps WHERE collection_id=?
+				ON CONFLICT DO NOTHING
+			`, tag.Id, app.Id, tag.Id)
+			if err != nil {
+				return err
+			}
+		}
+
+		var screenshots []RebbleScreenshotsPlatform
+		if app.Assets.Screenshots != nil {
+			screenshots = *app.Assets.Screenshots
+		}
+		err = insertAppRelations(tx, app.Id, app.SupportedPlatforms, screenshots, versions[app.Id])
+		if err != nil {
+			return err
+		}
+	}
+
+	return redirectAuthors(tx, moved)
+}
+
+// GetAllScreenshots returns the screenshots of every app, indexed by app ID
+func (handler Handler) GetAllScreenshots() (map[string][]RebbleScreenshotsPlatform, error) {
+	rows, err := handler.query("SELECT app_id, platform, url FROM app_screenshots ORDER BY app_id, position")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	screenshots := make(map[string][]RebbleScreenshotsPlatform)
+	for rows.Next() {
+		var appId, platform, url string
+		err = rows.Scan(&appId, &platform, &url)
+		if err != nil {
+			return nil, err
+		}
+		screenshots[appId] = appendScreenshot(screenshots[appId], platform, url)
+	}
+
+	return screenshots, rows.Err()
+}
+
+// SetScreenshots replaces the screenshots of the given apps (indexed by app ID)
+func (handler Handler) SetScreenshots(screenshots map[string][]RebbleScreenshotsPlatform) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for appId, platforms := range screenshots {
+		_, err = tx.Exec("DELETE FROM app_screenshots WHERE app_id=?", appId)
+		if err != nil {
+			return err
+		}
+		err = insertAppScreenshots(tx, appId, platforms)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// appendScreenshot adds a screenshot to the list of its platform, creating the
+// platform at the end of the list if it doesn't exist yet
+func appendScreenshot(screenshots []RebbleScreenshotsPlatform, platform string, url string) []RebbleScreenshotsPlatform {
+	for i := range screenshots {
+		if screenshots[i].Platform == platform {
+			screenshots[i].Screenshots = append(screenshots[i].Screenshots, url)
+			return screenshots
+		}
+	}
+
+	return append(screenshots, RebbleScreenshotsPlatform{
+		Platform:    platform,
+		Screenshots: []string{url},
+	})
+}
+
+// exportApps completes an export with the apps whose IDs are given, along with
+// their versions and original records
+func exportApps(store Store, fixture Fixture, ids []string) (Fixture, error) {
+	fixture.Apps = make([]RebbleApplication, 0, len(ids))
+	fixture.Versions = make(map[string][]RebbleVersion)
+	fixture.Sources = make(map[string][]json.RawMessage)
+	for _, id := range ids {
+		app, err := store.GetApp(id)
+		if err != nil {
+			return Fixture{}, err
+		}
+		fixture.Apps = append(fixture.Apps, app)
+
+		versions, err := store.GetAppVersions(id)
+		if err != nil {
+			return Fixture{}, err
+		}
+		if len(versions) > 0 {
+			fixture.Versions[id] = versions
+		}
+
+		sources, err := store.GetAppSources(id)
+		if err != nil {
+			return Fixture{}, err
+		}
+		if len(sources) > 0 {
+			fixture.Sources[id] = sources
+		}
+	}
+
+	return fixture, nil
+}
+
+// ExportCatalog returns the whole catalog (authors, collections and their apps,
+// apps, versions and original records), sorted by ID, in the format of a
+// fixture so that it can be imported back with ImportFixture
+func (handler Handler) ExportCatalog() (Fixture, error) {
+	fixture := Fixture{
+		Authors:        make([]RebbleAuthor, 0),
+		Collections:    make([]RebbleCollection, 0),
+		CollectionApps: make(map[string][]string),
+	}
+
+	rows, err := handler.query(`
+		SELECT id, name, COALESCE((SELECT MIN(developer_id) FROM author_developers WHERE author_developers.author_id = authors.id), '')
+		FROM authors ORDER BY id
+	`)
+	if err != nil {
+		return Fixture{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var author RebbleAuthor
+		err = rows.Scan(&author.Id, &author.Name, &author.DeveloperId)
+		if err != nil {
+			return Fixture{}, err
+		}
+		fixture.Authors = append(fixture.Authors, author)
+	}
+	if err = rows.Err(); err != nil {
+		return Fixture{}, err
+	}
+
+	rows, err = handler.query("SELECT id, name, color FROM collections ORDER BY id")
+	if err != nil {
+		return Fixture{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collection RebbleCollection
+		err = rows.Scan(&collection.Id, &collection.Name, &collection.Color)
+		if err != nil {
+			return Fixture{}, err
+		}
+		fixture.Collections = append(fixture.Collections, collection)
+		fixture.CollectionApps[collection.Id] = make([]string, 0)
+	}
+	if err = rows.Err(); err != nil {
+		return Fixture{}, err
+	}
+
+	rows, err = handler.query("SELECT collection_id, app_id FROM collection_apps ORDER BY collection_id, position, app_id")
+	if err != nil {
+		return Fixture{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collectionId, appId string
+		err = rows.Scan(&collectionId, &appId)
+		if err != nil {
+			return Fixture{}, err
+		}
+		fixture.CollectionApps[collectionId] = append(fixture.CollectionApps[collectionId], appId)
+	}
+	if err = rows.Err(); err != nil {
+		return Fixture{}, err
+	}
+
+	rows, err = handler.query("SELECT id FROM apps ORDER BY id")
+	if err != nil {
+		return Fixture{}, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return Fixture{}, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return Fixture{}, err
+	}
+	rows.Close()
+
+	return exportApps(handler, fixture, ids)
+}
+
+// DeleteApps removes apps, along with their screenshots, versions, collection
+// memberships and original records. Their authors are kept.
+func (handler Handler) DeleteApps(ids []string) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteApps(tx, ids)
+	if err != nil {
+		return err
+	}
+
+	err = reindexSearch(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteApps removes apps for DeleteApps and ApplyCatalogChanges
+func deleteApps(tx *Tx, ids []string) error {
+	for _, id := range ids {
+		_, err := tx.Exec("DELETE FROM apps WHERE id=?", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetAppSources replaces the original records of the given apps (indexed by
+// app ID), as they were read from the Pebble app store archive
+func (handler Handler) SetAppSources(sources map[string][]json.RawMessage) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = setAppSources(tx, sources)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setAppSources writes the original records of apps for SetAppSources and
+// ApplyCatalogChanges
+func setAppSources(tx *Tx, sources map[string][]json.RawMessage) error {
+	for appId, documents := range sources {
+		_, err := tx.Exec("DELETE FROM app_sources WHERE app_id=?", appId)
+		if err != nil {
+			return err
+		}
+		for i, document := range documents {
+			_, err = tx.Exec("INSERT INTO app_sources(app_id, position, document) VALUES(?, ?, ?)", appId, i, string(document))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetAppSources returns the original records of an app, as they were read from
+// the Pebble app store archive (one per hardware platform)
+func (handler Handler) GetAppSources(id string) ([]json.RawMessage, error) {
+	rows, err := handler.query("SELECT document FROM app_sources WHERE app_id=? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make([]json.RawMessage, 0)
+	for rows.Next() {
+		var document string
+		err = rows.Scan(&document)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, json.RawMessage(document))
+	}
+
+	return sources, rows.Err()
+}
@@ -0,0 +1,366 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testCatalog() ([]RebbleAuthor, []RebbleCollection, []RebbleApplication, map[string][]RebbleVersion) {
+	authors := []RebbleAuthor{{Id: 1, Name: "Ada Watchmaker"}, {Id: 2, Name: "Pebble Technology"}}
+	collections := []RebbleCollection{
+		{Id: "daily", Name: "Daily", Color: "55CCFF"},
+		{Id: "tools", Name: "Tools & Utilities", Color: "fdbf37"},
+	}
+
+	screenshots1 := []RebbleScreenshotsPlatform{{Platform: "basalt", Screenshots: []string{"s1", "s2"}}}
+	screenshots2 := []RebbleScreenshotsPlatform{{Platform: "aplite", Screenshots: []string{"s3"}}}
+	apps := []RebbleApplication{
+		{
+			Id:                 "app1",
+			Name:               "Weather",
+			Author:             authors[0],
+			Type:               "watchapp",
+			ThumbsUp:           10,
+			SupportedPlatforms: []string{"basalt", "chalk"},
+			Published:          JSONTime{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)},
+			AppInfo:            RebbleAppInfo{Tags: []RebbleCollection{collections[0]}},
+			Assets:             RebbleAssets{Screenshots: &screenshots1},
+		},
+		{
+			Id:                 "app2",
+			Name:               "Timer",
+			Author:             authors[1],
+			Type:               "watchapp",
+			ThumbsUp:           20,
+			SupportedPlatforms: []string{"aplite"},
+			Published:          JSONTime{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+			AppInfo:            RebbleAppInfo{Tags: []RebbleCollection{collections[0]}},
+			Assets:             RebbleAssets{Screenshots: &screenshots2},
+		},
+	}
+
+	versions := map[string][]RebbleVersion{
+		"app1": {{Number: "1.0", Description: "Initial release"}},
+	}
+
+	return authors, collections, apps, versions
+}
+
+func TestImportCatalog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.ImportCatalog(testCatalog())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Importing twice updates the existing rows instead of failing
+		authors, collections, apps, versions := testCatalog()
+		apps[0].AppInfo.Tags = []RebbleCollection{collections[1]}
+		apps[0].ThumbsUp = 0
+		err = store.ImportCatalog(authors, collections, apps, versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app, err := store.GetApp("app1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app.Author.Name != "Ada Watchmaker" || len(*app.Assets.Screenshots) != 1 || len((*app.Assets.Screenshots)[0].Screenshots) != 2 {
+			t.Fatalf("unexpected app %+v", app)
+		}
+		if len(app.AppInfo.Tags) != 1 || app.AppInfo.Tags[0].Id != "tools" {
+			t.Fatalf("tags were not replaced, got %v", app.AppInfo.Tags)
+		}
+		if app.ThumbsUp != 10 {
+			t.Fatalf("expected the hearts to be kept, got %d", app.ThumbsUp)
+		}
+
+		daily, err := store.GetAppsForCollection("daily", "popular", "all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(daily) != 1 || daily[0].Id != "app2" {
+			t.Fatalf("expected app1 to have moved out of 'daily', got %v", daily)
+		}
+
+		basalt, err := store.GetAppsForCollection("tools", "popular", "basalt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(basalt) != 1 || basalt[0].Id != "app1" {
+			t.Fatalf("expected app1 for basalt, got %v", basalt)
+		}
+		aplite, err := store.GetAppsForCollection("tools", "popular", "aplite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(aplite) != 0 {
+			t.Fatalf("expected no app for aplite, got %v", aplite)
+		}
+
+		cards, err := store.GetAuthorCards(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cards.Cards) != 1 || cards.Cards[0].ImageUrl != "s1" {
+			t.Fatalf("unexpected author cards %v", cards.Cards)
+		}
+
+		search, err := store.Search("tim", SearchFilters{}, "relevance", 0, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(search.Cards) != 1 || search.Cards[0].Id != "app2" || search.Cards[0].ImageUrl != "s3" {
+			t.Fatalf("unexpected search results %v", search.Cards)
+		}
+	})
+}
+
+func TestGetApps(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		// The apps come in the order of the IDs, unknown IDs are skipped
+		ids := []string{"5003d94014e27459d032ab58", "unknown", "500047e81195154d21eb4f43"}
+		apps, err := store.GetApps(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(apps) != 2 {
+			t.Fatalf("expected 2 apps, got %d", len(apps))
+		}
+		for i, id := range []string{ids[0], ids[2]} {
+			app, err := store.GetApp(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(apps[i], app) {
+				t.Errorf("%s: expected %+v, got %+v", id, app, apps[i])
+			}
+		}
+
+		apps, err = store.GetApps(nil)
+		if err != nil || len(apps) != 0 {
+			t.Errorf("expected no app, got %v %v", apps, err)
+		}
+	})
+}
+
+func TestExportCatalog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		catalog, err := store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fixture, err := ReadFixture("testdata/catalog.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog.Authors) != len(fixture.Authors) || len(catalog.Collections) != len(fixture.Collections) || len(catalog.Apps) != len(fixture.Apps) || len(catalog.Versions) != len(fixture.Versions) {
+			t.Fatalf("expected the whole fixture to be exported, got %d authors, %d collections, %d apps and %d versions", len(catalog.Authors), len(catalog.Collections), len(catalog.Apps), len(catalog.Versions))
+		}
+		for i := 1; i < len(catalog.Apps); i++ {
+			if catalog.Apps[i-1].Id >= catalog.Apps[i].Id {
+				t.Fatalf("apps are not sorted by ID: %s before %s", catalog.Apps[i-1].Id, catalog.Apps[i].Id)
+			}
+		}
+
+		// The export can be imported back as is
+		imported := NewMemoryStore()
+		err = ImportFixture(imported, catalog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported, err := imported.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exported, catalog) {
+			t.Errorf("the export changed after being imported back:\n%+v\n%+v", exported, catalog)
+		}
+	})
+}
+
+func TestAppDetails(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		app, err := store.GetApp("500047e81195154d21eb4f43")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app.Uuid != "0f0b5e4c-a4f1-4ce7-8e0b-d6c1ab9ff1d2" || app.AppInfo.ReleaseId != "5526a1c6a0e6f5c9e8000041" || app.AppInfo.JsVersion != 2 {
+			t.Errorf("unexpected release details %+v", app.AppInfo)
+		}
+		if !reflect.DeepEqual(app.AppInfo.Capabilities, []string{"location", "configurable"}) || app.AppInfo.Companions.Ios != nil || app.AppInfo.Companions.Android.Name != "Weather Now Companion" {
+			t.Errorf("unexpected capabilities and companions %+v", app.AppInfo)
+		}
+		if len(app.Assets.Banners) != 1 || len(app.Assets.Icons) != 2 || app.Assets.ListImages["80x80"] == "" {
+			t.Errorf("unexpected images %+v", app.Assets)
+		}
+
+		// Missing details are empty rather than null
+		app, err = store.GetApp("5003d94014e27459d032ab58")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app.AppInfo.Capabilities == nil || app.Assets.Banners == nil || app.Assets.Icons == nil || app.Assets.ListImages == nil {
+			t.Errorf("expected empty details, got %+v", app)
+		}
+	})
+}
+
+func TestAppSources(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		sources := map[string][]json.RawMessage{
+			"500047e81195154d21eb4f43": {json.RawMessage(`{"id": "500047e81195154d21eb4f43", "screenshot_hardware": "aplite"}`), json.RawMessage(`{"id": "500047e81195154d21eb4f43", "screenshot_hardware": "basalt"}`)},
+		}
+		err := store.SetAppSources(sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		documents, err := store.GetAppSources("500047e81195154d21eb4f43")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(documents, sources["500047e81195154d21eb4f43"]) {
+			t.Errorf("expected %s, got %s", sources["500047e81195154d21eb4f43"], documents)
+		}
+
+		// The records are part of the export
+		catalog, err := store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog.Sources) != 1 || len(catalog.Sources["500047e81195154d21eb4f43"]) != 2 {
+			t.Errorf("unexpected exported sources %v", catalog.Sources)
+		}
+
+		err = store.SetAppSources(map[string][]json.RawMessage{"nope": {json.RawMessage(`{}`)}})
+		if err == nil {
+			t.Error("expected the records of an unknown app to be rejected")
+		}
+	})
+}
+
+func TestDeleteApps(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		err := store.DeleteApps([]string{"500047e81195154d21eb4f43", "unknown"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.GetApp("500047e81195154d21eb4f43")
+		if err == nil {
+			t.Error("expected the app to be deleted")
+		}
+		cards, err := store.Search("weather now", SearchFilters{}, "relevance", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, card := range cards.Cards {
+			if card.Id == "500047e81195154d21eb4f43" {
+				t.Error("expected the deleted app to be removed from the search index")
+			}
+		}
+	})
+}
+
+func TestApplyCatalogChanges(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		authors, collections, apps, versions := testCatalog()
+		err = store.ImportCatalog(authors, collections, apps, versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A failure leaves the catalog as it was
+		apps[0].Name = "Weather Pro"
+		changes := CatalogChanges{
+			Apps:     apps[:1],
+			Versions: versions,
+			Sources:  map[string][]json.RawMessage{"app1": {json.RawMessage(`{"id": "app1"}`)}, "nope": {json.RawMessage(`{}`)}},
+			Removed:  []string{"app2"},
+		}
+		err = store.ApplyCatalogChanges(changes)
+		if err == nil {
+			t.Error("expected the records of an unknown app to be rejected")
+		}
+		app, err := store.GetApp("app1")
+		if err != nil || app.Name != "Weather" {
+			t.Errorf("expected app1 to be unchanged, got %q %v", app.Name, err)
+		}
+		_, err = store.GetApp("app2")
+		if err != nil {
+			t.Errorf("expected app2 to be kept, got %v", err)
+		}
+
+		delete(changes.Sources, "nope")
+		err = store.ApplyCatalogChanges(changes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app, err = store.GetApp("app1")
+		if err != nil || app.Name != "Weather Pro" {
+			t.Errorf("expected app1 to be renamed, got %q %v", app.Name, err)
+		}
+		documents, err := store.GetAppSources("app1")
+		if err != nil || len(documents) != 1 {
+			t.Errorf("expected the records of app1, got %s %v", documents, err)
+		}
+		_, err = store.GetApp("app2")
+		if err == nil {
+			t.Error("expected app2 to be deleted")
+		}
+	})
+}
+
+func TestImportCatalogNullAuthor(t *testing.T) {
+	forEachSQLStore(t, func(t *testing.T, handler Handler) {
+		err := handler.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = handler.ImportCatalog(testCatalog())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Apps without author are updated like the others
+		_, err = handler.exec("UPDATE apps SET author_id=NULL WHERE id=?", "app1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = handler.ImportCatalog(testCatalog())
+		if err != nil {
+			t.Fatal(err)
+		}
+		app, err := handler.GetApp("app1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app.Author.Id != 1 {
+			t.Errorf("expected the author to be set again, got %d", app.Author.Id)
+		}
+	})
+}
@@ -0,0 +1,485 @@
+package db
+
+import (
+	"errors"
+)
+
+// ErrNoCollection is returned when a collection doesn't exist
+var ErrNoCollection = errors.New("Specified collection does not exist")
+
+// ErrCollectionExists is returned when a collection is created with the ID of
+// another one
+var ErrCollectionExists = errors.New("A collection with this ID already exists")
+
+// ErrNoApp is returned when an app added to a collection doesn't exist
+var ErrNoApp = errors.New("No application with this ID")
+
+// ErrInvalidOrder is returned when a new order lists IDs that are unknown or
+// listed twice
+var ErrInvalidOrder = errors.New("The order lists unknown or repeated IDs")
+
+// reorder returns current with the IDs of order moved first, in that order,
+// followed by the others in their current order
+func reorder(current []string, order []string) ([]string, error) {
+	result := make([]string, 0, len(current))
+	for _, id := range order {
+		if !in(id, current) || in(id, result) {
+			return nil, ErrInvalidOrder
+		}
+		result = append(result, id)
+	}
+	for _, id := range current {
+		if !in(id, order) {
+			result = append(result, id)
+		}
+	}
+
+	return result, nil
+}
+
+// queryIds returns the IDs selected by query
+func queryIds(tx *Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// collectionExists returns ErrNoCollection if the collection doesn't exist
+func collectionExists(tx *Tx, id string) error {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM collections WHERE id=?", id).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoCollection
+	}
+
+	return nil
+}
+
+// orderCollections numbers the collections by ID, and the apps of each
+// collection in their current order, so that they can be ordered by hand
+func orderCollections(tx *Tx) error {
+	_, err := tx.Exec("alter table collections add column position integer not null default 0")
+	if err != nil {
+		return err
+	}
+
+	ids, err := queryIds(tx, "SELECT id FROM collections ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		_, err = tx.Exec("UPDATE collections SET position=? WHERE id=?", i, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		appIds, err := queryIds(tx, "SELECT app_id FROM collection_apps WHERE collection_id=? ORDER BY position IS NULL, position, app_id", id)
+		if err != nil {
+			return err
+		}
+		for i, appId := range appIds {
+			_, err = tx.Exec("UPDATE collection_apps SET position=? WHERE collection_id=? AND app_id=?", i, id, appId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetCollections returns every collection, in their manual order
+func (handler Handler) GetCollections() ([]RebbleCollection, error) {
+	rows, err := handler.query("SELECT id, name, color FROM collections ORDER BY position, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := make([]RebbleCollection, 0)
+	for rows.Next() {
+		var collection RebbleCollection
+		err = rows.Scan(&collection.Id, &collection.Name, &collection.Color)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+
+	return collections, rows.Err()
+}
+
+// CreateCollection adds an empty collection after the others
+func (handler Handler) CreateCollection(collection RebbleCollection) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = collectionExists(tx, collection.Id)
+	if err == nil {
+		return ErrCollectionExists
+	} else if err != ErrNoCollection {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO collections(id, name, color, position, curated) SELECT ?, ?, ?, COALESCE(MAX(position), -1) + 1, 1 FROM collections", collection.Id, collection.Name, collection.Color)
+	if err != nil {
+		return err
+	}
+
+	err = reindexSuggestions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateCollection changes the name and color of a collection, which imports
+// don't change anymore
+func (handler Handler) UpdateCollection(collection RebbleCollection) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = collectionExists(tx, collection.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE collections SET name=?, color=?, curated=1 WHERE id=?", collection.Name, collection.Color, collection.Id)
+	if err != nil {
+		return err
+	}
+
+	// The name of a collection is searched in the apps tagged with it
+	ids, err := queryIds(tx, "SELECT app_id FROM app_tags WHERE collection_id=?", collection.Id)
+	if err != nil {
+		return err
+	}
+	err = reindexSearchApps(tx, ids)
+	if err != nil {
+		return err
+	}
+	err = reindexSuggestions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCollection removes a collection, and the tags pointing to it. Its apps
+// are kept.
+func (handler Handler) DeleteCollection(id string) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = collectionExists(tx, id)
+	if err != nil {
+		return err
+	}
+	ids, err := queryIds(tx, "SELECT app_id FROM app_tags WHERE collection_id=?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM collections WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+
+	err = reindexSearchApps(tx, ids)
+	if err != nil {
+		return err
+	}
+	err = reindexSuggestions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// OrderCollections moves the given collections first, in that order, the
+// others keep their order after them
+func (handler Handler) OrderCollections(ids []string) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := queryIds(tx, "SELECT id FROM collections ORDER BY position, id")
+	if err != nil {
+		return err
+	}
+	order, err := reorder(current, ids)
+	if err != nil {
+		return err
+	}
+	for i, id := range order {
+		_, err = tx.Exec("UPDATE collections SET position=? WHERE id=?", i, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddCollectionApps adds apps at the end of a collection, in the given order.
+// Apps that are already in the collection stay where they are.
+func (handler Handler) AddCollectionApps(id string, appIds []string) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = collectionExists(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, appId := range appIds {
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM apps WHERE id=?", appId).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNoApp
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO collection_apps(collection_id, app_id, position)
+			SELECT ?, ?, COALESCE(MAX(position), -1) + 1 FROM collection_apps WHERE collection_id=?
+			ON CONFLICT DO NOTHING
+		`, id, appId, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = reindexSuggestions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveCollectionApps removes apps from a collection, apps that are not in it
+// are ignored. The apps keep their tags, so the next import puts the apps back
+// into the collections they are tagged with.
+func (handler Handler) RemoveCollectionApps(id string, appIds []string) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = collectionExists(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, appId := range appIds {
+		_, err = tx.Exec("DELETE FROM collection_apps WHERE collection_id=? AND app_id=?", id, appId)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = reindexSuggestions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// OrderCollectionApps moves the given apps first in a collection, in that
+// order, the others keep their order after them. This is the order of the
+// "manual" sort of GetAppsForCollection.
+func (handler Handler) OrderCollectionApps(id string, appIds []string) error {
+	tx, err := handler.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = collectionExists(tx, id)
+	if err != nil {
+		return err
+	}
+	current, err := queryIds(tx, "SELECT app_id FROM collection_apps WHERE collection_id=? ORDER BY position, app_id", id)
+	if err != nil {
+		return err
+	}
+	order, err := reorder(current, appIds)
+	if err != nil {
+		return err
+	}
+	for i, appId := range order {
+		_, err = tx.Exec("UPDATE collection_apps SET position=? WHERE collection_id=? AND app_id=?", i, id, appId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCollections returns every collection, in their manual order
+func (store *MemoryStore) GetCollections() ([]RebbleCollection, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	collections := make([]RebbleCollection, 0, len(store.collectionOrder))
+	for _, id := range store.collectionOrder {
+		collections = append(collections, store.collections[id])
+	}
+
+	return collections, nil
+}
+
+// CreateCollection adds an empty collection after the others
+func (store *MemoryStore) CreateCollection(collection RebbleCollection) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[collection.Id]; ok {
+		return ErrCollectionExists
+	}
+	store.collections[collection.Id] = collection
+	store.collectionOrder = append(store.collectionOrder, collection.Id)
+	store.curated[collection.Id] = true
+
+	return nil
+}
+
+// UpdateCollection changes the name and color of a collection
+func (store *MemoryStore) UpdateCollection(collection RebbleCollection) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[collection.Id]; !ok {
+		return ErrNoCollection
+	}
+	store.collections[collection.Id] = collection
+	store.curated[collection.Id] = true
+
+	return nil
+}
+
+// DeleteCollection removes a collection, and the tags pointing to it
+func (store *MemoryStore) DeleteCollection(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[id]; !ok {
+		return ErrNoCollection
+	}
+	delete(store.collections, id)
+	delete(store.collectionApps, id)
+	delete(store.curated, id)
+	store.collectionOrder = remove(id, store.collectionOrder)
+	for appId, tags := range store.appTags {
+		store.appTags[appId] = remove(id, tags)
+	}
+
+	return nil
+}
+
+// OrderCollections moves the given collections first, in that order
+func (store *MemoryStore) OrderCollections(ids []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	order, err := reorder(store.collectionOrder, ids)
+	if err != nil {
+		return err
+	}
+	store.collectionOrder = order
+
+	return nil
+}
+
+// AddCollectionApps adds apps at the end of a collection, in the given order
+func (store *MemoryStore) AddCollectionApps(id string, appIds []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[id]; !ok {
+		return ErrNoCollection
+	}
+	for _, appId := range appIds {
+		if _, ok := store.apps[appId]; !ok {
+			return ErrNoApp
+		}
+	}
+
+	for _, appId := range appIds {
+		if !in(appId, store.collectionApps[id]) {
+			store.collectionApps[id] = append(store.collectionApps[id], appId)
+		}
+	}
+
+	return nil
+}
+
+// RemoveCollectionApps removes apps from a collection
+func (store *MemoryStore) RemoveCollectionApps(id string, appIds []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[id]; !ok {
+		return ErrNoCollection
+	}
+	for _, appId := range appIds {
+		store.collectionApps[id] = remove(appId, store.collectionApps[id])
+	}
+
+	return nil
+}
+
+// OrderCollectionApps moves the given apps first in a collection, in that
+// order
+func (store *MemoryStore) OrderCollectionApps(id string, appIds []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[id]; !ok {
+		return ErrNoCollection
+	}
+	order, err := reorder(store.collectionApps[id], appIds)
+	if err != nil {
+		return err
+	}
+	store.collectionApps[id] = order
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+// collectionIds returns the IDs of every collection, in their order
+func collectionIds(t *testing.T, store Store) []string {
+	collections, err := store.GetCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, 0)
+	for _, collection := range collections {
+		ids = append(ids, collection.Id)
+	}
+	return ids
+}
+
+// collectionAppIds returns the IDs of the apps of a collection, sorted by sortby
+func collectionAppIds(t *testing.T, store Store, id string, sortby string) []string {
+	apps, err := store.GetAppsForCollection(id, sortby, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, 0)
+	for _, app := range apps {
+		ids = append(ids, app.Id)
+	}
+	return ids
+}
+
+func TestCollections(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.ImportCatalog(testCatalog())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// New collections come after the imported ones
+		err = store.CreateCollection(RebbleCollection{Id: "staff", Name: "Staff picks", Color: "ff0000"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := collectionIds(t, store); !reflect.DeepEqual(ids, []string{"daily", "tools", "staff"}) {
+			t.Errorf("unexpected collections %v", ids)
+		}
+		err = store.CreateCollection(RebbleCollection{Id: "staff", Name: "Staff picks again"})
+		if err != ErrCollectionExists {
+			t.Errorf("expected ErrCollectionExists, got %v", err)
+		}
+
+		// Apps are added in order, and can be moved first
+		err = store.AddCollectionApps("staff", []string{"app2", "app1", "app2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.AddCollectionApps("staff", []string{"app3"})
+		if err != ErrNoApp {
+			t.Errorf("expected ErrNoApp, got %v", err)
+		}
+		err = store.OrderCollectionApps("staff", []string{"app1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := collectionAppIds(t, store, "staff", "manual"); !reflect.DeepEqual(ids, []string{"app1", "app2"}) {
+			t.Errorf("unexpected manual order %v", ids)
+		}
+		if ids := collectionAppIds(t, store, "staff", "popular"); !reflect.DeepEqual(ids, []string{"app2", "app1"}) {
+			t.Errorf("unexpected popular order %v", ids)
+		}
+		for _, order := range [][]string{{"app3"}, {"app2", "app2"}} {
+			err = store.OrderCollectionApps("staff", order)
+			if err != ErrInvalidOrder {
+				t.Errorf("%v: expected ErrInvalidOrder, got %v", order, err)
+			}
+		}
+		_, err = store.GetAppsForCollection("staff", "random", "all")
+		if err == nil {
+			t.Error("expected an invalid sort to be rejected")
+		}
+
+		suggestions, err := store.Suggest("staff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(suggestions.Suggestions) != 1 || suggestions.Suggestions[0].Collection.Id != "staff" {
+			t.Errorf("unexpected suggestions %+v", suggestions)
+		}
+
+		// Collections are renamed and reordered
+		err = store.UpdateCollection(RebbleCollection{Id: "daily", Name: "Everyday", Color: "00ff00"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags, err := store.GetAppTags("app2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 1 || tags[0].Name != "Everyday" || tags[0].Color != "00ff00" {
+			t.Errorf("unexpected tags %v", tags)
+		}
+		err = store.OrderCollections([]string{"staff"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.OrderCollections([]string{"unknown"})
+		if err != ErrInvalidOrder {
+			t.Errorf("expected ErrInvalidOrder, got %v", err)
+		}
+
+		err = store.RemoveCollectionApps("staff", []string{"app1", "app3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.OrderCollectionApps("daily", []string{"app2", "app1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The next import keeps the names, colors and order set by hand
+		err = store.ImportCatalog(testCatalog())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := collectionIds(t, store); !reflect.DeepEqual(ids, []string{"staff", "daily", "tools"}) {
+			t.Errorf("unexpected collections %v", ids)
+		}
+		if ids := collectionAppIds(t, store, "staff", "manual"); !reflect.DeepEqual(ids, []string{"app2"}) {
+			t.Errorf("unexpected apps %v", ids)
+		}
+		if ids := collectionAppIds(t, store, "daily", "manual"); !reflect.DeepEqual(ids, []string{"app2", "app1"}) {
+			t.Errorf("expected the import to keep the manual order, got %v", ids)
+		}
+		name, err := store.GetCollectionName("daily")
+		if err != nil || name != "Everyday" {
+			t.Errorf("expected the import to keep the name, got %s %v", name, err)
+		}
+
+		// An export keeps the apps of the collections and their order
+		catalog, err := store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported := NewMemoryStore()
+		err = ImportFixture(imported, catalog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, expected := range map[string][]string{"staff": {"app2"}, "daily": {"app2", "app1"}} {
+			if ids := collectionAppIds(t, imported, id, "manual"); !reflect.DeepEqual(ids, expected) {
+				t.Errorf("%s: expected the export to keep %v, got %v", id, expected, ids)
+			}
+		}
+
+		// Deleting a collection removes the tags pointing to it
+		err = store.DeleteCollection("daily")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags, err = store.GetAppTags("app2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 0 {
+			t.Errorf("expected no tags, got %v", tags)
+		}
+		if ids := collectionIds(t, store); !reflect.DeepEqual(ids, []string{"staff", "tools"}) {
+			t.Errorf("unexpected collections %v", ids)
+		}
+		for _, err := range []error{
+			store.DeleteCollection("daily"),
+			store.UpdateCollection(RebbleCollection{Id: "daily", Name: "Daily"}),
+			store.AddCollectionApps("daily", []string{"app1"}),
+			store.RemoveCollectionApps("daily", []string{"app1"}),
+			store.OrderCollectionApps("daily", []string{"app1"}),
+		} {
+			if err != ErrNoCollection {
+				t.Errorf("expected ErrNoCollection, got %v", err)
+			}
+		}
+	})
+}
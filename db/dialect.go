@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"strconv"
+)
+
+// dialect describes the differences between the SQL databases supported by
+// Handler. Queries are always written with `?` placeholders and rewritten for
+// the dialect before being sent to the database.
+type dialect struct {
+	Name string
+
+	// Driver is the database/sql driver used for this dialect
+	Driver string
+
+	// NumberedPlaceholders is true when the database expects `$1, $2, ...`
+	// instead of `?`
+	NumberedPlaceholders bool
+
+	// Like is the operator used for case-insensitive pattern matching
+	Like string
+}
+
+var (
+	sqliteDialect = &dialect{
+		Name:   "sqlite",
+		Driver: "sqlite3",
+		Like:   "LIKE",
+	}
+
+	postgresDialect = &dialect{
+		Name:                 "postgres",
+		Driver:               "postgres",
+		NumberedPlaceholders: true,
+		Like:                 "ILIKE",
+	}
+)
+
+// rebind rewrites the `?` placeholders of a query for the dialect. Question
+// marks within quoted strings are left untouched.
+func (d *dialect) rebind(query string) string {
+	if !d.NumberedPlaceholders {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	inString := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+			b.WriteRune(c)
+		case c == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Tx is a database transaction that rewrites queries for the dialect of the
+// database it belongs to
+type Tx struct {
+	tx      *sql.Tx
+	dialect *dialect
+}
+
+// Exec executes a query that doesn't return rows
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+// Query executes a query that returns rows
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.Query(tx.dialect.rebind(query), args...)
+}
+
+// QueryRow executes a query that is expected to return at most one row
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+// Prepare creates a prepared statement for use within the transaction
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.tx.Prepare(tx.dialect.rebind(query))
+}
+
+// Commit commits the transaction
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+// Rollback aborts the transaction
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Fixture is a small catalog described in JSON, used to populate a Store in
+// tests
+type Fixture struct {
+	Authors     []RebbleAuthor             `json:"authors"`
+	Collections []RebbleCollection         `json:"collections"`
+	Apps        []RebbleApplication        `json:"apps"`
+	Versions    map[string][]RebbleVersion `json:"versions"`
+	// Sources are the original records of the apps in the Pebble app store
+	// archive, indexed by app ID
+	Sources map[string][]json.RawMessage `json:"sources,omitempty"`
+	// CollectionApps are the IDs of the apps of each collection, in their
+	// manual order. The apps of the collections left out are those tagged
+	// with them.
+	CollectionApps map[string][]string `json:"collection_apps,omitempty"`
+}
+
+// ReadFixture reads a fixture from a JSON file
+func ReadFixture(path string) (Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Fixture{}, err
+	}
+
+	var fixture Fixture
+	err = json.Unmarshal(data, &fixture)
+	if err != nil {
+		return Fixture{}, err
+	}
+
+	return fixture, nil
+}
+
+// LoadFixture imports the fixture stored in the JSON file at path into store
+func LoadFixture(store Store, path string) error {
+	fixture, err := ReadFixture(path)
+	if err != nil {
+		return err
+	}
+
+	return ImportFixture(store, fixture)
+}
+
+// ImportFixture imports a fixture, such as an export of another store, into
+// store. The collections listed in CollectionApps get exactly these apps, in
+// this order.
+func ImportFixture(store Store, fixture Fixture) error {
+	err := store.ImportCatalog(fixture.Authors, fixture.Collections, fixture.Apps, fixture.Versions)
+	if err != nil {
+		return err
+	}
+
+	if len(fixture.Sources) > 0 {
+		err = store.SetAppSources(fixture.Sources)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, appIds := range fixture.CollectionApps {
+		apps, err := store.GetAppsForCollection(id, "manual", "all")
+		if err != nil {
+			return err
+		}
+		removed := make([]string, 0)
+		for _, app := range apps {
+			if !in(app.Id, appIds) {
+				removed = append(removed, app.Id)
+			}
+		}
+
+		err = store.RemoveCollectionApps(id, removed)
+		if err != nil {
+			return err
+		}
+		err = store.AddCollectionApps(id, appIds)
+		if err != nil {
+			return err
+		}
+		err = store.OrderCollectionApps(id, appIds)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// fuzzyThreshold is the number of results under which a search tries to
+// correct typos in the query
+const fuzzyThreshold = 3
+
+// wordCandidate is a word of the search index that may be the right spelling
+// of a query token
+type wordCandidate struct {
+	Word string
+	// Documents is the number of apps containing the word
+	Documents int
+	// Shared is the number of trigrams the word has in common with the token
+	Shared int
+}
+
+// fuzzySearcher is implemented by the stores, so they share the typo
+// correction logic
+type fuzzySearcher interface {
+	// search returns a page of the apps matching exactly the query
+	search(query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error)
+	// wordCandidates returns the words of the search index sharing at least
+	// one trigram with token, and close enough in length to be a correction
+	wordCandidates(token string) ([]wordCandidate, error)
+}
+
+// fuzzySearch searches for query. If there are less than fuzzyThreshold
+// results, the words of the query are replaced by close words of the search
+// index that are more frequent. When that gives more results, the corrected
+// query is suggested, and its results are returned instead if the original
+// query had none.
+func fuzzySearch(searcher fuzzySearcher, query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error) {
+	cards, err := searcher.search(query, filters, sortby, offset, limit)
+	if err != nil || cards.Pagination.Total >= fuzzyThreshold {
+		return cards, err
+	}
+
+	phrases := searchPhrases(query)
+	corrected := false
+	for _, phrase := range phrases {
+		for i, token := range phrase {
+			if maxEdits(token) == 0 {
+				continue
+			}
+
+			candidates, err := searcher.wordCandidates(token)
+			if err != nil {
+				return RebbleCards{}, err
+			}
+
+			correction, ok := bestCorrection(token, candidates)
+			if ok && correction.Documents > cards.Pagination.Total {
+				phrase[i] = correction.Word
+				corrected = true
+			}
+		}
+	}
+	if !corrected {
+		return cards, nil
+	}
+
+	suggestion := joinPhrases(phrases)
+	correctedCards, err := searcher.search(suggestion, filters, sortby, offset, limit)
+	if err != nil {
+		return RebbleCards{}, err
+	}
+	if correctedCards.Pagination.Total <= cards.Pagination.Total {
+		return cards, nil
+	}
+
+	if cards.Pagination.Total == 0 {
+		cards = correctedCards
+	}
+	cards.DidYouMean = suggestion
+
+	return cards, nil
+}
+
+// maxEdits is the edit distance allowed between a token and its correction.
+// Very short tokens are never corrected.
+func maxEdits(token string) int {
+	length := utf8.RuneCountInString(token)
+	switch {
+	case length < 3:
+		return 0
+	case length <= 4:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// trigrams returns the distinct trigrams of a word, padded with `$` at both
+// ends so that short words and word boundaries have trigrams too
+func trigrams(word string) []string {
+	runes := []rune("$" + word + "$")
+	seen := make(map[string]bool)
+	grams := make([]string, 0, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+
+	return grams
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and
+// transpositions of adjacent letters needed to turn a into b (optimal string
+// alignment distance)
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// d[i][j] is the distance between the first i runes of a and the first j
+	// runes of b
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = d[i-1][j] + 1
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if d[i-1][j-1]+cost < d[i][j] {
+				d[i][j] = d[i-1][j-1] + cost
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+
+	return d[len(ra)][len(rb)]
+}
+
+// bestCorrection picks the most likely correction of token: the closest word
+// (by edit distance, then by shared trigrams), and the most frequent one
+// among equally close words. Words the token is a prefix of already match it,
+// so they are not corrections.
+func bestCorrection(token string, candidates []wordCandidate) (wordCandidate, bool) {
+	type scoredCandidate struct {
+		wordCandidate
+		distance int
+	}
+
+	scored := make([]scoredCandidate, 0)
+	for _, candidate := range candidates {
+		if candidate.Shared == 0 || strings.HasPrefix(candidate.Word, token) {
+			continue
+		}
+
+		distance := editDistance(token, candidate.Word)
+		if distance <= maxEdits(token) {
+			scored = append(scored, scoredCandidate{candidate, distance})
+		}
+	}
+	if len(scored) == 0 {
+		return wordCandidate{}, false
+	}
+
+	sort.Slice(scored, func(i, j int) bool {
+		a, b := scored[i], scored[j]
+		if a.distance != b.distance {
+			return a.distance < b.distance
+		}
+		if a.Shared != b.Shared {
+			return a.Shared > b.Shared
+		}
+		if a.Documents != b.Documents {
+			return a.Documents > b.Documents
+		}
+		return a.Word < b.Word
+	})
+
+	return scored[0].wordCandidate, true
+}
+
+// reindexSearchWords rebuilds the vocabulary of the search index (every word
+// of the indexed documents, with its trigrams) from the app_search table
+func reindexSearchWords(tx *Tx) error {
+	for _, table := range []string{"search_trigrams", "search_words"} {
+		_, err := tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return err
+		}
+	}
+
+	documents, err := countDocumentWords(tx, "SELECT name, description, author, category FROM app_search")
+	if err != nil {
+		return err
+	}
+
+	wordStmt, err := tx.Prepare("INSERT INTO search_words(word, documents) VALUES(?, ?)")
+	if err != nil {
+		return err
+	}
+	defer wordStmt.Close()
+
+	trigramStmt, err := tx.Prepare("INSERT INTO search_trigrams(trigram, word) VALUES(?, ?)")
+	if err != nil {
+		return err
+	}
+	defer trigramStmt.Close()
+
+	for word, count := range documents {
+		_, err = wordStmt.Exec(word, count)
+		if err != nil {
+			return err
+		}
+
+		for _, gram := range trigrams(word) {
+			_, err = trigramStmt.Exec(gram, word)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// countDocumentWords returns the number of documents selected by query (the
+// indexed fields of app_search) containing each word
+func countDocumentWords(tx *Tx, query string, args ...interface{}) (map[string]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := make(map[string]int)
+	for rows.Next() {
+		values := make([]string, len(searchFields))
+		err = rows.Scan(&values[0], &values[1], &values[2], &values[3])
+		if err != nil {
+			return nil, err
+		}
+
+		for word := range documentWords(values) {
+			documents[word]++
+		}
+	}
+
+	return documents, rows.Err()
+}
+
+// updateSearchWords adds the given number of documents to each word of the
+// vocabulary. New words are added with their trigrams, words left without
+// documents are removed.
+func updateSearchWords(tx *Tx, changes map[string]int) error {
+	for word, change := range changes {
+		if change == 0 {
+			continue
+		}
+
+		var documents int
+		err := tx.QueryRow("SELECT documents FROM search_words WHERE word=?", word).Scan(&documents)
+		if err == sql.ErrNoRows {
+			documents = 0
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case documents+change <= 0:
+			for _, table := range []string{"search_trigrams", "search_words"} {
+				_, err = tx.Exec("DELETE FROM "+table+" WHERE word=?", word)
+				if err != nil {
+					return err
+				}
+			}
+		case documents == 0:
+			_, err = tx.Exec("INSERT INTO search_words(word, documents) VALUES(?, ?)", word, change)
+			if err != nil {
+				return err
+			}
+			for _, gram := range trigrams(word) {
+				_, err = tx.Exec("INSERT INTO search_trigrams(trigram, word) VALUES(?, ?)", gram, word)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			_, err = tx.Exec("UPDATE search_words SET documents=? WHERE word=?", documents+change, word)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// documentWords returns the set of words of the indexed fields of an app
+func documentWords(values []string) map[string]bool {
+	words := make(map[string]bool)
+	for _, value := range values {
+		for _, word := range searchTokens(value) {
+			words[word] = true
+		}
+	}
+
+	return words
+}
+
+// wordCandidates returns the words of the search index that could be a
+// correction of token
+func (handler Handler) wordCandidates(token string) ([]wordCandidate, error) {
+	grams := trigrams(token)
+	length := utf8.RuneCountInString(token)
+
+	args := make([]interface{}, 0, len(grams)+2)
+	for _, gram := range grams {
+		args = append(args, gram)
+	}
+	args = append(args, length-maxEdits(token), length+maxEdits(token))
+
+	rows, err := handler.query(`
+		SELECT search_words.word, search_words.documents, COUNT(*)
+		FROM search_trigrams
+		JOIN search_words ON search_words.word = search_trigrams.word
+		WHERE search_trigrams.trigram IN (?`+strings.Repeat(", ?", len(grams)-1)+`)
+			AND length(search_words.word) BETWEEN ? AND ?
+		GROUP BY search_words.word, search_words.documents
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make([]wordCandidate, 0)
+	for rows.Next() {
+		var candidate wordCandidate
+		err = rows.Scan(&candidate.Word, &candidate.Documents, &candidate.Shared)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, rows.Err()
+}
+
+// wordCandidates returns the words of the search index that could be a
+// correction of token. The vocabulary is computed on every call.
+func (store *MemoryStore) wordCandidates(token string) ([]wordCandidate, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	documents := make(map[string]int)
+	for _, app := range store.apps {
+		for word := range documentWords(store.searchValues(app)) {
+			documents[word]++
+		}
+	}
+
+	tokenGrams := trigrams(token)
+	length := utf8.RuneCountInString(token)
+	candidates := make([]wordCandidate, 0)
+	for word, count := range documents {
+		wordLength := utf8.RuneCountInString(word)
+		if wordLength < length-maxEdits(token) || wordLength > length+maxEdits(token) {
+			continue
+		}
+
+		shared := 0
+		for _, gram := range trigrams(word) {
+			if in(gram, tokenGrams) {
+				shared++
+			}
+		}
+		if shared > 0 {
+			candidates = append(candidates, wordCandidate{word, count, shared})
+		}
+	}
+
+	return candidates, nil
+}
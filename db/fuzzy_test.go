@@ -0,0 +1,159 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"weather", "weather", 0},
+		{"wether", "weather", 1},
+		{"teh", "the", 1},
+		{"pokemon", "pokémon", 1},
+		{"clock", "", 5},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, test := range tests {
+		if d := editDistance(test.a, test.b); d != test.distance {
+			t.Errorf("editDistance(%q, %q): expected %d, got %d", test.a, test.b, test.distance, d)
+		}
+	}
+}
+
+func TestTrigrams(t *testing.T) {
+	expected := []string{"$ab", "abc", "bc$"}
+	if grams := trigrams("abc"); !reflect.DeepEqual(grams, expected) {
+		t.Fatalf("expected %v, got %v", expected, grams)
+	}
+
+	expected = []string{"$aa", "aaa", "aa$"}
+	if grams := trigrams("aaaa"); !reflect.DeepEqual(grams, expected) {
+		t.Fatalf("expected %v, got %v", expected, grams)
+	}
+}
+
+func TestBestCorrection(t *testing.T) {
+	candidates := []wordCandidate{
+		{"weather", 2, 4},
+		{"feather", 9, 3},
+		{"wet", 1, 2},
+		{"wethers", 5, 5},
+	}
+
+	// "wethers" starts with the token, so it doesn't correct anything
+	correction, ok := bestCorrection("wether", candidates)
+	if !ok || correction.Word != "weather" {
+		t.Fatalf("expected weather, got %v", correction)
+	}
+
+	_, ok = bestCorrection("xylophone", candidates)
+	if ok {
+		t.Fatal("expected no correction")
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		tests := []struct {
+			query      string
+			titles     []string
+			didYouMean string
+		}{
+			// No results, the corrected query is searched instead
+			{"wether", []string{"Weather Now", "Weather Line"}, "weather"},
+			{"big tiem", []string{"Big Time"}, "big time"},
+			// Words are prefixes, so a word being typed isn't a typo
+			{"compas", []string{"Compass"}, ""},
+			// Enough results, nothing to correct
+			{"weather", []string{"Weather Now", "Weather Line"}, ""},
+			// Nothing close enough
+			{"zzzzzz", []string{}, ""},
+		}
+
+		for _, test := range tests {
+			cards, err := store.Search(test.query, SearchFilters{}, "relevance", 0, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := make([]string, len(cards.Cards))
+			for i, card := range cards.Cards {
+				titles[i] = card.Title
+			}
+			if !reflect.DeepEqual(titles, test.titles) {
+				t.Errorf("%q: expected %v, got %v", test.query, test.titles, titles)
+			}
+			if cards.DidYouMean != test.didYouMean {
+				t.Errorf("%q: expected suggestion %q, got %q", test.query, test.didYouMean, cards.DidYouMean)
+			}
+		}
+	})
+}
+
+// searchIndex returns the documents and the vocabulary of the search index
+func searchIndex(t *testing.T, handler Handler) []string {
+	index := make([]string, 0)
+	for _, query := range []string{
+		"SELECT app_id || ':' || name || ':' || description || ':' || author || ':' || category FROM app_search ORDER BY app_id",
+		"SELECT word || ':' || documents FROM search_words ORDER BY word",
+		"SELECT trigram || ':' || word FROM search_trigrams ORDER BY trigram, word",
+	} {
+		rows, err := handler.query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var row string
+			err = rows.Scan(&row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index = append(index, row)
+		}
+		rows.Close()
+	}
+
+	return index
+}
+
+func TestReindexSearchApps(t *testing.T) {
+	forEachSQLStore(t, func(t *testing.T, handler Handler) {
+		loadTestFixture(t, handler)
+
+		// The apps of the collections changed are reindexed the same way as
+		// the whole catalog
+		err := handler.UpdateCollection(RebbleCollection{Id: "5261a8fb3b773043d5000001", Name: "Everyday Chronograph"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = handler.DeleteCollection("5261a8fb3b773043d500000c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := searchIndex(t, handler)
+
+		err = handler.Reindex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := searchIndex(t, handler); !reflect.DeepEqual(index, expected) {
+			t.Errorf("expected the index\n%v\ngot\n%v", expected, index)
+		}
+
+		cards, err := handler.Search("chronograph", SearchFilters{}, "relevance", 0, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cards.Cards) == 0 {
+			t.Error("expected the apps of the renamed collection to be found by its name")
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// The states of a job
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	// JobInterrupted is the state of the jobs that were running when the
+	// server stopped
+	JobInterrupted = "interrupted"
+)
+
+// Job is a long running operation of the admin API, run in the background
+type Job struct {
+	Id    string `json:"id"`
+	Kind  string `json:"kind"`
+	State string `json:"state"`
+	// Created is when the job was started, and Finished when it stopped (zero
+	// while it is running)
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+	// Progress counts the work done, such as files read or images downloaded
+	Progress map[string]int `json:"progress"`
+	Errors   []string       `json:"errors"`
+	// Result is the outcome of the job as JSON, such as the report of an
+	// import
+	Result json.RawMessage `json:"result,omitempty"`
+	// Log are the lines logged by the job
+	Log []string `json:"-"`
+}
+
+// copyJob returns a deep copy of job, with its missing lists and maps empty
+func copyJob(job Job) Job {
+	progress := make(map[string]int, len(job.Progress))
+	for counter, n := range job.Progress {
+		progress[counter] = n
+	}
+	job.Progress = progress
+	job.Errors = append([]string{}, job.Errors...)
+	job.Log = append([]string{}, job.Log...)
+	if job.Result != nil {
+		job.Result = append(json.RawMessage{}, job.Result...)
+	}
+
+	return job
+}
+
+// SaveJob inserts or updates a job
+func (handler Handler) SaveJob(job Job) error {
+	columns := make([]interface{}, 0, 3)
+	for _, value := range []interface{}{job.Progress, job.Errors, job.Log} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		columns = append(columns, string(data))
+	}
+	var finished int64
+	if !job.Finished.IsZero() {
+		finished = job.Finished.UnixNano()
+	}
+
+	_, err := handler.exec(`
+		INSERT INTO jobs(id, kind, state, created, finished, progress, errors, log, result)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			kind=excluded.kind, state=excluded.state, created=excluded.created, finished=excluded.finished,
+			progress=excluded.progress, errors=excluded.errors, log=excluded.log, result=excluded.result
+	`, append([]interface{}{job.Id, job.Kind, job.State, job.Created.UnixNano(), finished}, append(columns, string(job.Result))...)...)
+	return err
+}
+
+// scanJob reads a job from a row of the jobs table
+func scanJob(scan func(dest ...interface{}) error) (Job, error) {
+	var job Job
+	var created, finished int64
+	var progress, errs, log, result string
+	err := scan(&job.Id, &job.Kind, &job.State, &created, &finished, &progress, &errs, &log, &result)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job.Created = time.Unix(0, created).UTC()
+	if finished != 0 {
+		job.Finished = time.Unix(0, finished).UTC()
+	}
+	columns := []string{progress, errs, log}
+	for i, value := range []interface{}{&job.Progress, &job.Errors, &job.Log} {
+		err = json.Unmarshal([]byte(columns[i]), value)
+		if err != nil {
+			return Job{}, err
+		}
+	}
+	if result != "" {
+		job.Result = json.RawMessage(result)
+	}
+
+	return copyJob(job), nil
+}
+
+// jobColumns are the columns read by scanJob
+const jobColumns = "id, kind, state, created, finished, progress, errors, log, result"
+
+// GetJob returns the job with the given ID
+func (handler Handler) GetJob(id string) (Job, error) {
+	job, err := scanJob(handler.queryRow("SELECT "+jobColumns+" FROM jobs WHERE id=?", id).Scan)
+	if err == sql.ErrNoRows {
+		return Job{}, errors.New("No job with this ID")
+	}
+
+	return job, err
+}
+
+// GetJobs returns the last limit jobs, the most recent first
+func (handler Handler) GetJobs(limit int) ([]Job, error) {
+	rows, err := handler.query("SELECT "+jobColumns+" FROM jobs ORDER BY created DESC, id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]Job, 0)
+	for rows.Next() {
+		job, err := scanJob(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// InterruptJobs marks the running jobs as interrupted, when they can't be
+// running anymore
+func (handler Handler) InterruptJobs() error {
+	_, err := handler.exec("UPDATE jobs SET state=?, finished=? WHERE state=?", JobInterrupted, time.Now().UnixNano(), JobRunning)
+	return err
+}
+
+// SaveJob inserts or updates a job
+func (store *MemoryStore) SaveJob(job Job) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.jobs[job.Id] = copyJob(job)
+	return nil
+}
+
+// GetJob returns the job with the given ID
+func (store *MemoryStore) GetJob(id string) (Job, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	job, ok := store.jobs[id]
+	if !ok {
+		return Job{}, errors.New("No job with this ID")
+	}
+
+	return copyJob(job), nil
+}
+
+// GetJobs returns the last limit jobs, the most recent first
+func (store *MemoryStore) GetJobs(limit int) ([]Job, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	jobs := make([]Job, 0, len(store.jobs))
+	for _, job := range store.jobs {
+		jobs = append(jobs, copyJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Created.Equal(jobs[j].Created) {
+			return jobs[i].Created.After(jobs[j].Created)
+		}
+		return jobs[i].Id < jobs[j].Id
+	})
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+
+	return jobs, nil
+}
+
+// InterruptJobs marks the running jobs as interrupted
+func (store *MemoryStore) InterruptJobs() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for id, job := range store.jobs {
+		if job.State == JobRunning {
+			job.State = JobInterrupted
+			job.Finished = time.Now().UTC()
+			store.jobs[id] = job
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		created := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+		running := Job{Id: "b", Kind: "rebuild-db", State: JobRunning, Created: created.Add(time.Minute), Progress: map[string]int{"files": 10}, Log: []string{"Parsed 10 files"}}
+		done := Job{Id: "a", Kind: "rebuild-images", State: JobDone, Created: created, Finished: created.Add(time.Second), Errors: []string{"Not found"}, Result: json.RawMessage(`{"images":2}`)}
+		for _, job := range []Job{running, done} {
+			err = store.SaveJob(job)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		job, err := store.GetJob("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := copyJob(done)
+		if !reflect.DeepEqual(job, expected) {
+			t.Errorf("expected %+v, got %+v", expected, job)
+		}
+		_, err = store.GetJob("c")
+		if err == nil {
+			t.Error("expected an unknown job to be rejected")
+		}
+
+		// Jobs are updated in place
+		running.Progress["files"] = 20
+		running.Log = append(running.Log, "Parsed 20 files")
+		err = store.SaveJob(running)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := store.GetJobs(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 2 || !reflect.DeepEqual(jobs[0], copyJob(running)) || jobs[1].Id != "a" {
+			t.Errorf("unexpected jobs %+v", jobs)
+		}
+
+		// Jobs still running when the server stopped are interrupted
+		err = store.InterruptJobs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs, err = store.GetJobs(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 1 || jobs[0].State != JobInterrupted || jobs[0].Finished.IsZero() {
+			t.Errorf("expected the running job to be interrupted, got %+v", jobs)
+		}
+	})
+}
@@ -0,0 +1,656 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is an in-memory implementation of Store. It is meant for tests:
+// it starts empty, and its contents are lost when the process exits.
+type MemoryStore struct {
+	lock sync.RWMutex
+
+	authors        map[int]RebbleAuthor
+	collections    map[string]RebbleCollection
+	apps           map[string]RebbleApplication
+	appTags        map[string][]string
+	versions       map[string][]RebbleVersion
+	collectionApps map[string][]string
+	// collectionOrder are the IDs of the collections in their manual order
+	collectionOrder []string
+	// curated are the IDs of the collections created or edited by hand
+	curated map[string]bool
+	sources map[string][]json.RawMessage
+	// developers maps developer IDs to author IDs
+	developers      map[string]int
+	authorRedirects map[int]int
+	searchLog       []SearchLogEntry
+	jobs            map[string]Job
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		authors:         make(map[int]RebbleAuthor),
+		collections:     make(map[string]RebbleCollection),
+		apps:            make(map[string]RebbleApplication),
+		appTags:         make(map[string][]string),
+		versions:        make(map[string][]RebbleVersion),
+		collectionApps:  make(map[string][]string),
+		curated:         make(map[string]bool),
+		sources:         make(map[string][]json.RawMessage),
+		developers:      make(map[string]int),
+		authorRedirects: make(map[int]int),
+		jobs:            make(map[string]Job),
+	}
+}
+
+// Migrate does nothing, a MemoryStore has no schema
+func (store *MemoryStore) Migrate() error {
+	return nil
+}
+
+// Close does nothing
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// card returns the card of an app
+func (store *MemoryStore) card(app RebbleApplication) RebbleCard {
+	card := RebbleCard{
+		Id:       app.Id,
+		Title:    app.Name,
+		Type:     app.Type,
+		ThumbsUp: app.ThumbsUp,
+	}
+	if len(*app.Assets.Screenshots) != 0 {
+		card.ImageUrl = (*app.Assets.Screenshots)[0].Screenshots[0]
+	}
+
+	return card
+}
+
+// sortedApps returns the apps for which keep returns true, sorted with less
+// (ties are broken by ID)
+func (store *MemoryStore) sortedApps(keep func(app RebbleApplication) bool, less func(a, b RebbleApplication) bool) []RebbleApplication {
+	apps := make([]RebbleApplication, 0)
+	for _, app := range store.apps {
+		if keep(app) {
+			apps = append(apps, app)
+		}
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		if less(apps[i], apps[j]) {
+			return true
+		}
+		if less(apps[j], apps[i]) {
+			return false
+		}
+		return apps[i].Id < apps[j].Id
+	})
+
+	return apps
+}
+
+// GetAppsForCollection returns list of apps for single collection. If platform
+// is not "all", only apps compatible with that platform are returned.
+func (store *MemoryStore) GetAppsForCollection(collectionID string, sortby string, platform string) ([]RebbleApplication, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	positions := make(map[string]int)
+	for i, id := range store.collectionApps[collectionID] {
+		positions[id] = i
+	}
+
+	var less func(a, b RebbleApplication) bool
+	switch sortby {
+	case "popular":
+		less = func(a, b RebbleApplication) bool {
+			return a.ThumbsUp > b.ThumbsUp
+		}
+	case "new":
+		less = func(a, b RebbleApplication) bool {
+			return a.Published.After(b.Published.Time)
+		}
+	case "manual":
+		less = func(a, b RebbleApplication) bool {
+			return positions[a.Id] < positions[b.Id]
+		}
+	default:
+		return nil, errors.New("Invalid sortby parameter")
+	}
+
+	apps := store.sortedApps(func(app RebbleApplication) bool {
+		_, ok := positions[app.Id]
+		return ok && (platform == "all" || in(platform, app.SupportedPlatforms))
+	}, less)
+
+	result := make([]RebbleApplication, len(apps))
+	for i, app := range apps {
+		screenshots := copyScreenshots(*app.Assets.Screenshots)
+		result[i] = RebbleApplication{
+			Id:                 app.Id,
+			Name:               app.Name,
+			Type:               app.Type,
+			ThumbsUp:           app.ThumbsUp,
+			Published:          app.Published,
+			SupportedPlatforms: append([]string{}, app.SupportedPlatforms...),
+			Assets: RebbleAssets{
+				Screenshots: &screenshots,
+			},
+		}
+	}
+
+	return result, nil
+}
+
+// GetCollectionName returns the name of a collection
+func (store *MemoryStore) GetCollectionName(collectionID string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	collection, ok := store.collections[collectionID]
+	if !ok {
+		return "", ErrNoCollection
+	}
+
+	return collection.Name, nil
+}
+
+// GetAllApps returns all available apps
+func (store *MemoryStore) GetAllApps(sortby string, ascending bool, offset int, limit int) ([]RebbleApplication, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	var less func(a, b RebbleApplication) bool
+	switch sortby {
+	case "popular":
+		less = func(a, b RebbleApplication) bool { return a.ThumbsUp < b.ThumbsUp }
+	case "recent":
+		less = func(a, b RebbleApplication) bool { return a.Published.Before(b.Published.Time) }
+	default:
+		return nil, errors.New("Invalid sortby parameter")
+	}
+	if !ascending {
+		ascendingLess := less
+		less = func(a, b RebbleApplication) bool { return ascendingLess(b, a) }
+	}
+
+	apps := store.sortedApps(func(app RebbleApplication) bool {
+		_, ok := store.authors[app.Author.Id]
+		return ok
+	}, less)
+
+	result := make([]RebbleApplication, 0)
+	for i := offset; i < len(apps) && i < offset+limit; i++ {
+		app := RebbleApplication{
+			Id:        apps[i].Id,
+			Name:      apps[i].Name,
+			ThumbsUp:  apps[i].ThumbsUp,
+			Published: apps[i].Published,
+		}
+		app.Author.Name = store.authors[apps[i].Author.Id].Name
+		app.Assets.Icon = apps[i].Assets.Icon
+		result = append(result, app)
+	}
+
+	return result, nil
+}
+
+// GetApp returns a specific app
+func (store *MemoryStore) GetApp(id string) (RebbleApplication, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	app, ok := store.apps[id]
+	if !ok {
+		return RebbleApplication{}, errors.New("No application with this ID")
+	}
+	author, ok := store.authors[app.Author.Id]
+	if !ok {
+		return RebbleApplication{}, errors.New("No application with this ID")
+	}
+
+	app.Author = author
+	err := copyAppDetails(&app)
+	if err != nil {
+		return RebbleApplication{}, err
+	}
+	app.SupportedPlatforms = append([]string{}, app.SupportedPlatforms...)
+	app.AppInfo.Tags = store.appTagList(id)
+	screenshots := copyScreenshots(*app.Assets.Screenshots)
+	app.Assets.Screenshots = &screenshots
+
+	return app, nil
+}
+
+// GetApps returns the applications with the given IDs, in that order. Unknown
+// IDs are skipped.
+func (store *MemoryStore) GetApps(ids []string) ([]RebbleApplication, error) {
+	apps := make([]RebbleApplication, 0, len(ids))
+	for _, id := range ids {
+		store.lock.RLock()
+		_, ok := store.apps[id]
+		store.lock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		app, err := store.GetApp(id)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+
+	return apps, nil
+}
+
+// appTagList returns the collections an app is tagged with
+func (store *MemoryStore) appTagList(id string) []RebbleCollection {
+	tags := make([]RebbleCollection, 0)
+	for _, tagId := range store.appTags[id] {
+		tags = append(tags, store.collections[tagId])
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Id < tags[j].Id
+	})
+
+	return tags
+}
+
+// GetAppTags returns the the list of tags of the application with the id `id`
+func (store *MemoryStore) GetAppTags(id string) ([]RebbleCollection, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.appTagList(id), nil
+}
+
+// GetAppVersions returns the the list of versions of the application with the id `id`
+func (store *MemoryStore) GetAppVersions(id string) ([]RebbleVersion, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if _, ok := store.apps[id]; !ok {
+		return []RebbleVersion{}, errors.New("No app with this ID")
+	}
+
+	return append([]RebbleVersion{}, store.versions[id]...), nil
+}
+
+// GetAuthor returns a RebbleAuthor
+func (store *MemoryStore) GetAuthor(id int) (RebbleAuthor, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	author, ok := store.authors[id]
+	if !ok {
+		return RebbleAuthor{}, errors.New("No app with this ID")
+	}
+
+	return author, nil
+}
+
+// GetAuthorCards returns cards for all apps from a specific author
+func (store *MemoryStore) GetAuthorCards(id int) (RebbleCards, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	apps := store.sortedApps(func(app RebbleApplication) bool {
+		return app.Author.Id == id
+	}, func(a, b RebbleApplication) bool {
+		return a.Published.Before(b.Published.Time)
+	})
+
+	cards := RebbleCards{
+		Cards: make([]RebbleCard, 0),
+	}
+	for _, app := range apps {
+		cards.Cards = append(cards.Cards, store.card(app))
+	}
+
+	return cards, nil
+}
+
+// ImportCatalog inserts or updates authors, collections and apps (along with
+// their versions, indexed by app ID). It behaves like Handler.ImportCatalog.
+func (store *MemoryStore) ImportCatalog(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.importCatalog(authors, collections, apps, versions)
+}
+
+// importCatalog writes authors, collections and apps for ImportCatalog and
+// ApplyCatalogChanges, the store must be locked
+func (store *MemoryStore) importCatalog(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error {
+	// Validate everything before changing anything, like a rolled back
+	// transaction would
+	for _, app := range apps {
+		for _, tag := range app.AppInfo.Tags {
+			_, ok := store.collections[tag.Id]
+			for _, collection := range collections {
+				ok = ok || collection.Id == tag.Id
+			}
+			if !ok {
+				return fmt.Errorf("App %s is tagged with collection %s, which does not exist", app.Id, tag.Id)
+			}
+		}
+	}
+
+	for _, collection := range collections {
+		if _, ok := store.collections[collection.Id]; !ok {
+			store.collectionOrder = append(store.collectionOrder, collection.Id)
+		}
+		if !store.curated[collection.Id] {
+			store.collections[collection.Id] = collection
+		}
+	}
+
+	for _, author := range authors {
+		store.insertAuthor(author)
+	}
+
+	moved := make(movedAuthors)
+	for _, app := range apps {
+		app.Author = RebbleAuthor{Id: app.Author.Id}
+		if existing, ok := store.apps[app.Id]; ok {
+			moved.add(existing.Author.Id, app.Author.Id)
+		}
+		err := copyAppDetails(&app)
+		if err != nil {
+			return err
+		}
+		app.Published.Time = fromUnixNano(app.Published.UnixNano())
+		app.AppInfo.Updated.Time = fromUnixNano(app.AppInfo.Updated.UnixNano())
+
+		// Those fields are not part of the archive, or only set for new
+		// apps (hearts)
+		if existing, ok := store.apps[app.Id]; ok {
+			app.ThumbsUp = existing.ThumbsUp
+			app.AppInfo.RebbleReady = existing.AppInfo.RebbleReady
+			app.AppInfo.SupportUrl = existing.AppInfo.SupportUrl
+			app.DoomsdayBackup = existing.DoomsdayBackup
+		}
+
+		platforms := make([]string, 0)
+		for _, platform := range app.SupportedPlatforms {
+			if !in(platform, platforms) {
+				platforms = append(platforms, platform)
+			}
+		}
+		sortPlatforms(platforms)
+		app.SupportedPlatforms = platforms
+
+		var screenshots []RebbleScreenshotsPlatform
+		if app.Assets.Screenshots != nil {
+			screenshots = *app.Assets.Screenshots
+		}
+		screenshots = copyScreenshots(screenshots)
+		app.Assets.Screenshots = &screenshots
+
+		// Collection membership mirrors the tags of the app, but apps that
+		// were added to other collections by hand stay there, and apps keep
+		// their place in the collections.
+		tagIds := make([]string, 0)
+		for _, tag := range app.AppInfo.Tags {
+			if !in(tag.Id, tagIds) {
+				tagIds = append(tagIds, tag.Id)
+			}
+		}
+		for _, tagId := range store.appTags[app.Id] {
+			if !in(tagId, tagIds) {
+				store.collectionApps[tagId] = remove(app.Id, store.collectionApps[tagId])
+			}
+		}
+		for _, tagId := range tagIds {
+			if !in(app.Id, store.collectionApps[tagId]) {
+				store.collectionApps[tagId] = append(store.collectionApps[tagId], app.Id)
+			}
+		}
+		store.appTags[app.Id] = tagIds
+		app.AppInfo.Tags = nil
+
+		appVersions := make([]RebbleVersion, len(versions[app.Id]))
+		for i, version := range versions[app.Id] {
+			version.ReleaseDate.Time = fromUnixNano(version.ReleaseDate.UnixNano())
+			appVersions[i] = version
+		}
+		store.versions[app.Id] = appVersions
+
+		store.apps[app.Id] = app
+	}
+
+	store.redirectAuthors(moved)
+	return nil
+}
+
+// ImportCatalogBatch behaves like ImportCatalog, a MemoryStore has no search
+// index
+func (store *MemoryStore) ImportCatalogBatch(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error {
+	return store.ImportCatalog(authors, collections, apps, versions)
+}
+
+// Reindex does nothing, a MemoryStore has no search index
+func (store *MemoryStore) Reindex() error {
+	return nil
+}
+
+// ExportCatalog returns the whole catalog, sorted by ID. It behaves like
+// Handler.ExportCatalog.
+func (store *MemoryStore) ExportCatalog() (Fixture, error) {
+	store.lock.RLock()
+	fixture := Fixture{
+		Authors:        make([]RebbleAuthor, 0, len(store.authors)),
+		Collections:    make([]RebbleCollection, 0, len(store.collections)),
+		CollectionApps: make(map[string][]string),
+	}
+	developerIds := store.developerIds()
+	for _, author := range store.authors {
+		author.DeveloperId = developerIds[author.Id]
+		fixture.Authors = append(fixture.Authors, author)
+	}
+	for _, collection := range store.collections {
+		fixture.Collections = append(fixture.Collections, collection)
+		fixture.CollectionApps[collection.Id] = append(make([]string, 0), store.collectionApps[collection.Id]...)
+	}
+	ids := make([]string, 0, len(store.apps))
+	for id := range store.apps {
+		ids = append(ids, id)
+	}
+	store.lock.RUnlock()
+
+	sort.Slice(fixture.Authors, func(i, j int) bool {
+		return fixture.Authors[i].Id < fixture.Authors[j].Id
+	})
+	sort.Slice(fixture.Collections, func(i, j int) bool {
+		return fixture.Collections[i].Id < fixture.Collections[j].Id
+	})
+	sort.Strings(ids)
+
+	return exportApps(store, fixture, ids)
+}
+
+// GetAllScreenshots returns the screenshots of every app, indexed by app ID
+func (store *MemoryStore) GetAllScreenshots() (map[string][]RebbleScreenshotsPlatform, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	screenshots := make(map[string][]RebbleScreenshotsPlatform)
+	for id, app := range store.apps {
+		if len(*app.Assets.Screenshots) != 0 {
+			screenshots[id] = copyScreenshots(*app.Assets.Screenshots)
+		}
+	}
+
+	return screenshots, nil
+}
+
+// SetScreenshots replaces the screenshots of the given apps (indexed by app ID)
+func (store *MemoryStore) SetScreenshots(screenshots map[string][]RebbleScreenshotsPlatform) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for id, platforms := range screenshots {
+		app, ok := store.apps[id]
+		if !ok {
+			continue
+		}
+		platforms = copyScreenshots(platforms)
+		app.Assets.Screenshots = &platforms
+		store.apps[id] = app
+	}
+
+	return nil
+}
+
+// DeleteApps removes apps, along with their screenshots, versions, collection
+// memberships and original records. Their authors are kept.
+func (store *MemoryStore) DeleteApps(ids []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.deleteApps(ids)
+	return nil
+}
+
+// deleteApps removes apps for DeleteApps and ApplyCatalogChanges, the store
+// must be locked
+func (store *MemoryStore) deleteApps(ids []string) {
+	for _, id := range ids {
+		for collectionId, appIds := range store.collectionApps {
+			store.collectionApps[collectionId] = remove(id, appIds)
+		}
+		delete(store.apps, id)
+		delete(store.appTags, id)
+		delete(store.versions, id)
+		delete(store.sources, id)
+	}
+}
+
+// SetAppSources replaces the original records of the given apps (indexed by
+// app ID)
+func (store *MemoryStore) SetAppSources(sources map[string][]json.RawMessage) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for id := range sources {
+		if _, ok := store.apps[id]; !ok {
+			return fmt.Errorf("App %s does not exist", id)
+		}
+	}
+	store.setAppSources(sources)
+
+	return nil
+}
+
+// setAppSources writes the original records of apps for SetAppSources and
+// ApplyCatalogChanges, the store must be locked
+func (store *MemoryStore) setAppSources(sources map[string][]json.RawMessage) {
+	for id, documents := range sources {
+		copies := make([]json.RawMessage, len(documents))
+		for i, document := range documents {
+			copies[i] = append(json.RawMessage{}, document...)
+		}
+		store.sources[id] = copies
+	}
+}
+
+// ApplyCatalogChanges imports, sets the original records of and deletes apps
+// at once. It behaves like Handler.ApplyCatalogChanges.
+func (store *MemoryStore) ApplyCatalogChanges(changes CatalogChanges) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// Validate the records before changing anything, like a rolled back
+	// transaction would
+	for id := range changes.Sources {
+		_, ok := store.apps[id]
+		for _, app := range changes.Apps {
+			ok = ok || app.Id == id
+		}
+		if !ok {
+			return fmt.Errorf("App %s does not exist", id)
+		}
+	}
+
+	err := store.importCatalog(changes.Authors, changes.Collections, changes.Apps, changes.Versions)
+	if err != nil {
+		return err
+	}
+	store.setAppSources(changes.Sources)
+	store.deleteApps(changes.Removed)
+
+	return nil
+}
+
+// GetAppSources returns the original records of an app
+func (store *MemoryStore) GetAppSources(id string) ([]json.RawMessage, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	sources := make([]json.RawMessage, 0, len(store.sources[id]))
+	for _, document := range store.sources[id] {
+		sources = append(sources, append(json.RawMessage{}, document...))
+	}
+
+	return sources, nil
+}
+
+// copyAppDetails replaces the details of app stored as JSON with a deep copy,
+// as they would be read back from the database
+func copyAppDetails(app *RebbleApplication) error {
+	details, err := encodeAppDetails(*app)
+	if err != nil {
+		return err
+	}
+
+	columns := make([]string, len(details))
+	for i, detail := range details {
+		columns[i] = detail.(string)
+	}
+
+	return decodeAppDetails(app, columns)
+}
+
+// copyScreenshots returns a deep copy of a list of screenshots, as it would be
+// read back from the database (platforms without any screenshot are dropped)
+func copyScreenshots(screenshots []RebbleScreenshotsPlatform) []RebbleScreenshotsPlatform {
+	result := make([]RebbleScreenshotsPlatform, 0)
+	for _, platform := range screenshots {
+		for _, url := range platform.Screenshots {
+			result = appendScreenshot(result, platform.Platform, url)
+		}
+	}
+
+	return result
+}
+
+// in returns true if s is in array
+func in(s string, array []string) bool {
+	for _, item := range array {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remove returns array without s
+func remove(s string, array []string) []string {
+	result := make([]string, 0, len(array))
+	for _, item := range array {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
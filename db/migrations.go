@@ -0,0 +1,625 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// migration is a single, ordered step of the database schema. Migrations are
+// applied in order of Version, and each one is only ever applied once. Each
+// dialect has its own step, a nil step meaning there is nothing to do for that
+// dialect.
+type migration struct {
+	Version     int
+	Description string
+	SQLite      func(tx *Tx) error
+	Postgres    func(tx *Tx) error
+	// Reindex is true if the search index has to be rebuilt after the
+	// migration. Migrations don't fill the index themselves, as the code
+	// indexing the catalog follows the latest schema: it is rebuilt once
+	// every migration is applied.
+	Reindex bool
+}
+
+// execStatements returns a migration step that executes the given SQL
+// statements in order
+func execStatements(statements ...string) func(tx *Tx) error {
+	return func(tx *Tx) error {
+		for _, stmt := range statements {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return fmt.Errorf("%q: %s", err, stmt)
+			}
+		}
+		return nil
+	}
+}
+
+// migrations is the list of every schema change, in order. Never edit or
+// remove a migration once it has been released, add a new one instead.
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "Initial catalog layout (apps, authors, collections)",
+		// This is the layout that used to be (re)created by the rebuild
+		// handler, so databases built before migrations existed are already
+		// at version 1.
+		SQLite: execStatements(
+			`create table if not exists apps (
+				id text not null primary key,
+				name text,
+				author_id integer,
+				tag_ids blob,
+				description text,
+				thumbs_up integer,
+				type text,
+				supported_platforms blob,
+				published_date integer,
+				pbw_url text,
+				rebble_ready integer,
+				updated integer,
+				version text,
+				support_url text,
+				author_url text,
+				source_url text,
+				screenshots blob,
+				banner_url text,
+				icon_url text,
+				doomsday_backup integer,
+				versions blob
+			)`,
+			`create table if not exists authors (
+				id text not null primary key,
+				name text
+			)`,
+			`create table if not exists collections (
+				id text not null primary key,
+				name text,
+				color text,
+				apps blob,
+				cache_apps_most_popular blob,
+				cache_time integer
+			)`,
+		),
+		// PostgreSQL support was added after the JSON blob columns were
+		// removed (see migration 2), so they are never created.
+		Postgres: execStatements(
+			`create table apps (
+				id text not null primary key,
+				name text,
+				author_id integer,
+				description text,
+				thumbs_up integer,
+				type text,
+				published_date bigint,
+				pbw_url text,
+				rebble_ready boolean,
+				updated bigint,
+				version text,
+				support_url text,
+				author_url text,
+				source_url text,
+				banner_url text,
+				icon_url text,
+				doomsday_backup boolean
+			)`,
+			`create index apps_author_id on apps(author_id)`,
+			`create table authors (
+				id integer not null primary key,
+				name text
+			)`,
+			`create table collections (
+				id text not null primary key,
+				name text,
+				color text
+			)`,
+		),
+	},
+	{
+		Version:     2,
+		Description: "Move JSON blob columns into relational tables",
+		SQLite:      normalizeJSONBlobs,
+		Postgres:    createRelationTablesPostgres,
+	},
+	{
+		Version:     3,
+		Description: "Full-text search index",
+		SQLite: func(tx *Tx) error {
+			_, err := tx.Exec("create virtual table app_search using fts5(app_id unindexed, name, description, author, category)")
+			if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("SQLite was built without FTS5, build with `-tags sqlite_fts5`: %v", err)
+			}
+			return err
+		},
+		Postgres: execStatements(
+			`create table app_search (
+				app_id text not null primary key references apps(id) on delete cascade,
+				name text,
+				description text,
+				author text,
+				category text,
+				document tsvector
+			)`,
+			`create index app_search_document on app_search using gin(document)`,
+		),
+		Reindex: true,
+	},
+	{
+		Version:     4,
+		Description: "Vocabulary of the search index, for typo tolerance",
+		SQLite:      createSearchVocabulary,
+		Postgres:    createSearchVocabulary,
+		Reindex:     true,
+	},
+	{
+		Version:     5,
+		Description: "Prefix index of app, author and collection names",
+		SQLite: func(tx *Tx) error {
+			return createSuggestionIndex(tx, "text")
+		},
+		Postgres: func(tx *Tx) error {
+			// Prefixes are looked up with ranges, which only works with a
+			// byte-wise collation
+			return createSuggestionIndex(tx, `text collate "C"`)
+		},
+		Reindex: true,
+	},
+	{
+		Version:     6,
+		Description: "Unicode normalization of the search index",
+		Reindex:     true,
+	},
+	{
+		Version:     7,
+		Description: "Log of the searches, for analytics",
+		SQLite: execStatements(
+			`create table search_log (
+				query text not null,
+				searched_at integer not null,
+				results integer not null,
+				filters text not null,
+				latency integer not null
+			)`,
+			`create index search_log_searched_at on search_log(searched_at)`,
+		),
+		Postgres: execStatements(
+			`create table search_log (
+				query text not null,
+				searched_at bigint not null,
+				results integer not null,
+				filters text not null,
+				latency bigint not null
+			)`,
+			`create index search_log_searched_at on search_log(searched_at)`,
+		),
+	},
+	{
+		Version:     8,
+		Description: "Details of the Pebble app records, and the records themselves",
+		SQLite:      execStatements(appDetailsStatements...),
+		Postgres:    execStatements(appDetailsStatements...),
+	},
+	{
+		Version:     9,
+		Description: "Author IDs of the Pebble developers, and redirects of renumbered authors",
+		SQLite:      execStatements(authorIdsStatements...),
+		Postgres:    execStatements(authorIdsStatements...),
+	},
+	{
+		Version:     10,
+		Description: "Icons and banners of the apps for each hardware platform",
+		SQLite:      execStatements(`alter table apps add column hardware_images text not null default '{}'`),
+		Postgres:    execStatements(`alter table apps add column hardware_images text not null default '{}'`),
+	},
+	{
+		Version:     11,
+		Description: "Background jobs of the admin API",
+		SQLite:      execStatements(jobsStatements...),
+		Postgres:    execStatements(jobsStatements...),
+	},
+	{
+		Version:     12,
+		Description: "Manual order of the collections and of their apps",
+		SQLite:      orderCollections,
+		Postgres:    orderCollections,
+	},
+	{
+		Version:     13,
+		Description: "Collections created or edited by hand, which imports leave alone",
+		SQLite:      execStatements(`alter table collections add column curated integer not null default 0`),
+		Postgres:    execStatements(`alter table collections add column curated integer not null default 0`),
+	},
+}
+
+// LatestSchemaVersion returns the version the database will be at once all
+// migrations have been applied
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the current version of the database schema (0 if no
+// migration has ever been applied)
+func (handler Handler) SchemaVersion() (int, error) {
+	_, err := handler.exec(`
+		create table if not exists schema_version (
+			version integer not null primary key,
+			description text,
+			applied bigint
+		)
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = handler.queryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// Migrate brings the database schema up to date by applying every migration
+// that hasn't been applied yet. Each migration runs in its own transaction.
+// The search index is then rebuilt if a migration changed it.
+func (handler Handler) Migrate() error {
+	current, err := handler.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	reindex := false
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		up := m.SQLite
+		if handler.dialect == postgresDialect {
+			up = m.Postgres
+		}
+
+		tx, err := handler.begin()
+		if err != nil {
+			return err
+		}
+
+		if up != nil {
+			err = up(tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_version(version, description, applied) VALUES(?, ?, ?)", m.Version, m.Description, time.Now().UnixNano())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Applied database migration %d: %s", m.Version, m.Description)
+		reindex = reindex || m.Reindex
+	}
+
+	if !reindex {
+		return nil
+	}
+	err = handler.Reindex()
+	if err != nil {
+		return fmt.Errorf("Rebuilding the search index after the migrations failed: %v", err)
+	}
+	log.Print("Rebuilt the search index")
+	return nil
+}
+
+// normalizeJSONBlobs moves the marshalled tag_ids, supported_platforms,
+// screenshots and versions columns of apps (and the apps column of
+// collections) into their own tables. The existing blobs are converted, so
+// no data is lost.
+func normalizeJSONBlobs(tx *Tx) error {
+	type blobs struct {
+		id                 string
+		tagIds             []string
+		supportedPlatforms []string
+		screenshots        []RebbleScreenshotsPlatform
+		versions           []RebbleVersion
+	}
+
+	// SQLite cannot drop columns, so the data is read before the tables are
+	// re-created.
+	rows, err := tx.Query("SELECT id, tag_ids, supported_platforms, screenshots, versions FROM apps")
+	if err != nil {
+		return err
+	}
+	apps := make([]blobs, 0)
+	for rows.Next() {
+		var app blobs
+		var tagIds_b, supportedPlatforms_b, screenshots_b, versions_b []byte
+		err = rows.Scan(&app.id, &tagIds_b, &supportedPlatforms_b, &screenshots_b, &versions_b)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		// Missing or invalid blobs simply result in no rows
+		json.Unmarshal(tagIds_b, &app.tagIds)
+		json.Unmarshal(supportedPlatforms_b, &app.supportedPlatforms)
+		json.Unmarshal(screenshots_b, &app.screenshots)
+		json.Unmarshal(versions_b, &app.versions)
+		apps = append(apps, app)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.Query("SELECT id, apps FROM collections")
+	if err != nil {
+		return err
+	}
+	collectionApps := make(map[string][]string)
+	for rows.Next() {
+		var id string
+		var apps_b []byte
+		var appIds []string
+		err = rows.Scan(&id, &apps_b)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		json.Unmarshal(apps_b, &appIds)
+		collectionApps[id] = appIds
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	err = execStatements(
+		`create table apps_new (
+			id text not null primary key,
+			name text,
+			author_id integer,
+			description text,
+			thumbs_up integer,
+			type text,
+			published_date integer,
+			pbw_url text,
+			rebble_ready integer,
+			updated integer,
+			version text,
+			support_url text,
+			author_url text,
+			source_url text,
+			banner_url text,
+			icon_url text,
+			doomsday_backup integer
+		)`,
+		`insert into apps_new
+			select id, name, author_id, description, thumbs_up, type, published_date, pbw_url, rebble_ready, updated, version, support_url, author_url, source_url, banner_url, icon_url, doomsday_backup
+			from apps`,
+		`drop table apps`,
+		`alter table apps_new rename to apps`,
+		`create index apps_author_id on apps(author_id)`,
+
+		`create table collections_new (
+			id text not null primary key,
+			name text,
+			color text
+		)`,
+		`insert into collections_new select id, name, color from collections`,
+		`drop table collections`,
+		`alter table collections_new rename to collections`,
+
+		`create table app_tags (
+			app_id text not null references apps(id) on delete cascade,
+			collection_id text not null references collections(id) on delete cascade,
+			primary key (app_id, collection_id)
+		)`,
+		`create index app_tags_collection_id on app_tags(collection_id)`,
+
+		// position is the index of the screenshot across all platforms of an
+		// app, so ordering by it keeps both platform and screenshot order.
+		`create table app_screenshots (
+			app_id text not null references apps(id) on delete cascade,
+			platform text not null,
+			position integer not null,
+			url text not null,
+			primary key (app_id, position)
+		)`,
+		`create index app_screenshots_platform on app_screenshots(platform)`,
+
+		`create table app_platforms (
+			app_id text not null references apps(id) on delete cascade,
+			platform text not null,
+			primary key (app_id, platform)
+		)`,
+		`create index app_platforms_platform on app_platforms(platform)`,
+
+		`create table app_versions (
+			app_id text not null references apps(id) on delete cascade,
+			position integer not null,
+			number text,
+			release_date integer,
+			description text,
+			primary key (app_id, position)
+		)`,
+
+		`create table collection_apps (
+			collection_id text not null references collections(id) on delete cascade,
+			app_id text not null references apps(id) on delete cascade,
+			position integer,
+			primary key (collection_id, app_id)
+		)`,
+		`create index collection_apps_app_id on collection_apps(app_id)`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, app := range apps {
+		for _, tagId := range app.tagIds {
+			// Tags pointing to a collection that doesn't exist are dropped
+			_, err = tx.Exec("INSERT OR IGNORE INTO app_tags(app_id, collection_id) SELECT ?, id FROM collections WHERE id=?", app.id, tagId)
+			if err != nil {
+				return err
+			}
+		}
+		err = insertAppRelations(tx, app.id, app.supportedPlatforms, app.screenshots, app.versions)
+		if err != nil {
+			return err
+		}
+	}
+
+	for collectionId, appIds := range collectionApps {
+		for i, appId := range appIds {
+			_, err = tx.Exec("INSERT OR IGNORE INTO collection_apps(collection_id, app_id, position) SELECT ?, id, ? FROM apps WHERE id=?", collectionId, i, appId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// createRelationTablesPostgres is the PostgreSQL version of the tables created
+// by normalizeJSONBlobs
+func createRelationTablesPostgres(tx *Tx) error {
+	return execStatements(
+		`create table app_tags (
+			app_id text not null references apps(id) on delete cascade,
+			collection_id text not null references collections(id) on delete cascade,
+			primary key (app_id, collection_id)
+		)`,
+		`create index app_tags_collection_id on app_tags(collection_id)`,
+		`create table app_screenshots (
+			app_id text not null references apps(id) on delete cascade,
+			platform text not null,
+			position integer not null,
+			url text not null,
+			primary key (app_id, position)
+		)`,
+		`create index app_screenshots_platform on app_screenshots(platform)`,
+		`create table app_platforms (
+			app_id text not null references apps(id) on delete cascade,
+			platform text not null,
+			primary key (app_id, platform)
+		)`,
+		`create index app_platforms_platform on app_platforms(platform)`,
+		`create table app_versions (
+			app_id text not null references apps(id) on delete cascade,
+			position integer not null,
+			number text,
+			release_date bigint,
+			description text,
+			primary key (app_id, position)
+		)`,
+		`create table collection_apps (
+			collection_id text not null references collections(id) on delete cascade,
+			app_id text not null references apps(id) on delete cascade,
+			position integer,
+			primary key (collection_id, app_id)
+		)`,
+		`create index collection_apps_app_id on collection_apps(app_id)`,
+	)(tx)
+}
+
+// appDetailsStatements add the columns of the app details that are only
+// displayed (lists and maps are stored as JSON), and the table of the original
+// records of the Pebble app store, so that nothing is lost in the import
+var appDetailsStatements = []string{
+	`alter table apps add column uuid text not null default ''`,
+	`alter table apps add column release_id text not null default ''`,
+	`alter table apps add column release_notes text not null default ''`,
+	`alter table apps add column js_md5 text not null default ''`,
+	`alter table apps add column js_version integer not null default 0`,
+	`alter table apps add column capabilities text not null default '[]'`,
+	`alter table apps add column companions text not null default '{}'`,
+	`alter table apps add column icons text not null default '{}'`,
+	`alter table apps add column banners text not null default '[]'`,
+	`alter table apps add column list_images text not null default '{}'`,
+	`create table app_sources (
+		app_id text not null references apps(id) on delete cascade,
+		position integer not null,
+		document text not null,
+		primary key (app_id, position)
+	)`,
+}
+
+// authorIdsStatements create the mapping of the developer IDs of the Pebble app
+// store to author IDs, which keeps the IDs stable across imports, and the
+// redirects of the author IDs that were renumbered
+var authorIdsStatements = []string{
+	`create table author_developers (
+		developer_id text not null primary key,
+		author_id integer not null
+	)`,
+	`create index author_developers_author_id on author_developers(author_id)`,
+	`create table author_redirects (
+		old_id integer not null primary key,
+		author_id integer not null
+	)`,
+}
+
+// jobsStatements create the table of the background jobs, where their state,
+// progress and log are kept across restarts (lists and maps are stored as JSON)
+var jobsStatements = []string{
+	`create table jobs (
+		id text not null primary key,
+		kind text not null,
+		state text not null,
+		created bigint not null,
+		finished bigint not null,
+		progress text not null,
+		errors text not null,
+		log text not null,
+		result text not null
+	)`,
+	`create index jobs_created on jobs(created)`,
+}
+
+// createSearchVocabulary creates the tables listing the words of the search
+// index and their trigrams
+func createSearchVocabulary(tx *Tx) error {
+	return execStatements(
+		`create table search_words (
+			word text not null primary key,
+			documents integer not null
+		)`,
+		`create table search_trigrams (
+			trigram text not null,
+			word text not null references search_words(word) on delete cascade,
+			primary key (trigram, word)
+		)`,
+	)(tx)
+}
+
+// createSuggestionIndex creates the prefix index of suggestions. tailType is
+// the SQL type of the indexed names.
+func createSuggestionIndex(tx *Tx, tailType string) error {
+	return execStatements(
+		`create table search_suggestions (
+			type text not null,
+			prefix text not null,
+			tail `+tailType+` not null,
+			later integer not null,
+			popularity integer not null,
+			name text not null,
+			id text not null
+		)`,
+		`create index search_suggestions_prefix on search_suggestions(type, prefix, later, popularity desc, name, id)`,
+		`create index search_suggestions_tail on search_suggestions(type, tail)`,
+	)(tx)
+}
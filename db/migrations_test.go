@@ -0,0 +1,186 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	forEachSQLStore(t, func(t *testing.T, handler Handler) {
+		err := handler.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version, err := handler.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != LatestSchemaVersion() {
+			t.Fatalf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+		}
+
+		for _, table := range []string{"apps", "authors", "collections", "app_tags", "app_screenshots", "app_platforms", "app_versions", "collection_apps"} {
+			var n int
+			err = handler.queryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+			if err != nil {
+				t.Fatalf("table %s was not created: %v", table, err)
+			}
+		}
+
+		// Migrating an up-to-date database is a no-op
+		err = handler.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMigrateOldLayout(t *testing.T) {
+	handler, cleanup := openSQLiteTestStore(t)
+	defer cleanup()
+
+	// This is the layout the rebuild handler created before migrations existed
+	_, err := handler.exec(`
+		create table apps (
+			id text not null primary key,
+			name text,
+			author_id integer,
+			tag_ids blob,
+			description text,
+			thumbs_up integer,
+			type text,
+			supported_platforms blob,
+			published_date integer,
+			pbw_url text,
+			rebble_ready integer,
+			updated integer,
+			version text,
+			support_url text,
+			author_url text,
+			source_url text,
+			screenshots blob,
+			banner_url text,
+			icon_url text,
+			doomsday_backup integer,
+			versions blob
+		);
+		create table authors (
+			id text not null primary key,
+			name text
+		);
+		create table collections (
+			id text not null primary key,
+			name text,
+			color text,
+			apps blob,
+			cache_apps_most_popular blob,
+			cache_time integer
+		);
+		INSERT INTO apps(id, name, author_id, thumbs_up, description, type, published_date, pbw_url, rebble_ready, updated, version, support_url, author_url, source_url, banner_url, icon_url, doomsday_backup, tag_ids, supported_platforms, screenshots, versions) VALUES(
+			'52ee2d5df3b7aaf4b00000d3', 'Old App', 1, 42, '', 'watchapp', 0, '', 0, 0, '1.1', '', '', '', '', '', 0,
+			'["5261a8fb3b773043d500000c"]',
+			'["android","basalt","aplite"]',
+			'[{"platform":"basalt","screenshots":["b1","b2"]},{"platform":"aplite","screenshots":["a1"]}]',
+			'[{"number":"1.0","release_date":"2014-01-01T00:00:00Z","description":"First"},{"number":"1.1","release_date":"2015-01-01T00:00:00Z","description":"Second"}]'
+		);
+		INSERT INTO authors(id, name) VALUES(1, 'Old Author');
+		INSERT INTO collections(id, name, color, apps) VALUES('5261a8fb3b773043d500000c', 'Tools & Utilities', 'fdbf37', '["52ee2d5df3b7aaf4b00000d3","doesnotexist"]');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handler.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := handler.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+
+	var name string
+	var thumbsUp int
+	err = handler.queryRow("SELECT name, thumbs_up FROM apps WHERE id=?", "52ee2d5df3b7aaf4b00000d3").Scan(&name, &thumbsUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Old App" || thumbsUp != 42 {
+		t.Fatalf("existing app was not preserved, got %q with %d hearts", name, thumbsUp)
+	}
+
+	app, err := handler.GetApp("52ee2d5df3b7aaf4b00000d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(app.SupportedPlatforms, []string{"android", "aplite", "basalt"}) {
+		t.Fatalf("unexpected platforms %v", app.SupportedPlatforms)
+	}
+	expectedScreenshots := []RebbleScreenshotsPlatform{
+		{Platform: "basalt", Screenshots: []string{"b1", "b2"}},
+		{Platform: "aplite", Screenshots: []string{"a1"}},
+	}
+	if !reflect.DeepEqual(*app.Assets.Screenshots, expectedScreenshots) {
+		t.Fatalf("unexpected screenshots %v", *app.Assets.Screenshots)
+	}
+	if len(app.AppInfo.Tags) != 1 || app.AppInfo.Tags[0].Name != "Tools & Utilities" {
+		t.Fatalf("unexpected tags %v", app.AppInfo.Tags)
+	}
+
+	versions, err := handler.GetAppVersions("52ee2d5df3b7aaf4b00000d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Number != "1.0" || versions[1].Description != "Second" {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	apps, err := handler.GetAppsForCollection("5261a8fb3b773043d500000c", "popular", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Id != "52ee2d5df3b7aaf4b00000d3" {
+		t.Fatalf("unexpected collection apps %v", apps)
+	}
+
+	// The collections and their apps are numbered, so they can be ordered
+	err = handler.OrderCollectionApps("5261a8fb3b773043d500000c", []string{"52ee2d5df3b7aaf4b00000d3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps, err = handler.GetAppsForCollection("5261a8fb3b773043d500000c", "manual", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 {
+		t.Fatalf("unexpected collection apps %v", apps)
+	}
+	collections, err := handler.GetCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) == 0 {
+		t.Fatal("expected the collections to be kept")
+	}
+
+	// The search index is built once the schema is up to date
+	cards, err := handler.Search("old", SearchFilters{}, "relevance", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards.Cards) != 1 || cards.Cards[0].Id != "52ee2d5df3b7aaf4b00000d3" {
+		t.Fatalf("expected the app to be indexed, got %+v", cards.Cards)
+	}
+	suggestions, err := handler.Suggest("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions.Suggestions) == 0 {
+		t.Fatal("expected the app to be suggested")
+	}
+}
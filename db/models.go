@@ -7,16 +7,85 @@ type RebbleCard struct {
 	Type     string `json:"type"`
 	ImageUrl string `json:"image_url"`
 	ThumbsUp int    `json:"thumbs_up"`
+
+	// Only set for search results
+	Score         float64  `json:"score,omitempty"`
+	MatchedFields []string `json:"matched_fields,omitempty"`
 }
 
 // RebbleCards is a collection of RebbleCard
 type RebbleCards struct {
 	Cards []RebbleCard `json:"cards"`
+
+	// Only set for search results
+	Facets     *SearchFacets `json:"facets,omitempty"`
+	Pagination *Pagination   `json:"pagination,omitempty"`
+	// DidYouMean is a corrected query, when the search found few results.
+	// If it found none, the results are the ones of the corrected query.
+	DidYouMean string `json:"did_you_mean,omitempty"`
+}
+
+// Pagination describes the page of a list of results that is returned
+type Pagination struct {
+	// Total is the number of results across all pages
+	Total int `json:"total"`
+	Page  int `json:"page"`
+	Limit int `json:"limit"`
+	Pages int `json:"pages"`
+}
+
+// SearchFacets counts the search results for each value of the search filters,
+// so the filters can be displayed along with the number of apps they match
+type SearchFacets struct {
+	Types      []FacetCount `json:"types"`
+	Platforms  []FacetCount `json:"platforms"`
+	Categories []FacetCount `json:"categories"`
+	Authors    []FacetCount `json:"authors"`
+	Years      []FacetCount `json:"published_years"`
+}
+
+// FacetCount is the number of search results having a given value of a facet
+// (the name is only set when the value is an ID)
+type FacetCount struct {
+	Value string `json:"value"`
+	Name  string `json:"name,omitempty"`
+	Count int    `json:"count"`
+}
+
+// RebbleSuggestion is an autocompletion of a search query: an app, an author or
+// a collection, depending on the type
+type RebbleSuggestion struct {
+	Type       string            `json:"type"`
+	App        *RebbleCard       `json:"app,omitempty"`
+	Author     *RebbleAuthor     `json:"author,omitempty"`
+	Collection *RebbleCollection `json:"collection,omitempty"`
+}
+
+// RebbleSuggestions is a list of RebbleSuggestion
+type RebbleSuggestions struct {
+	Suggestions []RebbleSuggestion `json:"suggestions"`
+}
+
+// SearchCount is the number of times a query was searched
+type SearchCount struct {
+	Query        string   `json:"query"`
+	Count        int      `json:"count"`
+	LastSearched JSONTime `json:"last_searched"`
+}
+
+// SearchPeriod sums up the searches made during a period of time
+type SearchPeriod struct {
+	Start       JSONTime `json:"start"`
+	Searches    int      `json:"searches"`
+	ZeroResults int      `json:"zero_results"`
+	// AverageLatency is in milliseconds
+	AverageLatency float64 `json:"average_latency"`
 }
 
 // RebbleApplication contains Pebble App information from the DB
 type RebbleApplication struct {
 	Id                 string        `json:"id"`
+	Uuid               string        `json:"uuid"`
 	Name               string        `json:"title"`
 	Author             RebbleAuthor  `json:"author"`
 	Description        string        `json:"description"`
@@ -39,12 +108,39 @@ type RebbleAppInfo struct {
 	SupportUrl  string             `json:"supportUrl"`
 	AuthorUrl   string             `json:"authorUrl"`
 	SourceUrl   string             `json:"sourceUrl"`
+	// ReleaseId, ReleaseNotes, JsMd5 and JsVersion describe the latest
+	// release, like PbwUrl, Updated and Version
+	ReleaseId    string           `json:"releaseId"`
+	ReleaseNotes string           `json:"releaseNotes"`
+	JsMd5        string           `json:"jsMd5"`
+	JsVersion    int              `json:"jsVersion"`
+	Capabilities []string         `json:"capabilities"`
+	Companions   RebbleCompanions `json:"companions"`
+}
+
+// RebbleCompanions are the phone apps a Pebble app works with, if any
+type RebbleCompanions struct {
+	Ios     *RebbleCompanion `json:"ios"`
+	Android *RebbleCompanion `json:"android"`
+}
+
+// RebbleCompanion describes a phone app a Pebble app works with
+type RebbleCompanion struct {
+	Id               string `json:"id"`
+	Name             string `json:"name"`
+	Icon             string `json:"icon"`
+	Url              string `json:"url"`
+	Required         bool   `json:"required"`
+	PebblekitVersion string `json:"pebblekitVersion"`
 }
 
 // RebbleAuthor describes the autor of a Rebble app (ID and name)
 type RebbleAuthor struct {
 	Id   int    `json:"id"`
 	Name string `json:"name"`
+	// DeveloperId is the ID of the developer in the Pebble app store, it is
+	// only set by the import and the export
+	DeveloperId string `json:"developer_id,omitempty"`
 }
 
 // RebbleCollection describes the collection (category) of a Rebble application
@@ -59,6 +155,21 @@ type RebbleAssets struct {
 	Banner      string                         `json:"appBanner"`
 	Icon        string                         `json:"appIcon"`
 	Screenshots *([]RebbleScreenshotsPlatform) `json:"screenshots"`
+	// Banners, Icons and ListImages are the images in every size, indexed
+	// by size (WxH, or orig for the original image)
+	Banners    []map[string]string `json:"appBanners"`
+	Icons      map[string]string   `json:"appIcons"`
+	ListImages map[string]string   `json:"listImages"`
+	// HardwareImages are the icons and banners of each hardware platform,
+	// indexed by platform, as apps may have different ones for each watch
+	HardwareImages map[string]RebbleHardwareImages `json:"hardwareImages"`
+}
+
+// RebbleHardwareImages are the icons and banners of an app for a hardware
+// platform, indexed by size like the ones of RebbleAssets
+type RebbleHardwareImages struct {
+	Icons   map[string]string   `json:"appIcons"`
+	Banners []map[string]string `json:"appBanners"`
 }
 
 // RebbleScreenshotsPlatform contains a list of screenshots specific to some hardware (since each Pebble watch renders UI differently)
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// combiningDiacritics are the accents removed from letters by normalizeText.
+// Other marks, such as the Japanese voicing marks or the vowels of Indic
+// scripts, change the letter they are attached to, so they are kept.
+var combiningDiacritics = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x0300, Hi: 0x036f, Stride: 1},
+	},
+}
+
+// foldedLetters are letters that have no decomposition, but are written
+// without their stroke or ligature by people typing without the right
+// keyboard
+var foldedLetters = strings.NewReplacer(
+	"æ", "ae",
+	"œ", "oe",
+	"ø", "o",
+	"ł", "l",
+	"đ", "d",
+	"ħ", "h",
+	"ı", "i",
+	"þ", "th",
+)
+
+// normalizeText puts text in the form it has in the search index: compatibility
+// characters (full-width letters, ligatures, ...) are replaced by the usual
+// ones (NFKC), case is folded and accents are removed.
+func normalizeText(text string) string {
+	// Casers and transformers keep state, they can't be shared
+	text = cases.Fold().String(norm.NFKC.String(text))
+
+	unaccented, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(combiningDiacritics)), norm.NFC), text)
+	if err == nil {
+		text = unaccented
+	}
+
+	return foldedLetters.Replace(text)
+}
+
+// isCJK returns true for the letters of the scripts that don't separate words
+// with spaces (and for Korean, which does but is usually indexed the same way)
+func isCJK(c rune) bool {
+	// The prolonged sound mark is shared by hiragana and katakana
+	return unicode.In(c, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || c == 'ー'
+}
+
+// isWordCharacter returns true for the characters words are made of
+func isWordCharacter(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsNumber(c) || unicode.IsMark(c)
+}
+
+// cjkBigrams splits a word into its runs of CJK and other characters. CJK runs
+// are indexed as their overlapping pairs of characters (a run of a single
+// character stays as it is), as there is no way to tell where their words
+// start and end: "天気予報" gives "天気", "気予" and "予報".
+func cjkBigrams(word string) []string {
+	tokens := make([]string, 0)
+
+	run := make([]rune, 0, len(word))
+	cjk := false
+	flush := func() {
+		switch {
+		case len(run) == 0:
+		case !cjk || len(run) == 1:
+			tokens = append(tokens, string(run))
+		default:
+			for i := 0; i+1 < len(run); i++ {
+				tokens = append(tokens, string(run[i:i+2]))
+			}
+		}
+		run = run[:0]
+	}
+
+	for _, c := range word {
+		// Marks belong to the character they follow
+		if len(run) > 0 && !unicode.IsMark(c) && isCJK(c) != cjk {
+			flush()
+		}
+		if len(run) == 0 {
+			cjk = isCJK(c)
+		}
+		run = append(run, c)
+	}
+	flush()
+
+	return tokens
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		text       string
+		normalized string
+	}{
+		{"Météo Française", "meteo francaise"},
+		{"Ｆｕｌｌ Ｗｉｄｔｈ", "full width"},
+		{"Straßenbahn", "strassenbahn"},
+		{"Zegarek Łódź", "zegarek lodz"},
+		{"Ρολόι", "ρολοι"},
+		{"ЧАСЫ", "часы"},
+		{"ﬁtness", "fitness"},
+		// Voicing marks are part of the letter
+		{"ガジェット", "ガジェット"},
+		{"ｶﾞｼﾞｪｯﾄ", "ガジェット"},
+	}
+
+	for _, test := range tests {
+		if normalized := normalizeText(test.text); normalized != test.normalized {
+			t.Errorf("%q: expected %q, got %q", test.text, test.normalized, normalized)
+		}
+	}
+}
+
+func TestSearchTokens(t *testing.T) {
+	tests := []struct {
+		text   string
+		tokens []string
+	}{
+		{"Big Time!", []string{"big", "time"}},
+		{"天気予報", []string{"天気", "気予", "予報"}},
+		{"月", []string{"月"}},
+		{"Pebble時計 v2", []string{"pebble", "時計", "v2"}},
+		{"カレンダー", []string{"カレ", "レン", "ンダ", "ダー"}},
+		{"날씨 시계", []string{"날씨", "시계"}},
+		// The nukta changes the letter, it is kept
+		{"हिन्दी घड़ी", []string{"हिन्दी", "घड\u093cी"}},
+	}
+
+	for _, test := range tests {
+		if tokens := searchTokens(test.text); !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%q: expected %q, got %q", test.text, test.tokens, tokens)
+		}
+	}
+}
+
+func TestMultilingualSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = LoadFixture(store, "testdata/multilingual.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			query  string
+			titles []string
+		}{
+			{"meteo", []string{"Météo Française"}},
+			{"MÉTÉO", []string{"Météo Française"}},
+			{"ｆｕｌｌ", []string{"Ｆｕｌｌ Ｗｉｄｔｈ Ｃｌｏｃｋ"}},
+			{"full width clock", []string{"Ｆｕｌｌ Ｗｉｄｔｈ Ｃｌｏｃｋ"}},
+			{"天気", []string{"天気予報"}},
+			{"予報", []string{"天気予報"}},
+			{"天気予報", []string{"天気予報"}},
+			{"カレンダ", []string{"カレンダー"}},
+			{"날씨", []string{"날씨 시계"}},
+			{"ЧАСЫ", []string{"Часы и погода"}},
+			{"strassenbahn", []string{"Straßenbahn Wien"}},
+			{"straßenbahn wien", []string{"Straßenbahn Wien"}},
+			{"lodz", []string{"Zegarek Łódź"}},
+			{"ρολοι", []string{"Ρολόι Αθήνα"}},
+			{"时钟", []string{"中文时钟"}},
+			{`author:"equipe horlogere" wien`, []string{"Straßenbahn Wien"}},
+		}
+
+		for _, test := range tests {
+			query, err := ParseSearchQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cards, err := store.Search(query.Text, query.Filters, "relevance", 0, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := make([]string, len(cards.Cards))
+			for i, card := range cards.Cards {
+				titles[i] = card.Title
+			}
+			if !reflect.DeepEqual(titles, test.titles) {
+				t.Errorf("%q: expected %v, got %v", test.query, test.titles, titles)
+			}
+		}
+
+		suggestions, err := store.Suggest("カレ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(suggestions.Suggestions) == 0 || suggestions.Suggestions[0].App == nil || suggestions.Suggestions[0].App.Title != "カレンダー" {
+			t.Errorf("expected カレンダー to be suggested, got %+v", suggestions.Suggestions)
+		}
+	})
+}
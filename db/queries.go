@@ -2,132 +2,173 @@ package db
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
-// Handler contains reference to the database client
+// Handler is the SQL implementation of Store. It is shared by the SQLite and
+// PostgreSQL backends, the differences between them being described by
+// the dialect.
 type Handler struct {
-	*sql.DB
+	db      *sql.DB
+	dialect *dialect
+	// source is the DSN the database was opened with, and path the file of
+	// a SQLite database (empty for PostgreSQL)
+	source string
+	path   string
 }
 
-// Search returns search results for applications
-func (handler Handler) Search(query string) (RebbleCards, error) {
-	query = strings.Replace(query, "!", "!!", -1)
-	query = strings.Replace(query, "%", "!%", -1)
-	query = strings.Replace(query, "_", "!_", -1)
-	query = strings.Replace(query, "[", "![", -1)
-	query = "%" + query + "%"
-
-	var cards RebbleCards
-	rows, err := handler.Query(
-		"SELECT id, name, type, thumbs_up, screenshots FROM apps WHERE name LIKE ? ESCAPE '!' ORDER BY thumbs_up DESC LIMIT 12",
-		query,
-	)
-	if err != nil {
-		return cards, err
-	}
-	cards.Cards = make([]RebbleCard, 0)
-	for rows.Next() {
-		card := RebbleCard{}
-		var screenshots_b []byte
-		var screenshots []RebbleScreenshotsPlatform
-		err = rows.Scan(&card.Id, &card.Title, &card.Type, &card.ThumbsUp, &screenshots_b)
-		if err != nil {
-			return RebbleCards{}, err
-		}
-		err = json.Unmarshal(screenshots_b, &screenshots)
-		if err != nil {
-			return RebbleCards{}, err
-		}
-		if len(screenshots) != 0 && len(screenshots[0].Screenshots) != 0 {
-			card.ImageUrl = screenshots[0].Screenshots[0]
-		}
-		cards.Cards = append(cards.Cards, card)
-	}
-	return cards, nil
-}
+// cardImageColumn selects the first screenshot of an app (or an empty string),
+// which is used as the image of its card
+const cardImageColumn = "COALESCE((SELECT url FROM app_screenshots WHERE app_screenshots.app_id = apps.id ORDER BY position LIMIT 1), '')"
 
-// GetAppsForCollection returns list of apps for single collection
-func (handler Handler) GetAppsForCollection(collectionID string, sortByPopular bool) ([]RebbleApplication, error) {
-	var order string
+// fromUnixNano converts a timestamp stored in the database to a time
+func fromUnixNano(t int64) time.Time {
+	return time.Unix(0, t).UTC()
+}
 
-	if sortByPopular {
-		order = "thumbs_up"
-	} else {
-		order = "published_date"
-	}
+// platformOrder is the order in which supported platforms are listed
+var platformOrder = []string{"ios", "android", "aplite", "basalt", "chalk", "diorite", "emery"}
 
-	row := handler.QueryRow("SELECT apps FROM collections WHERE id=?", collectionID)
-	var appIdsB []byte
-	var appIds []string
-	err := row.Scan(&appIdsB)
-	if err != nil {
-		return nil, err
+// sortPlatforms sorts a list of platforms in platformOrder
+func sortPlatforms(platforms []string) {
+	rank := func(platform string) int {
+		for i, p := range platformOrder {
+			if p == platform {
+				return i
+			}
+		}
+		return len(platformOrder)
 	}
-	json.Unmarshal(appIdsB, &appIds)
+	sort.SliceStable(platforms, func(i, j int) bool {
+		return rank(platforms[i]) < rank(platforms[j])
+	})
+}
 
-	for i, appId := range appIds {
-		appIds[i] = "'" + appId + "'"
+// GetAppsForCollection returns list of apps for single collection, sorted by
+// sortby: "popular", "new", or "manual" for the order set by
+// OrderCollectionApps. If platform is not "all", only apps compatible with that
+// platform are returned.
+func (handler Handler) GetAppsForCollection(collectionID string, sortby string, platform string) ([]RebbleApplication, error) {
+	var order string
+	switch sortby {
+	case "popular":
+		order = "apps.thumbs_up DESC"
+	case "new":
+		order = "apps.published_date DESC"
+	case "manual":
+		order = "collection_apps.position"
+	default:
+		return nil, errors.New("Invalid sortby parameter")
 	}
 
-	idList := strings.Join(appIds, ", ")
-
-	// There is no feasible way for idList to contain user generated data, and therefore for it to be a SQL injection vector. But just in case, we strip any non-authorized character
-	reg, err := regexp.Compile("[^a-zA-Z0-9, ']+")
-	if err != nil {
-		return nil, err
+	// Apps that are compatible with the requested platform
+	filter := "1=1"
+	args := []interface{}{collectionID}
+	if platform != "all" {
+		filter = "apps.id IN (SELECT app_id FROM app_platforms WHERE platform=?)"
+		args = append(args, platform)
 	}
-	idList = reg.ReplaceAllString(idList, "")
 
-	apps := make([]RebbleApplication, 0)
-
-	// It is not possible to give a list or an order via a prepared statement, so this will have to do. We just sanitized idList, so SQL injection isn't a concern.
-	rows, err := handler.Query("SELECT id, name, type, thumbs_up, screenshots, published_date, supported_platforms FROM apps WHERE id IN (" + idList + ") ORDER BY " + order + " DESC")
+	// ORDER BY does not work with prepared statements, but order never comes
+	// from user input.
+	rows, err := handler.query(`
+		SELECT apps.id, apps.name, apps.type, apps.thumbs_up, apps.published_date
+		FROM collection_apps
+		JOIN apps ON apps.id = collection_apps.app_id
+		WHERE collection_apps.collection_id=? AND `+filter+`
+		ORDER BY `+order+`, apps.id
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
-
 	defer rows.Close()
 
+	apps := make([]RebbleApplication, 0)
+	indexes := make(map[string]int)
 	for rows.Next() {
 		app := RebbleApplication{}
 		var t int64
-		var supported_platforms_b []byte
-		var screenshots_b []byte
-		err = rows.Scan(&app.Id, &app.Name, &app.Type, &app.ThumbsUp, &screenshots_b, &t, &supported_platforms_b)
+		err = rows.Scan(&app.Id, &app.Name, &app.Type, &app.ThumbsUp, &t)
 		if err != nil {
 			return []RebbleApplication{}, err
 		}
-		app.Published.Time = time.Unix(0, t)
-		err = json.Unmarshal(supported_platforms_b, &app.SupportedPlatforms)
+		app.Published.Time = fromUnixNano(t)
+		app.SupportedPlatforms = make([]string, 0)
+		screenshots := make([]RebbleScreenshotsPlatform, 0)
+		app.Assets.Screenshots = &screenshots
+		indexes[app.Id] = len(apps)
+		apps = append(apps, app)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	platformRows, err := handler.query(`
+		SELECT app_platforms.app_id, app_platforms.platform
+		FROM app_platforms
+		JOIN collection_apps ON collection_apps.app_id = app_platforms.app_id
+		WHERE collection_apps.collection_id=?
+	`, collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer platformRows.Close()
+	for platformRows.Next() {
+		var appId, p string
+		err = platformRows.Scan(&appId, &p)
 		if err != nil {
-			return []RebbleApplication{}, err
+			return nil, err
 		}
-		err = json.Unmarshal(screenshots_b, &app.Assets.Screenshots)
+		if i, ok := indexes[appId]; ok {
+			apps[i].SupportedPlatforms = append(apps[i].SupportedPlatforms, p)
+		}
+	}
+	if err = platformRows.Err(); err != nil {
+		return nil, err
+	}
+
+	screenshotRows, err := handler.query(`
+		SELECT app_screenshots.app_id, app_screenshots.platform, app_screenshots.url
+		FROM app_screenshots
+		JOIN collection_apps ON collection_apps.app_id = app_screenshots.app_id
+		WHERE collection_apps.collection_id=?
+		ORDER BY app_screenshots.app_id, app_screenshots.position
+	`, collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer screenshotRows.Close()
+	for screenshotRows.Next() {
+		var appId, p, url string
+		err = screenshotRows.Scan(&appId, &p, &url)
 		if err != nil {
-			return []RebbleApplication{}, err
+			return nil, err
+		}
+		if i, ok := indexes[appId]; ok {
+			*apps[i].Assets.Screenshots = appendScreenshot(*apps[i].Assets.Screenshots, p, url)
 		}
-		apps = append(apps, app)
 	}
+	if err = screenshotRows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range apps {
+		sortPlatforms(apps[i].SupportedPlatforms)
+	}
+
 	return apps, nil
 }
 
 // GetCollectionName returns the name of a collection
 func (handler Handler) GetCollectionName(collectionID string) (string, error) {
-	rows, err := handler.Query("SELECT name FROM collections WHERE id=?", collectionID)
-	if err != nil {
-		return "", err
-	}
-	if !rows.Next() {
-		return "", errors.New("Specified collection does not exist")
-	}
 	var name string
-	err = rows.Scan(&name)
-	if err != nil {
+	err := handler.queryRow("SELECT name FROM collections WHERE id=?", collectionID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", ErrNoCollection
+	} else if err != nil {
 		return "", err
 	}
 
@@ -153,11 +194,11 @@ func (handler Handler) GetAllApps(sortby string, ascending bool, offset int, lim
 
 	// this code looks weird, but ORDER BY does not currently work with prepared statements,
 	// that is why it is written this way. it should be completely safe as it doesn't take user input
-	rows, err := handler.Query(`
+	rows, err := handler.query(`
 		SELECT apps.name, authors.name, apps.icon_url, apps.id, apps.thumbs_up, apps.published_date
 		FROM apps
 		JOIN authors ON apps.author_id = authors.id
-		ORDER BY `+orderCol+" "+order+`
+		ORDER BY `+orderCol+" "+order+`, apps.id
 		LIMIT ?
 		OFFSET ?
 	`, limit, offset)
@@ -169,7 +210,7 @@ func (handler Handler) GetAllApps(sortby string, ascending bool, offset int, lim
 		app := RebbleApplication{}
 		var t_published int64
 		err = rows.Scan(&app.Name, &app.Author.Name, &app.Assets.Icon, &app.Id, &app.ThumbsUp, &t_published)
-		app.Published.Time = time.Unix(0, t_published)
+		app.Published.Time = fromUnixNano(t_published)
 
 		apps = append(apps, app)
 	}
@@ -178,103 +219,204 @@ func (handler Handler) GetAllApps(sortby string, ascending bool, offset int, lim
 
 // GetApp returns a specific app
 func (handler Handler) GetApp(id string) (RebbleApplication, error) {
-	row := handler.QueryRow("SELECT apps.id, apps.name, apps.author_id, authors.name, apps.tag_ids, apps.description, apps.thumbs_up, apps.type, apps.supported_platforms, apps.published_date, apps.pbw_url, apps.rebble_ready, apps.updated, apps.version, apps.support_url, apps.author_url, apps.source_url, apps.screenshots, apps.banner_url, apps.icon_url, apps.doomsday_backup FROM apps JOIN authors ON apps.author_id = authors.id WHERE apps.id=?", id)
-
-	app := RebbleApplication{}
-	var supportedPlatforms_b []byte
-	var t_published, t_updated int64
-	var tagIds_b []byte
-	var tagIds []string
-	var screenshots_b []byte
-	var screenshots *([]RebbleScreenshotsPlatform)
-	err := row.Scan(&app.Id, &app.Name, &app.Author.Id, &app.Author.Name, &tagIds_b, &app.Description, &app.ThumbsUp, &app.Type, &supportedPlatforms_b, &t_published, &app.AppInfo.PbwUrl, &app.AppInfo.RebbleReady, &t_updated, &app.AppInfo.Version, &app.AppInfo.SupportUrl, &app.AppInfo.AuthorUrl, &app.AppInfo.SourceUrl, &screenshots_b, &app.Assets.Banner, &app.Assets.Icon, &app.DoomsdayBackup)
-	if err == sql.ErrNoRows {
-		return RebbleApplication{}, errors.New("No application with this ID")
-	} else if err != nil {
+	apps, err := handler.GetApps([]string{id})
+	if err != nil {
 		return RebbleApplication{}, err
 	}
+	if len(apps) == 0 {
+		return RebbleApplication{}, errors.New("No application with this ID")
+	}
 
-	json.Unmarshal(supportedPlatforms_b, &app.SupportedPlatforms)
-	app.Published.Time = time.Unix(0, t_published)
-	app.AppInfo.Updated.Time = time.Unix(0, t_updated)
-	json.Unmarshal(tagIds_b, &tagIds)
-	app.AppInfo.Tags = make([]RebbleCollection, len(tagIds))
-	json.Unmarshal(screenshots_b, &screenshots)
-	app.Assets.Screenshots = screenshots
+	return apps[0], nil
+}
 
-	for i, tagID := range tagIds {
-		row := handler.QueryRow("SELECT id, name, color FROM collections WHERE id=?", tagID)
+// GetApps returns the applications with the given IDs, in that order, with
+// the same details as GetApp. It takes the same number of queries whatever the
+// number of apps. Unknown IDs are skipped.
+func (handler Handler) GetApps(ids []string) ([]RebbleApplication, error) {
+	if len(ids) == 0 {
+		return make([]RebbleApplication, 0), nil
+	}
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
 
-		err = row.Scan(&app.AppInfo.Tags[i].Id, &app.AppInfo.Tags[i].Name, &app.AppInfo.Tags[i].Color)
+	rows, err := handler.query("SELECT apps.id, apps.uuid, apps.name, apps.author_id, authors.name, apps.description, apps.thumbs_up, apps.type, apps.published_date, apps.pbw_url, apps.rebble_ready, apps.updated, apps.version, apps.release_id, apps.release_notes, apps.js_md5, apps.js_version, apps.support_url, apps.author_url, apps.source_url, apps.banner_url, apps.icon_url, apps.doomsday_backup, "+appDetailColumns+" FROM apps JOIN authors ON apps.author_id = authors.id WHERE apps.id IN "+in, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := make(map[string]*RebbleApplication)
+	for rows.Next() {
+		app := RebbleApplication{}
+		var t_published, t_updated int64
+		details := make([]string, 6)
+		err = rows.Scan(&app.Id, &app.Uuid, &app.Name, &app.Author.Id, &app.Author.Name, &app.Description, &app.ThumbsUp, &app.Type, &t_published, &app.AppInfo.PbwUrl, &app.AppInfo.RebbleReady, &t_updated, &app.AppInfo.Version, &app.AppInfo.ReleaseId, &app.AppInfo.ReleaseNotes, &app.AppInfo.JsMd5, &app.AppInfo.JsVersion, &app.AppInfo.SupportUrl, &app.AppInfo.AuthorUrl, &app.AppInfo.SourceUrl, &app.Assets.Banner, &app.Assets.Icon, &app.DoomsdayBackup, &details[0], &details[1], &details[2], &details[3], &details[4], &details[5])
 		if err != nil {
-			return RebbleApplication{}, err
+			return nil, err
 		}
-	}
 
-	return app, nil
-}
+		err = decodeAppDetails(&app, details)
+		if err != nil {
+			return nil, err
+		}
 
-// GetAppTags returns the the list of tags of the application with the id `id`
-func (handler Handler) GetAppTags(id string) ([]RebbleCollection, error) {
-	rows, err := handler.Query("SELECT apps.tag_ids FROM apps WHERE id=?", id)
-	if err != nil {
-		return []RebbleCollection{}, err
+		app.Published.Time = fromUnixNano(t_published)
+		app.AppInfo.Updated.Time = fromUnixNano(t_updated)
+		app.SupportedPlatforms = make([]string, 0)
+		app.AppInfo.Tags = make([]RebbleCollection, 0)
+		screenshots := make([]RebbleScreenshotsPlatform, 0)
+		app.Assets.Screenshots = &screenshots
+		apps[app.Id] = &app
 	}
-	exists := rows.Next()
-	if !exists {
-		return []RebbleCollection{}, err
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
+	rows.Close()
 
-	var tagIds_b []byte
-	var tagIds []string
-	err = rows.Scan(&tagIds_b)
+	rows, err = handler.query("SELECT app_id, platform FROM app_platforms WHERE app_id IN "+in, args...)
 	if err != nil {
-		return []RebbleCollection{}, err
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, platform string
+		err = rows.Scan(&id, &platform)
+		if err != nil {
+			return nil, err
+		}
+		if app, ok := apps[id]; ok {
+			app.SupportedPlatforms = append(app.SupportedPlatforms, platform)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = handler.query(`
+		SELECT app_tags.app_id, collections.id, collections.name, collections.color
+		FROM app_tags
+		JOIN collections ON collections.id = app_tags.collection_id
+		WHERE app_tags.app_id IN `+in+`
+		ORDER BY collections.id
+	`, args...)
+	if err != nil {
+		return nil, err
 	}
-	json.Unmarshal(tagIds_b, &tagIds)
-	collections := make([]RebbleCollection, len(tagIds))
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		collection := RebbleCollection{}
+		err = rows.Scan(&id, &collection.Id, &collection.Name, &collection.Color)
+		if err != nil {
+			return nil, err
+		}
+		if app, ok := apps[id]; ok {
+			app.AppInfo.Tags = append(app.AppInfo.Tags, collection)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
-	for i, tagId := range tagIds {
-		rows, err := handler.Query("SELECT id, name, color FROM collections WHERE id=?", tagId)
+	rows, err = handler.query("SELECT app_id, platform, url FROM app_screenshots WHERE app_id IN "+in+" ORDER BY position", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, platform, url string
+		err = rows.Scan(&id, &platform, &url)
 		if err != nil {
-			return []RebbleCollection{}, err
+			return nil, err
 		}
+		if app, ok := apps[id]; ok {
+			screenshots := appendScreenshot(*app.Assets.Screenshots, platform, url)
+			app.Assets.Screenshots = &screenshots
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]RebbleApplication, 0, len(apps))
+	for _, id := range ids {
+		if app, ok := apps[id]; ok {
+			sortPlatforms(app.SupportedPlatforms)
+			result = append(result, *app)
+		}
+	}
+
+	return result, nil
+}
+
+// GetAppTags returns the the list of tags of the application with the id `id`
+func (handler Handler) GetAppTags(id string) ([]RebbleCollection, error) {
+	rows, err := handler.query(`
+		SELECT collections.id, collections.name, collections.color
+		FROM app_tags
+		JOIN collections ON collections.id = app_tags.collection_id
+		WHERE app_tags.app_id=?
+		ORDER BY collections.id
+	`, id)
+	if err != nil {
+		return []RebbleCollection{}, err
+	}
+	defer rows.Close()
 
-		rows.Next()
-		err = rows.Scan(&collections[i].Id, &collections[i].Name, &collections[i].Color)
+	collections := make([]RebbleCollection, 0)
+	for rows.Next() {
+		collection := RebbleCollection{}
+		err = rows.Scan(&collection.Id, &collection.Name, &collection.Color)
 		if err != nil {
 			return []RebbleCollection{}, err
 		}
+		collections = append(collections, collection)
 	}
 
-	return collections, nil
+	return collections, rows.Err()
 }
 
 // GetAppVersions returns the the list of versions of the application with the id `id`
 func (handler Handler) GetAppVersions(id string) ([]RebbleVersion, error) {
-	rows, err := handler.Query("SELECT apps.versions FROM apps WHERE id=?", id)
+	var exists int
+	err := handler.queryRow("SELECT COUNT(*) FROM apps WHERE id=?", id).Scan(&exists)
 	if err != nil {
 		return []RebbleVersion{}, err
 	}
-	exists := rows.Next()
-	if !exists {
+	if exists == 0 {
 		return []RebbleVersion{}, errors.New("No app with this ID")
 	}
 
-	var versions_b []byte
-	var versions []RebbleVersion
-	err = rows.Scan(&versions_b)
+	rows, err := handler.query("SELECT number, release_date, description FROM app_versions WHERE app_id=? ORDER BY position", id)
 	if err != nil {
 		return []RebbleVersion{}, err
 	}
-	json.Unmarshal(versions_b, &versions)
+	defer rows.Close()
 
-	return versions, nil
+	versions := make([]RebbleVersion, 0)
+	for rows.Next() {
+		version := RebbleVersion{}
+		var t int64
+		err = rows.Scan(&version.Number, &t, &version.Description)
+		if err != nil {
+			return []RebbleVersion{}, err
+		}
+		version.ReleaseDate.Time = fromUnixNano(t)
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
 }
 
 // GetAuthor returns a RebbleAuthor
 func (handler Handler) GetAuthor(id int) (RebbleAuthor, error) {
-	rows, err := handler.Query("SELECT authors.name FROM authors WHERE id=?", id)
+	rows, err := handler.query("SELECT authors.name FROM authors WHERE id=?", id)
 	if err != nil {
 		return RebbleAuthor{}, err
 	}
@@ -296,15 +438,16 @@ func (handler Handler) GetAuthor(id int) (RebbleAuthor, error) {
 
 // GetAuthorCards returns cards for all apps from a specific author
 func (handler Handler) GetAuthorCards(id int) (RebbleCards, error) {
-	rows, err := handler.Query(`
-		SELECT id, name, type, screenshots, thumbs_up
+	rows, err := handler.query(`
+		SELECT id, name, type, `+cardImageColumn+`, thumbs_up
 		FROM apps
 		WHERE author_id=?
-		ORDER BY published_date ASC
+		ORDER BY published_date ASC, id
 	`, id)
 	if err != nil {
 		return RebbleCards{}, err
 	}
+	defer rows.Close()
 
 	cards := RebbleCards{
 		Cards: make([]RebbleCard, 0),
@@ -313,23 +456,13 @@ func (handler Handler) GetAuthorCards(id int) (RebbleCards, error) {
 	for rows.Next() {
 		card := RebbleCard{}
 
-		var screenshots_b []byte
-		var screenshots []RebbleScreenshotsPlatform
-
-		err = rows.Scan(&card.Id, &card.Title, &card.Type, &screenshots_b, &card.ThumbsUp)
+		err = rows.Scan(&card.Id, &card.Title, &card.Type, &card.ImageUrl, &card.ThumbsUp)
 		if err != nil {
 			return RebbleCards{}, err
 		}
 
-		err = json.Unmarshal(screenshots_b, &screenshots)
-		if err != nil {
-			return RebbleCards{}, err
-		}
-		if len(screenshots) != 0 && len(screenshots[0].Screenshots) != 0 {
-			card.ImageUrl = screenshots[0].Screenshots[0]
-		}
 		cards.Cards = append(cards.Cards, card)
 	}
 
-	return cards, nil
+	return cards, rows.Err()
 }
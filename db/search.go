@@ -0,0 +1,939 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchField is a field of an app that is indexed for search, along with its
+// weight in the relevance score
+type searchField struct {
+	Name   string
+	Weight float64
+}
+
+// searchFields are the fields of the search index, in the order of the
+// columns of the app_search table
+var searchFields = []searchField{
+	{"title", 10.0},
+	{"description", 1.0},
+	{"author", 5.0},
+	{"category", 3.0},
+}
+
+// searchOrders are the SQL orders of the search results for each sortby
+// value. They are all descending, except for the name.
+var searchOrders = map[string]string{
+	"relevance": "score DESC",
+	"popular":   "apps.thumbs_up DESC",
+	"recent":    "apps.published_date DESC",
+	"name":      "apps.name ASC",
+}
+
+// newPagination describes the page of results starting at offset
+func newPagination(total int, offset int, limit int) *Pagination {
+	pages := (total + limit - 1) / limit
+	return &Pagination{
+		Total: total,
+		Page:  offset/limit + 1,
+		Limit: limit,
+		Pages: pages,
+	}
+}
+
+// hardwarePlatforms are the platforms search results can be filtered on
+var hardwarePlatforms = []string{"aplite", "basalt", "chalk", "diorite"}
+
+// SearchFilters restricts the results of a search. The zero value of a field
+// doesn't filter anything.
+type SearchFilters struct {
+	// Type is either "watchapp" or "watchface"
+	Type string
+	// Platform is one of hardwarePlatforms
+	Platform string
+	// Category is the ID of a collection the apps belong to
+	Category string
+	// Author is the ID of the author of the apps
+	Author int
+	// AuthorName is the name of the author of the apps, compared once
+	// normalized (see normalizeText)
+	AuthorName string
+	// Apps must have at least HeartsFrom hearts, and less than HeartsUntil
+	HeartsFrom  int
+	HeartsUntil int
+	// Apps must be published at or after PublishedFrom, and before
+	// PublishedUntil
+	PublishedFrom  time.Time
+	PublishedUntil time.Time
+	// Apps must be updated at or after UpdatedFrom, and before UpdatedUntil
+	UpdatedFrom  time.Time
+	UpdatedUntil time.Time
+}
+
+// Merge returns the filters restricting the results to the apps passing both
+// filters and other. Values can't be combined when filters and other each
+// require a different one.
+func (filters SearchFilters) Merge(other SearchFilters) (SearchFilters, error) {
+	merged := filters
+
+	values := []struct {
+		name  string
+		value *string
+		other string
+	}{
+		{"type", &merged.Type, other.Type},
+		{"platform", &merged.Platform, other.Platform},
+		{"category", &merged.Category, other.Category},
+		{"author", &merged.AuthorName, other.AuthorName},
+	}
+	for _, v := range values {
+		if *v.value != "" && v.other != "" && !strings.EqualFold(*v.value, v.other) {
+			return SearchFilters{}, errors.New("Conflicting '" + v.name + "' filters")
+		}
+		if v.other != "" {
+			*v.value = v.other
+		}
+	}
+	if merged.Author != 0 && other.Author != 0 && merged.Author != other.Author {
+		return SearchFilters{}, errors.New("Conflicting 'author' filters")
+	}
+	if other.Author != 0 {
+		merged.Author = other.Author
+	}
+
+	// Ranges are intersected
+	if other.HeartsFrom > merged.HeartsFrom {
+		merged.HeartsFrom = other.HeartsFrom
+	}
+	if other.HeartsUntil != 0 && (merged.HeartsUntil == 0 || other.HeartsUntil < merged.HeartsUntil) {
+		merged.HeartsUntil = other.HeartsUntil
+	}
+	times := []struct {
+		value *time.Time
+		other time.Time
+		after bool
+	}{
+		{&merged.PublishedFrom, other.PublishedFrom, true},
+		{&merged.PublishedUntil, other.PublishedUntil, false},
+		{&merged.UpdatedFrom, other.UpdatedFrom, true},
+		{&merged.UpdatedUntil, other.UpdatedUntil, false},
+	}
+	for _, t := range times {
+		if !t.other.IsZero() && (t.value.IsZero() || t.other.After(*t.value) == t.after) {
+			*t.value = t.other
+		}
+	}
+
+	return merged, nil
+}
+
+// where returns the SQL conditions (each starting with AND) matching the
+// filters, and their arguments
+func (filters SearchFilters) where() (string, []interface{}) {
+	where := ""
+	args := make([]interface{}, 0)
+	if filters.Type != "" {
+		where += " AND apps.type = ?"
+		args = append(args, filters.Type)
+	}
+	if filters.Platform != "" {
+		where += " AND apps.id IN (SELECT app_id FROM app_platforms WHERE platform = ?)"
+		args = append(args, filters.Platform)
+	}
+	if filters.Category != "" {
+		where += " AND apps.id IN (SELECT app_id FROM collection_apps WHERE collection_id = ?)"
+		args = append(args, filters.Category)
+	}
+	if filters.Author != 0 {
+		where += " AND apps.author_id = ?"
+		args = append(args, filters.Author)
+	}
+	if filters.AuthorName != "" {
+		where += " AND apps.id IN (SELECT app_id FROM app_search WHERE author = ?)"
+		args = append(args, strings.Join(searchTokens(filters.AuthorName), " "))
+	}
+	if filters.HeartsFrom != 0 {
+		where += " AND apps.thumbs_up >= ?"
+		args = append(args, filters.HeartsFrom)
+	}
+	if filters.HeartsUntil != 0 {
+		where += " AND apps.thumbs_up < ?"
+		args = append(args, filters.HeartsUntil)
+	}
+	if !filters.PublishedFrom.IsZero() {
+		where += " AND apps.published_date >= ?"
+		args = append(args, filters.PublishedFrom.UnixNano())
+	}
+	if !filters.PublishedUntil.IsZero() {
+		where += " AND apps.published_date < ?"
+		args = append(args, filters.PublishedUntil.UnixNano())
+	}
+	if !filters.UpdatedFrom.IsZero() {
+		where += " AND apps.updated >= ?"
+		args = append(args, filters.UpdatedFrom.UnixNano())
+	}
+	if !filters.UpdatedUntil.IsZero() {
+		where += " AND apps.updated < ?"
+		args = append(args, filters.UpdatedUntil.UnixNano())
+	}
+
+	return where, args
+}
+
+// facetCounter accumulates the counts of the values of a facet
+type facetCounter map[string]*FacetCount
+
+// add counts n more results having value
+func (counter facetCounter) add(value string, name string, n int) {
+	if _, ok := counter[value]; !ok {
+		counter[value] = &FacetCount{Value: value, Name: name}
+	}
+	counter[value].Count += n
+}
+
+// list returns the counts, most frequent values first (ties are broken by
+// value)
+func (counter facetCounter) list() []FacetCount {
+	counts := make([]FacetCount, 0, len(counter))
+	for _, count := range counter {
+		counts = append(counts, *count)
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+
+	return counts
+}
+
+// newSearchFacets returns facets with no values
+func newSearchFacets() *SearchFacets {
+	return &SearchFacets{
+		Types:      make([]FacetCount, 0),
+		Platforms:  make([]FacetCount, 0),
+		Categories: make([]FacetCount, 0),
+		Authors:    make([]FacetCount, 0),
+		Years:      make([]FacetCount, 0),
+	}
+}
+
+// yearFacets returns the years facet, in chronological order
+func yearFacets(counter facetCounter) []FacetCount {
+	years := counter.list()
+	sort.Slice(years, func(i, j int) bool {
+		return years[i].Value < years[j].Value
+	})
+
+	return years
+}
+
+// searchTokens splits text into the normalized words (see normalizeText) the
+// search index is made of. CJK text is split into bigrams.
+func searchTokens(text string) []string {
+	tokens := make([]string, 0)
+	for _, word := range strings.FieldsFunc(normalizeText(text), func(c rune) bool { return !isWordCharacter(c) }) {
+		tokens = append(tokens, cjkBigrams(word)...)
+	}
+
+	return tokens
+}
+
+// searchPhrases splits a query into phrases, the tokens that must follow each
+// other in a document: the tokens of each "quoted" part of the query form a
+// phrase, the other tokens are phrases on their own
+func searchPhrases(query string) [][]string {
+	phrases := make([][]string, 0)
+	for i, part := range strings.Split(query, "\"") {
+		tokens := searchTokens(part)
+		if i%2 == 1 {
+			if len(tokens) > 0 {
+				phrases = append(phrases, tokens)
+			}
+			continue
+		}
+		for _, token := range tokens {
+			phrases = append(phrases, []string{token})
+		}
+	}
+
+	return phrases
+}
+
+// joinPhrases is the opposite of searchPhrases, it returns the query of
+// phrases
+func joinPhrases(phrases [][]string) string {
+	parts := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		parts[i] = strings.Join(phrase, " ")
+		if len(phrase) > 1 {
+			parts[i] = "\"" + parts[i] + "\""
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// countPhrase returns the number of times the phrase appears in words. The
+// last token of the phrase is a prefix (so results appear while typing), the
+// others must be whole words.
+func countPhrase(words []string, phrase []string) int {
+	count := 0
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		matches := true
+		for j, token := range phrase {
+			if j == len(phrase)-1 {
+				matches = matches && strings.HasPrefix(words[i+j], token)
+			} else {
+				matches = matches && words[i+j] == token
+			}
+		}
+		if matches {
+			count++
+		}
+	}
+
+	return count
+}
+
+// matchedFields returns the names of the fields (in the order of
+// searchFields) that contain at least one of the query phrases
+func matchedFields(phrases [][]string, values []string) []string {
+	matched := make([]string, 0)
+	for i, value := range values {
+		words := searchTokens(value)
+		for _, phrase := range phrases {
+			if countPhrase(words, phrase) > 0 {
+				matched = append(matched, searchFields[i].Name)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// ftsQuery builds a SQLite FTS5 query from the query phrases, the last token
+// of each one being a prefix. Tokens only contain letters and digits, so they
+// can't contain FTS5 syntax.
+func ftsQuery(phrases [][]string) string {
+	terms := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		terms[i] = "\"" + strings.Join(phrase, " ") + "\"*"
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// tsQuery builds a PostgreSQL tsquery from the query phrases
+func tsQuery(phrases [][]string) string {
+	terms := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		terms[i] = strings.Join(phrase, " <-> ") + ":*"
+		if len(phrase) > 1 {
+			terms[i] = "(" + terms[i] + ")"
+		}
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// heartsBoost is the factor applied to the relevance of an app depending on
+// its number of hearts: from 1 (no hearts) up to 2 (very popular). The same
+// formula is used in the SQL queries.
+func heartsBoost(thumbsUp int) float64 {
+	if thumbsUp < 0 {
+		thumbsUp = 0
+	}
+	return 1.0 + float64(thumbsUp)/(float64(thumbsUp)+100.0)
+}
+
+// reindexSearch rebuilds the search index from the catalog tables. It must be
+// called by every write path that changes an indexed field.
+func reindexSearch(tx *Tx) error {
+	err := reindexSearchDocuments(tx)
+	if err != nil {
+		return err
+	}
+
+	err = reindexSearchWords(tx)
+	if err != nil {
+		return err
+	}
+
+	return reindexSuggestions(tx)
+}
+
+// reindexSearchApps rebuilds the indexed documents of some apps, and updates
+// the vocabulary with the words they gained or lost. It is meant for changes
+// that touch few apps, such as renaming a collection.
+func reindexSearchApps(tx *Tx, ids []string) error {
+	for _, id := range ids {
+		before, err := countDocumentWords(tx, "SELECT name, description, author, category FROM app_search WHERE app_id=?", id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM app_search WHERE app_id=?", id)
+		if err != nil {
+			return err
+		}
+		documents, err := searchDocuments(tx, "WHERE apps.id=?", id)
+		if err != nil {
+			return err
+		}
+		err = insertSearchDocuments(tx, documents)
+		if err != nil {
+			return err
+		}
+
+		after, err := countDocumentWords(tx, "SELECT name, description, author, category FROM app_search WHERE app_id=?", id)
+		if err != nil {
+			return err
+		}
+		for word := range before {
+			after[word]--
+		}
+		err = updateSearchWords(tx, after)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reindexSearchDocuments rebuilds the indexed documents, one per app. Their
+// fields are stored normalized, as their words separated by spaces, so that
+// the tokenizers of the databases split them the same way as searchTokens.
+func reindexSearchDocuments(tx *Tx) error {
+	_, err := tx.Exec("DELETE FROM app_search")
+	if err != nil {
+		return err
+	}
+
+	documents, err := searchDocuments(tx, "")
+	if err != nil {
+		return err
+	}
+
+	return insertSearchDocuments(tx, documents)
+}
+
+// searchDocuments returns the fields to index of the apps selected by where,
+// each preceded by the ID of the app
+func searchDocuments(tx *Tx, where string, args ...interface{}) ([][]string, error) {
+	categories := "SELECT group_concat(collections.name, ' ') FROM app_tags JOIN collections ON collections.id = app_tags.collection_id WHERE app_tags.app_id = apps.id"
+	if tx.dialect == postgresDialect {
+		categories = "SELECT string_agg(collections.name, ' ') FROM app_tags JOIN collections ON collections.id = app_tags.collection_id WHERE app_tags.app_id = apps.id"
+	}
+
+	rows, err := tx.Query(`
+		SELECT apps.id, COALESCE(apps.name, ''), COALESCE(apps.description, ''), COALESCE(authors.name, ''), COALESCE((`+categories+`), '')
+		FROM apps
+		LEFT JOIN authors ON authors.id = apps.author_id
+	`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([][]string, 0)
+	for rows.Next() {
+		document := make([]string, 1+len(searchFields))
+		err = rows.Scan(&document[0], &document[1], &document[2], &document[3], &document[4])
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	err = rows.Err()
+	rows.Close()
+
+	return documents, err
+}
+
+// insertSearchDocuments adds documents returned by searchDocuments to the
+// index
+func insertSearchDocuments(tx *Tx, documents [][]string) error {
+	stmt, err := tx.Prepare("INSERT INTO app_search(app_id, name, description, author, category) VALUES(?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, document := range documents {
+		args := []interface{}{document[0]}
+		for _, value := range document[1:] {
+			args = append(args, strings.Join(searchTokens(value), " "))
+		}
+		_, err = stmt.Exec(args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tx.dialect == postgresDialect {
+		_, err = tx.Exec(`
+			UPDATE app_search SET document =
+				setweight(to_tsvector('simple', name), 'A') ||
+				setweight(to_tsvector('simple', author), 'B') ||
+				setweight(to_tsvector('simple', category), 'C') ||
+				setweight(to_tsvector('simple', description), 'D')
+			WHERE document IS NULL
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Search returns a page of search results for applications. The relevance is
+// BM25 (on SQLite) weighted by the number of hearts of each app, sortby can be
+// "relevance", "popular", "recent" or "name". Every query word is matched as a
+// prefix, in any of the indexed fields, and the words of "quoted phrases" must
+// follow each other. Without words, the results are the
+// apps passing the filters. The facets count all the apps matching the query
+// and the filters. If there are few results, typos in the query are
+// corrected.
+func (handler Handler) Search(query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error) {
+	return fuzzySearch(handler, query, filters, sortby, offset, limit)
+}
+
+// search returns a page of the apps matching exactly the query
+func (handler Handler) search(query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error) {
+	order, ok := searchOrders[sortby]
+	if !ok || limit < 1 || offset < 0 {
+		return RebbleCards{}, errors.New("Invalid search parameters")
+	}
+
+	cards := RebbleCards{
+		Cards:      make([]RebbleCard, 0),
+		Facets:     newSearchFacets(),
+		Pagination: newPagination(0, offset, limit),
+	}
+
+	phrases := searchPhrases(query)
+	if len(phrases) == 0 && filters == (SearchFilters{}) {
+		return cards, nil
+	}
+
+	filtersWhere, filtersArgs := filters.where()
+
+	var match string
+	matchArgs := make([]interface{}, 0)
+	var rows *sql.Rows
+	var err error
+	if len(phrases) == 0 {
+		// Without words, every app passing the filters matches, the most
+		// popular first
+		match = "1 = 1"
+		if sortby == "relevance" {
+			order = searchOrders["popular"]
+		}
+
+		rows, err = handler.query(`
+			SELECT apps.id, apps.name, apps.type, apps.thumbs_up, `+cardImageColumn+`,
+				'', '', '', '', 0.0 AS score
+			FROM apps
+			WHERE `+match+filtersWhere+`
+			ORDER BY `+order+`, apps.id
+			LIMIT ?
+			OFFSET ?
+		`, append(filtersArgs, limit, offset)...)
+	} else if handler.dialect == postgresDialect {
+		match = "apps.id IN (SELECT app_id FROM app_search WHERE document @@ to_tsquery('simple', ?))"
+		matchArgs = append(matchArgs, tsQuery(phrases))
+
+		args := append([]interface{}{matchArgs[0], matchArgs[0]}, filtersArgs...)
+		rows, err = handler.query(`
+			SELECT apps.id, apps.name, apps.type, apps.thumbs_up, `+cardImageColumn+`,
+				app_search.name, app_search.description, app_search.author, app_search.category,
+				ts_rank(app_search.document, to_tsquery('simple', ?)) * (1.0 + apps.thumbs_up / (apps.thumbs_up + 100.0)) AS score
+			FROM app_search
+			JOIN apps ON apps.id = app_search.app_id
+			WHERE app_search.document @@ to_tsquery('simple', ?)`+filtersWhere+`
+			ORDER BY `+order+`, apps.id
+			LIMIT ?
+			OFFSET ?
+		`, append(args, limit, offset)...)
+	} else {
+		match = "apps.id IN (SELECT app_id FROM app_search WHERE app_search MATCH ?)"
+		matchArgs = append(matchArgs, ftsQuery(phrases))
+
+		// bm25() is negative, the better the match the lower the value. The
+		// first weight is for the unindexed app_id column.
+		args := append([]interface{}{matchArgs[0]}, filtersArgs...)
+		rows, err = handler.query(`
+			SELECT apps.id, apps.name, apps.type, apps.thumbs_up, `+cardImageColumn+`,
+				app_search.name, app_search.description, app_search.author, app_search.category,
+				-bm25(app_search, 0.0, 10.0, 1.0, 5.0, 3.0) * (1.0 + apps.thumbs_up / (apps.thumbs_up + 100.0)) AS score
+			FROM app_search
+			JOIN apps ON apps.id = app_search.app_id
+			WHERE app_search MATCH ?`+filtersWhere+`
+			ORDER BY `+order+`, apps.id
+			LIMIT ?
+			OFFSET ?
+		`, append(args, limit, offset)...)
+	}
+	if err != nil {
+		return RebbleCards{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		card := RebbleCard{}
+		values := make([]string, len(searchFields))
+		err = rows.Scan(&card.Id, &card.Title, &card.Type, &card.ThumbsUp, &card.ImageUrl, &values[0], &values[1], &values[2], &values[3], &card.Score)
+		if err != nil {
+			return RebbleCards{}, err
+		}
+		card.MatchedFields = matchedFields(phrases, values)
+		cards.Cards = append(cards.Cards, card)
+	}
+	err = rows.Err()
+	if err != nil {
+		return RebbleCards{}, err
+	}
+
+	where := match + filtersWhere
+	args := append(matchArgs, filtersArgs...)
+
+	var total int
+	err = handler.queryRow("SELECT COUNT(*) FROM apps WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return RebbleCards{}, err
+	}
+	cards.Pagination = newPagination(total, offset, limit)
+
+	cards.Facets, err = handler.searchFacets(where, args)
+	if err != nil {
+		return RebbleCards{}, err
+	}
+
+	return cards, nil
+}
+
+// searchFacets counts the apps matching the where condition for each value of
+// the search filters
+func (handler Handler) searchFacets(where string, args []interface{}) (*SearchFacets, error) {
+	facets := newSearchFacets()
+
+	queries := []struct {
+		facet *[]FacetCount
+		query string
+	}{
+		{&facets.Types, "SELECT apps.type, '', COUNT(*) FROM apps WHERE " + where + " GROUP BY apps.type"},
+		{&facets.Platforms, `
+			SELECT app_platforms.platform, '', COUNT(*) FROM app_platforms
+			JOIN apps ON apps.id = app_platforms.app_id
+			WHERE app_platforms.platform IN ('` + strings.Join(hardwarePlatforms, "', '") + `') AND ` + where + `
+			GROUP BY app_platforms.platform
+		`},
+		{&facets.Categories, `
+			SELECT collections.id, collections.name, COUNT(*) FROM collection_apps
+			JOIN collections ON collections.id = collection_apps.collection_id
+			JOIN apps ON apps.id = collection_apps.app_id
+			WHERE ` + where + `
+			GROUP BY collections.id, collections.name
+		`},
+		{&facets.Authors, `
+			SELECT authors.id, authors.name, COUNT(*) FROM apps
+			JOIN authors ON authors.id = apps.author_id
+			WHERE ` + where + `
+			GROUP BY authors.id, authors.name
+		`},
+	}
+
+	for _, q := range queries {
+		rows, err := handler.query(q.query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		counter := make(facetCounter)
+		for rows.Next() {
+			var value, name string
+			var count int
+			err = rows.Scan(&value, &name, &count)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counter.add(value, name, count)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		*q.facet = counter.list()
+	}
+
+	// Years are computed here, as both databases extract them differently
+	rows, err := handler.query("SELECT apps.published_date FROM apps WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	years := make(facetCounter)
+	for rows.Next() {
+		var published int64
+		err = rows.Scan(&published)
+		if err != nil {
+			return nil, err
+		}
+		years.add(strconv.Itoa(fromUnixNano(published).Year()), "", 1)
+	}
+	facets.Years = yearFacets(years)
+
+	return facets, rows.Err()
+}
+
+// searchResults sorts the cards and apps of the results of a MemoryStore
+// search the same way as the SQL queries
+type searchResults struct {
+	cards  []RebbleCard
+	apps   []RebbleApplication
+	sortby string
+}
+
+func (results searchResults) Len() int {
+	return len(results.cards)
+}
+
+func (results searchResults) Swap(i, j int) {
+	results.cards[i], results.cards[j] = results.cards[j], results.cards[i]
+	results.apps[i], results.apps[j] = results.apps[j], results.apps[i]
+}
+
+func (results searchResults) Less(i, j int) bool {
+	a, b := results.apps[i], results.apps[j]
+	switch results.sortby {
+	case "relevance":
+		if results.cards[i].Score != results.cards[j].Score {
+			return results.cards[i].Score > results.cards[j].Score
+		}
+	case "popular":
+		if a.ThumbsUp != b.ThumbsUp {
+			return a.ThumbsUp > b.ThumbsUp
+		}
+	case "recent":
+		if !a.Published.Equal(b.Published.Time) {
+			return a.Published.After(b.Published.Time)
+		}
+	case "name":
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	}
+
+	return a.Id < b.Id
+}
+
+// matchesFilters returns true if app passes the search filters
+func (store *MemoryStore) matchesFilters(app RebbleApplication, filters SearchFilters) bool {
+	if filters.Type != "" && app.Type != filters.Type {
+		return false
+	}
+	if filters.Platform != "" && !in(filters.Platform, app.SupportedPlatforms) {
+		return false
+	}
+	if filters.Category != "" && !in(app.Id, store.collectionApps[filters.Category]) {
+		return false
+	}
+	if filters.Author != 0 && app.Author.Id != filters.Author {
+		return false
+	}
+	if filters.AuthorName != "" && strings.Join(searchTokens(store.authors[app.Author.Id].Name), " ") != strings.Join(searchTokens(filters.AuthorName), " ") {
+		return false
+	}
+	if (filters.HeartsFrom != 0 && app.ThumbsUp < filters.HeartsFrom) || (filters.HeartsUntil != 0 && app.ThumbsUp >= filters.HeartsUntil) {
+		return false
+	}
+	if !filters.PublishedFrom.IsZero() && app.Published.Before(filters.PublishedFrom) {
+		return false
+	}
+	if !filters.PublishedUntil.IsZero() && !app.Published.Before(filters.PublishedUntil) {
+		return false
+	}
+	if !filters.UpdatedFrom.IsZero() && app.AppInfo.Updated.Before(filters.UpdatedFrom) {
+		return false
+	}
+	if !filters.UpdatedUntil.IsZero() && !app.AppInfo.Updated.Before(filters.UpdatedUntil) {
+		return false
+	}
+
+	return true
+}
+
+// searchFacets counts apps for each value of the search filters
+func (store *MemoryStore) searchFacets(apps []RebbleApplication) *SearchFacets {
+	types := make(facetCounter)
+	platforms := make(facetCounter)
+	categories := make(facetCounter)
+	authors := make(facetCounter)
+	years := make(facetCounter)
+	for _, app := range apps {
+		types.add(app.Type, "", 1)
+		for _, platform := range app.SupportedPlatforms {
+			if in(platform, hardwarePlatforms) {
+				platforms.add(platform, "", 1)
+			}
+		}
+		for id, collectionApps := range store.collectionApps {
+			if in(app.Id, collectionApps) {
+				categories.add(id, store.collections[id].Name, 1)
+			}
+		}
+		author := store.authors[app.Author.Id]
+		authors.add(strconv.Itoa(author.Id), author.Name, 1)
+		years.add(strconv.Itoa(app.Published.UTC().Year()), "", 1)
+	}
+
+	return &SearchFacets{
+		Types:      types.list(),
+		Platforms:  platforms.list(),
+		Categories: categories.list(),
+		Authors:    authors.list(),
+		Years:      yearFacets(years),
+	}
+}
+
+// Search returns a page of search results for applications. The relevance is
+// computed the same way as SQLite's FTS5 bm25() function.
+func (store *MemoryStore) Search(query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error) {
+	return fuzzySearch(store, query, filters, sortby, offset, limit)
+}
+
+// searchValues returns the indexed fields of an app, in the order of
+// searchFields
+func (store *MemoryStore) searchValues(app RebbleApplication) []string {
+	categories := make([]string, 0)
+	for _, tag := range store.appTagList(app.Id) {
+		categories = append(categories, tag.Name)
+	}
+
+	return []string{app.Name, app.Description, store.authors[app.Author.Id].Name, strings.Join(categories, " ")}
+}
+
+// search returns a page of the apps matching exactly the query
+func (store *MemoryStore) search(query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error) {
+	if _, ok := searchOrders[sortby]; !ok || limit < 1 || offset < 0 {
+		return RebbleCards{}, errors.New("Invalid search parameters")
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	cards := RebbleCards{
+		Cards:      make([]RebbleCard, 0),
+		Facets:     newSearchFacets(),
+		Pagination: newPagination(0, offset, limit),
+	}
+
+	phrases := searchPhrases(query)
+	if len(phrases) == 0 && filters == (SearchFilters{}) {
+		return cards, nil
+	}
+
+	// Without words, every app passing the filters matches, the most popular
+	// first
+	if len(phrases) == 0 && sortby == "relevance" {
+		sortby = "popular"
+	}
+
+	type document struct {
+		app    RebbleApplication
+		values []string
+		words  [][]string
+		length int
+	}
+
+	documents := make([]document, 0, len(store.apps))
+	totalLength := 0
+	for _, app := range store.apps {
+		doc := document{
+			app:    app,
+			values: store.searchValues(app),
+		}
+		for _, value := range doc.values {
+			words := searchTokens(value)
+			doc.words = append(doc.words, words)
+			doc.length += len(words)
+		}
+		totalLength += doc.length
+		documents = append(documents, doc)
+	}
+	if len(documents) == 0 {
+		return cards, nil
+	}
+	averageLength := float64(totalLength) / float64(len(documents))
+
+	// Number of documents containing each phrase
+	containing := make([]int, len(phrases))
+	for i, phrase := range phrases {
+		for _, doc := range documents {
+			for _, words := range doc.words {
+				if countPhrase(words, phrase) > 0 {
+					containing[i]++
+					break
+				}
+			}
+		}
+	}
+
+	const k1, b = 1.2, 0.75
+	scored := make([]RebbleCard, 0)
+	matching := make([]RebbleApplication, 0)
+	for _, doc := range documents {
+		score := 0.0
+		matchesAll := true
+		for i, phrase := range phrases {
+			frequency := 0.0
+			for c, words := range doc.words {
+				frequency += float64(countPhrase(words, phrase)) * searchFields[c].Weight
+			}
+			if frequency == 0 {
+				matchesAll = false
+				break
+			}
+
+			idf := math.Log((float64(len(documents)-containing[i]) + 0.5) / (float64(containing[i]) + 0.5))
+			if idf <= 0 {
+				idf = 1e-6
+			}
+			score += idf * (frequency * (k1 + 1)) / (frequency + k1*(1-b+b*float64(doc.length)/averageLength))
+		}
+		if !matchesAll || !store.matchesFilters(doc.app, filters) {
+			continue
+		}
+		matching = append(matching, doc.app)
+
+		card := store.card(doc.app)
+		card.Score = score * heartsBoost(doc.app.ThumbsUp)
+		card.MatchedFields = matchedFields(phrases, doc.values)
+		scored = append(scored, card)
+	}
+
+	// scored and matching are in the same order
+	sort.Sort(searchResults{scored, matching, sortby})
+	for i := offset; i < len(scored) && i < offset+limit; i++ {
+		cards.Cards = append(cards.Cards, scored[i])
+	}
+	cards.Pagination = newPagination(len(scored), offset, limit)
+	cards.Facets = store.searchFacets(matching)
+
+	return cards, nil
+}
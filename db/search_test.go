@@ -0,0 +1,198 @@
+package db
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		tests := []struct {
+			query   string
+			titles  []string
+			matched []string
+		}{
+			// Matches the title and description, more hearts first
+			{"weather", []string{"Weather Now", "Weather Line"}, []string{"title", "description"}},
+			// Words are prefixes, case doesn't matter
+			{"STOPW", []string{"Stopwatch"}, []string{"title"}},
+			// Every word must match, in any field
+			{"tools north", []string{"Compass"}, []string{"description", "category"}},
+			{"sam tide", []string{"Tide Times"}, []string{"title", "description", "author"}},
+			{"weather unicorn", []string{}, nil},
+			{"  !! ", []string{}, nil},
+		}
+
+		for _, test := range tests {
+			cards, err := store.Search(test.query, SearchFilters{}, "relevance", 0, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := make([]string, len(cards.Cards))
+			for i, card := range cards.Cards {
+				titles[i] = card.Title
+				if card.Score <= 0 {
+					t.Errorf("%q: expected a positive score for %s, got %v", test.query, card.Title, card.Score)
+				}
+			}
+			if !reflect.DeepEqual(titles, test.titles) {
+				t.Errorf("%q: expected %v, got %v", test.query, test.titles, titles)
+			}
+			if len(cards.Cards) > 0 && !reflect.DeepEqual(cards.Cards[0].MatchedFields, test.matched) {
+				t.Errorf("%q: expected matched fields %v, got %v", test.query, test.matched, cards.Cards[0].MatchedFields)
+			}
+		}
+	})
+}
+
+func TestSearchFilters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		tests := []struct {
+			query   string
+			filters SearchFilters
+			titles  []string
+		}{
+			{"weather", SearchFilters{Type: "watchface"}, []string{"Weather Line"}},
+			{"weather", SearchFilters{Platform: "aplite"}, []string{"Weather Now"}},
+			{"time", SearchFilters{Category: "5261a8fb3b773043d500000c"}, []string{"Timer", "Tide Times"}},
+			{"weather", SearchFilters{Author: 3}, []string{"Weather Line"}},
+			// The start of the range is included, the end is not
+			{"time", SearchFilters{
+				PublishedFrom:  time.Date(2014, 7, 14, 9, 30, 0, 0, time.UTC),
+				PublishedUntil: time.Date(2014, 7, 14, 9, 45, 0, 0, time.UTC),
+			}, []string{"Timer"}},
+			{"weather", SearchFilters{Type: "watchapp", Author: 3}, []string{}},
+		}
+
+		for _, test := range tests {
+			cards, err := store.Search(test.query, test.filters, "relevance", 0, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := make([]string, len(cards.Cards))
+			for i, card := range cards.Cards {
+				titles[i] = card.Title
+			}
+			if !reflect.DeepEqual(titles, test.titles) {
+				t.Errorf("%q %+v: expected %v, got %v", test.query, test.filters, test.titles, titles)
+			}
+		}
+	})
+}
+
+func TestSearchFacets(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		cards, err := store.Search("weather", SearchFilters{}, "relevance", 0, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := &SearchFacets{
+			Types: []FacetCount{{"watchapp", "", 1}, {"watchface", "", 1}},
+			Platforms: []FacetCount{
+				{"basalt", "", 2}, {"chalk", "", 2}, {"aplite", "", 1},
+			},
+			Categories: []FacetCount{
+				{"5261a8fb3b773043d5000001", "Daily", 1}, {"528d3ef2dc7b5f580700000a", "Faces", 1},
+			},
+			Authors: []FacetCount{{"1", "Ada Watchmaker", 1}, {"3", "Sam Ticker", 1}},
+			Years:   []FacetCount{{"2015", "", 1}, {"2016", "", 1}},
+		}
+		if !reflect.DeepEqual(cards.Facets, expected) {
+			t.Fatalf("expected facets %+v, got %+v", expected, cards.Facets)
+		}
+
+		// Facets only count the apps passing the filters
+		cards, err = store.Search("weather", SearchFilters{Type: "watchface"}, "relevance", 0, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cards.Facets.Types, []FacetCount{{"watchface", "", 1}}) {
+			t.Fatalf("unexpected type facet %+v", cards.Facets.Types)
+		}
+	})
+}
+
+func TestSearchPagination(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		tests := []struct {
+			sortby string
+			offset int
+			limit  int
+			titles []string
+			page   Pagination
+		}{
+			{"popular", 0, 3, []string{"Weather Now", "Step Counter", "Timer"}, Pagination{12, 1, 3, 4}},
+			{"popular", 3, 3, []string{"Stopwatch", "Calendar Face", "Calculator"}, Pagination{12, 2, 3, 4}},
+			{"recent", 10, 5, []string{"Timer", "Calculator"}, Pagination{12, 3, 5, 3}},
+			{"name", 0, 4, []string{"Calculator", "Calendar Face", "Converter", "Flashlight"}, Pagination{12, 1, 4, 3}},
+			{"name", 20, 4, []string{}, Pagination{12, 6, 4, 3}},
+		}
+
+		for _, test := range tests {
+			cards, err := store.Search("a", SearchFilters{}, test.sortby, test.offset, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := make([]string, len(cards.Cards))
+			for i, card := range cards.Cards {
+				titles[i] = card.Title
+			}
+			if !reflect.DeepEqual(titles, test.titles) {
+				t.Errorf("%s %d %d: expected %v, got %v", test.sortby, test.offset, test.limit, test.titles, titles)
+			}
+			if *cards.Pagination != test.page {
+				t.Errorf("%s %d %d: expected %+v, got %+v", test.sortby, test.offset, test.limit, test.page, *cards.Pagination)
+			}
+		}
+
+		_, err := store.Search("a", SearchFilters{}, "hearts", 0, 12)
+		if err == nil {
+			t.Fatal("expected an error for an invalid sortby")
+		}
+	})
+}
+
+// The memory store must rank exactly like SQLite, so that handler tests using
+// it are meaningful
+func TestMemorySearchMatchesSQLite(t *testing.T) {
+	sqlite, cleanup := openSQLiteTestStore(t)
+	defer cleanup()
+	loadTestFixture(t, sqlite)
+
+	memory := NewMemoryStore()
+	loadTestFixture(t, memory)
+
+	for _, query := range []string{"weather", "time", "ada", "the", "pebble tech", "c"} {
+		expected, err := sqlite.Search(query, SearchFilters{}, "relevance", 0, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := memory.Search(query, SearchFilters{}, "relevance", 0, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(expected.Cards) != len(actual.Cards) {
+			t.Fatalf("%q: expected %d results, got %d", query, len(expected.Cards), len(actual.Cards))
+		}
+		for i := range expected.Cards {
+			if expected.Cards[i].Id != actual.Cards[i].Id || math.Abs(expected.Cards[i].Score-actual.Cards[i].Score) > 1e-9 {
+				t.Fatalf("%q: result %d: expected %s (%v), got %s (%v)", query, i, expected.Cards[i].Title, expected.Cards[i].Score, actual.Cards[i].Title, actual.Cards[i].Score)
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxSearchPeriods is the maximum number of periods of a search history
+const MaxSearchPeriods = 1000
+
+// SearchLogEntry is a search, as recorded in the search log
+type SearchLogEntry struct {
+	Query string
+	Time  time.Time
+	// Results is the number of results across all pages
+	Results int
+	// Filters are the filters chosen besides the query, as a URL query
+	Filters string
+	Latency time.Duration
+}
+
+// SearchLogOptions are the privacy settings of the search log
+type SearchLogOptions struct {
+	// Retention is how long searches are kept, forever when it is 0
+	Retention time.Duration
+	// Anonymize only keeps the words of the queries that start a word of the
+	// catalog, so that the log can't contain personal information
+	Anonymize bool
+}
+
+// anonymizeQuery returns the words of query that start a word of the catalog,
+// according to known
+func anonymizeQuery(query string, known func(token string) (bool, error)) (string, error) {
+	words := make([]string, 0)
+	for _, token := range searchTokens(query) {
+		ok, err := known(token)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			words = append(words, token)
+		}
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// searchPeriods returns the periods of length interval covering from to until,
+// aligned on multiples of interval since the Unix epoch (so days start at
+// midnight UTC)
+func searchPeriods(from time.Time, until time.Time, interval time.Duration) ([]SearchPeriod, error) {
+	if interval <= 0 || !from.Before(until) || until.Sub(from)/interval >= MaxSearchPeriods {
+		return nil, errors.New("Invalid search history parameters")
+	}
+
+	start := from.UnixNano() - from.UnixNano()%int64(interval)
+	periods := make([]SearchPeriod, 0)
+	for t := start; t < until.UnixNano(); t += int64(interval) {
+		periods = append(periods, SearchPeriod{Start: JSONTime{fromUnixNano(t)}})
+	}
+
+	return periods, nil
+}
+
+// LogSearch records a search in the search log
+func (handler Handler) LogSearch(entry SearchLogEntry, options SearchLogOptions) error {
+	if options.Anonymize {
+		var err error
+		entry.Query, err = anonymizeQuery(entry.Query, func(token string) (bool, error) {
+			var count int
+			err := handler.queryRow("SELECT COUNT(*) FROM (SELECT word FROM search_words WHERE word LIKE ? LIMIT 1) AS words", token+"%").Scan(&count)
+			return count > 0, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := handler.exec(
+		"INSERT INTO search_log(query, searched_at, results, filters, latency) VALUES(?, ?, ?, ?, ?)",
+		entry.Query, entry.Time.UnixNano(), entry.Results, entry.Filters, entry.Latency.Nanoseconds(),
+	)
+	return err
+}
+
+// PruneSearchLog removes the searches made before before from the search log
+func (handler Handler) PruneSearchLog(before time.Time) error {
+	_, err := handler.exec("DELETE FROM search_log WHERE searched_at < ?", before.UnixNano())
+	return err
+}
+
+// TopSearches returns the queries searched the most between from and until,
+// only the ones that had no results if zeroResults is true
+func (handler Handler) TopSearches(from time.Time, until time.Time, zeroResults bool, limit int) ([]SearchCount, error) {
+	where := ""
+	if zeroResults {
+		where = " AND results = 0"
+	}
+
+	rows, err := handler.query(`
+		SELECT query, COUNT(*), MAX(searched_at) FROM search_log
+		WHERE searched_at >= ? AND searched_at < ?`+where+`
+		GROUP BY query
+		ORDER BY COUNT(*) DESC, query
+		LIMIT ?
+	`, from.UnixNano(), until.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]SearchCount, 0)
+	for rows.Next() {
+		var count SearchCount
+		var lastSearched int64
+		err = rows.Scan(&count.Query, &count.Count, &lastSearched)
+		if err != nil {
+			return nil, err
+		}
+		count.LastSearched.Time = fromUnixNano(lastSearched)
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
+
+// SearchHistory returns the number of searches made between from and until, in
+// periods of length interval
+func (handler Handler) SearchHistory(from time.Time, until time.Time, interval time.Duration) ([]SearchPeriod, error) {
+	periods, err := searchPeriods(from, until, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := handler.query(`
+		SELECT searched_at - searched_at % ? AS period, COUNT(*), SUM(CASE WHEN results = 0 THEN 1 ELSE 0 END), AVG(latency)
+		FROM search_log
+		WHERE searched_at >= ? AND searched_at < ?
+		GROUP BY period
+	`, int64(interval), periods[0].Start.UnixNano(), until.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start int64
+		var period SearchPeriod
+		err = rows.Scan(&start, &period.Searches, &period.ZeroResults, &period.AverageLatency)
+		if err != nil {
+			return nil, err
+		}
+		period.Start.Time = fromUnixNano(start)
+		period.AverageLatency /= float64(time.Millisecond)
+		periods[(start-periods[0].Start.UnixNano())/int64(interval)] = period
+	}
+
+	return periods, rows.Err()
+}
+
+// LogSearch records a search in the search log
+func (store *MemoryStore) LogSearch(entry SearchLogEntry, options SearchLogOptions) error {
+	if options.Anonymize {
+		var err error
+		entry.Query, err = anonymizeQuery(entry.Query, func(token string) (bool, error) {
+			store.lock.RLock()
+			defer store.lock.RUnlock()
+
+			for _, app := range store.apps {
+				for word := range documentWords(store.searchValues(app)) {
+					if strings.HasPrefix(word, token) {
+						return true, nil
+					}
+				}
+			}
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.searchLog = append(store.searchLog, entry)
+
+	return nil
+}
+
+// PruneSearchLog removes the searches made before before from the search log
+func (store *MemoryStore) PruneSearchLog(before time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	kept := make([]SearchLogEntry, 0, len(store.searchLog))
+	for _, entry := range store.searchLog {
+		if !entry.Time.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	store.searchLog = kept
+
+	return nil
+}
+
+// TopSearches returns the queries searched the most between from and until,
+// only the ones that had no results if zeroResults is true
+func (store *MemoryStore) TopSearches(from time.Time, until time.Time, zeroResults bool, limit int) ([]SearchCount, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	counts := make(map[string]*SearchCount)
+	for _, entry := range store.searchLog {
+		if entry.Time.Before(from) || !entry.Time.Before(until) || (zeroResults && entry.Results != 0) {
+			continue
+		}
+
+		if _, ok := counts[entry.Query]; !ok {
+			counts[entry.Query] = &SearchCount{Query: entry.Query}
+		}
+		count := counts[entry.Query]
+		count.Count++
+		if entry.Time.After(count.LastSearched.Time) {
+			count.LastSearched.Time = fromUnixNano(entry.Time.UnixNano())
+		}
+	}
+
+	list := make([]SearchCount, 0, len(counts))
+	for _, count := range counts {
+		list = append(list, *count)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Query < list[j].Query
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	return list, nil
+}
+
+// SearchHistory returns the number of searches made between from and until, in
+// periods of length interval
+func (store *MemoryStore) SearchHistory(from time.Time, until time.Time, interval time.Duration) ([]SearchPeriod, error) {
+	periods, err := searchPeriods(from, until, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	latencies := make([]time.Duration, len(periods))
+	for _, entry := range store.searchLog {
+		if entry.Time.Before(periods[0].Start.Time) || !entry.Time.Before(until) {
+			continue
+		}
+
+		i := (entry.Time.UnixNano() - periods[0].Start.UnixNano()) / int64(interval)
+		periods[i].Searches++
+		if entry.Results == 0 {
+			periods[i].ZeroResults++
+		}
+		latencies[i] += entry.Latency
+	}
+	for i := range periods {
+		if periods[i].Searches > 0 {
+			periods[i].AverageLatency = float64(latencies[i]) / float64(periods[i].Searches) / float64(time.Millisecond)
+		}
+	}
+
+	return periods, nil
+}
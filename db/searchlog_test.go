@@ -0,0 +1,95 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		base := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+		entries := []SearchLogEntry{
+			{"weather", base, 2, "", 10 * time.Millisecond},
+			{"weather", base.Add(time.Hour), 2, "type=watchapp", 20 * time.Millisecond},
+			{"wether", base.Add(2 * time.Hour), 0, "", 30 * time.Millisecond},
+			{"clock", base.Add(25 * time.Hour), 5, "", 10 * time.Millisecond},
+			{"xyz", base.Add(26 * time.Hour), 0, "", 10 * time.Millisecond},
+			{"wether", base.Add(27 * time.Hour), 0, "", 10 * time.Millisecond},
+		}
+		for _, entry := range entries {
+			err := store.LogSearch(entry, SearchLogOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		top, err := store.TopSearches(base, base.Add(48*time.Hour), false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []SearchCount{
+			{"weather", 2, JSONTime{base.Add(time.Hour)}},
+			{"wether", 2, JSONTime{base.Add(27 * time.Hour)}},
+			{"clock", 1, JSONTime{base.Add(25 * time.Hour)}},
+			{"xyz", 1, JSONTime{base.Add(26 * time.Hour)}},
+		}
+		if !reflect.DeepEqual(top, expected) {
+			t.Errorf("expected top searches %v, got %v", expected, top)
+		}
+
+		top, err = store.TopSearches(base.Add(time.Hour), base.Add(48*time.Hour), true, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = []SearchCount{
+			{"wether", 2, JSONTime{base.Add(27 * time.Hour)}},
+		}
+		if !reflect.DeepEqual(top, expected) {
+			t.Errorf("expected zero result searches %v, got %v", expected, top)
+		}
+
+		history, err := store.SearchHistory(base, base.Add(48*time.Hour), 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		day := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+		expectedHistory := []SearchPeriod{
+			{JSONTime{day}, 3, 1, 20},
+			{JSONTime{day.AddDate(0, 0, 1)}, 3, 2, 10},
+			{JSONTime{day.AddDate(0, 0, 2)}, 0, 0, 0},
+		}
+		if !reflect.DeepEqual(history, expectedHistory) {
+			t.Errorf("expected history %v, got %v", expectedHistory, history)
+		}
+
+		_, err = store.SearchHistory(base, base.Add(48*time.Hour), time.Minute)
+		if err == nil {
+			t.Error("expected too many periods to fail")
+		}
+
+		// Older searches are removed, and anonymized queries only keep the
+		// words of the catalog
+		later := base.AddDate(0, 1, 0)
+		err = store.LogSearch(SearchLogEntry{"Weather xqzv john 0612345678", later, 2, "", time.Millisecond}, SearchLogOptions{Anonymize: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.PruneSearchLog(later.AddDate(0, 0, -7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		top, err = store.TopSearches(base, later.Add(time.Hour), false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = []SearchCount{
+			{"weather", 1, JSONTime{later}},
+		}
+		if !reflect.DeepEqual(top, expected) {
+			t.Errorf("expected the anonymized search only, got %v", top)
+		}
+	})
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// searchQualifiers are the keys of the qualifiers of the search query
+// language, such as `type:watchface`
+var searchQualifiers = []string{"author", "platform", "type", "hearts", "updated", "published"}
+
+// SearchQuery is a parsed search query: the text to search for, and the
+// filters given by its qualifiers
+type SearchQuery struct {
+	Text    string
+	Filters SearchFilters
+
+	// qualifiers are the qualifiers of the query, as they were typed
+	qualifiers []string
+}
+
+// WithText returns the query with its text replaced by text, and the same
+// qualifiers
+func (query SearchQuery) WithText(text string) string {
+	return strings.TrimSpace(text + " " + strings.Join(query.qualifiers, " "))
+}
+
+// ParseSearchQuery parses a search query. Besides words and "quoted phrases"
+// (whose words must follow each other, they keep their quotes in the text),
+// the query can contain qualifiers restricting the results:
+//
+//	author:"Ada Watchmaker"  apps of the author with this name (ignoring case
+//	                         and accents)
+//	type:watchface           watchapp or watchface
+//	platform:chalk           aplite, basalt, chalk or diorite
+//	hearts:>100              number of hearts
+//	updated:2016             date of the last update
+//	published:<2015-06       date of publication
+//
+// Numbers and dates can be compared (`>`, `>=`, `<`, `<=`) or be a range
+// (`10..100`, `2015..2016-03`). Dates are a year, a month or a day, and cover
+// all of it. Words that look like a qualifier with an unknown key are searched
+// as they are.
+func ParseSearchQuery(query string) (SearchQuery, error) {
+	var parsed SearchQuery
+	words := make([]string, 0)
+	seen := make(map[string]bool)
+
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		key := ""
+		for j := i; j < len(runes) && (unicode.IsLetter(runes[j]) || runes[j] == ':'); j++ {
+			if runes[j] == ':' {
+				if in(strings.ToLower(string(runes[i:j])), searchQualifiers) {
+					key = strings.ToLower(string(runes[i:j]))
+					i = j + 1
+				}
+				break
+			}
+		}
+
+		quoted := i < len(runes) && runes[i] == '"'
+		value, end, err := searchQueryTerm(runes, i)
+		if err != nil {
+			return SearchQuery{}, err
+		}
+		i = end
+
+		if key == "" {
+			if quoted && value != "" {
+				words = append(words, "\""+value+"\"")
+			} else if value != "" {
+				words = append(words, value)
+			}
+			continue
+		}
+
+		if seen[key] {
+			return SearchQuery{}, errors.New("Multiple '" + key + "' qualifiers are not allowed")
+		}
+		seen[key] = true
+		if value == "" {
+			return SearchQuery{}, errors.New("Empty '" + key + "' qualifier")
+		}
+
+		err = parsed.Filters.qualify(key, value)
+		if err != nil {
+			return SearchQuery{}, err
+		}
+		parsed.qualifiers = append(parsed.qualifiers, string(runes[start:end]))
+	}
+
+	parsed.Text = strings.Join(words, " ")
+	return parsed, nil
+}
+
+// searchQueryTerm reads the term of a query starting at runes[start]: either a
+// quoted string, or everything up to the next space. It returns the term
+// (without quotes) and the position following it.
+func searchQueryTerm(runes []rune, start int) (string, int, error) {
+	if start < len(runes) && runes[start] == '"' {
+		for end := start + 1; end < len(runes); end++ {
+			if runes[end] == '"' {
+				return string(runes[start+1 : end]), end + 1, nil
+			}
+		}
+		return "", 0, errors.New("Unterminated quote in search query")
+	}
+
+	end := start
+	for end < len(runes) && !unicode.IsSpace(runes[end]) {
+		end++
+	}
+
+	return string(runes[start:end]), end, nil
+}
+
+// qualify adds the filter of a qualifier of a search query
+func (filters *SearchFilters) qualify(key string, value string) error {
+	switch key {
+	case "author":
+		filters.AuthorName = value
+	case "type":
+		value = strings.ToLower(value)
+		if value != "watchapp" && value != "watchface" {
+			return errors.New("Invalid 'type' qualifier, it should be watchapp or watchface")
+		}
+		filters.Type = value
+	case "platform":
+		value = strings.ToLower(value)
+		if !in(value, hardwarePlatforms) {
+			return errors.New("Invalid 'platform' qualifier, it should be one of " + strings.Join(hardwarePlatforms, ", "))
+		}
+		filters.Platform = value
+	case "hearts":
+		from, until, ok := parseQueryRange(value, heartsBounds)
+		if !ok {
+			return errors.New("Invalid 'hearts' qualifier, it should be a number (100), a comparison (>100) or a range (10..100)")
+		}
+		if from == math.MinInt64 {
+			from = 0
+		}
+		if until <= from {
+			return errors.New("Invalid 'hearts' qualifier, no app can match it")
+		}
+		filters.HeartsFrom = int(from)
+		if until != math.MaxInt64 {
+			filters.HeartsUntil = int(until)
+		}
+	case "updated", "published":
+		from, until, ok := parseQueryRange(value, dateBounds)
+		if !ok {
+			return errors.New("Invalid '" + key + "' qualifier, it should be a date (2016, 2016-05 or 2016-05-03), a comparison (>2016) or a range (2015..2016)")
+		}
+		if until <= from {
+			return errors.New("Invalid '" + key + "' qualifier, no app can match it")
+		}
+
+		var fromTime, untilTime time.Time
+		if from != math.MinInt64 {
+			fromTime = time.Unix(from, 0).UTC()
+		}
+		if until != math.MaxInt64 {
+			untilTime = time.Unix(until, 0).UTC()
+		}
+		if key == "updated" {
+			filters.UpdatedFrom, filters.UpdatedUntil = fromTime, untilTime
+		} else {
+			filters.PublishedFrom, filters.PublishedUntil = fromTime, untilTime
+		}
+	}
+
+	return nil
+}
+
+// parseQueryRange parses a number or date qualifier into the range of values
+// [from, until) it matches. math.MinInt64 and math.MaxInt64 stand for no
+// bound. bounds returns the range of a single value.
+func parseQueryRange(value string, bounds func(string) (int64, int64, bool)) (int64, int64, bool) {
+	if parts := strings.SplitN(value, "..", 2); len(parts) == 2 {
+		from, _, ok := bounds(parts[0])
+		if !ok {
+			return 0, 0, false
+		}
+		_, until, ok := bounds(parts[1])
+		return from, until, ok
+	}
+
+	// The longest operators come first
+	for _, operator := range []string{">=", "<=", ">", "<"} {
+		if !strings.HasPrefix(value, operator) {
+			continue
+		}
+
+		start, end, ok := bounds(strings.TrimPrefix(value, operator))
+		switch operator {
+		case ">=":
+			return start, math.MaxInt64, ok
+		case "<=":
+			return math.MinInt64, end, ok
+		case ">":
+			return end, math.MaxInt64, ok
+		default:
+			return math.MinInt64, start, ok
+		}
+	}
+
+	return bounds(value)
+}
+
+// heartsBounds returns the range of a number of hearts
+func heartsBounds(value string) (int64, int64, bool) {
+	// ParseInt would accept signs
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return 0, 0, false
+		}
+	}
+	hearts, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return hearts, hearts + 1, true
+}
+
+// dateBounds returns the range of a year, a month or a day, as Unix times
+func dateBounds(value string) (int64, int64, bool) {
+	layouts := []struct {
+		layout              string
+		years, months, days int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	}
+
+	for _, l := range layouts {
+		if len(value) != len(l.layout) {
+			continue
+		}
+		start, err := time.Parse(l.layout, value)
+		// Published dates are stored in nanoseconds, which don't go
+		// much further
+		if err != nil || start.Year() < 1970 || start.Year() >= 2200 {
+			return 0, 0, false
+		}
+
+		return start.Unix(), start.AddDate(l.years, l.months, l.days).Unix(), true
+	}
+
+	return 0, 0, false
+}
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	date := func(value string) time.Time {
+		d, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		query   string
+		text    string
+		filters SearchFilters
+	}{
+		{"weather", "weather", SearchFilters{}},
+		{`  big   "tide times" `, `big "tide times"`, SearchFilters{}},
+		{
+			`author:"Foo Bar" platform:chalk type:watchface hearts:>100 updated:2016`,
+			"",
+			SearchFilters{
+				AuthorName:   "Foo Bar",
+				Platform:     "chalk",
+				Type:         "watchface",
+				HeartsFrom:   101,
+				UpdatedFrom:  date("2016-01-01"),
+				UpdatedUntil: date("2017-01-01"),
+			},
+		},
+		{"clock Type:WatchApp face", "clock face", SearchFilters{Type: "watchapp"}},
+		{"author:foo", "", SearchFilters{AuthorName: "foo"}},
+		{"hearts:100", "", SearchFilters{HeartsFrom: 100, HeartsUntil: 101}},
+		{"hearts:>=100", "", SearchFilters{HeartsFrom: 100}},
+		{"hearts:<100", "", SearchFilters{HeartsUntil: 100}},
+		{"hearts:<=100", "", SearchFilters{HeartsUntil: 101}},
+		{"hearts:10..20", "", SearchFilters{HeartsFrom: 10, HeartsUntil: 21}},
+		{"hearts:0", "", SearchFilters{HeartsUntil: 1}},
+		{"published:2016-02", "", SearchFilters{PublishedFrom: date("2016-02-01"), PublishedUntil: date("2016-03-01")}},
+		{"published:>2016-02-28", "", SearchFilters{PublishedFrom: date("2016-02-29")}},
+		{"published:<=2015", "", SearchFilters{PublishedUntil: date("2016-01-01")}},
+		{"updated:2014-06..2015", "", SearchFilters{UpdatedFrom: date("2014-06-01"), UpdatedUntil: date("2016-01-01")}},
+		// Unknown keys and other colons are searched
+		{"12:30 color:red", "12:30 color:red", SearchFilters{}},
+		{`"type:watchapp"`, `"type:watchapp"`, SearchFilters{}},
+	}
+
+	for _, test := range tests {
+		query, err := ParseSearchQuery(test.query)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.query, err)
+			continue
+		}
+		if query.Text != test.text {
+			t.Errorf("%q: expected text %q, got %q", test.query, test.text, query.Text)
+		}
+		if !reflect.DeepEqual(query.Filters, test.filters) {
+			t.Errorf("%q: expected filters %+v, got %+v", test.query, test.filters, query.Filters)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	queries := []string{
+		`author:"Foo`,
+		`weather "big`,
+		"author:",
+		`author:""`,
+		"type:app",
+		"platform:emery",
+		"type:watchapp type:watchface",
+		"hearts:many",
+		"hearts:-5",
+		"hearts:+5",
+		"hearts:>",
+		"hearts:<0",
+		"hearts:20..10",
+		"hearts:99999999999",
+		"updated:16",
+		"updated:2016-13",
+		"updated:2016-5-3",
+		"updated:2016..2015",
+		"updated:1969",
+		"published:>=",
+	}
+
+	for _, q := range queries {
+		query, err := ParseSearchQuery(q)
+		if err == nil {
+			t.Errorf("%q: expected an error, got %+v", q, query)
+		}
+	}
+}
+
+func TestSearchQueryWithText(t *testing.T) {
+	query, err := ParseSearchQuery(`wether type:watchapp author:"Foo Bar"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `weather type:watchapp author:"Foo Bar"`
+	if text := query.WithText("weather"); text != expected {
+		t.Fatalf("expected %q, got %q", expected, text)
+	}
+}
+
+func TestSearchFiltersMerge(t *testing.T) {
+	a := SearchFilters{Type: "watchapp", HeartsFrom: 10, HeartsUntil: 100, PublishedUntil: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := SearchFilters{Type: "watchapp", Platform: "chalk", HeartsFrom: 50, PublishedFrom: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), PublishedUntil: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	merged, err := a.Merge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SearchFilters{
+		Type:           "watchapp",
+		Platform:       "chalk",
+		HeartsFrom:     50,
+		HeartsUntil:    100,
+		PublishedFrom:  time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		PublishedUntil: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, merged)
+	}
+
+	_, err = a.Merge(SearchFilters{Type: "watchface"})
+	if err == nil {
+		t.Fatal("expected conflicting types to fail")
+	}
+	_, err = SearchFilters{Author: 1}.Merge(SearchFilters{Author: 2})
+	if err == nil {
+		t.Fatal("expected conflicting authors to fail")
+	}
+}
+
+func TestSearchQualifiers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		tests := []struct {
+			query  string
+			titles []string
+		}{
+			{`author:"ada watchmaker" weather`, []string{"Weather Now"}},
+			// Without words, the most popular apps come first
+			{"type:watchface hearts:>100", []string{"Big Time", "Minimal Face", "Calendar Face"}},
+			{"platform:chalk updated:2016", []string{"Calendar Face", "Weather Line", "Habit Tracker"}},
+			{"hearts:10..100 published:<2016", []string{"Flashlight", "Tide Times"}},
+			{`author:"SAM TICKER" type:watchapp hearts:<100`, []string{"Tide Times"}},
+			{"author:nobody", []string{}},
+			// The words of a phrase follow each other, the last one is a
+			// prefix
+			{`"single line"`, []string{"Weather Line"}},
+			{`"line single"`, []string{}},
+			{`"single b" type:watchapp`, []string{"Stopwatch"}},
+			{`"three day" weather`, []string{"Weather Now"}},
+		}
+
+		for _, test := range tests {
+			query, err := ParseSearchQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cards, err := store.Search(query.Text, query.Filters, "relevance", 0, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := make([]string, len(cards.Cards))
+			for i, card := range cards.Cards {
+				titles[i] = card.Title
+			}
+			if !reflect.DeepEqual(titles, test.titles) {
+				t.Errorf("%q: expected %v, got %v", test.query, test.titles, titles)
+			}
+		}
+	})
+}
+
+// FuzzParseSearchQuery parses arbitrary queries, starting from pieces of the
+// query language. Parsing must not panic, and the filters of valid queries must
+// be consistent.
+func FuzzParseSearchQuery(f *testing.F) {
+	for _, query := range []string{
+		"", " ", "weather", `"big time"`, `"unterminated`, "時計 é", "author:", "author:12",
+		"type:watchface", "Type:watchapp", "type:watchface -type:watchapp", "platform:chalk", "-platform:emery",
+		"hearts:>100", "hearts:>=5", "hearts:<0", "hearts:5..100", "hearts:99999999999", "hearts:-13",
+		"updated:2016", "updated:>=2016-02", "published:2016-02-29", "published:<1969", "published:2016..2016-02",
+		`weather type:watchapp "three day" hearts:>5 -platform:aplite`, ":..", "\t-:<=",
+	} {
+		f.Add(query)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		parsed, err := ParseSearchQuery(query)
+		if err != nil {
+			return
+		}
+
+		filters := parsed.Filters
+		if filters.Type != "" && filters.Type != "watchapp" && filters.Type != "watchface" {
+			t.Errorf("%q: invalid type %q", query, filters.Type)
+		}
+		if filters.Platform != "" && !in(filters.Platform, hardwarePlatforms) {
+			t.Errorf("%q: invalid platform %q", query, filters.Platform)
+		}
+		if filters.HeartsFrom < 0 || (filters.HeartsUntil != 0 && filters.HeartsUntil <= filters.HeartsFrom) {
+			t.Errorf("%q: invalid hearts range %d..%d", query, filters.HeartsFrom, filters.HeartsUntil)
+		}
+		if !filters.PublishedUntil.IsZero() && !filters.PublishedFrom.Before(filters.PublishedUntil) {
+			t.Errorf("%q: invalid published range", query)
+		}
+		if !filters.UpdatedUntil.IsZero() && !filters.UpdatedFrom.Before(filters.UpdatedUntil) {
+			t.Errorf("%q: invalid updated range", query)
+		}
+		if strings.Contains(parsed.Text, `"`) && !strings.Contains(query, `"`) {
+			t.Errorf("%q: text %q has quotes", query, parsed.Text)
+		}
+
+		// The qualifiers alone give the same filters
+		qualifiers, err := ParseSearchQuery(parsed.WithText(""))
+		if err != nil {
+			t.Errorf("%q: qualifiers %q don't parse: %v", query, parsed.WithText(""), err)
+		} else if !reflect.DeepEqual(qualifiers.Filters, filters) {
+			t.Errorf("%q: qualifiers %q give different filters", query, parsed.WithText(""))
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ErrNoShadow is returned by Shadow when the store can't be copied, in which
+// case it has to be changed in place
+var ErrNoShadow = errors.New("Only SQLite database files can be shadowed")
+
+// shadowSuffix is appended to the path of a SQLite database to get the path of
+// its shadow
+const shadowSuffix = ".shadow"
+
+// Shadow copies the SQLite database file next to it, and opens the copy. A
+// shadow left over by a previous call is overwritten.
+func (handler Handler) Shadow() (Store, error) {
+	if handler.path == "" || handler.path == ":memory:" {
+		return nil, ErrNoShadow
+	}
+
+	shadowPath := handler.path + shadowSuffix
+	err := os.Remove(shadowPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, err = handler.exec("VACUUM INTO ?", shadowPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return Open(strings.Replace(handler.source, handler.path, shadowPath, 1))
+}
+
+// Replace closes the database, moves the file of shadow over the database
+// file, and opens it again. If the file can't be moved, the database is opened
+// again as it was, and returned with the error.
+func (handler Handler) Replace(shadow Store) (Store, error) {
+	shadowHandler, ok := shadow.(Handler)
+	if !ok || handler.path == "" || shadowHandler.path != handler.path+shadowSuffix {
+		return handler, errors.New("Not a shadow of this database")
+	}
+
+	err := copySearchLog(handler, shadowHandler)
+	if err != nil {
+		return handler, err
+	}
+	err = copyJobs(handler, shadowHandler)
+	if err != nil {
+		return handler, err
+	}
+	err = shadowHandler.Close()
+	if err != nil {
+		return handler, err
+	}
+
+	// SQLite finds the journal of a database from the name of its file, so
+	// a database that is still open when its file is replaced would use the
+	// journal of the new file
+	err = handler.Close()
+	if err == nil {
+		err = os.Rename(shadowHandler.path, handler.path)
+	}
+	store, openErr := Open(handler.source)
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	return store, err
+}
+
+// copyJobs saves the jobs of from into to
+func copyJobs(from Handler, to Handler) error {
+	rows, err := from.query("SELECT " + jobColumns + " FROM jobs")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	jobs := make([]Job, 0)
+	for rows.Next() {
+		job, err := scanJob(rows.Scan)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		err = to.SaveJob(job)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copySearchLog copies the searches logged in from after the last one of to
+func copySearchLog(from Handler, to Handler) error {
+	var since int64
+	err := to.queryRow("SELECT COALESCE(MAX(searched_at), 0) FROM search_log").Scan(&since)
+	if err != nil {
+		return err
+	}
+
+	rows, err := from.query("SELECT query, searched_at, results, filters, latency FROM search_log WHERE searched_at > ? ORDER BY searched_at", since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tx, err := to.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for rows.Next() {
+		var query, filters string
+		var searchedAt, latency int64
+		var results int
+		err = rows.Scan(&query, &searchedAt, &results, &filters, &latency)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO search_log(query, searched_at, results, filters, latency) VALUES(?, ?, ?, ?, ?)", query, searchedAt, results, filters, latency)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Shadow returns a copy of the store
+func (store *MemoryStore) Shadow() (Store, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	shadow := NewMemoryStore()
+	for id, author := range store.authors {
+		shadow.authors[id] = author
+	}
+	for id, collection := range store.collections {
+		shadow.collections[id] = collection
+	}
+	shadow.collectionOrder = append([]string{}, store.collectionOrder...)
+	for id := range store.curated {
+		shadow.curated[id] = true
+	}
+	for id, app := range store.apps {
+		shadow.apps[id] = app
+	}
+	for id, tags := range store.appTags {
+		shadow.appTags[id] = append([]string{}, tags...)
+	}
+	for id, versions := range store.versions {
+		shadow.versions[id] = append([]RebbleVersion{}, versions...)
+	}
+	for id, apps := range store.collectionApps {
+		shadow.collectionApps[id] = append([]string{}, apps...)
+	}
+	for id, sources := range store.sources {
+		shadow.sources[id] = append([]json.RawMessage{}, sources...)
+	}
+	for developerId, id := range store.developers {
+		shadow.developers[developerId] = id
+	}
+	for id, to := range store.authorRedirects {
+		shadow.authorRedirects[id] = to
+	}
+	shadow.searchLog = append([]SearchLogEntry{}, store.searchLog...)
+	for id, job := range store.jobs {
+		shadow.jobs[id] = copyJob(job)
+	}
+
+	return shadow, nil
+}
+
+// Replace returns shadow, with the searches logged and the jobs saved in store
+// since it was copied
+func (store *MemoryStore) Replace(shadow Store) (Store, error) {
+	shadowStore, ok := shadow.(*MemoryStore)
+	if !ok || shadowStore == store {
+		return store, errors.New("Not a shadow of this store")
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	shadowStore.lock.Lock()
+	defer shadowStore.lock.Unlock()
+
+	var since int64
+	for _, entry := range shadowStore.searchLog {
+		if entry.Time.UnixNano() > since {
+			since = entry.Time.UnixNano()
+		}
+	}
+	for _, entry := range store.searchLog {
+		if entry.Time.UnixNano() > since {
+			shadowStore.searchLog = append(shadowStore.searchLog, entry)
+		}
+	}
+	for id, job := range store.jobs {
+		shadowStore.jobs[id] = copyJob(job)
+	}
+
+	return shadowStore, nil
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		shadow, err := store.Shadow()
+		if handler, ok := store.(Handler); ok && handler.dialect == postgresDialect {
+			// PostgreSQL databases are rebuilt in place
+			if err != ErrNoShadow {
+				t.Errorf("expected ErrNoShadow, got %v", err)
+			}
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		rejected, err := store.Replace(store)
+		if err == nil || rejected != store {
+			t.Error("expected a store that is not a shadow to be rejected")
+		}
+
+		// Changes to the shadow don't affect the store, searches logged
+		// meanwhile are carried over
+		err = shadow.DeleteApps([]string{"5003d94014e27459d032ab58"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetApp("5003d94014e27459d032ab58")
+		if err != nil {
+			t.Errorf("expected the app to be kept in the store: %v", err)
+		}
+		searched := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+		err = store.LogSearch(SearchLogEntry{Query: "weather", Time: searched, Results: 2}, SearchLogOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.SaveJob(Job{Id: "job", Kind: "test", State: JobDone, Created: searched})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		replaced, err := store.Replace(shadow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer replaced.Close()
+
+		_, err = replaced.GetApp("5003d94014e27459d032ab58")
+		if err == nil {
+			t.Error("expected the app to be deleted")
+		}
+		_, err = replaced.GetApp("500047e81195154d21eb4f43")
+		if err != nil {
+			t.Errorf("expected the other apps to be kept: %v", err)
+		}
+		searches, err := replaced.TopSearches(searched.Add(-time.Hour), searched.Add(time.Hour), false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(searches) != 1 || searches[0].Query != "weather" {
+			t.Errorf("expected the logged search to be carried over, got %+v", searches)
+		}
+		job, err := replaced.GetJob("job")
+		if err != nil || job.State != JobDone {
+			t.Errorf("expected the saved job to be carried over, got %+v %v", job, err)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store is the storage backend of the Rebble Store. It covers everything the
+// HTTP handlers need from the database.
+type Store interface {
+	// Migrate brings the schema of the store up to date
+	Migrate() error
+	// Close releases the resources held by the store
+	Close() error
+
+	Search(query string, filters SearchFilters, sortby string, offset int, limit int) (RebbleCards, error)
+	Suggest(prefix string) (RebbleSuggestions, error)
+	GetAppsForCollection(collectionID string, sortby string, platform string) ([]RebbleApplication, error)
+	GetCollectionName(collectionID string) (string, error)
+	GetCollections() ([]RebbleCollection, error)
+	GetAllApps(sortby string, ascending bool, offset int, limit int) ([]RebbleApplication, error)
+	GetApp(id string) (RebbleApplication, error)
+	GetApps(ids []string) ([]RebbleApplication, error)
+	GetAppTags(id string) ([]RebbleCollection, error)
+	GetAppVersions(id string) ([]RebbleVersion, error)
+	GetAuthor(id int) (RebbleAuthor, error)
+	GetAuthorCards(id int) (RebbleCards, error)
+	GetAuthorRedirect(id int) (int, error)
+
+	ImportCatalog(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error
+	ImportCatalogBatch(authors []RebbleAuthor, collections []RebbleCollection, apps []RebbleApplication, versions map[string][]RebbleVersion) error
+	Reindex() error
+	ExportCatalog() (Fixture, error)
+	GetAuthorIds() (AuthorIds, error)
+	DeleteApps(ids []string) error
+	GetAllScreenshots() (map[string][]RebbleScreenshotsPlatform, error)
+	SetScreenshots(screenshots map[string][]RebbleScreenshotsPlatform) error
+	SetAppSources(sources map[string][]json.RawMessage) error
+	ApplyCatalogChanges(changes CatalogChanges) error
+	GetAppSources(id string) ([]json.RawMessage, error)
+
+	// Collections are changed by hand with these, imports leave the name
+	// and color of these collections and the order of their apps alone
+	CreateCollection(collection RebbleCollection) error
+	UpdateCollection(collection RebbleCollection) error
+	DeleteCollection(id string) error
+	OrderCollections(ids []string) error
+	AddCollectionApps(id string, appIds []string) error
+	RemoveCollectionApps(id string, appIds []string) error
+	OrderCollectionApps(id string, appIds []string) error
+
+	// Shadow returns a copy of the store, which can be changed without
+	// affecting it and then take its place with Replace. It returns
+	// ErrNoShadow if the store can't be copied (PostgreSQL databases and
+	// in-memory SQLite databases), which then has to be changed in place.
+	Shadow() (Store, error)
+	// Replace puts shadow, returned by Shadow, in place of the store, and
+	// returns the store to use from then on, which is the store itself if
+	// shadow was rejected. The store must not be used meanwhile, and not
+	// anymore afterwards. The searches logged and the jobs saved since
+	// Shadow are carried over, other changes made to the store are lost (the
+	// server refuses changes to the collections from Shadow on).
+	Replace(shadow Store) (Store, error)
+
+	LogSearch(entry SearchLogEntry, options SearchLogOptions) error
+	PruneSearchLog(before time.Time) error
+	TopSearches(from time.Time, until time.Time, zeroResults bool, limit int) ([]SearchCount, error)
+	SearchHistory(from time.Time, until time.Time, interval time.Duration) ([]SearchPeriod, error)
+
+	SaveJob(job Job) error
+	GetJob(id string) (Job, error)
+	GetJobs(limit int) ([]Job, error)
+	InterruptJobs() error
+}
+
+// Open connects to the database described by dsn. A DSN starting with
+// `postgres://` or `postgresql://` selects the PostgreSQL backend, anything
+// else is the path to a SQLite database (optionally prefixed with
+// `sqlite3://`).
+func Open(dsn string) (Store, error) {
+	source := dsn
+	path := ""
+	d := sqliteDialect
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		d = postgresDialect
+	} else {
+		dsn = strings.TrimPrefix(dsn, "sqlite3://")
+		path = strings.SplitN(strings.TrimPrefix(dsn, "file:"), "?", 2)[0]
+
+		// Foreign keys are disabled by default in SQLite
+		if strings.Contains(dsn, "?") {
+			dsn = dsn + "&_foreign_keys=1"
+		} else {
+			dsn = dsn + "?_foreign_keys=1"
+		}
+	}
+
+	database, err := sql.Open(d.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.Ping()
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	return Handler{database, d, source, path}, nil
+}
+
+// Close closes the database
+func (handler Handler) Close() error {
+	return handler.db.Close()
+}
+
+// exec executes a query that doesn't return rows
+func (handler Handler) exec(query string, args ...interface{}) (sql.Result, error) {
+	return handler.db.Exec(handler.dialect.rebind(query), args...)
+}
+
+// query executes a query that returns rows
+func (handler Handler) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return handler.db.Query(handler.dialect.rebind(query), args...)
+}
+
+// queryRow executes a query that is expected to return at most one row
+func (handler Handler) queryRow(query string, args ...interface{}) *sql.Row {
+	return handler.db.QueryRow(handler.dialect.rebind(query), args...)
+}
+
+// begin starts a transaction
+func (handler Handler) begin() (*Tx, error) {
+	tx, err := handler.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{tx, handler.dialect}, nil
+}
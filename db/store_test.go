@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// postgresTestDSN is the environment variable pointing to a PostgreSQL
+// database the tests may use. PostgreSQL tests are skipped when it is unset.
+const postgresTestDSN = "REBBLE_TEST_POSTGRES_DSN"
+
+// openSQLiteTestStore creates an empty SQLite database in a temporary directory
+func openSQLiteTestStore(t *testing.T) (Handler, func()) {
+	dir, err := ioutil.TempDir("", "rebblestore-db-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store.(Handler), func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// openPostgresTestStore creates an empty schema in the PostgreSQL test
+// database, and connects to it
+func openPostgresTestStore(t *testing.T, dsn string) (Handler, func()) {
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := fmt.Sprintf("rebble_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	store, err := Open(u.String())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return store.(Handler), func() {
+		store.Close()
+		cleanup()
+	}
+}
+
+// forEachStore runs a test against a fresh instance of every Store
+// implementation that is available locally
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+
+	forEachSQLStore(t, func(t *testing.T, handler Handler) {
+		test(t, handler)
+	})
+}
+
+// forEachSQLStore runs a test against a fresh database of every SQL backend
+// that is available locally
+func forEachSQLStore(t *testing.T, test func(t *testing.T, handler Handler)) {
+	t.Run("sqlite", func(t *testing.T) {
+		store, cleanup := openSQLiteTestStore(t)
+		defer cleanup()
+		test(t, store)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(postgresTestDSN)
+		if dsn == "" {
+			t.Skip(postgresTestDSN + " is not set")
+		}
+		store, cleanup := openPostgresTestStore(t, dsn)
+		defer cleanup()
+		test(t, store)
+	})
+}
+
+// loadTestFixture migrates store and loads the test fixture into it
+func loadTestFixture(t *testing.T, store Store) {
+	err := store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = LoadFixture(store, "testdata/catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT a FROM t WHERE b=? AND c LIKE ? ESCAPE '?' AND d=?"
+
+	if sqliteDialect.rebind(query) != query {
+		t.Fatalf("SQLite queries should not be rewritten, got %s", sqliteDialect.rebind(query))
+	}
+
+	expected := "SELECT a FROM t WHERE b=$1 AND c LIKE $2 ESCAPE '?' AND d=$3"
+	if postgresDialect.rebind(query) != expected {
+		t.Fatalf("expected %s, got %s", expected, postgresDialect.rebind(query))
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = LoadFixture(store, "testdata/catalog.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		apps, err := store.GetAllApps("popular", false, 0, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(apps) != 15 || apps[0].Name != "Big Time" {
+			t.Fatalf("unexpected apps %v", apps)
+		}
+
+		// The second page of the most recent apps
+		apps, err = store.GetAllApps("recent", false, 10, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(apps) != 5 || apps[4].Name != "Big Time" {
+			t.Fatalf("unexpected apps %v", apps)
+		}
+	})
+}
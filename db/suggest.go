@@ -0,0 +1,290 @@
+package db
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// suggestionTypes are the types of suggestions, in the order they are
+// returned, with the maximum number of suggestions of each type
+var suggestionTypes = []struct {
+	Type  string
+	Limit int
+}{
+	{"app", 5},
+	{"author", 3},
+	{"collection", 2},
+}
+
+// suggestionPrefixLength is the length of the longest prefixes stored in the
+// prefix index. Longer prefixes match few names, they are looked up by range
+// in the index of tails instead.
+const suggestionPrefixLength = 10
+
+// prefixEnd is appended to a prefix to get an upper bound of the strings
+// starting with it (it is the last Unicode code point)
+const prefixEnd = "\U0010FFFF"
+
+// suggestionEntry is something that can be suggested: an app, an author or a
+// collection. Popular entries are suggested first: apps with more hearts,
+// authors whose apps have more hearts, and collections with more apps.
+type suggestionEntry struct {
+	Type       string
+	Id         string
+	Name       string
+	Popularity int
+}
+
+// nameTails returns the ends of a name starting at each of its words,
+// normalized the same way as search queries. A prefix matches a name if one of
+// its tails starts with the prefix.
+func nameTails(name string) []string {
+	words := searchTokens(name)
+	tails := make([]string, len(words))
+	for i := range words {
+		tails[i] = strings.Join(words[i:], " ")
+	}
+
+	return tails
+}
+
+// reindexSuggestions rebuilds the prefix index of suggestions. Every prefix (up
+// to suggestionPrefixLength letters) of every tail of a name gets a row, so
+// that the index gives the best suggestions for a prefix without sorting all
+// the matching names.
+func reindexSuggestions(tx *Tx) error {
+	_, err := tx.Exec("DELETE FROM search_suggestions")
+	if err != nil {
+		return err
+	}
+
+	queries := map[string]string{
+		"app":        "SELECT id, name, thumbs_up FROM apps",
+		"author":     "SELECT authors.id, authors.name, COALESCE((SELECT SUM(apps.thumbs_up) FROM apps WHERE apps.author_id = authors.id), 0) FROM authors",
+		"collection": "SELECT collections.id, collections.name, (SELECT COUNT(*) FROM collection_apps WHERE collection_apps.collection_id = collections.id) FROM collections",
+	}
+
+	entries := make([]suggestionEntry, 0)
+	for _, t := range suggestionTypes {
+		rows, err := tx.Query(queries[t.Type])
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			entry := suggestionEntry{Type: t.Type}
+			err = rows.Scan(&entry.Id, &entry.Name, &entry.Popularity)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO search_suggestions(type, prefix, tail, later, popularity, name, id) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		for position, tail := range nameTails(entry.Name) {
+			// Names starting with the prefix come first
+			later := 0
+			if position > 0 {
+				later = 1
+			}
+
+			runes := []rune(tail)
+			for length := 1; length <= len(runes) && length <= suggestionPrefixLength; length++ {
+				_, err = stmt.Exec(entry.Type, string(runes[:length]), tail, later, entry.Popularity, entry.Name, entry.Id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Suggest returns apps, authors and collections whose name contains a word
+// starting with prefix (when prefix contains several words, they must follow
+// each other in the name). Names starting with the prefix come first, then
+// the most popular ones.
+func (handler Handler) Suggest(prefix string) (RebbleSuggestions, error) {
+	suggestions := RebbleSuggestions{
+		Suggestions: make([]RebbleSuggestion, 0),
+	}
+
+	prefix = strings.Join(searchTokens(prefix), " ")
+	if prefix == "" {
+		return suggestions, nil
+	}
+
+	// Every tail has a single row with a prefix of suggestionPrefixLength
+	// letters (length() also keeps the prefix index from being used)
+	where := "prefix = ?"
+	args := []interface{}{prefix}
+	if utf8.RuneCountInString(prefix) > suggestionPrefixLength {
+		where = "tail >= ? AND tail < ? AND length(prefix) = ?"
+		args = []interface{}{prefix, prefix + prefixEnd, suggestionPrefixLength}
+	}
+
+	for _, t := range suggestionTypes {
+		// A name can match several times (once per word starting with the
+		// prefix), its best match comes first. Names matching more than
+		// four times may push others out of the suggestions, which is fine.
+		rows, err := handler.query(`
+			SELECT id, name FROM search_suggestions
+			WHERE type = ? AND `+where+`
+			ORDER BY later, popularity DESC, name, id
+			LIMIT ?
+		`, append(append([]interface{}{t.Type}, args...), 4*t.Limit)...)
+		if err != nil {
+			return RebbleSuggestions{}, err
+		}
+
+		entries := make([]suggestionEntry, 0)
+		seen := make(map[string]bool)
+		for rows.Next() {
+			entry := suggestionEntry{Type: t.Type}
+			err = rows.Scan(&entry.Id, &entry.Name)
+			if err != nil {
+				rows.Close()
+				return RebbleSuggestions{}, err
+			}
+			if !seen[entry.Id] && len(entries) < t.Limit {
+				seen[entry.Id] = true
+				entries = append(entries, entry)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return RebbleSuggestions{}, err
+		}
+
+		for _, entry := range entries {
+			suggestion, err := handler.suggestion(entry)
+			if err != nil {
+				return RebbleSuggestions{}, err
+			}
+			suggestions.Suggestions = append(suggestions.Suggestions, suggestion)
+		}
+	}
+
+	return suggestions, nil
+}
+
+// suggestion returns the details of a suggested entry
+func (handler Handler) suggestion(entry suggestionEntry) (RebbleSuggestion, error) {
+	suggestion := RebbleSuggestion{Type: entry.Type}
+
+	switch entry.Type {
+	case "app":
+		card := RebbleCard{Id: entry.Id, Title: entry.Name}
+		err := handler.queryRow("SELECT apps.type, apps.thumbs_up, "+cardImageColumn+" FROM apps WHERE apps.id = ?", entry.Id).Scan(&card.Type, &card.ThumbsUp, &card.ImageUrl)
+		if err != nil {
+			return RebbleSuggestion{}, err
+		}
+		suggestion.App = &card
+	case "author":
+		id, err := strconv.Atoi(entry.Id)
+		if err != nil {
+			return RebbleSuggestion{}, err
+		}
+		suggestion.Author = &RebbleAuthor{Id: id, Name: entry.Name}
+	case "collection":
+		collection := RebbleCollection{Id: entry.Id, Name: entry.Name}
+		err := handler.queryRow("SELECT color FROM collections WHERE id = ?", entry.Id).Scan(&collection.Color)
+		if err != nil {
+			return RebbleSuggestion{}, err
+		}
+		suggestion.Collection = &collection
+	}
+
+	return suggestion, nil
+}
+
+// Suggest returns apps, authors and collections whose name contains a word
+// starting with prefix, ranked the same way as in the SQL stores
+func (store *MemoryStore) Suggest(prefix string) (RebbleSuggestions, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	suggestions := RebbleSuggestions{
+		Suggestions: make([]RebbleSuggestion, 0),
+	}
+
+	prefix = strings.Join(searchTokens(prefix), " ")
+	if prefix == "" {
+		return suggestions, nil
+	}
+
+	type match struct {
+		suggestion RebbleSuggestion
+		entry      suggestionEntry
+		position   int
+	}
+
+	matches := make(map[string][]match)
+	add := func(suggestion RebbleSuggestion, entry suggestionEntry) {
+		for position, tail := range nameTails(entry.Name) {
+			if strings.HasPrefix(tail, prefix) {
+				matches[entry.Type] = append(matches[entry.Type], match{suggestion, entry, position})
+				return
+			}
+		}
+	}
+
+	for _, app := range store.apps {
+		card := store.card(app)
+		add(RebbleSuggestion{Type: "app", App: &card}, suggestionEntry{"app", app.Id, app.Name, app.ThumbsUp})
+	}
+	for _, author := range store.authors {
+		hearts := 0
+		for _, app := range store.apps {
+			if app.Author.Id == author.Id {
+				hearts += app.ThumbsUp
+			}
+		}
+		a := author
+		add(RebbleSuggestion{Type: "author", Author: &a}, suggestionEntry{"author", strconv.Itoa(author.Id), author.Name, hearts})
+	}
+	for _, collection := range store.collections {
+		c := collection
+		add(RebbleSuggestion{Type: "collection", Collection: &c}, suggestionEntry{"collection", collection.Id, collection.Name, len(store.collectionApps[collection.Id])})
+	}
+
+	for _, t := range suggestionTypes {
+		list := matches[t.Type]
+		sort.Slice(list, func(i, j int) bool {
+			a, b := list[i], list[j]
+			if (a.position == 0) != (b.position == 0) {
+				return a.position == 0
+			}
+			if a.entry.Popularity != b.entry.Popularity {
+				return a.entry.Popularity > b.entry.Popularity
+			}
+			if a.entry.Name != b.entry.Name {
+				return a.entry.Name < b.entry.Name
+			}
+			return a.entry.Id < b.entry.Id
+		})
+
+		for i := 0; i < len(list) && i < t.Limit; i++ {
+			suggestions.Suggestions = append(suggestions.Suggestions, list[i].suggestion)
+		}
+	}
+
+	return suggestions, nil
+}
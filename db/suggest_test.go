@@ -0,0 +1,55 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNameTails(t *testing.T) {
+	expected := []string{"tools utilities", "utilities"}
+	if tails := nameTails("Tools & Utilities"); !reflect.DeepEqual(tails, expected) {
+		t.Fatalf("expected %v, got %v", expected, tails)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		loadTestFixture(t, store)
+
+		tests := []struct {
+			prefix      string
+			suggestions []string
+		}{
+			// Names starting with the prefix first, then by popularity
+			{"t", []string{"app:Timer", "app:Tide Times", "app:Big Time", "app:Habit Tracker", "author:Sam Ticker", "author:Pebble Technology", "collection:Tools & Utilities"}},
+			{"Big ti", []string{"app:Big Time"}},
+			{"ada w", []string{"author:Ada Watchmaker"}},
+			{"fac", []string{"app:Minimal Face", "app:Calendar Face", "collection:Faces"}},
+			{"calendar fa", []string{"app:Calendar Face"}},
+			{"time big", []string{}},
+			{"", []string{}},
+		}
+
+		for _, test := range tests {
+			suggestions, err := store.Suggest(test.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, len(suggestions.Suggestions))
+			for i, suggestion := range suggestions.Suggestions {
+				switch suggestion.Type {
+				case "app":
+					names[i] = "app:" + suggestion.App.Title
+				case "author":
+					names[i] = "author:" + suggestion.Author.Name
+				case "collection":
+					names[i] = "collection:" + suggestion.Collection.Name
+				}
+			}
+			if !reflect.DeepEqual(names, test.suggestions) {
+				t.Errorf("%q: expected %v, got %v", test.prefix, test.suggestions, names)
+			}
+		}
+	})
+}
@@ -1,25 +1,32 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
-	"net/http"
+	"log"
 	"os"
+	"strings"
+	"time"
 
 	"pebble-dev/rebblestore-api/common"
 	"pebble-dev/rebblestore-api/db"
 	"pebble-dev/rebblestore-api/rebbleHandlers"
 
-	"github.com/gorilla/handlers"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/pborman/getopt"
 )
 
 func main() {
 	var version bool
+	var anonymizeSearches bool
+	databaseDsn := "./RebbleAppStore.db"
+	searchRetention := 90
 	rebbleHandlers.StoreUrl = "http://docs.rebble.io"
 	getopt.BoolVarLong(&version, "version", 'V', "Get the current version info")
 	getopt.StringVarLong(&rebbleHandlers.StoreUrl, "store-url", 'u', "Set the store URL (defaults to http://docs.rebble.io)")
+	getopt.StringVarLong(&databaseDsn, "database", 'd', "Set the database, either a SQLite file or a postgres:// DSN (defaults to ./RebbleAppStore.db)")
+	getopt.IntVarLong(&searchRetention, "search-retention", 0, "Number of days searches are kept in the search log, 0 to keep them forever (defaults to 90)")
+	getopt.BoolVarLong(&anonymizeSearches, "anonymize-searches", 0, "Only keep the words of the catalog in the search log")
+	getopt.StringVarLong(&diffApply, "apply", 0, "Categories of changes applied by diff-archive, separated by commas: "+strings.Join(rebbleHandlers.DiffCategories, ", ")+" (defaults to none)")
+	getopt.SetParameters("[command [arguments]]")
 	getopt.Parse()
 	if version {
 		//fmt.Fprintf(os.Stderr, "Version %s\nBuild Host: %s\nBuild Date: %s\nBuild Hash: %s\n", rsapi.Buildversionstring, rsapi.Buildhost, rsapi.Buildstamp, rsapi.Buildgithash)
@@ -27,18 +34,49 @@ func main() {
 		return
 	}
 
-	database, err := sql.Open("sqlite3", "./RebbleAppStore.db")
+	name := "serve"
+	args := getopt.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok || len(args) != len(cmd.args) {
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
+		} else {
+			fmt.Fprintf(os.Stderr, "Wrong number of arguments for %s\n", name)
+		}
+		getopt.Usage()
+		commandsUsage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	database, err := db.Open(databaseDsn)
 	if err != nil {
-		panic("Could not connect to database" + err.Error())
+		logger.Print("Could not connect to database: ", err)
+		os.Exit(exitDatabase)
 	}
 
-	dbHandler := db.Handler{database}
+	err = database.Migrate()
+	if err != nil {
+		database.Close()
+		logger.Print("Could not migrate database: ", err)
+		os.Exit(exitDatabase)
+	}
 
 	// construct the context that will be injected in to handlers
-	context := &rebbleHandlers.HandlerContext{&dbHandler}
+	context := &rebbleHandlers.HandlerContext{
+		Database: database,
+		SearchLog: db.SearchLogOptions{
+			Retention: time.Duration(searchRetention) * 24 * time.Hour,
+			Anonymize: anonymizeSearches,
+		},
+	}
 
-	r := rebbleHandlers.Handlers(context)
-	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
-	http.Handle("/", r)
-	http.ListenAndServe(":8080", loggedRouter)
+	code := cmd.run(context, args, os.Stdout, logger)
+	context.FlushSearchLog()
+	context.Store().Close()
+	os.Exit(code)
 }
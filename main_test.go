@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"os"
 	"testing"
 
@@ -11,7 +10,6 @@ import (
 	"github.com/adams-sarah/test2doc/test"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var server *test.Server
@@ -19,13 +17,12 @@ var server *test.Server
 func TestMain(m *testing.M) {
 	var err error
 
-	database, err := sql.Open("sqlite3", "./RebbleAppStore.db")
+	store := db.NewMemoryStore()
+	err = db.LoadFixture(store, "db/testdata/catalog.json")
 	if err != nil {
-		panic("Could not connect to database" + err.Error())
+		panic("Could not load fixture: " + err.Error())
 	}
-
-	dbHandler := db.Handler{database}
-	context := &rebbleHandlers.HandlerContext{&dbHandler}
+	context := &rebbleHandlers.HandlerContext{Database: store}
 
 	var r = rebbleHandlers.Handlers(context)
 	r.KeepContext = true
@@ -42,6 +39,5 @@ func TestMain(m *testing.M) {
 
 	server.Finish()
 
-	os.Remove("./foo_test.db")
 	os.Exit(exitCode)
 }
@@ -2,287 +2,379 @@ package rebbleHandlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"pebble-dev/rebblestore-api/db"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/nu7hatch/gouuid"
 )
 
-// walkFiles is intended to quickly crawl the pebble application folder
-// in-order to re-build the application database.
-func walkFiles(root string) (<-chan string, <-chan error) {
-	// Create a couple of channels to communicate with the main process.
-	// (multi-threading FTW!)
-	paths := make(chan string)
-	errf := make(chan error, 1)
-
-	// Crawl the directory in the background.
-	go func() {
-		defer close(paths)
-		errf <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				log.Println(err)
-			}
-			if info.IsDir() {
-				return nil
-			}
-			if strings.HasSuffix(info.Name(), ".json") {
-				paths <- path
-			}
-			return nil
-		})
-	}()
+// ImportReport sums up an import of the Pebble app store archive. Bad files
+// are skipped instead of failing the whole import, and files with problems are
+// listed along with the reasons.
+type ImportReport struct {
+	// Files is the number of JSON files read
+	Files int `json:"files"`
+	// Imported is the number of apps imported
+	Imported int `json:"imported"`
+	// Skipped is the number of files that were not imported
+	Skipped int `json:"skipped"`
+	// Warned is the number of files that were imported despite problems
+	Warned   int                `json:"warned"`
+	Problems []ImportFileReport `json:"problems"`
+}
 
-	// Return the channels so that our goroutine can communicate with the main
-	// thread.
-	return paths, errf
+// ImportFileReport lists the problems of a file of the archive
+type ImportFileReport struct {
+	File string `json:"file"`
+	// App is the ID of the app, when the file could be decoded
+	App     string   `json:"app,omitempty"`
+	Skipped bool     `json:"skipped"`
+	Reasons []string `json:"reasons"`
 }
 
-// AdminRebuildDBHandler allows an administrator to rebuild the database from
-// the application directory after hitting a single API end point.
-func AdminRebuildDBHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	//w.WriteHeader(418)
-	//fmt.Fprintf(w, "I'm a teapot!")
-	/*
-		w.Header().Add("content-type", "text/html")
-		path, errc := walkFiles("PebbleAppStore/apps")
-		for item := range path {
-			fmt.Fprintf(w, "File: %s<br />", item)
-		}
-		if err := <-errc; err != nil {
-			log.Fatal(err)
-		}
-		/**/
-
-	//return /*
-	//db.Close()
-
-	dbHandler := ctx.Database
-
-	// tag_ids and screenshot_urls are Marshaled arrays, hence the BLOB type.
-	sqlStmt := `
-			drop table if exists apps;
-			create table apps (
-				id text not null primary key,
-				name text,
-				author_id integer,
-				tag_ids blob,
-				description text,
-				thumbs_up integer,
-				type text,
-				supported_platforms blob,
-				published_date integer,
-				pbw_url text,
-				rebble_ready integer,
-				updated integer,
-				version text,
-				support_url text,
-				author_url text,
-				source_url text,
-				screenshots blob,
-				banner_url text,
-				icon_url text,
-				doomsday_backup integer,
-				versions blob
-			);
-			delete from apps;
-		`
-	_, err := dbHandler.Exec(sqlStmt)
+// skip records that file was not imported
+func (report *ImportReport) skip(file string, app string, reason string) {
+	report.Skipped++
+	report.Problems = append(report.Problems, ImportFileReport{file, app, true, []string{reason}})
+}
+
+// warn records that file was imported despite problems
+func (report *ImportReport) warn(file string, app string, reasons []string) {
+	report.Warned++
+	report.Problems = append(report.Problems, ImportFileReport{file, app, false, reasons})
+}
+
+// archiveCatalog is (a batch of) the catalog read from the Pebble app store
+// archive
+type archiveCatalog struct {
+	authors     []db.RebbleAuthor
+	collections []db.RebbleCollection
+	apps        []db.RebbleApplication
+	versions    map[string][]db.RebbleVersion
+	// sources are the original records of each app, one per hardware platform
+	sources map[string][]json.RawMessage
+}
+
+// archiveReader merges the apps of the archive, which are described once per
+// hardware platform, into batches
+type archiveReader struct {
+	store       db.Store
+	report      ImportReport
+	authors     *archiveAuthors
+	collections map[string]db.RebbleCollection
+	// files are the files each app was first read from
+	files map[string]string
+	// platforms are the hardware platforms each app was read for
+	platforms map[string][]string
+
+	batch archiveCatalog
+	// batchApps are the indexes of the apps of batch
+	batchApps map[string]int
+}
+
+// newBatch starts an empty batch
+func (reader *archiveReader) newBatch() {
+	reader.batch = archiveCatalog{
+		apps:     make([]db.RebbleApplication, 0),
+		versions: make(map[string][]db.RebbleVersion),
+		sources:  make(map[string][]json.RawMessage),
+	}
+	reader.batchApps = make(map[string]int)
+}
+
+// add puts an app into the batch
+func (reader *archiveReader) add(app db.RebbleApplication, versions []db.RebbleVersion, sources []json.RawMessage) {
+	reader.batchApps[app.Id] = len(reader.batch.apps)
+	reader.batch.apps = append(reader.batch.apps, app)
+	reader.batch.versions[app.Id] = versions
+	reader.batch.sources[app.Id] = sources
+}
+
+// reload puts an app written with a previous batch back into the batch, so that
+// another of its records can be merged
+func (reader *archiveReader) reload(id string) error {
+	app, err := reader.store.GetApp(id)
 	if err != nil {
-		return http.StatusInternalServerError, err
-	}
-
-	// Placeholder until we implement an actual author/developer system.
-	sqlStmt = `
-			drop table if exists authors;
-			create table authors (
-				id text not null primary key,
-				name text
-			);
-			delete from authors;
-		`
-	_, err = dbHandler.Exec(sqlStmt)
+		return err
+	}
+	versions, err := reader.store.GetAppVersions(id)
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("%q: %s", err, sqlStmt)
-	}
-
-	// Placeholder until we implement an actual collections system.
-	sqlStmt = `
-			drop table if exists collections;
-			create table collections (
-				id text not null primary key,
-				name text,
-				color text,
-				apps blob,
-				cache_apps_most_popular blob,
-				cache_time integer
-			);
-			delete from collections;
-		`
-	_, err = dbHandler.Exec(sqlStmt)
+		return err
+	}
+	sources, err := reader.store.GetAppSources(id)
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("%q: %s", err, sqlStmt)
+		return err
 	}
 
-	tx, err := dbHandler.Begin()
-	if err != nil {
-		return http.StatusInternalServerError, err
+	reader.add(app, versions, sources)
+	return nil
+}
+
+// read merges a decoded file into the batch
+func (reader *archiveReader) read(file decodedFile) error {
+	reader.report.Files++
+	if file.err != nil {
+		reader.report.skip(file.name, "", file.err.Error())
+		return nil
 	}
-	defer tx.Rollback()
+	pebbleApp := file.app
 
-	stmt, err := tx.Prepare("INSERT INTO apps(id, name, author_id, tag_ids, description, thumbs_up, type, supported_platforms, published_date, pbw_url, rebble_ready, updated, version, support_url, author_url, source_url, screenshots, banner_url, icon_url, doomsday_backup, versions) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return http.StatusInternalServerError, err
+	if in_array(pebbleApp.ScreenshotHardware, reader.platforms[pebbleApp.Id]) {
+		reader.report.skip(file.name, pebbleApp.Id, fmt.Sprintf("Duplicate ID, %s was already imported from %s for %s", pebbleApp.Id, reader.files[pebbleApp.Id], pebbleApp.ScreenshotHardware))
+		return nil
+	}
+	reader.platforms[pebbleApp.Id] = append(reader.platforms[pebbleApp.Id], pebbleApp.ScreenshotHardware)
+
+	warnings := appWarnings(pebbleApp)
+	app, versions := parseApp(pebbleApp, reader.authors, &reader.collections)
+	if _, ok := reader.files[app.Id]; !ok {
+		reader.files[app.Id] = file.name
+		reader.add(*app, *versions, []json.RawMessage{file.source})
+	} else {
+		// Apps are described once per hardware platform
+		if _, ok := reader.batchApps[app.Id]; !ok {
+			err := reader.reload(app.Id)
+			if err != nil {
+				return err
+			}
+		}
+		i := reader.batchApps[app.Id]
+		var conflicts []FieldDiff
+		reader.batch.versions[app.Id], conflicts = mergeApp(&reader.batch.apps[i], reader.batch.versions[app.Id], app, *versions)
+		reader.batch.sources[app.Id] = append(reader.batch.sources[app.Id], file.source)
+
+		for _, conflict := range conflicts {
+			kept, _ := json.Marshal(conflict.Old)
+			ignored, _ := json.Marshal(conflict.New)
+			warnings = append(warnings, fmt.Sprintf("Conflicting %s, kept %s from %s instead of %s", conflict.Field, kept, reader.files[app.Id], ignored))
+		}
+	}
+
+	if len(warnings) > 0 {
+		reader.report.warn(file.name, pebbleApp.Id, warnings)
+	}
+	return nil
+}
+
+// flush completes the batch with the authors and collections of its apps, and
+// passes it to write
+func (reader *archiveReader) flush(write func(batch archiveCatalog) error) error {
+	if len(reader.batch.apps) == 0 {
+		return nil
 	}
-	defer stmt.Close()
 
-	authors := make(map[string]int)
+	authors := make(map[int]db.RebbleAuthor)
 	collections := make(map[string]db.RebbleCollection)
-	lastAuthorId := 0
-	path, errc := walkFiles("PebbleAppStore/")
-	apps := make(map[string]db.RebbleApplication)
-	versions := make(map[string]([]db.RebbleVersion))
-	for item := range path {
-		app, v, err := parseApp(item, &authors, &lastAuthorId, &collections)
-		if err != nil {
-			return http.StatusInternalServerError, err
+	for _, app := range reader.batch.apps {
+		authors[app.Author.Id] = app.Author
+		for _, tag := range app.AppInfo.Tags {
+			collections[tag.Id] = tag
 		}
+	}
+	reader.batch.authors = make([]db.RebbleAuthor, 0, len(authors))
+	for _, author := range authors {
+		reader.batch.authors = append(reader.batch.authors, author)
+	}
+	sort.Slice(reader.batch.authors, func(i, j int) bool {
+		return reader.batch.authors[i].Id < reader.batch.authors[j].Id
+	})
+	reader.batch.collections = make([]db.RebbleCollection, 0, len(collections))
+	for _, collection := range collections {
+		reader.batch.collections = append(reader.batch.collections, collection)
+	}
+	sort.Slice(reader.batch.collections, func(i, j int) bool {
+		return reader.batch.collections[i].Id < reader.batch.collections[j].Id
+	})
 
-		if _, ok := apps[app.Id]; ok {
-			platformExists := false
-			for _, platform := range *apps[app.Id].Assets.Screenshots {
-				if platform.Platform == (*app.Assets.Screenshots)[0].Platform {
-					platformExists = true
-				}
-			}
+	err := write(reader.batch)
+	if err != nil {
+		return err
+	}
 
-			if !platformExists {
-				(*apps[app.Id].Assets.Screenshots) = append((*apps[app.Id].Assets.Screenshots), (*app.Assets.Screenshots)[0])
-			}
-		} else {
-			apps[app.Id] = *app
-			versions[app.Id] = *v
-		}
+	reader.newBatch()
+	return nil
+}
+
+// readArchive reads the Pebble app store archive at path, either a directory, a
+// .tar.gz or a .zip file, and reports its progress to p and logger. The files are
+// decoded in parallel, and the apps are merged and passed to write in batches
+// of batchSize apps (all at once if batchSize is 0), along with their authors
+// and collections. The batches only depend on the order of the files in the
+// archive. Authors are given the IDs they already have in store. Files that
+// can't be imported are skipped and listed in the report, an error is only
+// returned if the archive can't be read or a batch can't be written.
+func readArchive(store db.Store, path string, batchSize int, write func(batch archiveCatalog) error, p progress, logger *log.Logger) (ImportReport, error) {
+	source, err := openFileSource(path)
+	if err != nil {
+		return ImportReport{}, err
 	}
+	defer source.Close()
+	p.expect("bytes", int(source.Size()))
 
-	for _, app := range apps {
-		tag_ids_s := make([]string, 1)
-		tag_ids_s[0] = app.AppInfo.Tags[0].Id
-		tag_ids, err := json.Marshal(tag_ids_s)
-		if err != nil {
-			return http.StatusInternalServerError, err
-		}
-		screenshots, err := json.Marshal(app.Assets.Screenshots)
-		if err != nil {
-			return http.StatusInternalServerError, err
+	known, err := store.GetAuthorIds()
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	reader := archiveReader{
+		store:       store,
+		report:      ImportReport{Problems: make([]ImportFileReport, 0)},
+		authors:     newArchiveAuthors(known),
+		collections: make(map[string]db.RebbleCollection),
+		files:       make(map[string]string),
+		platforms:   make(map[string][]string),
+	}
+	reader.newBatch()
+
+	err = decodeArchive(source, importWorkers, importWindow, func(file decodedFile) error {
+		if p.cancelled() {
+			return errCancelled
 		}
-		supported_platforms, err := json.Marshal(app.SupportedPlatforms)
+
+		problems := len(reader.report.Problems)
+		err := reader.read(file)
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return err
 		}
-		versions, err := json.Marshal(versions[app.Id])
-		if err != nil {
-			return http.StatusInternalServerError, err
+		p.count("files", 1)
+		p.count("bytes", int(file.size))
+		for _, problem := range reader.report.Problems[problems:] {
+			if problem.Skipped {
+				p.problem(fmt.Sprintf("%s: %s", problem.File, strings.Join(problem.Reasons, ", ")))
+			}
 		}
 
-		_, err = stmt.Exec(app.Id, app.Name, app.Author.Id, tag_ids, app.Description, app.ThumbsUp, app.Type, supported_platforms, app.Published.UnixNano(), app.AppInfo.PbwUrl, app.AppInfo.RebbleReady, app.AppInfo.Updated.UnixNano(), app.AppInfo.Version, app.AppInfo.SupportUrl, app.AppInfo.AuthorUrl, app.AppInfo.SourceUrl, screenshots, app.Assets.Banner, app.Assets.Icon, app.DoomsdayBackup, versions)
-		if err != nil {
-			return http.StatusInternalServerError, err
+		if reader.report.Files%1000 == 0 {
+			logger.Printf("Parsed %d files", reader.report.Files)
+		}
+		if batchSize > 0 && len(reader.batch.apps) >= batchSize {
+			return reader.flush(write)
 		}
+		return nil
+	})
+	if err != nil {
+		return ImportReport{}, err
 	}
-	if err := <-errc; err != nil {
-		return http.StatusInternalServerError, err
+	err = reader.flush(write)
+	if err != nil {
+		return ImportReport{}, err
 	}
 
-	for author, id := range authors {
-		_, err = tx.Exec("INSERT INTO authors(id, name) VALUES(?, ?)", id, author)
+	logger.Printf("Parsed %d files, found %d apps, skipped %d files", reader.report.Files, len(reader.files), reader.report.Skipped)
+	return reader.report, nil
+}
+
+// ImportArchive rebuilds the catalog from the Pebble app store archive at path,
+// either a directory, a .tar.gz or a .zip file, and logs its progress to logger. Apps,
+// authors and collections are inserted or updated, the rest of the database is
+// left untouched. Authors are identified by their developer ID and keep the ID
+// given by the previous imports. The apps are written in batches, each in its
+// own transaction, and the search index is rebuilt at the end. Files that
+// can't be imported are skipped and listed in the report, an error is only
+// returned if the archive can't be read or the catalog can't be saved.
+func ImportArchive(store db.Store, path string, logger *log.Logger) (ImportReport, error) {
+	return importArchive(store, path, noProgress{}, logger)
+}
+
+// importArchive is ImportArchive, reporting its progress to p and stopping
+// between two files if it is cancelled
+func importArchive(store db.Store, path string, p progress, logger *log.Logger) (ImportReport, error) {
+	apps := make(map[string]bool)
+	authors := make(map[int]bool)
+	collections := make(map[string]bool)
+	report, err := readArchive(store, path, importBatchSize, func(batch archiveCatalog) error {
+		// The tables are created by the migrations (see db.Migrate), the
+		// import only (re)populates catalog data and leaves everything else
+		// untouched.
+		err := store.ImportCatalogBatch(batch.authors, batch.collections, batch.apps, batch.versions)
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return err
 		}
-	}
-
-	for id, collection := range collections {
-		collectionApps := make([]string, 0)
-		for _, app := range apps {
-			for _, tag := range app.AppInfo.Tags {
-				if tag.Id == collection.Id {
-					collectionApps = append(collectionApps, app.Id)
-				}
-			}
+		err = store.SetAppSources(batch.sources)
+		if err != nil {
+			return err
 		}
 
-		collectionApps_b, err := json.Marshal(collectionApps)
-
-		_, err = tx.Exec("INSERT INTO collections(id, name, color, apps) VALUES(?, ?, ?, ?)", id, collection.Name, collection.Color, collectionApps_b)
-		if err != nil {
-			return http.StatusInternalServerError, err
+		imported := len(apps)
+		for _, app := range batch.apps {
+			apps[app.Id] = true
+		}
+		p.count("apps", len(apps)-imported)
+		for _, author := range batch.authors {
+			authors[author.Id] = true
+		}
+		for _, collection := range batch.collections {
+			collections[collection.Id] = true
 		}
+		logger.Printf("Imported %d apps", len(apps))
+		return nil
+	}, p, logger)
+	if err != nil {
+		return ImportReport{}, err
 	}
 
-	tx.Commit()
-
-	log.Print("AppStore Database rebuilt successfully.")
-	return http.StatusOK, nil
+	err = store.Reindex()
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report.Imported = len(apps)
 
+	logger.Printf("Imported %d apps, %d authors and %d collections", len(apps), len(authors), len(collections))
+	return report, nil
 }
 
-// AdminRebuildImagesHandler allows an administrator to rebuild the images database from the application directory after hitting a single API end point.
-func AdminRebuildImagesHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	dbHandler := ctx.Database
+// RebuildImages downloads the screenshots of every app into the directory
+// images (which is emptied first), and points the screenshots of the apps to
+// the downloaded copies. It logs its progress to logger.
+func RebuildImages(store db.Store, images string, logger *log.Logger) error {
+	return rebuildImages(store, images, noProgress{}, logger)
+}
 
-	err := os.RemoveAll("PebbleImages")
+// rebuildImages is RebuildImages, reporting its progress to p and stopping
+// between two apps if it is cancelled
+func rebuildImages(store db.Store, images string, p progress, logger *log.Logger) error {
+	err := os.RemoveAll(images)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
-	err = os.Mkdir("PebbleImages", 0755)
+	err = os.Mkdir(images, 0755)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
 
-	tx, err := dbHandler.Begin()
+	screenshots, err := store.GetAllScreenshots()
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
-	defer tx.Rollback()
 
-	rows, err := tx.Query("SELECT id, screenshots FROM apps")
-	if err != nil {
-		return http.StatusInternalServerError, err
+	distinct := make(map[string]bool)
+	for _, appScreenshots := range screenshots {
+		for _, platform := range appScreenshots {
+			for _, screenshot := range platform.Screenshots {
+				distinct[screenshot] = true
+			}
+		}
 	}
+	p.expect("images", len(distinct))
 
-	apps := make(map[string]db.RebbleApplication, 0)
+	newScreenshots := make(map[string][]db.RebbleScreenshotsPlatform, len(screenshots))
 	urls := make([]string, 0)
-	for rows.Next() {
-		var id string
-		var screenshots_b []byte
-		var screenshots *([]db.RebbleScreenshotsPlatform)
-		err = rows.Scan(&id, &screenshots_b)
-		if err != nil {
-			return http.StatusInternalServerError, err
+	for id, appScreenshots := range screenshots {
+		if p.cancelled() {
+			return errCancelled
 		}
-
-		err = json.Unmarshal(screenshots_b, &screenshots)
-		if err != nil {
-			return http.StatusInternalServerError, err
-		}
-
 		platforms := make([]db.RebbleScreenshotsPlatform, 0)
-		apps[id] = db.RebbleApplication{
-			Id: id,
-			Assets: db.RebbleAssets{
-				Screenshots: &platforms,
-			},
-		}
 
-		for _, platform := range *screenshots {
+		for _, platform := range appScreenshots {
 			newPlatform := db.RebbleScreenshotsPlatform{
 				Platform: platform.Platform,
 			}
@@ -295,7 +387,7 @@ func AdminRebuildImagesHandler(ctx *HandlerContext, w http.ResponseWriter, r *ht
 
 				u, err := uuid.NewV4()
 				if err != nil {
-					return http.StatusInternalServerError, err
+					return err
 				}
 
 				newPlatform.Screenshots = append(newPlatform.Screenshots, fmt.Sprintf("/images/%v", u.String()))
@@ -304,20 +396,21 @@ func AdminRebuildImagesHandler(ctx *HandlerContext, w http.ResponseWriter, r *ht
 				errs = append(errs, make(chan error))
 
 				go func(url string, id string, err chan error) {
-					log.Println("Downloading", url)
+					logger.Println("Downloading", url)
 					resp, e := http.Get(url)
 					if e != nil {
 						err <- e
 						return
 					}
+					defer resp.Body.Close()
 
-					out, e := os.Create(fmt.Sprintf("PebbleImages/%v", id))
+					out, e := os.Create(filepath.Join(images, id))
 					if e != nil {
 						err <- e
 						return
 					}
+					defer out.Close()
 
-					defer resp.Body.Close()
 					_, e = io.Copy(out, resp.Body)
 
 					err <- e
@@ -327,30 +420,132 @@ func AdminRebuildImagesHandler(ctx *HandlerContext, w http.ResponseWriter, r *ht
 			for _, err := range errs {
 				e := <-err
 				if e != nil {
-					return http.StatusInternalServerError, e
+					return e
 				}
+				p.count("images", 1)
 			}
 
 			if len(newPlatform.Screenshots) > 0 {
 				platforms = append(platforms, newPlatform)
 			}
 		}
+
+		newScreenshots[id] = platforms
 	}
 
-	for id, app := range apps {
-		screenshots, err := json.Marshal(*app.Assets.Screenshots)
-		if err != nil {
-			return http.StatusInternalServerError, err
+	err = store.SetScreenshots(newScreenshots)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Downloaded %d screenshots of %d apps", len(urls), len(newScreenshots))
+	return nil
+}
+
+// adminLogger is where the admin handlers log the progress of their operations
+var adminLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+// archivePaths are the places where AdminRebuildDBHandler looks for the Pebble
+// app store archive, in order
+var archivePaths = []string{"PebbleAppStore/", "PebbleAppStore.tar.gz", "PebbleAppStore.zip"}
+
+// validateRebuild checks the catalog rebuilt into shadow before it replaces the
+// one of live: it must have every app imported, and at least as many apps as
+// live since the import doesn't remove any
+func validateRebuild(live db.Store, shadow db.Store, report ImportReport) error {
+	if report.Imported == 0 {
+		return errors.New("No app was imported")
+	}
+
+	before, err := GetCatalogStats(live)
+	if err != nil {
+		return err
+	}
+	after, err := GetCatalogStats(shadow)
+	if err != nil {
+		return err
+	}
+	if after.Apps < report.Imported || after.Apps < before.Apps {
+		return fmt.Errorf("The rebuilt catalog has %d apps, expected at least %d imported and %d before", after.Apps, report.Imported, before.Apps)
+	}
+
+	return nil
+}
+
+// rebuildCatalog imports the Pebble app store archive at path into a shadow of
+// the store of ctx, validates it, then swaps it with the store, so that the
+// catalog remains available and consistent during the import. Stores that
+// can't be shadowed are imported into directly. It reports its progress to p
+// and logger.
+func rebuildCatalog(ctx *HandlerContext, path string, p progress, logger *log.Logger) (ImportReport, error) {
+	live := ctx.Store()
+	shadow, err := ctx.shadowStore(live)
+	if err == db.ErrNoShadow {
+		logger.Print("The database can't be shadowed, importing into it directly")
+		return importArchive(live, path, p, logger)
+	} else if err != nil {
+		return ImportReport{}, err
+	}
+	defer ctx.endReplace()
+
+	report, err := importArchive(shadow, path, p, logger)
+	if err == nil {
+		err = validateRebuild(live, shadow, report)
+	}
+	if err != nil {
+		shadow.Close()
+		return ImportReport{}, err
+	}
+
+	err = ctx.swapStore(live, shadow)
+	if err != nil {
+		shadow.Close()
+		return ImportReport{}, err
+	}
+
+	logger.Print("Swapped the rebuilt catalog in")
+	return report, nil
+}
+
+// AdminRebuildDBHandler allows an administrator to rebuild the database from
+// the application directory (or the archive itself) after hitting a single API
+// end point. The catalog is rebuilt in the background into a shadow database,
+// which replaces the database once complete (see rebuildCatalog). It answers
+// with the job (see AdminJobHandler), whose result is the report of the
+// import, or 409 if a rebuild is already running.
+func AdminRebuildDBHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	archive := ""
+	for _, path := range archivePaths {
+		if _, err := os.Stat(path); err == nil {
+			archive = path
+			break
 		}
-		_, err = tx.Exec("UPDATE apps SET screenshots=? WHERE id=?", screenshots, id)
+	}
+	if archive == "" {
+		return http.StatusInternalServerError, errors.New("No Pebble app store archive found")
+	}
+
+	return startJobHandler(ctx, w, jobRebuildDB, func(j *runningJob, logger *log.Logger) (interface{}, error) {
+		report, err := rebuildCatalog(ctx, archive, j, logger)
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return nil, err
 		}
-	}
 
-	tx.Commit()
+		logger.Print("AppStore Database rebuilt successfully.")
+		return report, nil
+	})
+}
 
-	log.Print("AppStore Image Database rebuilt successfully.")
-	return http.StatusOK, nil
+// AdminRebuildImagesHandler allows an administrator to rebuild the images database from the application directory after hitting a single API end point.
+// The images are downloaded in the background, it answers with the job, or 409 if a rebuild is already running, as the database may be replaced meanwhile.
+func AdminRebuildImagesHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return startJobHandler(ctx, w, jobRebuildImages, func(j *runningJob, logger *log.Logger) (interface{}, error) {
+		err := rebuildImages(ctx.Store(), "PebbleImages", j, logger)
+		if err != nil {
+			return nil, err
+		}
 
+		logger.Print("AppStore Image Database rebuilt successfully.")
+		return nil, nil
+	})
 }
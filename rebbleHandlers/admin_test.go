@@ -0,0 +1,630 @@
+package rebbleHandlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// testArchive is a small Pebble app store archive: three apps from two
+// authors, one of them described once per hardware platform
+const testArchive = "rebbleHandlers/testdata/archive"
+
+// testArchiveFiles lists the files of the test archive, relative to its root
+func testArchiveFiles(t *testing.T) []string {
+	files := make([]string, 0)
+	err := filepath.Walk(testArchive, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(testArchive, file)
+		files = append(files, filepath.ToSlash(name))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+// writeTestTarGz packs the test archive into a .tar.gz file in dir
+func writeTestTarGz(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "PebbleAppStore.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+
+	err = archive.WriteHeader(&tar.Header{Name: "PebbleAppStore/", Mode: 0755, Typeflag: tar.TypeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testArchiveFiles(t) {
+		data, err := ioutil.ReadFile(filepath.Join(testArchive, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = archive.WriteHeader(&tar.Header{Name: "PebbleAppStore/" + name, Mode: 0644, Size: int64(len(data))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = archive.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// writeTestZip packs the test archive into a .zip file in dir
+func writeTestZip(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "PebbleAppStore.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	archive := zip.NewWriter(f)
+
+	_, err = archive.Create("PebbleAppStore/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testArchiveFiles(t) {
+		data, err := ioutil.ReadFile(filepath.Join(testArchive, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := archive.Create("PebbleAppStore/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestFileSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebblestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []string{
+		"apps/59a3c1d2e4b0a1f2c3d4e5f6-aplite.json",
+		"apps/59a3c1d2e4b0a1f2c3d4e5f6-basalt.json",
+		"apps/5a0e7b1c9d8f6e5d4c3b2a10.json",
+		"apps/5b1f2e3d4c5b6a7988776655.json",
+	}
+	for _, path := range []string{testArchive, writeTestTarGz(t, dir), writeTestZip(t, dir)} {
+		source, err := openFileSource(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		names := make([]string, 0)
+		for {
+			file, err := source.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			if file.Err != nil || len(file.Data) == 0 {
+				t.Errorf("%s: could not read %s: %v", path, file.Name, file.Err)
+			}
+			names = append(names, strings.TrimPrefix(file.Name, "PebbleAppStore/"))
+		}
+		err = source.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected files %v, got %v", path, expected, names)
+		}
+	}
+
+	_, err = openFileSource(filepath.Join(testArchive, "README.txt"))
+	if err == nil {
+		t.Error("expected a file that isn't an archive to be rejected")
+	}
+
+	// The whole archive can't be read past a corrupted entry
+	corrupted := filepath.Join(dir, "corrupted.tar.gz")
+	data, err := ioutil.ReadFile(writeTestTarGz(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(corrupted, data[:len(data)/2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportArchive(db.NewMemoryStore(), corrupted, log.New(ioutil.Discard, "", 0))
+	if err == nil {
+		t.Error("expected a truncated archive to fail the import")
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebblestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	for _, path := range []string{testArchive, writeTestTarGz(t, dir), writeTestZip(t, dir)} {
+		store := db.NewMemoryStore()
+		report, err := ImportArchive(store, path, logger)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if report.Files != 4 || report.Imported != 3 || report.Skipped != 0 || report.Warned != 1 || report.Problems[0].App != "5b1f2e3d4c5b6a7988776655" {
+			t.Errorf("%s: unexpected report %+v", path, report)
+		}
+
+		catalog, err := store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog.Apps) != 3 || len(catalog.Authors) != 2 || len(catalog.Collections) != 3 {
+			t.Fatalf("%s: unexpected catalog %+v", path, catalog)
+		}
+
+		// The apps described once per platform are merged
+		app, err := store.GetApp("59a3c1d2e4b0a1f2c3d4e5f6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		platforms := make([]string, 0)
+		for _, platform := range *app.Assets.Screenshots {
+			platforms = append(platforms, platform.Platform)
+		}
+		if !reflect.DeepEqual(platforms, []string{"aplite", "basalt"}) || app.Author.Name != "Marina Tides" || app.Assets.Banner != "https://assets.getpebble.com/banners/tide-clock.png" {
+			t.Errorf("%s: unexpected app %+v", path, app)
+		}
+
+		// Every field of the original records is kept
+		if app.Uuid != "6d3c1b0a-8f7e-4d2c-9b1a-0e5f4d3c2b1a" || app.AppInfo.JsVersion != -1 || len(app.Assets.Icons) != 2 || len(app.Assets.ListImages) != 2 || app.Assets.Banners[0]["720x320"] == "" {
+			t.Errorf("%s: details are missing from %+v", path, app)
+		}
+		if !reflect.DeepEqual(app.AppInfo.Capabilities, []string{"location", "health"}) || app.AppInfo.Companions.Ios != nil || app.AppInfo.Companions.Android.PebblekitVersion != "3" {
+			t.Errorf("%s: unexpected capabilities and companions %+v", path, app.AppInfo)
+		}
+		if !reflect.DeepEqual(app.SupportedPlatforms, []string{"ios", "android", "aplite", "basalt", "diorite", "emery"}) {
+			t.Errorf("%s: unexpected platforms %v", path, app.SupportedPlatforms)
+		}
+		if len(app.Assets.HardwareImages) != 2 || len(app.Assets.HardwareImages["aplite"].Icons) != 2 || len(app.Assets.HardwareImages["basalt"].Banners) != 1 {
+			t.Errorf("%s: unexpected hardware images %+v", path, app.Assets.HardwareImages)
+		}
+		sources, err := store.GetAppSources(app.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sources) != 2 || !strings.Contains(string(sources[0]), `"developer_id": "53a9e2f1c4b0a1e2f3000011"`) || !strings.Contains(string(sources[1]), `"add_heart"`) {
+			t.Errorf("%s: unexpected sources %s", path, sources)
+		}
+
+		versions, err := store.GetAppVersions("59a3c1d2e4b0a1f2c3d4e5f6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || versions[0].Number != "1.1" {
+			t.Errorf("%s: unexpected versions %+v", path, versions)
+		}
+	}
+
+}
+
+func TestImportArchiveReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebblestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tideClock, err := ioutil.ReadFile(filepath.Join(testArchive, "apps", "59a3c1d2e4b0a1f2c3d4e5f6-basalt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a-tide-clock.json":    string(tideClock),
+		"b-duplicate.json":     string(tideClock),
+		"c-broken.json":        `{"data": [{"id": "abc", `,
+		"d-empty.json":         `{"data": []}`,
+		"e-two.json":           `{"data": [{"id": "a"}, {"id": "b"}]}`,
+		"f-no-id.json":         `{"data": [{"title": "No ID"}]}`,
+		"g-no-category.json":   `{"data": [{"id": "5c00000000000000000000aa", "title": "Lonely", "author": "Nobody", "type": "watchapp", "screenshot_images": [{"144x168": "s.png"}], "screenshot_hardware": "basalt"}]}`,
+		"h-no-screenshot.json": `{"data": [{"id": "5c00000000000000000000bb", "title": "Blank", "author": "Nobody", "type": "watchface", "category_id": "faces", "category_name": "Faces", "screenshot_images": "", "screenshot_hardware": "chalk"}]}`,
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := db.NewMemoryStore()
+	report, err := ImportArchive(store, dir, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ImportReport{
+		Files:    8,
+		Imported: 3,
+		Skipped:  5,
+		Warned:   2,
+		Problems: []ImportFileReport{
+			{"b-duplicate.json", "59a3c1d2e4b0a1f2c3d4e5f6", true, []string{"Duplicate ID, 59a3c1d2e4b0a1f2c3d4e5f6 was already imported from a-tide-clock.json for basalt"}},
+			{"c-broken.json", "", true, []string{"Invalid JSON: unexpected end of JSON input"}},
+			{"d-empty.json", "", true, []string{"Expected a single app, found 0"}},
+			{"e-two.json", "", true, []string{"Expected a single app, found 2"}},
+			{"f-no-id.json", "", true, []string{"Missing app ID"}},
+			{"g-no-category.json", "5c00000000000000000000aa", false, []string{"Missing category, the app is in no collection"}},
+			{"h-no-screenshot.json", "5c00000000000000000000bb", false, []string{"No screenshot"}},
+		},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+
+	app, err := store.GetApp("5c00000000000000000000aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(app.AppInfo.Tags) != 0 {
+		t.Errorf("expected the app without category to be in no collection, got %v", app.AppInfo.Tags)
+	}
+}
+
+func TestImportArchiveMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebblestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The basalt record of Tide Clock also supports chalk, has its own icon
+	// and a newer version, but disagrees on the hearts and the first release
+	aplite, err := ioutil.ReadFile(filepath.Join(testArchive, "apps", "59a3c1d2e4b0a1f2c3d4e5f6-aplite.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	basalt, err := ioutil.ReadFile(filepath.Join(testArchive, "apps", "59a3c1d2e4b0a1f2c3d4e5f6-basalt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a-aplite.json": string(aplite),
+		"b-basalt.json": strings.NewReplacer(
+			`"supported": false`, `"supported": true`,
+			"tide-clock-48.png", "tide-clock-basalt-48.png",
+			`"hearts": 154`, `"hearts": 160`,
+			`"changelog": [`, `"changelog": [{"version": "1.2", "published_date": "2016-07-01T12:00:00.000Z", "release_notes": "Tides on chalk."},`,
+			"Initial release.", "First release.",
+		).Replace(string(basalt)),
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := db.NewMemoryStore()
+	report, err := ImportArchive(store, dir, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || report.Warned != 1 || len(report.Problems) != 1 || report.Problems[0].File != "b-basalt.json" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	reasons := report.Problems[0].Reasons
+	if len(reasons) != 2 || reasons[0] != "Conflicting thumbs_up, kept 154 from a-aplite.json instead of 160" || !strings.HasPrefix(reasons[1], "Conflicting changelog 1.0, kept ") {
+		t.Errorf("unexpected conflicts %q", reasons)
+	}
+
+	app, err := store.GetApp("59a3c1d2e4b0a1f2c3d4e5f6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(app.SupportedPlatforms, []string{"ios", "android", "aplite", "basalt", "chalk", "diorite", "emery"}) || app.ThumbsUp != 154 {
+		t.Errorf("unexpected app %+v", app)
+	}
+	if app.Assets.Icon != "https://assets.getpebble.com/icons/tide-clock-48.png" || app.Assets.HardwareImages["aplite"].Icons["48x48"] != app.Assets.Icon || app.Assets.HardwareImages["basalt"].Icons["48x48"] != "https://assets.getpebble.com/icons/tide-clock-basalt-48.png" {
+		t.Errorf("unexpected icons %+v", app.Assets)
+	}
+
+	versions, err := store.GetAppVersions(app.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := make([]string, 0)
+	for _, version := range versions {
+		numbers = append(numbers, version.Number)
+	}
+	if !reflect.DeepEqual(numbers, []string{"1.2", "1.1", "1.0"}) || versions[2].Description != "Initial release." {
+		t.Errorf("unexpected versions %+v", versions)
+	}
+}
+
+func TestImportArchiveAuthorIds(t *testing.T) {
+	// A catalog imported before developer IDs were tracked, where the author
+	// of Transit Times had another name
+	store := db.NewMemoryStore()
+	err := store.ImportCatalog(
+		[]db.RebbleAuthor{{Id: 1, Name: "Marina Tides"}, {Id: 5, Name: "Lee C."}},
+		nil,
+		[]db.RebbleApplication{{Id: "5b1f2e3d4c5b6a7988776655", Author: db.RebbleAuthor{Id: 5}, Type: "watchapp"}},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	for i := 0; i < 2; i++ {
+		_, err = ImportArchive(store, testArchive, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		catalog, err := store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []db.RebbleAuthor{
+			{Id: 1, Name: "Marina Tides", DeveloperId: "53a9e2f1c4b0a1e2f3000011"},
+			{Id: 6, Name: "Lee Commuter", DeveloperId: "54b0f3a2d5c1b2f3a4000022"},
+		}
+		if !reflect.DeepEqual(catalog.Authors, expected) {
+			t.Errorf("import %d: expected authors %+v, got %+v", i+1, expected, catalog.Authors)
+		}
+	}
+
+	r := Handlers(&HandlerContext{Database: store})
+	req := httptest.NewRequest("GET", "/dev/author/id/5", nil)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusMovedPermanently || res.Header().Get("Location") != "/dev/author/id/6" {
+		t.Errorf("expected a redirect to /dev/author/id/6, got %d %q", res.Code, res.Header().Get("Location"))
+	}
+}
+
+func TestRebuildCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebblestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New(ioutil.Discard, "", 0)
+
+	sqlite, err := db.Open(filepath.Join(dir, "rebuild.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlite.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]db.Store{"memory": db.NewMemoryStore(), "sqlite": sqlite} {
+		ctx := &HandlerContext{Database: store}
+		err = store.LogSearch(db.SearchLogEntry{Query: "tide", Time: time.Now()}, db.SearchLogOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The catalog is imported into a shadow, then swapped in
+		report, err := rebuildCatalog(ctx, testArchive, noProgress{}, logger)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if report.Imported != 3 || ctx.Store() == store {
+			t.Errorf("%s: expected the rebuilt store to replace the store, got %+v", name, report)
+		}
+		_, err = ctx.Store().GetApp("59a3c1d2e4b0a1f2c3d4e5f6")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		_, err = store.GetApp("59a3c1d2e4b0a1f2c3d4e5f6")
+		if err == nil {
+			t.Errorf("%s: expected the previous store to be left as it was", name)
+		}
+
+		// An archive without any app is rejected, the catalog is kept
+		rebuilt := ctx.Store()
+		_, err = rebuildCatalog(ctx, dir, noProgress{}, logger)
+		if err == nil || ctx.Store() != rebuilt {
+			t.Errorf("%s: expected the empty archive to be rejected, got %v", name, err)
+		}
+		ctx.Store().Close()
+	}
+}
+
+// unshadowedStore is a store that can't be shadowed, like a PostgreSQL
+// database
+type unshadowedStore struct {
+	db.Store
+}
+
+func (unshadowedStore) Shadow() (db.Store, error) {
+	return nil, db.ErrNoShadow
+}
+
+func TestRebuildCatalogInPlace(t *testing.T) {
+	store := unshadowedStore{db.NewMemoryStore()}
+	ctx := &HandlerContext{Database: store}
+
+	// The catalog is imported into the store, which is kept
+	report, err := rebuildCatalog(ctx, testArchive, noProgress{}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 3 || ctx.Store() != store {
+		t.Errorf("expected the store to be imported into, got %+v", report)
+	}
+	_, err = store.GetApp("59a3c1d2e4b0a1f2c3d4e5f6")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSwapStore(t *testing.T) {
+	live := db.NewMemoryStore()
+	ctx := &HandlerContext{Database: live}
+	shadow, err := live.Shadow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is only replaced once the requests using it are done
+	ctx.swapLock.RLock()
+	swapped := make(chan error)
+	go func() {
+		swapped <- ctx.swapStore(live, shadow)
+	}()
+	select {
+	case <-swapped:
+		t.Fatal("expected the swap to wait for the request")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if ctx.Store() != live {
+		t.Error("expected the store to be kept during the request")
+	}
+	ctx.swapLock.RUnlock()
+
+	err = <-swapped
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Store() != shadow {
+		t.Error("expected the store to be replaced")
+	}
+}
+
+func TestCatalogStats(t *testing.T) {
+	store := db.NewMemoryStore()
+	_, err := ImportArchive(store, testArchive, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetCatalogStats(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CatalogStats{
+		Apps:        3,
+		Watchapps:   2,
+		Watchfaces:  1,
+		Authors:     2,
+		Collections: 3,
+		Versions:    3,
+		Screenshots: 4,
+		Platforms:   map[string]int{"ios": 3, "android": 2, "aplite": 2, "basalt": 3, "chalk": 1, "diorite": 1, "emery": 1},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestCheckCatalog(t *testing.T) {
+	store := db.NewMemoryStore()
+	err := db.LoadFixture(store, "db/testdata/catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := CheckCatalog(store, "PebbleImages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problem in the fixture, got %v", problems)
+	}
+
+	err = store.ImportCatalog(
+		[]db.RebbleAuthor{{Id: 10, Name: "Ada Watchmaker"}},
+		[]db.RebbleCollection{{Id: "empty", Name: "Empty", Color: "000000"}},
+		[]db.RebbleApplication{{
+			Id:     "broken",
+			Author: db.RebbleAuthor{Id: 10},
+			Type:   "watchapp",
+			Assets: db.RebbleAssets{Screenshots: &[]db.RebbleScreenshotsPlatform{
+				{Platform: "basalt", Screenshots: []string{"/images/00000000-0000-0000-0000-000000000000"}},
+			}},
+		}},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = CheckCatalog(store, "PebbleImages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`Authors 1 and 10 have the same name "Ada Watchmaker"`,
+		"App broken has no title",
+		"App broken supports no platform",
+		"App broken is in no collection",
+		"App broken has a missing screenshot /images/00000000-0000-0000-0000-000000000000",
+		"Collection empty (Empty) has no app",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected problems %q, got %q", expected, problems)
+	}
+
+	// Collections are checked by their apps, not by the tags of the apps
+	err = store.AddCollectionApps("empty", []string{"broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = CheckCatalog(store, "PebbleImages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(problems, []string{expected[0], expected[1], expected[2], expected[4]}) {
+		t.Errorf("expected the collection and its app to be fine, got %q", problems)
+	}
+}
@@ -0,0 +1,412 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// The Pebble mobile app searches the store through Algolia. These handlers
+// implement the part of the Algolia REST API it uses (searching one or
+// several indexes, with pagination and tag filters) on top of our catalog, and
+// BootHandler gives the app our application ID and index. The app derives the
+// Algolia hosts from the application ID (ALGOLIA_APP_ID-dsn.algolia.net), so
+// they must be routed to this server, like the boot URL.
+
+const (
+	ALGOLIA_APP_ID  string = "rebble"
+	ALGOLIA_API_KEY string = "public"
+	ALGOLIA_INDEX   string = "rebble-appstore"
+)
+
+// AlgoliaHit is an app in the results of an Algolia query. It has the fields
+// of the records of the Pebble App Store index.
+type AlgoliaHit struct {
+	ObjectId         string   `json:"objectID"`
+	Id               string   `json:"id"`
+	Title            string   `json:"title"`
+	Author           string   `json:"author"`
+	Description      string   `json:"description"`
+	Type             string   `json:"type"`
+	Category         string   `json:"category"`
+	Hearts           int      `json:"hearts"`
+	IconImage        string   `json:"icon_image"`
+	ListImage        string   `json:"list_image"`
+	ScreenshotImages []string `json:"screenshot_images"`
+	Tags             []string `json:"_tags"`
+}
+
+// AlgoliaResult is the answer to an Algolia query
+type AlgoliaResult struct {
+	Hits             []AlgoliaHit `json:"hits"`
+	NbHits           int          `json:"nbHits"`
+	Page             int          `json:"page"`
+	NbPages          int          `json:"nbPages"`
+	HitsPerPage      int          `json:"hitsPerPage"`
+	ProcessingTimeMS int          `json:"processingTimeMS"`
+	Query            string       `json:"query"`
+	Params           string       `json:"params"`
+	Index            string       `json:"index,omitempty"`
+}
+
+// AlgoliaResults is the answer to several Algolia queries
+type AlgoliaResults struct {
+	Results []AlgoliaResult `json:"results"`
+}
+
+// AlgoliaError is the body of an Algolia error response
+type AlgoliaError struct {
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// algoliaParams reads the parameters of a query from a request body. They are
+// either URL-encoded in `params`, or given as JSON fields (or both).
+func algoliaParams(body map[string]interface{}) (url.Values, error) {
+	params := url.Values{}
+	for key, value := range body {
+		switch v := value.(type) {
+		case string:
+			if key == "params" {
+				parsed, err := url.ParseQuery(v)
+				if err != nil {
+					return nil, errors.New("Invalid params: " + err.Error())
+				}
+				for k, values := range parsed {
+					params[k] = append(params[k], values...)
+				}
+			} else {
+				params.Add(key, v)
+			}
+		case float64:
+			params.Add(key, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			params.Add(key, string(data))
+		}
+	}
+
+	return params, nil
+}
+
+// algoliaTagFilters parses the tagFilters parameter, either a JSON array
+// (`["watchface",["basalt"]]`) or a comma-separated list (`watchface,(basalt)`).
+// Tags are types and hardware platforms. Nested arrays or parentheses are
+// groups of tags of which at least one must match, only groups of one tag are
+// supported.
+func algoliaTagFilters(filters string) (db.SearchFilters, error) {
+	var result db.SearchFilters
+
+	filters = strings.TrimSpace(filters)
+	if filters == "" {
+		return result, nil
+	}
+
+	groups := make([][]string, 0)
+	if strings.HasPrefix(filters, "[") {
+		var list []interface{}
+		err := json.Unmarshal([]byte(filters), &list)
+		if err != nil {
+			return result, errors.New("Invalid tagFilters: " + err.Error())
+		}
+
+		for _, item := range list {
+			switch v := item.(type) {
+			case string:
+				groups = append(groups, []string{v})
+			case []interface{}:
+				group := make([]string, 0)
+				for _, tag := range v {
+					s, ok := tag.(string)
+					if !ok {
+						return result, errors.New("Invalid tagFilters: tags must be strings")
+					}
+					group = append(group, s)
+				}
+				groups = append(groups, group)
+			default:
+				return result, errors.New("Invalid tagFilters: tags must be strings")
+			}
+		}
+	} else {
+		for len(filters) > 0 {
+			var group string
+			if filters[0] == '(' {
+				end := strings.Index(filters, ")")
+				if end < 0 {
+					return result, errors.New("Invalid tagFilters: missing ')'")
+				}
+				group, filters = filters[1:end], filters[end+1:]
+			} else {
+				end := strings.Index(filters, ",")
+				if end < 0 {
+					end = len(filters)
+				}
+				group, filters = filters[:end], filters[end:]
+			}
+			groups = append(groups, strings.Split(group, ","))
+			filters = strings.TrimPrefix(strings.TrimSpace(filters), ",")
+		}
+	}
+
+	for _, group := range groups {
+		if len(group) != 1 {
+			return result, errors.New("Unsupported tagFilters: only single tags are supported")
+		}
+
+		tag := strings.TrimSpace(group[0])
+		switch tag {
+		case "watchface", "watchapp":
+			if result.Type != "" && result.Type != tag {
+				return result, errors.New("Unsupported tagFilters: multiple types")
+			}
+			result.Type = tag
+		case "aplite", "basalt", "chalk", "diorite":
+			if result.Platform != "" && result.Platform != tag {
+				return result, errors.New("Unsupported tagFilters: multiple platforms")
+			}
+			result.Platform = tag
+		default:
+			return result, errors.New("Unsupported tag '" + tag + "'")
+		}
+	}
+
+	return result, nil
+}
+
+// algoliaHit converts an app of the catalog to an Algolia hit
+func algoliaHit(app db.RebbleApplication, image string) AlgoliaHit {
+	hit := AlgoliaHit{
+		ObjectId:         app.Id,
+		Id:               app.Id,
+		Title:            app.Name,
+		Author:           app.Author.Name,
+		Description:      app.Description,
+		Type:             app.Type,
+		Hearts:           app.ThumbsUp,
+		IconImage:        app.Assets.Icon,
+		ListImage:        image,
+		ScreenshotImages: make([]string, 0),
+		Tags:             append([]string{app.Type}, app.SupportedPlatforms...),
+	}
+	if len(app.AppInfo.Tags) > 0 {
+		hit.Category = app.AppInfo.Tags[0].Name
+	}
+	if app.Assets.Screenshots != nil && len(*app.Assets.Screenshots) > 0 {
+		hit.ScreenshotImages = append(hit.ScreenshotImages, (*app.Assets.Screenshots)[0].Screenshots...)
+	}
+
+	return hit
+}
+
+// algoliaSearch runs an Algolia query on the catalog. The status code is
+// meaningful if there is an error.
+func algoliaSearch(ctx *HandlerContext, params url.Values) (AlgoliaResult, int, error) {
+	start := time.Now()
+
+	for key, values := range params {
+		if len(values) > 1 {
+			return AlgoliaResult{}, http.StatusBadRequest, errors.New("Multiple '" + key + "' parameters are not allowed")
+		}
+	}
+
+	page := 0
+	if p := params.Get("page"); p != "" {
+		var err error
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 0 || page >= maxSearchPage {
+			return AlgoliaResult{}, http.StatusBadRequest, errors.New("Parameter 'page' should be an integer between 0 and " + strconv.Itoa(maxSearchPage-1))
+		}
+	}
+
+	hitsPerPage := 20
+	if h := params.Get("hitsPerPage"); h != "" {
+		var err error
+		hitsPerPage, err = strconv.Atoi(h)
+		if err != nil || hitsPerPage < 1 || hitsPerPage > 50 {
+			return AlgoliaResult{}, http.StatusBadRequest, errors.New("Parameter 'hitsPerPage' should be an integer between 1 and 50")
+		}
+	}
+
+	filters, err := algoliaTagFilters(params.Get("tagFilters"))
+	if err != nil {
+		return AlgoliaResult{}, http.StatusBadRequest, err
+	}
+
+	query := params.Get("query")
+	cards, err := ctx.Store().Search(query, filters, "relevance", page*hitsPerPage, hitsPerPage)
+	if err != nil {
+		return AlgoliaResult{}, http.StatusInternalServerError, err
+	}
+
+	result := AlgoliaResult{
+		Hits:        make([]AlgoliaHit, 0, len(cards.Cards)),
+		NbHits:      cards.Pagination.Total,
+		Page:        page,
+		NbPages:     cards.Pagination.Pages,
+		HitsPerPage: hitsPerPage,
+		Query:       query,
+		Params:      params.Encode(),
+	}
+	ids := make([]string, len(cards.Cards))
+	images := make(map[string]string)
+	for i, card := range cards.Cards {
+		ids[i] = card.Id
+		images[card.Id] = card.ImageUrl
+	}
+	apps, err := ctx.Store().GetApps(ids)
+	if err != nil {
+		return AlgoliaResult{}, http.StatusInternalServerError, err
+	}
+	for _, app := range apps {
+		result.Hits = append(result.Hits, algoliaHit(app, images[app.Id]))
+	}
+	result.ProcessingTimeMS = int(time.Since(start) / time.Millisecond)
+
+	return result, http.StatusOK, nil
+}
+
+// writeAlgolia sends an Algolia response, or an Algolia error if err is not
+// nil
+func writeAlgolia(w http.ResponseWriter, status int, err error, response interface{}) (int, error) {
+	if err != nil {
+		// Algolia clients expect errors in JSON
+		log.Printf("HTTP %d: %q", status, err)
+		response = AlgoliaError{err.Error(), status}
+	}
+
+	data, err := json.MarshalIndent(response, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+
+	return status, nil
+}
+
+// readJSONBody decodes the JSON body of a request, such as an Algolia query
+func readJSONBody(r *http.Request, body interface{}) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, body)
+	if err != nil {
+		return errors.New("Invalid JSON body: " + err.Error())
+	}
+
+	return nil
+}
+
+// AlgoliaQueryHandler searches an index, with the parameters in the URL query
+// (GET) or in the body (POST). The name of the index doesn't matter, all of
+// them are the catalog.
+func AlgoliaQueryHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	params := r.URL.Query()
+	if r.Method == "POST" {
+		var body map[string]interface{}
+		err := readJSONBody(r, &body)
+		if err != nil {
+			return writeAlgolia(w, http.StatusBadRequest, err, nil)
+		}
+
+		params, err = algoliaParams(body)
+		if err != nil {
+			return writeAlgolia(w, http.StatusBadRequest, err, nil)
+		}
+	}
+
+	result, status, err := algoliaSearch(ctx, params)
+	return writeAlgolia(w, status, err, result)
+}
+
+// maxAlgoliaRequests is the number of queries AlgoliaQueriesHandler runs at
+// most at once
+const maxAlgoliaRequests = 50
+
+// AlgoliaQueriesHandler runs several queries at once, up to maxAlgoliaRequests
+func AlgoliaQueriesHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	var body struct {
+		Requests []map[string]interface{} `json:"requests"`
+	}
+	err := readJSONBody(r, &body)
+	if err != nil {
+		return writeAlgolia(w, http.StatusBadRequest, err, nil)
+	}
+	if len(body.Requests) > maxAlgoliaRequests {
+		return writeAlgolia(w, http.StatusBadRequest, fmt.Errorf("Too many requests, at most %d are allowed", maxAlgoliaRequests), nil)
+	}
+
+	results := AlgoliaResults{
+		Results: make([]AlgoliaResult, 0, len(body.Requests)),
+	}
+	for i, request := range body.Requests {
+		index, _ := request["indexName"].(string)
+		delete(request, "indexName")
+		if index == "" {
+			return writeAlgolia(w, http.StatusBadRequest, fmt.Errorf("Missing 'indexName' in request %d", i), nil)
+		}
+
+		params, err := algoliaParams(request)
+		if err != nil {
+			return writeAlgolia(w, http.StatusBadRequest, err, nil)
+		}
+
+		result, status, err := algoliaSearch(ctx, params)
+		if err != nil {
+			return writeAlgolia(w, status, err, nil)
+		}
+		result.Index = index
+		results.Results = append(results.Results, result)
+	}
+
+	return writeAlgolia(w, http.StatusOK, nil, results)
+}
+
+// algoliaConfig rewrites the `algolia` section of the boot config so the
+// Pebble app searches with the handlers above. Only the keys of the upstream
+// section are replaced, no key is added, and the other fields are kept.
+func algoliaConfig(upstream json.RawMessage) (json.RawMessage, error) {
+	if len(upstream) == 0 || string(upstream) == "null" {
+		return upstream, nil
+	}
+	config := make(map[string]interface{})
+	err := json.Unmarshal(upstream, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range map[string]string{
+		"app_id":  ALGOLIA_APP_ID,
+		"api_key": ALGOLIA_API_KEY,
+		"index":   ALGOLIA_INDEX,
+	} {
+		if _, ok := config[key]; ok {
+			config[key] = value
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(data), nil
+}
@@ -0,0 +1,181 @@
+package rebbleHandlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// algoliaFixture is a request the Pebble app sends to Algolia, along with the
+// expected response
+type algoliaFixture struct {
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Body     string          `json:"body,omitempty"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// withoutProcessingTime removes the processing times from an Algolia
+// response, as they change from one run to the other
+func withoutProcessingTime(response interface{}) interface{} {
+	switch v := response.(type) {
+	case map[string]interface{}:
+		delete(v, "processingTimeMS")
+		for key := range v {
+			v[key] = withoutProcessingTime(v[key])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = withoutProcessingTime(v[i])
+		}
+	}
+
+	return response
+}
+
+// TestAlgolia replays the requests of testdata/algolia. The requests were
+// written after the Algolia REST API the Pebble app uses, they are not
+// captures of its traffic. Run the tests with -update to record the
+// responses.
+func TestAlgolia(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("rebbleHandlers", "testdata", "algolia", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No Algolia fixtures")
+	}
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fixture algoliaFixture
+		err = json.Unmarshal(data, &fixture)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		req, err := http.NewRequest(fixture.Method, server.URL+fixture.Path, strings.NewReader(fixture.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Algolia-Application-Id", "7683OW76EQ")
+		req.Header.Set("X-Algolia-API-Key", "252f4938082b8693a8a9fc0157d1d24f")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var actual interface{}
+		err = json.Unmarshal(body, &actual)
+		if err != nil {
+			t.Fatalf("%s: invalid JSON response %s", path, body)
+		}
+		actual = withoutProcessingTime(actual)
+
+		if *update {
+			fixture.Status = res.StatusCode
+			fixture.Response, err = json.Marshal(actual)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buffer bytes.Buffer
+			encoder := json.NewEncoder(&buffer)
+			encoder.SetIndent("", "\t")
+			encoder.SetEscapeHTML(false)
+			err = encoder.Encode(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(path, buffer.Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if res.StatusCode != fixture.Status {
+			t.Errorf("%s: expected %d, got %d", path, fixture.Status, res.StatusCode)
+		}
+		var expected interface{}
+		err = json.Unmarshal(fixture.Response, &expected)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: response does not match, got:\n%s", path, body)
+		}
+	}
+}
+
+func TestAlgoliaConfig(t *testing.T) {
+	upstream := json.RawMessage(`{"api_key": "252f4938082b8693a8a9fc0157d1d24f", "app_id": "7683OW76EQ", "index": "pebble-appstore-production", "timeout": 5}`)
+	config, err := algoliaConfig(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"api_key":"public","app_id":"rebble","index":"rebble-appstore","timeout":5}`
+	if string(config) != expected {
+		t.Fatalf("expected %s, got %s", expected, config)
+	}
+
+	// Keys missing upstream are not added, as the app wouldn't read them
+	config, err = algoliaConfig(json.RawMessage(`{"app_id": "7683OW76EQ"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected = `{"app_id":"rebble"}`; string(config) != expected {
+		t.Fatalf("expected %s, got %s", expected, config)
+	}
+	config, err = algoliaConfig(json.RawMessage("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(config) != "null" {
+		t.Fatalf("expected no section, got %s", config)
+	}
+}
+
+func TestAlgoliaTagFilters(t *testing.T) {
+	tests := []struct {
+		filters  string
+		typ      string
+		platform string
+		valid    bool
+	}{
+		{"", "", "", true},
+		{`["watchface"]`, "watchface", "", true},
+		{`["watchapp",["basalt"]]`, "watchapp", "basalt", true},
+		{"watchface,(chalk)", "watchface", "chalk", true},
+		{"diorite", "", "diorite", true},
+		{"(aplite,basalt)", "", "", false},
+		{"watchface,watchapp", "", "", false},
+		{"android", "", "", false},
+		{"(chalk", "", "", false},
+		{`["watchface"`, "", "", false},
+	}
+
+	for _, test := range tests {
+		filters, err := algoliaTagFilters(test.filters)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.filters, err)
+			continue
+		}
+		if test.valid && (filters.Type != test.typ || filters.Platform != test.platform) {
+			t.Errorf("%q: expected %s/%s, got %s/%s", test.filters, test.typ, test.platform, filters.Type, filters.Platform)
+		}
+	}
+}
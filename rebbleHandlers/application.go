@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 
 	"pebble-dev/rebblestore-api/db"
@@ -15,9 +16,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// PebbleAppList contains a list of PebbleApplication. It matches the format of Pebble API answers.
+// PebbleAppList contains a list of PebbleApplication, as raw JSON so that the
+// original records can be kept. It matches the format of Pebble API answers.
 type PebbleAppList struct {
-	Apps []*PebbleApplication `json:"data"`
+	Apps []json.RawMessage `json:"data"`
 }
 
 // RebbleTagList contains a list of tag. Used by getApi(id)
@@ -30,11 +32,13 @@ type RebbleChangelog struct {
 	Versions []db.RebbleVersion `json:"versions"`
 }
 
-// PebbleApplication is used by the parseApp() function. It matches directly the `{id}.json` format.
+// PebbleApplication is used by the decodeApp() and parseApp() functions. It matches directly the `{id}.json` format.
 type PebbleApplication struct {
 	Id                 string                   `json:"id"`
+	Uuid               string                   `json:"uuid"`
 	Name               string                   `json:"title"`
 	Author             string                   `json:"author"`
+	DeveloperId        string                   `json:"developer_id"`
 	CategoryId         string                   `json:"category_id"`
 	CategoryName       string                   `json:"category_name"`
 	CategoryColor      string                   `json:"category_color"`
@@ -45,11 +49,14 @@ type PebbleApplication struct {
 	Source             string                   `json:"source"`
 	Screenshots        PebbleScreenshotImages   `json:"screenshot_images"`
 	Icons              PebbleIcons              `json:"icon_image"`
+	ListImages         PebbleIcons              `json:"list_image"`
 	ScreenshotHardware string                   `json:"screenshot_hardware"`
 	HeaderImages       PebbleHeaderImages       `json:"header_images"`
 	Hearts             int                      `json:"hearts"`
 	Type               string                   `json:"type"`
 	Compatibility      PebbleCompatibility      `json:"compatibility"`
+	Capabilities       []string                 `json:"capabilities"`
+	Companions         PebbleCompanions         `json:"companions"`
 	Changelog          []PebbleVersion          `json:"changelog"`
 }
 
@@ -59,6 +66,9 @@ type PebbleApplicationRelease struct {
 	PbwUrl    string      `json:"pbw_file"`
 	Published db.JSONTime `json:"published_date"`
 	Version   string      `json:"version"`
+	Notes     string      `json:"release_notes"`
+	JsMd5     string      `json:"js_md5"`
+	JsVersion int         `json:"js_version"`
 }
 
 // PebbleVersion describes a version change
@@ -76,6 +86,7 @@ type PebbleCompatibility struct {
 	Basalt  PebbleCompatibilityBool `json:"basalt"`
 	Chalk   PebbleCompatibilityBool `json:"chalk"`
 	Diorite PebbleCompatibilityBool `json:"diorite"`
+	Emery   PebbleCompatibilityBool `json:"emery"`
 }
 
 // PebbleCompatibilityBool describes the contents of a `compatibility` tag of a pebble JSON
@@ -83,16 +94,36 @@ type PebbleCompatibilityBool struct {
 	Supported bool `json:"supported"`
 }
 
+// PebbleCompanions describes the `companions` tag of a pebble JSON, the phone
+// apps the app works with (null if there are none)
+type PebbleCompanions struct {
+	Ios     *PebbleCompanion `json:"ios"`
+	Android *PebbleCompanion `json:"android"`
+}
+
+// PebbleCompanion describes a phone app the app works with
+type PebbleCompanion struct {
+	Id               string       `json:"id"`
+	Name             string       `json:"name"`
+	Icon             string       `json:"icon"`
+	Url              string       `json:"url"`
+	Required         bool         `json:"required"`
+	PebblekitVersion PebbleString `json:"pebblekit_version"`
+}
+
+// PebbleString is a generic type to allow mixed contents (string or number)
+type PebbleString string
+
 // PebbleHeaderImages is a generic type to allow mixed contents (empty string or array of header images)
 type PebbleHeaderImages []PebbleHeaderImage
 
 // PebbleScreenshotImages is a generic type to allow mixed contents (empty string or array of screenshots)
 type PebbleScreenshotImages []PebbleScreenshotImage
 
-// PebbleHeaderImage is used by PebbleHeaderImages to allow mixed contents
-type PebbleHeaderImage struct {
-	Orig string `json:"orig"`
-}
+// PebbleHeaderImage is used by PebbleHeaderImages to allow mixed contents. It
+// contains the header image at varying resolutions (orig being the original
+// one).
+type PebbleHeaderImage map[string]string
 
 // PebbleScreenshotImage is used by PebbleHeaderImages to allow mixed contents
 type PebbleScreenshotImage map[string]string
@@ -120,6 +151,7 @@ func (psi *PebbleScreenshotImages) UnmarshalJSON(b []byte) error {
 	return json.Unmarshal(b, (*([]PebbleScreenshotImage))(psi))
 }
 
+// UnmarshalJSON for PebbleIcons allows for mixed content
 func (pi *PebbleIcons) UnmarshalJSON(b []byte) error {
 	if len(b) == 0 || b[0] == '"' {
 		*pi = make(map[string]string, 0)
@@ -129,107 +161,300 @@ func (pi *PebbleIcons) UnmarshalJSON(b []byte) error {
 	return json.Unmarshal(b, (*(map[string]string))(pi))
 }
 
-func parseApp(path string, authors *map[string]int, lastAuthorId *int, collections *map[string]db.RebbleCollection) (*db.RebbleApplication, *[]db.RebbleVersion, error) {
-	f, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, nil, err
+// UnmarshalJSON for PebbleString allows for mixed content
+func (ps *PebbleString) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '"' && string(b) != "null" {
+		*ps = PebbleString(b)
+		return nil
 	}
+
+	return json.Unmarshal(b, (*string)(ps))
+}
+
+// decodeApp decodes the app described by a `{id}.json` file of the archive,
+// and returns it along with its original record
+func decodeApp(f []byte) (*PebbleApplication, json.RawMessage, error) {
 	var data = PebbleAppList{}
 
-	err = json.Unmarshal(f, &data)
+	err := json.Unmarshal(f, &data)
 	if err != nil {
-		log.Print("Error parsing app JSON: " + path)
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("Invalid JSON: %v", err)
 	}
 	if len(data.Apps) != 1 {
-		//log.Println(data)
-		//log.Println(data.Data)
-		panic("Data is not the size of 1")
+		return nil, nil, fmt.Errorf("Expected a single app, found %d", len(data.Apps))
 	}
 
-	// Create author if it doesn't exist
-	if _, ok := (*authors)[data.Apps[0].Author]; !ok {
-		(*authors)[data.Apps[0].Author] = *lastAuthorId + 1
-		*lastAuthorId = *lastAuthorId + 1
+	var app *PebbleApplication
+	err = json.Unmarshal(data.Apps[0], &app)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	if app == nil || app.Id == "" {
+		return nil, nil, errors.New("Missing app ID")
 	}
 
-	// Create collection if it doesn't exist
-	if _, ok := (*collections)[data.Apps[0].CategoryId]; !ok {
-		(*collections)[data.Apps[0].CategoryId] = db.RebbleCollection{
-			Id:    data.Apps[0].CategoryId,
-			Name:  data.Apps[0].CategoryName,
-			Color: data.Apps[0].CategoryColor,
-		}
+	return app, data.Apps[0], nil
+}
+
+// companion converts a companion app of the archive, if there is one
+func (pc *PebbleCompanion) companion() *db.RebbleCompanion {
+	if pc == nil {
+		return nil
+	}
+
+	return &db.RebbleCompanion{
+		Id:               pc.Id,
+		Name:             pc.Name,
+		Icon:             pc.Icon,
+		Url:              pc.Url,
+		Required:         pc.Required,
+		PebblekitVersion: string(pc.PebblekitVersion),
+	}
+}
+
+// appWarnings lists what is missing from an app for it to be displayed properly
+func appWarnings(app *PebbleApplication) []string {
+	warnings := make([]string, 0)
+	if app.CategoryId == "" {
+		warnings = append(warnings, "Missing category, the app is in no collection")
+	}
+	if len(app.Screenshots) == 0 {
+		warnings = append(warnings, "No screenshot")
+	}
+
+	return warnings
+}
+
+// archiveAuthors gives their ID to the authors of the archive. Authors are
+// keyed on their developer ID, and keep the ID given by the previous imports.
+type archiveAuthors struct {
+	known db.AuthorIds
+	// authors are indexed by developer ID
+	authors map[string]db.RebbleAuthor
+}
+
+// newArchiveAuthors creates an archiveAuthors that keeps the known IDs
+func newArchiveAuthors(known db.AuthorIds) *archiveAuthors {
+	return &archiveAuthors{known, make(map[string]db.RebbleAuthor)}
+}
+
+// author returns the author of an app, giving it an ID if it doesn't have one
+// yet
+func (a *archiveAuthors) author(pebbleApp *PebbleApplication) db.RebbleAuthor {
+	key := pebbleApp.DeveloperId
+	if key == "" {
+		// Without a developer ID, authors can only be told apart by name
+		key = "name:" + pebbleApp.Author
+	}
+	if author, ok := a.authors[key]; ok {
+		return author
+	}
+
+	author := db.RebbleAuthor{Name: pebbleApp.Author, DeveloperId: pebbleApp.DeveloperId}
+	if id, ok := a.known.Developers[pebbleApp.DeveloperId]; ok && pebbleApp.DeveloperId != "" {
+		author.Id = id
+	} else if id, ok := a.known.Names[pebbleApp.Author]; ok {
+		// Authors imported before developer IDs were tracked keep their
+		// ID, the first developer with their name takes it
+		author.Id = id
+		delete(a.known.Names, pebbleApp.Author)
+	} else {
+		a.known.Last++
+		author.Id = a.known.Last
 	}
+	a.authors[key] = author
+
+	return author
+}
 
+// parseApp converts an app of the archive to a RebbleApplication, creating its
+// author and collection if they don't exist yet
+func parseApp(pebbleApp *PebbleApplication, authors *archiveAuthors, collections *map[string]db.RebbleCollection) (*db.RebbleApplication, *[]db.RebbleVersion) {
 	app := db.RebbleApplication{}
-	app.AppInfo.Tags = make([]db.RebbleCollection, 1)
+	app.AppInfo.Tags = make([]db.RebbleCollection, 0, 1)
 	screenshots := make(([]db.RebbleScreenshotsPlatform), 0)
 	app.Assets.Screenshots = &screenshots
 
+	// Create collection if it doesn't exist
+	if pebbleApp.CategoryId != "" {
+		if _, ok := (*collections)[pebbleApp.CategoryId]; !ok {
+			(*collections)[pebbleApp.CategoryId] = db.RebbleCollection{
+				Id:    pebbleApp.CategoryId,
+				Name:  pebbleApp.CategoryName,
+				Color: pebbleApp.CategoryColor,
+			}
+		}
+		app.AppInfo.Tags = append(app.AppInfo.Tags, (*collections)[pebbleApp.CategoryId])
+	}
+
 	supportedPlatforms := make([]string, 0)
-	if data.Apps[0].Compatibility.Ios.Supported {
+	if pebbleApp.Compatibility.Ios.Supported {
 		supportedPlatforms = append(supportedPlatforms, "ios")
 	}
-	if data.Apps[0].Compatibility.Android.Supported {
+	if pebbleApp.Compatibility.Android.Supported {
 		supportedPlatforms = append(supportedPlatforms, "android")
 	}
-	if data.Apps[0].Compatibility.Aplite.Supported {
+	if pebbleApp.Compatibility.Aplite.Supported {
 		supportedPlatforms = append(supportedPlatforms, "aplite")
 	}
-	if data.Apps[0].Compatibility.Basalt.Supported {
+	if pebbleApp.Compatibility.Basalt.Supported {
 		supportedPlatforms = append(supportedPlatforms, "basalt")
 	}
-	if data.Apps[0].Compatibility.Chalk.Supported {
+	if pebbleApp.Compatibility.Chalk.Supported {
 		supportedPlatforms = append(supportedPlatforms, "chalk")
 	}
-	if data.Apps[0].Compatibility.Diorite.Supported {
+	if pebbleApp.Compatibility.Diorite.Supported {
 		supportedPlatforms = append(supportedPlatforms, "diorite")
 	}
+	if pebbleApp.Compatibility.Emery.Supported {
+		supportedPlatforms = append(supportedPlatforms, "emery")
+	}
 
-	app.Id = data.Apps[0].Id
-	app.Name = data.Apps[0].Name
-	app.AppInfo.Tags[0].Id = data.Apps[0].CategoryId
-	app.AppInfo.Tags[0].Name = data.Apps[0].CategoryName
-	app.AppInfo.Tags[0].Color = data.Apps[0].CategoryColor
-	app.Published = data.Apps[0].Published
-	app.Description = data.Apps[0].Description
-	app.ThumbsUp = data.Apps[0].Hearts
-	app.Type = data.Apps[0].Type
+	app.Id = pebbleApp.Id
+	app.Uuid = pebbleApp.Uuid
+	app.Name = pebbleApp.Name
+	app.Published = pebbleApp.Published
+	app.Description = pebbleApp.Description
+	app.ThumbsUp = pebbleApp.Hearts
+	app.Type = pebbleApp.Type
 	app.SupportedPlatforms = supportedPlatforms
-	app.Author = db.RebbleAuthor{(*authors)[data.Apps[0].Author], data.Apps[0].Author}
-	app.AppInfo.PbwUrl = data.Apps[0].Release.PbwUrl
+	app.Author = authors.author(pebbleApp)
+	app.AppInfo.PbwUrl = pebbleApp.Release.PbwUrl
 	app.AppInfo.RebbleReady = false
-	app.AppInfo.Updated = data.Apps[0].Release.Published
-	app.AppInfo.Version = data.Apps[0].Release.Version
+	app.AppInfo.Updated = pebbleApp.Release.Published
+	app.AppInfo.Version = pebbleApp.Release.Version
+	app.AppInfo.ReleaseId = pebbleApp.Release.Id
+	app.AppInfo.ReleaseNotes = pebbleApp.Release.Notes
+	app.AppInfo.JsMd5 = pebbleApp.Release.JsMd5
+	app.AppInfo.JsVersion = pebbleApp.Release.JsVersion
+	app.AppInfo.Capabilities = make([]string, 0, len(pebbleApp.Capabilities))
+	app.AppInfo.Capabilities = append(app.AppInfo.Capabilities, pebbleApp.Capabilities...)
+	app.AppInfo.Companions.Ios = pebbleApp.Companions.Ios.companion()
+	app.AppInfo.Companions.Android = pebbleApp.Companions.Android.companion()
 	app.AppInfo.SupportUrl = ""
-	app.AppInfo.AuthorUrl = data.Apps[0].Website
-	app.AppInfo.SourceUrl = data.Apps[0].Source
-	if len(data.Apps[0].HeaderImages) > 0 {
-		app.Assets.Banner = data.Apps[0].HeaderImages[0].Orig
+	app.AppInfo.AuthorUrl = pebbleApp.Website
+	app.AppInfo.SourceUrl = pebbleApp.Source
+	if len(pebbleApp.HeaderImages) > 0 {
+		app.Assets.Banner = pebbleApp.HeaderImages[0]["orig"]
 	} else {
 		app.Assets.Banner = ""
 	}
-	if icon, ok := data.Apps[0].Icons["48x48"]; ok {
+	if icon, ok := pebbleApp.Icons["48x48"]; ok {
 		app.Assets.Icon = icon
 	}
-	screenshots = append(*app.Assets.Screenshots, db.RebbleScreenshotsPlatform{data.Apps[0].ScreenshotHardware, make([]string, 0)})
+	app.Assets.Banners = make([]map[string]string, 0, len(pebbleApp.HeaderImages))
+	for _, banner := range pebbleApp.HeaderImages {
+		app.Assets.Banners = append(app.Assets.Banners, banner)
+	}
+	app.Assets.Icons = make(map[string]string)
+	for size, icon := range pebbleApp.Icons {
+		app.Assets.Icons[size] = icon
+	}
+	app.Assets.ListImages = make(map[string]string)
+	for size, image := range pebbleApp.ListImages {
+		app.Assets.ListImages[size] = image
+	}
+	app.Assets.HardwareImages = make(map[string]db.RebbleHardwareImages)
+	if pebbleApp.ScreenshotHardware != "" {
+		images := db.RebbleHardwareImages{
+			Icons:   make(map[string]string),
+			Banners: make([]map[string]string, 0, len(pebbleApp.HeaderImages)),
+		}
+		for size, icon := range pebbleApp.Icons {
+			images.Icons[size] = icon
+		}
+		for _, banner := range pebbleApp.HeaderImages {
+			images.Banners = append(images.Banners, banner)
+		}
+		app.Assets.HardwareImages[pebbleApp.ScreenshotHardware] = images
+	}
+	screenshots = append(*app.Assets.Screenshots, db.RebbleScreenshotsPlatform{Platform: pebbleApp.ScreenshotHardware, Screenshots: make([]string, 0)})
 	app.Assets.Screenshots = &screenshots
-	for _, screenshot := range data.Apps[0].Screenshots {
+	for _, screenshot := range pebbleApp.Screenshots {
 		for _, s := range screenshot {
 			(*app.Assets.Screenshots)[0].Screenshots = append((*app.Assets.Screenshots)[0].Screenshots, s)
 		}
 	}
 	app.DoomsdayBackup = false
 
-	versions := make([]db.RebbleVersion, len(data.Apps[0].Changelog))
-	for i, pv := range data.Apps[0].Changelog {
+	versions := make([]db.RebbleVersion, len(pebbleApp.Changelog))
+	for i, pv := range pebbleApp.Changelog {
 		versions[i].Number = pv.Version
 		versions[i].Description = pv.Notes
 		versions[i].ReleaseDate = pv.Published
 	}
 
-	return &app, &versions, nil
+	return &app, &versions
+}
+
+// platformOrder is the order in which the supported platforms of an app are
+// listed
+var platformOrder = []string{"ios", "android", "aplite", "basalt", "chalk", "diorite", "emery"}
+
+// scalarFields are the fields of an app that should be the same in all of its
+// records, they keep the value of the first record
+var scalarFields = appFields("name", "uuid", "author_id", "description", "thumbs_up", "type", "published_date", "tags", "author_url", "source_url",
+	"version", "updated", "pbw_url", "release_id", "release_notes", "js_md5", "js_version")
+
+// appFields returns the fields of an app with the given names
+func appFields(names ...string) []appField {
+	fields := make([]appField, 0, len(names))
+	for _, name := range names {
+		for _, field := range append(append(metadataFields, releaseFields...), thumbsUpField) {
+			if field.name == name {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	return fields
+}
+
+// mergeApp merges record, another hardware record of app, into app (with
+// versions, the changelog of app): the screenshots, icons and banners of its
+// platform are added, the supported platforms and changelogs are united, and
+// the other fields are left as they are. It returns the merged changelog, and
+// the fields whose value differs in record, changelog entries included.
+func mergeApp(app *db.RebbleApplication, versions []db.RebbleVersion, record *db.RebbleApplication, recordVersions []db.RebbleVersion) ([]db.RebbleVersion, []FieldDiff) {
+	*app.Assets.Screenshots = append(*app.Assets.Screenshots, (*record.Assets.Screenshots)...)
+	for platform, images := range record.Assets.HardwareImages {
+		app.Assets.HardwareImages[platform] = images
+	}
+
+	supported := make([]string, 0, len(platformOrder))
+	for _, platform := range platformOrder {
+		if in_array(platform, app.SupportedPlatforms) || in_array(platform, record.SupportedPlatforms) {
+			supported = append(supported, platform)
+		}
+	}
+	app.SupportedPlatforms = supported
+
+	conflicts := changedFields(scalarFields, app, record)
+	added := false
+	for _, version := range recordVersions {
+		found := false
+		for _, known := range versions {
+			if known.Number != version.Number {
+				continue
+			}
+			found = true
+			if known.Description != version.Description || !known.ReleaseDate.Equal(version.ReleaseDate.Time) {
+				conflicts = append(conflicts, FieldDiff{"changelog " + version.Number, known, version})
+			}
+		}
+		if !found {
+			versions = append(versions, version)
+			added = true
+		}
+	}
+	// The changelogs of the archive list the newest version first
+	if added {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].ReleaseDate.After(versions[j].ReleaseDate.Time)
+		})
+	}
+
+	return versions, conflicts
 }
 
 func RecurseFolder(w http.ResponseWriter, path string, f os.FileInfo, lvl int) {
@@ -306,7 +531,7 @@ func AppsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (i
 		sortby = "recent"
 	}
 
-	apps, err := ctx.Database.GetAllApps(sortby, ascending, (page-1)*limit, limit)
+	apps, err := ctx.Store().GetAllApps(sortby, ascending, (page-1)*limit, limit)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -323,7 +548,7 @@ func AppsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (i
 
 // AppHandler returns a particular application from the backend DB as JSON
 func AppHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	app, err := ctx.Database.GetApp(mux.Vars(r)["id"])
+	app, err := ctx.Store().GetApp(mux.Vars(r)["id"])
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -341,7 +566,7 @@ func AppHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (in
 
 // TagsHandler returns the list of tags of a particular appliction as JSON
 func TagsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	collections, err := ctx.Database.GetAppTags(mux.Vars(r)["id"])
+	collections, err := ctx.Store().GetAppTags(mux.Vars(r)["id"])
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -364,7 +589,7 @@ func TagsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (i
 
 // VersionsHandler returns the server version
 func VersionsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	versions, err := ctx.Database.GetAppVersions(mux.Vars(r)["id"])
+	versions, err := ctx.Store().GetAppVersions(mux.Vars(r)["id"])
 
 	changelog := RebbleChangelog{}
 	changelog.Versions = versions
@@ -0,0 +1,273 @@
+package rebbleHandlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sourceFile is a JSON file of the Pebble app store archive
+type sourceFile struct {
+	// Name is the path of the file, relative to the root of the archive
+	Name string
+	Data []byte
+	// Err is set when this file couldn't be read, but the others can be
+	Err error
+	// Size is the number of bytes of the archive read for this file
+	Size int64
+}
+
+// fileSource lists the JSON files of the Pebble app store archive, whether it
+// was extracted or not
+type fileSource interface {
+	// Next returns the next JSON file, or io.EOF when all of them were read.
+	// Any other error means the archive can't be read any further.
+	Next() (sourceFile, error)
+	// Size returns the number of bytes of the archive that will be read, the
+	// sum of the Size of the files
+	Size() int64
+	Close() error
+}
+
+// openFileSource opens the archive at path: a directory, a .tar.gz or a .zip
+// file. Archives are read as a stream, without being extracted.
+func openFileSource(path string) (fileSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.IsDir():
+		return newDirSource(path), nil
+	case strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz"):
+		return newTarGzSource(path)
+	case strings.HasSuffix(path, ".zip"):
+		return newZipSource(path)
+	default:
+		return nil, errors.New("Unsupported archive format, expected a directory, a .tar.gz or a .zip file")
+	}
+}
+
+// walkFiles is intended to quickly crawl the pebble application folder
+// in-order to re-build the application database.
+func walkFiles(root string) (<-chan string, <-chan error) {
+	// Create a couple of channels to communicate with the main process.
+	// (multi-threading FTW!)
+	paths := make(chan string)
+	errf := make(chan error, 1)
+
+	// Crawl the directory in the background.
+	go func() {
+		defer close(paths)
+		errf <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(info.Name(), ".json") {
+				paths <- path
+			}
+			return nil
+		})
+	}()
+
+	// Return the channels so that our goroutine can communicate with the main
+	// thread.
+	return paths, errf
+}
+
+// dirSource reads the JSON files of an extracted archive
+type dirSource struct {
+	root  string
+	paths <-chan string
+	errc  <-chan error
+}
+
+func newDirSource(root string) *dirSource {
+	paths, errc := walkFiles(root)
+	return &dirSource{root, paths, errc}
+}
+
+// Size adds up the size of the JSON files, which are walked a first time
+func (source *dirSource) Size() int64 {
+	var size int64
+	filepath.Walk(source.root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+func (source *dirSource) Next() (sourceFile, error) {
+	path, ok := <-source.paths
+	if !ok {
+		err := <-source.errc
+		if err != nil {
+			return sourceFile{}, err
+		}
+		return sourceFile{}, io.EOF
+	}
+
+	name, err := filepath.Rel(source.root, path)
+	if err != nil {
+		name = path
+	}
+	data, err := ioutil.ReadFile(path)
+
+	return sourceFile{filepath.ToSlash(name), data, err, int64(len(data))}, nil
+}
+
+// Close lets the walk finish, so that its goroutine doesn't leak
+func (source *dirSource) Close() error {
+	for range source.paths {
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarGzSource streams the JSON files out of a .tar.gz archive
+type tarGzSource struct {
+	file    *os.File
+	size    int64
+	counter *countingReader
+	// read is the number of compressed bytes read up to the last file
+	read    int64
+	gz      *gzip.Reader
+	archive *tar.Reader
+}
+
+func newTarGzSource(path string) (*tarGzSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	counter := &countingReader{r: f}
+	gz, err := gzip.NewReader(counter)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &tarGzSource{f, info.Size(), counter, 0, gz, tar.NewReader(gz)}, nil
+}
+
+// Size is the size of the compressed archive
+func (source *tarGzSource) Size() int64 {
+	return source.size
+}
+
+func (source *tarGzSource) Next() (sourceFile, error) {
+	for {
+		header, err := source.archive.Next()
+		if err != nil {
+			return sourceFile{}, err
+		}
+
+		if !header.FileInfo().Mode().IsRegular() || !strings.HasSuffix(header.Name, ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(source.archive)
+		if err != nil {
+			return sourceFile{}, err
+		}
+
+		// The file accounts for the compressed bytes read since the
+		// previous one
+		size := source.counter.n - source.read
+		source.read = source.counter.n
+		return sourceFile{path.Clean(header.Name), data, nil, size}, nil
+	}
+}
+
+func (source *tarGzSource) Close() error {
+	source.gz.Close()
+	return source.file.Close()
+}
+
+// zipSource reads the JSON files of a .zip archive, one at a time
+type zipSource struct {
+	archive *zip.ReadCloser
+	next    int
+}
+
+func newZipSource(path string) (*zipSource, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zipSource{archive, 0}, nil
+}
+
+func (source *zipSource) Next() (sourceFile, error) {
+	for source.next < len(source.archive.File) {
+		f := source.archive.File[source.next]
+		source.next++
+
+		if f.FileInfo().IsDir() || !strings.HasSuffix(f.Name, ".json") {
+			continue
+		}
+
+		size := int64(f.CompressedSize64)
+		r, err := f.Open()
+		if err != nil {
+			return sourceFile{path.Clean(f.Name), nil, err, size}, nil
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+
+		return sourceFile{path.Clean(f.Name), data, err, size}, nil
+	}
+
+	return sourceFile{}, io.EOF
+}
+
+// Size adds up the compressed size of the JSON files
+func (source *zipSource) Size() int64 {
+	var size int64
+	for _, f := range source.archive.File {
+		if !f.FileInfo().IsDir() && strings.HasSuffix(f.Name, ".json") {
+			size += int64(f.CompressedSize64)
+		}
+	}
+
+	return size
+}
+
+func (source *zipSource) Close() error {
+	return source.archive.Close()
+}
@@ -3,6 +3,7 @@ package rebbleHandlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"pebble-dev/rebblestore-api/db"
 	"strconv"
@@ -22,12 +23,22 @@ func AuthorHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request)
 		return http.StatusBadRequest, errors.New("Non-numeric ID")
 	}
 
-	author, err := ctx.Database.GetAuthor(id)
+	// Authors renumbered by an import are still reachable at their old ID
+	redirect, err := ctx.Store().GetAuthorRedirect(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if redirect != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/dev/author/id/%d", redirect), http.StatusMovedPermanently)
+		return http.StatusMovedPermanently, nil
+	}
+
+	author, err := ctx.Store().GetAuthor(id)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	cards, err := ctx.Database.GetAuthorCards(id)
+	cards, err := ctx.Store().GetAuthorCards(id)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
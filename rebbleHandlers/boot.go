@@ -111,6 +111,10 @@ func BootHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (i
 	response.Config.Webviews["appstore/developer_apps"] = fmt.Sprintf("%s/developer/$$id$$?pebble_color=$$pebble_color$$&hardware=$$hardware$$&uid=$$user_id$$&mid=$$phone_id$$&pid=$$pebble_id$$&$$extras$$", store_uri)
 	response.Config.Webviews["appstore/watchfaces"] = fmt.Sprintf("%s/watchfaces?pebble_color=$$pebble_color$$&hardware=$$hardware$$&uid=$$user_id$$&mid=$$phone_id$$&pid=$$pebble_id$$&$$extras$$", store_uri)
 	response.Config.Webviews["appstore/watchapps"] = fmt.Sprintf("%s/watchapps?pebble_color=$$pebble_color$$&hardware=$$hardware$$&uid=$$user_id$$&mid=$$phone_id$$&pid=$$pebble_id$$&$$extras$$", store_uri)
+	response.Config.Algolia, err = algoliaConfig(response.Config.Algolia)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
 	response.Config.Href = LOCAL_BOOT_URI + r.URL.Path
 	response.Config.Id = strings.Replace(r.URL.Path, "/boot/", "", -1)
 
@@ -8,12 +8,8 @@ import (
 	"testing"
 
 	"pebble-dev/rebblestore-api/common"
-
-	"github.com/adams-sarah/test2doc/test"
 )
 
-var server *test.Server
-
 func TestVersion(t *testing.T) {
 
 	url := fmt.Sprintf("%s/admin/version", server.URL)
@@ -65,19 +61,8 @@ func TestHome(t *testing.T) {
 	}
 }
 
-func TestApps(t *testing.T) {
-	url := fmt.Sprintf("%s/dev/apps", server.URL)
-	r, err := http.Get(url)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if r.StatusCode != 200 && r.StatusCode != 500 {
-		t.Fatalf("expected 200 or 500 (depending on wether the database has been built or not), got %v", r.StatusCode)
-	}
-}
-
 func TestBoot(t *testing.T) {
-	url := fmt.Sprintf("%s/boot/ios/v3/1/1?app_version=4.3&store_uri=https%3A%2F%2Fsantoku.adamfourney.com", server.URL)
+	url := fmt.Sprintf("%s/boot/ios/v3/1/1?app_version=4.3&store_uri=https%%3A%%2F%%2Fsantoku.adamfourney.com", server.URL)
 	r, err := http.Get(url)
 	if err != nil {
 		t.Fatal(err)
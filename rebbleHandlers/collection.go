@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"pebble-dev/rebblestore-api/db"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -27,17 +28,6 @@ func in_array(s string, array []string) bool {
 	return false
 }
 
-func nCompatibleApps(apps *([]db.RebbleApplication), platform string) int {
-	var n int
-	for _, app := range *apps {
-		if platform == "all" || in_array(platform, app.SupportedPlatforms) {
-			n = n + 1
-		}
-	}
-
-	return n
-}
-
 // CollectionHandler serves a list of cards from a collection
 func CollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
 	urlquery := r.URL.Query()
@@ -46,14 +36,12 @@ func CollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Reque
 		return http.StatusBadRequest, errors.New("Missing 'id' parameter")
 	}
 
-	var sortByPopular bool
+	order := "new"
 	if o, ok := urlquery["order"]; ok {
 		if len(o) > 1 {
 			return http.StatusBadRequest, errors.New("Multiple 'order' parameters are not allowed")
-		} else if o[0] == "popular" {
-			sortByPopular = true
-		} else if o[0] == "new" {
-			sortByPopular = false
+		} else if o[0] == "popular" || o[0] == "new" || o[0] == "manual" {
+			order = o[0]
 		} else {
 			return http.StatusBadRequest, errors.New("Invalid 'order' parameter")
 		}
@@ -81,26 +69,27 @@ func CollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	apps, err := ctx.Database.GetAppsForCollection(mux.Vars(r)["id"], sortByPopular)
+	apps, err := ctx.Store().GetAppsForCollection(mux.Vars(r)["id"], order, platform)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	collectionName, err := ctx.Database.GetCollectionName(mux.Vars(r)["id"])
+	collectionName, err := ctx.Store().GetCollectionName(mux.Vars(r)["id"])
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	nCompatibleApps := nCompatibleApps(&apps, platform)
-	pages := nCompatibleApps / 12
-	if nCompatibleApps%12 > 0 {
+	pages := len(apps) / 12
+	if len(apps)%12 > 0 {
 		pages = pages + 1
 	}
 
-	if page != pages {
+	if page < pages {
 		apps = apps[(page-1)*12 : page*12]
 	} else if page == pages {
 		apps = apps[(page-1)*12:]
+	} else {
+		apps = apps[:0]
 	}
 
 	// Only allow to view up to 20 pages - More pages = more computation time
@@ -143,3 +132,259 @@ func CollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Reque
 
 	return http.StatusOK, nil
 }
+
+// AdminCollection is a collection as the admin API describes it, with the IDs
+// of its apps in their manual order
+type AdminCollection struct {
+	Id    string   `json:"id"`
+	Name  string   `json:"name"`
+	Color string   `json:"color"`
+	Apps  []string `json:"apps"`
+}
+
+// collectionStatus returns the HTTP status of an error of the collections
+func collectionStatus(err error) int {
+	switch err {
+	case db.ErrNoCollection:
+		return http.StatusNotFound
+	case db.ErrCollectionExists:
+		return http.StatusConflict
+	case db.ErrNoApp, db.ErrInvalidOrder:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// adminCollections returns the collections whose IDs are given, or every
+// collection if ids is nil
+func adminCollections(store db.Store, ids []string) ([]AdminCollection, error) {
+	collections, err := store.GetCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]AdminCollection, 0)
+	for _, collection := range collections {
+		if ids != nil && !in_array(collection.Id, ids) {
+			continue
+		}
+
+		apps, err := store.GetAppsForCollection(collection.Id, "manual", "all")
+		if err != nil {
+			return nil, err
+		}
+		appIds := make([]string, 0, len(apps))
+		for _, app := range apps {
+			appIds = append(appIds, app.Id)
+		}
+		result = append(result, AdminCollection{collection.Id, collection.Name, collection.Color, appIds})
+	}
+
+	return result, nil
+}
+
+// writeAdminCollections answers with the collections whose IDs are given (all
+// of them if ids is nil), or with the only one if single is true
+func writeAdminCollections(ctx *HandlerContext, w http.ResponseWriter, status int, ids []string, single bool) (int, error) {
+	collections, err := adminCollections(ctx.Store(), ids)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	var v interface{} = collections
+	if single {
+		if len(collections) == 0 {
+			return http.StatusNotFound, db.ErrNoCollection
+		}
+		v = collections[0]
+	}
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	return status, nil
+}
+
+// AdminCollectionsHandler lists the collections in their manual order, with
+// their apps
+func AdminCollectionsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return writeAdminCollections(ctx, w, http.StatusOK, nil, false)
+}
+
+// AdminCollectionHandler returns a collection, with its apps
+func AdminCollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return writeAdminCollections(ctx, w, http.StatusOK, []string{mux.Vars(r)["id"]}, true)
+}
+
+// AdminCreateCollectionHandler creates an empty collection from the JSON body
+// (its id, name and color), after the other collections. The id `order` is
+// reserved.
+func AdminCreateCollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	var collection db.RebbleCollection
+	err := readJSONBody(r, &collection)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if collection.Id == "" || strings.Contains(collection.Id, "/") {
+		return http.StatusBadRequest, errors.New("Invalid 'id', it should be non-empty and without slashes")
+	}
+	if collection.Id == "order" {
+		// POST /admin/collections/order reorders the collections
+		return http.StatusBadRequest, errors.New("Invalid 'id', 'order' is reserved")
+	}
+	if collection.Name == "" {
+		return http.StatusBadRequest, errors.New("Missing 'name'")
+	}
+
+	err = ctx.Store().CreateCollection(collection)
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	return writeAdminCollections(ctx, w, http.StatusCreated, []string{collection.Id}, true)
+}
+
+// AdminUpdateCollectionHandler renames and recolors a collection, with the
+// name and color of the JSON body (either can be left out)
+func AdminUpdateCollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	id := mux.Vars(r)["id"]
+	collections, err := adminCollections(ctx.Store(), []string{id})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(collections) == 0 {
+		return http.StatusNotFound, db.ErrNoCollection
+	}
+
+	collection := db.RebbleCollection{Id: id, Name: collections[0].Name, Color: collections[0].Color}
+	err = readJSONBody(r, &collection)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	collection.Id = id
+	if collection.Name == "" {
+		return http.StatusBadRequest, errors.New("Missing 'name'")
+	}
+
+	err = ctx.Store().UpdateCollection(collection)
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	return writeAdminCollections(ctx, w, http.StatusOK, []string{id}, true)
+}
+
+// AdminDeleteCollectionHandler deletes a collection, its apps are kept
+func AdminDeleteCollectionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	err := ctx.Store().DeleteCollection(mux.Vars(r)["id"])
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// AdminOrderCollectionsHandler moves the collections whose IDs are listed in
+// the JSON body first, in that order, and answers with every collection
+func AdminOrderCollectionsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	var ids []string
+	err := readJSONBody(r, &ids)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = ctx.Store().OrderCollections(ids)
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	return writeAdminCollections(ctx, w, http.StatusOK, nil, false)
+}
+
+// AdminAddCollectionAppsHandler adds the apps whose IDs are listed in the JSON
+// body at the end of a collection
+func AdminAddCollectionAppsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	id := mux.Vars(r)["id"]
+	var appIds []string
+	err := readJSONBody(r, &appIds)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = ctx.Store().AddCollectionApps(id, appIds)
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	return writeAdminCollections(ctx, w, http.StatusOK, []string{id}, true)
+}
+
+// AdminRemoveCollectionAppHandler removes an app from a collection
+func AdminRemoveCollectionAppHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	id := mux.Vars(r)["id"]
+	err := ctx.Store().RemoveCollectionApps(id, []string{mux.Vars(r)["app"]})
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	return writeAdminCollections(ctx, w, http.StatusOK, []string{id}, true)
+}
+
+// AdminOrderCollectionAppsHandler moves the apps whose IDs are listed in the
+// JSON body first in a collection, in that order
+func AdminOrderCollectionAppsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !ctx.lockCollections() {
+		return http.StatusConflict, errRebuildRunning
+	}
+	defer ctx.unlockCollections()
+
+	id := mux.Vars(r)["id"]
+	var appIds []string
+	err := readJSONBody(r, &appIds)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = ctx.Store().OrderCollectionApps(id, appIds)
+	if err != nil {
+		return collectionStatus(err), err
+	}
+
+	return writeAdminCollections(ctx, w, http.StatusOK, []string{id}, true)
+}
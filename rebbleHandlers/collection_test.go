@@ -0,0 +1,181 @@
+package rebbleHandlers
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+func TestAdminCollections(t *testing.T) {
+	store := db.NewMemoryStore()
+	_, err := ImportArchive(store, testArchive, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &HandlerContext{Database: store}
+	r := Handlers(ctx)
+
+	var collection AdminCollection
+	res := adminRequestBody(t, r, "POST", "/admin/collections", `{"id": "staff", "name": "Staff picks", "color": "ff0000"}`, &collection)
+	if res.Code != http.StatusCreated || collection.Name != "Staff picks" || len(collection.Apps) != 0 {
+		t.Fatalf("expected the collection to be created, got %d %s", res.Code, res.Body)
+	}
+	for body, status := range map[string]int{
+		`{"id": "staff", "name": "Staff picks"}`: http.StatusConflict,
+		`{"id": "", "name": "No ID"}`:            http.StatusBadRequest,
+		`{"id": "order", "name": "Reserved"}`:    http.StatusBadRequest,
+		`{"id": "nameless"}`:                     http.StatusBadRequest,
+		`not JSON`:                               http.StatusBadRequest,
+	} {
+		res = adminRequestBody(t, r, "POST", "/admin/collections", body, nil)
+		if res.Code != status {
+			t.Errorf("%s: expected %d, got %d", body, status, res.Code)
+		}
+	}
+
+	// Apps are added at the end, and reordered
+	res = adminRequestBody(t, r, "POST", "/admin/collections/staff/apps", `["5b1f2e3d4c5b6a7988776655", "5a0e7b1c9d8f6e5d4c3b2a10"]`, &collection)
+	if res.Code != http.StatusOK || !reflect.DeepEqual(collection.Apps, []string{"5b1f2e3d4c5b6a7988776655", "5a0e7b1c9d8f6e5d4c3b2a10"}) {
+		t.Fatalf("expected the apps to be added, got %d %s", res.Code, res.Body)
+	}
+	res = adminRequestBody(t, r, "POST", "/admin/collections/staff/apps", `["unknown"]`, nil)
+	if res.Code != http.StatusBadRequest || res.Body.String() != db.ErrNoApp.Error()+"\n" {
+		t.Errorf("expected an unknown app to be rejected, got %d %q", res.Code, res.Body)
+	}
+	res = adminRequestBody(t, r, "POST", "/admin/collections/staff/apps/order", `["5a0e7b1c9d8f6e5d4c3b2a10"]`, &collection)
+	if res.Code != http.StatusOK || collection.Apps[0] != "5a0e7b1c9d8f6e5d4c3b2a10" {
+		t.Errorf("expected the apps to be reordered, got %d %s", res.Code, res.Body)
+	}
+
+	// The public collection follows the manual order
+	var public RebbleCollection
+	res = adminRequest(t, r, "GET", "/dev/apps/get_collection/id/staff?order=manual", &public)
+	if res.Code != http.StatusOK || public.Name != "Staff picks" || len(public.Cards) != 2 || public.Cards[0].Id != "5a0e7b1c9d8f6e5d4c3b2a10" {
+		t.Errorf("unexpected collection %d %s", res.Code, res.Body)
+	}
+
+	res = adminRequestBody(t, r, "POST", "/admin/collections/staff", `{"name": "Our favorites"}`, &collection)
+	if res.Code != http.StatusOK || collection.Name != "Our favorites" || collection.Color != "ff0000" {
+		t.Errorf("expected the collection to be renamed, got %d %s", res.Code, res.Body)
+	}
+	res = adminRequest(t, r, "DELETE", "/admin/collections/staff/apps/5a0e7b1c9d8f6e5d4c3b2a10", &collection)
+	if res.Code != http.StatusOK || !reflect.DeepEqual(collection.Apps, []string{"5b1f2e3d4c5b6a7988776655"}) {
+		t.Errorf("expected the app to be removed, got %d %s", res.Code, res.Body)
+	}
+
+	var collections []AdminCollection
+	res = adminRequestBody(t, r, "POST", "/admin/collections/order", `["staff"]`, &collections)
+	if res.Code != http.StatusOK || len(collections) < 2 || collections[0].Id != "staff" {
+		t.Errorf("expected the collection to be moved first, got %d %s", res.Code, res.Body)
+	}
+	res = adminRequestBody(t, r, "POST", "/admin/collections/order", `["unknown"]`, nil)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown collection to be rejected, got %d", res.Code)
+	}
+
+	res = adminRequest(t, r, "DELETE", "/admin/collections/staff", nil)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("expected the collection to be deleted, got %d", res.Code)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		res = adminRequest(t, r, method, "/admin/collections/staff", nil)
+		if res.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 for a deleted collection, got %d", method, res.Code)
+		}
+	}
+
+	// Rebuilding the images doesn't replace the store, the collections can
+	// be changed meanwhile
+	if !ctx.startRebuild() {
+		t.Fatal("expected the rebuild to start")
+	}
+	res = adminRequestBody(t, r, "POST", "/admin/collections", `{"id": "images", "name": "During images"}`, nil)
+	ctx.endRebuild()
+	if res.Code != http.StatusCreated {
+		t.Errorf("expected the collection to be created during an image rebuild, got %d", res.Code)
+	}
+
+	// The collections can be read but not changed once the store is
+	// shadowed to be replaced
+	shadow, err := ctx.shadowStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Close()
+	defer ctx.endReplace()
+	res = adminRequest(t, r, "GET", "/admin/collections", nil)
+	if res.Code != http.StatusOK {
+		t.Errorf("expected the collections during a rebuild, got %d", res.Code)
+	}
+	res = adminRequestBody(t, r, "POST", "/admin/collections", `{"id": "staff", "name": "Staff picks"}`, nil)
+	if res.Code != http.StatusConflict {
+		t.Errorf("expected 409 during a rebuild, got %d", res.Code)
+	}
+	res = adminRequest(t, r, "GET", "/admin/collections/staff", nil)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected no collection to be created, got %d", res.Code)
+	}
+}
+
+// blockingStore is a store whose collections are created once release is
+// closed, it tells entered when a creation starts
+type blockingStore struct {
+	db.Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (store blockingStore) CreateCollection(collection db.RebbleCollection) error {
+	close(store.entered)
+	<-store.release
+	return store.Store.CreateCollection(collection)
+}
+
+// TestAdminCollectionsShadowed checks that a rebuild starting while a
+// collection is being changed shadows the store with the change
+func TestAdminCollectionsShadowed(t *testing.T) {
+	memory := db.NewMemoryStore()
+	_, err := ImportArchive(memory, testArchive, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := blockingStore{memory, make(chan struct{}), make(chan struct{})}
+	ctx := &HandlerContext{Database: store}
+	r := Handlers(ctx)
+
+	created := make(chan int)
+	go func() {
+		res := adminRequestBody(t, r, "POST", "/admin/collections", `{"id": "staff", "name": "Staff picks"}`, nil)
+		created <- res.Code
+	}()
+	<-store.entered
+
+	shadowed := make(chan db.Store)
+	go func() {
+		shadow, err := ctx.shadowStore(store)
+		if err != nil {
+			t.Error(err)
+		}
+		shadowed <- shadow
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(store.release)
+
+	if code := <-created; code != http.StatusCreated {
+		t.Errorf("expected the collection to be created, got %d", code)
+	}
+	shadow := <-shadowed
+	if shadow == nil {
+		return
+	}
+	defer shadow.Close()
+	defer ctx.endReplace()
+	if _, err := shadow.GetCollectionName("staff"); err != nil {
+		t.Errorf("expected the shadow to have the collection, got %v", err)
+	}
+}
@@ -0,0 +1,443 @@
+package rebbleHandlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// Categories of the changes between an archive and the catalog, which can be
+// applied separately
+const (
+	// DiffAdded are the apps of the archive missing from the catalog
+	DiffAdded = "added"
+	// DiffRemoved are the apps of the catalog missing from the archive
+	DiffRemoved = "removed"
+	// DiffVersions are the apps with a new release or changelog
+	DiffVersions = "versions"
+	// DiffMetadata are the other changes of the apps
+	DiffMetadata = "metadata"
+	// DiffAuthors are the authors whose name changed
+	DiffAuthors = "authors"
+)
+
+// DiffCategories are the categories of changes, in the order they are reported
+var DiffCategories = []string{DiffAdded, DiffRemoved, DiffVersions, DiffMetadata, DiffAuthors}
+
+// CatalogDiff lists the changes between a Pebble app store archive and the
+// catalog
+type CatalogDiff struct {
+	Added    []AppDiff      `json:"added"`
+	Removed  []AppDiff      `json:"removed"`
+	Versions []VersionDiff  `json:"versions"`
+	Metadata []MetadataDiff `json:"metadata"`
+	Authors  []AuthorDiff   `json:"authors"`
+	// Applied are the categories of changes that were applied to the catalog
+	Applied []string `json:"applied"`
+}
+
+// AppDiff is an app added or removed
+type AppDiff struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// VersionDiff is an app with a new release or changelog
+type VersionDiff struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	NewVersion string `json:"new_version"`
+	// Added are the numbers of the versions added to the changelog
+	Added []string `json:"added"`
+}
+
+// MetadataDiff lists the changed fields of an app
+type MetadataDiff struct {
+	Id     string      `json:"id"`
+	Name   string      `json:"name"`
+	Fields []FieldDiff `json:"fields"`
+}
+
+// FieldDiff is a changed field of an app, with its current and new values
+type FieldDiff struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// AuthorDiff is an author whose name changed
+type AuthorDiff struct {
+	Id          int    `json:"id"`
+	DeveloperId string `json:"developer_id"`
+	Name        string `json:"name"`
+	NewName     string `json:"new_name"`
+}
+
+// Empty returns true if the archive matches the catalog
+func (diff CatalogDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Versions) == 0 && len(diff.Metadata) == 0 && len(diff.Authors) == 0
+}
+
+// Summary describes the changes, one per line
+func (diff CatalogDiff) Summary() []string {
+	lines := make([]string, 0)
+	plural := func(n int, singular string, plural string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, singular)
+		}
+		return fmt.Sprintf("%d %s", n, plural)
+	}
+
+	lines = append(lines, plural(len(diff.Added), "app added", "apps added"))
+	for _, app := range diff.Added {
+		lines = append(lines, fmt.Sprintf("  + %s %s", app.Id, app.Name))
+	}
+	lines = append(lines, plural(len(diff.Removed), "app removed", "apps removed"))
+	for _, app := range diff.Removed {
+		lines = append(lines, fmt.Sprintf("  - %s %s", app.Id, app.Name))
+	}
+	lines = append(lines, plural(len(diff.Versions), "app with new versions", "apps with new versions"))
+	for _, app := range diff.Versions {
+		line := fmt.Sprintf("  ~ %s %s: %s -> %s", app.Id, app.Name, app.Version, app.NewVersion)
+		if len(app.Added) > 0 {
+			line += fmt.Sprintf(" (changelog: %s)", strings.Join(app.Added, ", "))
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, plural(len(diff.Metadata), "app with changed metadata", "apps with changed metadata"))
+	for _, app := range diff.Metadata {
+		fields := make([]string, 0, len(app.Fields))
+		for _, field := range app.Fields {
+			fields = append(fields, field.Field)
+		}
+		lines = append(lines, fmt.Sprintf("  ~ %s %s: %s", app.Id, app.Name, strings.Join(fields, ", ")))
+	}
+	lines = append(lines, plural(len(diff.Authors), "author renamed", "authors renamed"))
+	for _, author := range diff.Authors {
+		lines = append(lines, fmt.Sprintf("  ~ %d %s -> %s", author.Id, author.Name, author.NewName))
+	}
+	if len(diff.Applied) > 0 {
+		lines = append(lines, "Applied: "+strings.Join(diff.Applied, ", "))
+	} else {
+		lines = append(lines, "Nothing applied")
+	}
+
+	return lines
+}
+
+// ParseDiffCategories parses a comma separated list of categories of changes
+func ParseDiffCategories(s string) ([]string, error) {
+	categories := make([]string, 0)
+	if s == "" {
+		return categories, nil
+	}
+
+	for _, category := range strings.Split(s, ",") {
+		category = strings.TrimSpace(category)
+		if !in_array(category, DiffCategories) {
+			return nil, fmt.Errorf("Unknown category %q, expected %s", category, strings.Join(DiffCategories, ", "))
+		}
+		if !in_array(category, categories) {
+			categories = append(categories, category)
+		}
+	}
+
+	return categories, nil
+}
+
+// appField is a field of an app compared by DiffArchive
+type appField struct {
+	name string
+	// value returns a pointer to the field of app
+	value func(app *db.RebbleApplication) interface{}
+}
+
+// releaseFields are the fields of the latest release of an app, compared along
+// with its changelog
+var releaseFields = []appField{
+	{"version", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.Version }},
+	{"updated", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.Updated }},
+	{"pbw_url", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.PbwUrl }},
+	{"release_id", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.ReleaseId }},
+	{"release_notes", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.ReleaseNotes }},
+	{"js_md5", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.JsMd5 }},
+	{"js_version", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.JsVersion }},
+}
+
+// metadataFields are the other fields of an app that come from the archive
+var metadataFields = []appField{
+	{"name", func(app *db.RebbleApplication) interface{} { return &app.Name }},
+	{"uuid", func(app *db.RebbleApplication) interface{} { return &app.Uuid }},
+	{"author_id", func(app *db.RebbleApplication) interface{} { return &app.Author.Id }},
+	{"description", func(app *db.RebbleApplication) interface{} { return &app.Description }},
+	{"type", func(app *db.RebbleApplication) interface{} { return &app.Type }},
+	{"published_date", func(app *db.RebbleApplication) interface{} { return &app.Published }},
+	{"supported_platforms", func(app *db.RebbleApplication) interface{} { return &app.SupportedPlatforms }},
+	{"tags", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.Tags }},
+	{"author_url", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.AuthorUrl }},
+	{"source_url", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.SourceUrl }},
+	{"capabilities", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.Capabilities }},
+	{"companions", func(app *db.RebbleApplication) interface{} { return &app.AppInfo.Companions }},
+	{"banner", func(app *db.RebbleApplication) interface{} { return &app.Assets.Banner }},
+	{"icon", func(app *db.RebbleApplication) interface{} { return &app.Assets.Icon }},
+	{"banners", func(app *db.RebbleApplication) interface{} { return &app.Assets.Banners }},
+	{"icons", func(app *db.RebbleApplication) interface{} { return &app.Assets.Icons }},
+	{"list_images", func(app *db.RebbleApplication) interface{} { return &app.Assets.ListImages }},
+	{"hardware_images", func(app *db.RebbleApplication) interface{} { return &app.Assets.HardwareImages }},
+	{"screenshots", func(app *db.RebbleApplication) interface{} { return &app.Assets.Screenshots }},
+}
+
+// thumbsUpField is the number of hearts of an app. It isn't compared: the
+// archive only sets it for new apps, the store counts them afterwards.
+var thumbsUpField = appField{"thumbs_up", func(app *db.RebbleApplication) interface{} { return &app.ThumbsUp }}
+
+// sameJSON returns true if a and b are encoded the same way in JSON, which is
+// how they are compared to the catalog
+func sameJSON(a interface{}, b interface{}) bool {
+	aData, aErr := json.Marshal(a)
+	bData, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aData, bData)
+}
+
+// changedFields returns the fields that differ between the app in the catalog
+// and in the archive
+func changedFields(fields []appField, current *db.RebbleApplication, archived *db.RebbleApplication) []FieldDiff {
+	changes := make([]FieldDiff, 0)
+	for _, field := range fields {
+		// Screenshots downloaded by RebuildImages can't be compared to the
+		// ones of the archive
+		if field.name == "screenshots" && hasLocalScreenshots(current) {
+			continue
+		}
+
+		was, now := field.value(current), field.value(archived)
+		if !sameJSON(was, now) {
+			changes = append(changes, FieldDiff{field.name, reflect.ValueOf(was).Elem().Interface(), reflect.ValueOf(now).Elem().Interface()})
+		}
+	}
+
+	return changes
+}
+
+// copyFields sets the given fields of app to their value in archived
+func copyFields(fields []FieldDiff, all []appField, app *db.RebbleApplication, archived *db.RebbleApplication) {
+	for _, field := range all {
+		for _, change := range fields {
+			if change.Field == field.name {
+				reflect.ValueOf(field.value(app)).Elem().Set(reflect.ValueOf(field.value(archived)).Elem())
+			}
+		}
+	}
+}
+
+// hasLocalScreenshots returns true if the screenshots of app were downloaded by
+// RebuildImages
+func hasLocalScreenshots(app *db.RebbleApplication) bool {
+	if app.Assets.Screenshots == nil {
+		return false
+	}
+	for _, platform := range *app.Assets.Screenshots {
+		for _, url := range platform.Screenshots {
+			if _, ok := localImage(url); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DiffArchive compares the Pebble app store archive at path to the catalog, and
+// applies the given categories of changes (none for a dry run). Apps whose
+// file was skipped are not reported as removed. It logs its progress to
+// logger.
+func DiffArchive(store db.Store, path string, apply []string, logger *log.Logger) (CatalogDiff, error) {
+	// The whole archive is compared at once
+	var archive archiveCatalog
+	report, err := readArchive(store, path, 0, func(batch archiveCatalog) error {
+		archive = batch
+		return nil
+	}, noProgress{}, logger)
+	if err != nil {
+		return CatalogDiff{}, err
+	}
+
+	current, err := store.ExportCatalog()
+	if err != nil {
+		return CatalogDiff{}, err
+	}
+
+	diff := CatalogDiff{
+		Added:    make([]AppDiff, 0),
+		Removed:  make([]AppDiff, 0),
+		Versions: make([]VersionDiff, 0),
+		Metadata: make([]MetadataDiff, 0),
+		Authors:  make([]AuthorDiff, 0),
+		Applied:  append([]string{}, apply...),
+	}
+
+	currentApps := make(map[string]db.RebbleApplication)
+	for _, app := range current.Apps {
+		currentApps[app.Id] = app
+	}
+	archivedApps := make(map[string]bool)
+	for _, app := range archive.apps {
+		archivedApps[app.Id] = true
+	}
+	for _, problem := range report.Problems {
+		if problem.Skipped && problem.App != "" {
+			archivedApps[problem.App] = true
+		}
+	}
+
+	sort.Slice(archive.apps, func(i, j int) bool {
+		return archive.apps[i].Id < archive.apps[j].Id
+	})
+
+	// Changes are applied by importing the apps as they are in the catalog,
+	// with the applied changes only
+	apps := make([]db.RebbleApplication, 0)
+	versions := make(map[string][]db.RebbleVersion)
+	sources := make(map[string][]json.RawMessage)
+	for _, archived := range archive.apps {
+		// The catalog has no platform without screenshots
+		screenshots := make([]db.RebbleScreenshotsPlatform, 0)
+		for _, platform := range *archived.Assets.Screenshots {
+			if len(platform.Screenshots) > 0 {
+				screenshots = append(screenshots, platform)
+			}
+		}
+		archived.Assets.Screenshots = &screenshots
+
+		app, ok := currentApps[archived.Id]
+		if !ok {
+			diff.Added = append(diff.Added, AppDiff{archived.Id, archived.Name})
+			if in_array(DiffAdded, apply) {
+				apps = append(apps, archived)
+				versions[archived.Id] = archive.versions[archived.Id]
+				sources[archived.Id] = archive.sources[archived.Id]
+			}
+			continue
+		}
+
+		appVersions := current.Versions[app.Id]
+		changed := false
+
+		release := changedFields(releaseFields, &app, &archived)
+		changelog := len(appVersions)+len(archive.versions[app.Id]) > 0 && !sameJSON(appVersions, archive.versions[app.Id])
+		if len(release) > 0 || changelog {
+			added := make([]string, 0)
+			for _, version := range archive.versions[app.Id] {
+				known := false
+				for _, v := range appVersions {
+					known = known || v.Number == version.Number
+				}
+				if !known {
+					added = append(added, version.Number)
+				}
+			}
+			diff.Versions = append(diff.Versions, VersionDiff{app.Id, app.Name, app.AppInfo.Version, archived.AppInfo.Version, added})
+
+			if in_array(DiffVersions, apply) {
+				copyFields(release, releaseFields, &app, &archived)
+				appVersions = archive.versions[app.Id]
+				changed = true
+			}
+		}
+
+		metadata := changedFields(metadataFields, &app, &archived)
+		if len(metadata) > 0 {
+			diff.Metadata = append(diff.Metadata, MetadataDiff{app.Id, app.Name, metadata})
+
+			if in_array(DiffMetadata, apply) {
+				copyFields(metadata, metadataFields, &app, &archived)
+				changed = true
+			}
+		}
+
+		if changed {
+			apps = append(apps, app)
+			versions[app.Id] = appVersions
+			sources[app.Id] = archive.sources[app.Id]
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, app := range current.Apps {
+		if !archivedApps[app.Id] {
+			diff.Removed = append(diff.Removed, AppDiff{app.Id, app.Name})
+			removed = append(removed, app.Id)
+		}
+	}
+
+	// Authors and collections are only written when they are renamed, or
+	// needed by the apps written
+	currentAuthors := make(map[int]db.RebbleAuthor)
+	for _, author := range current.Authors {
+		currentAuthors[author.Id] = author
+	}
+	needed := make(map[int]bool)
+	for _, app := range apps {
+		needed[app.Author.Id] = true
+	}
+	authors := make([]db.RebbleAuthor, 0)
+	for _, author := range archive.authors {
+		existing, ok := currentAuthors[author.Id]
+		if ok && existing.Name != author.Name {
+			diff.Authors = append(diff.Authors, AuthorDiff{author.Id, author.DeveloperId, existing.Name, author.Name})
+			if !in_array(DiffAuthors, apply) {
+				author.Name = existing.Name
+			}
+			authors = append(authors, author)
+		} else if ok || needed[author.Id] {
+			authors = append(authors, author)
+		}
+	}
+
+	currentCollections := make(map[string]bool)
+	for _, collection := range current.Collections {
+		currentCollections[collection.Id] = true
+	}
+	collections := make([]db.RebbleCollection, 0)
+	for _, collection := range archive.collections {
+		if currentCollections[collection.Id] {
+			continue
+		}
+		for _, app := range apps {
+			if len(app.AppInfo.Tags) > 0 && app.AppInfo.Tags[0].Id == collection.Id {
+				collections = append(collections, collection)
+				break
+			}
+		}
+	}
+
+	if len(apply) == 0 {
+		return diff, nil
+	}
+
+	if !in_array(DiffRemoved, apply) {
+		removed = nil
+	}
+	// The changes are applied all at once, or not at all
+	err = store.ApplyCatalogChanges(db.CatalogChanges{
+		Authors:     authors,
+		Collections: collections,
+		Apps:        apps,
+		Versions:    versions,
+		Sources:     sources,
+		Removed:     removed,
+	})
+	if err != nil {
+		return CatalogDiff{}, err
+	}
+
+	logger.Printf("Applied %s: wrote %d apps, removed %d apps", strings.Join(apply, ", "), len(apps), len(removed))
+	return diff, nil
+}
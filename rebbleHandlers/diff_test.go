@@ -0,0 +1,153 @@
+package rebbleHandlers
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// writeNewerTestArchive writes a newer crawl of the test archive into dir: Step
+// Counter is gone, Bus Stops is new, and Transit Times has a new release, more
+// hearts and an author with a new name
+func writeNewerTestArchive(t *testing.T, dir string) {
+	err := os.Mkdir(filepath.Join(dir, "apps"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, data string) {
+		err := ioutil.WriteFile(filepath.Join(dir, "apps", name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range testArchiveFiles(t) {
+		data, err := ioutil.ReadFile(filepath.Join(testArchive, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name = filepath.Base(name)
+
+		switch name {
+		case "5a0e7b1c9d8f6e5d4c3b2a10.json":
+			continue
+		case "5b1f2e3d4c5b6a7988776655.json":
+			transitTimes := strings.NewReplacer(
+				`"hearts": 12`, `"hearts": 15`,
+				`"Next departures from the stops around you."`, `"Next departures from the stops and stations around you."`,
+				`"Lee Commuter"`, `"Lee Commuter Jr."`,
+				`"version": "1.0"`, `"version": "1.1"`,
+			).Replace(string(data))
+			write(name, transitTimes)
+			write("5c2a3b4c5d6e7f8091a2b3c4.json", strings.NewReplacer(
+				"5b1f2e3d4c5b6a7988776655", "5c2a3b4c5d6e7f8091a2b3c4",
+				"Transit Times", "Bus Stops",
+			).Replace(transitTimes))
+		default:
+			write(name, string(data))
+		}
+	}
+}
+
+func TestDiffArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebblestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeNewerTestArchive(t, dir)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	store := db.NewMemoryStore()
+	_, err = ImportArchive(store, testArchive, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffArchive(store, testArchive, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("expected no change, got %+v", diff)
+	}
+
+	diff, err = DiffArchive(store, dir, []string{DiffVersions, DiffAuthors}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CatalogDiff{
+		Added:    []AppDiff{{"5c2a3b4c5d6e7f8091a2b3c4", "Bus Stops"}},
+		Removed:  []AppDiff{{"5a0e7b1c9d8f6e5d4c3b2a10", "Step Counter"}},
+		Versions: []VersionDiff{{"5b1f2e3d4c5b6a7988776655", "Transit Times", "1.0", "1.1", []string{}}},
+		Metadata: []MetadataDiff{{"5b1f2e3d4c5b6a7988776655", "Transit Times", []FieldDiff{{"description", "Next departures from the stops around you.", "Next departures from the stops and stations around you."}}}},
+		Authors:  []AuthorDiff{{2, "54b0f3a2d5c1b2f3a4000022", "Lee Commuter", "Lee Commuter Jr."}},
+		Applied:  []string{DiffVersions, DiffAuthors},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+	summary := strings.Join(diff.Summary(), "\n")
+	if !strings.Contains(summary, "1 app added\n  + 5c2a3b4c5d6e7f8091a2b3c4 Bus Stops\n") || !strings.Contains(summary, "Transit Times: 1.0 -> 1.1") {
+		t.Errorf("unexpected summary %s", summary)
+	}
+
+	// Only the selected categories were applied
+	app, err := store.GetApp("5b1f2e3d4c5b6a7988776655")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.AppInfo.Version != "1.1" || app.ThumbsUp != 12 || app.Author.Name != "Lee Commuter Jr." {
+		t.Errorf("unexpected app %+v", app)
+	}
+	_, err = store.GetApp("5a0e7b1c9d8f6e5d4c3b2a10")
+	if err != nil {
+		t.Errorf("expected Step Counter to be kept: %v", err)
+	}
+	_, err = store.GetApp("5c2a3b4c5d6e7f8091a2b3c4")
+	if err == nil {
+		t.Error("expected Bus Stops not to be added")
+	}
+
+	_, err = DiffArchive(store, dir, DiffCategories, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err = DiffArchive(store, dir, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("expected every change to be applied, got %+v", diff)
+	}
+
+	// The hearts counted by the store are kept
+	app, err = store.GetApp("5b1f2e3d4c5b6a7988776655")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.ThumbsUp != 12 || app.Description != "Next departures from the stops and stations around you." {
+		t.Errorf("unexpected app %+v", app)
+	}
+}
+
+func TestParseDiffCategories(t *testing.T) {
+	categories, err := ParseDiffCategories("added, versions,added")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(categories, []string{DiffAdded, DiffVersions}) {
+		t.Errorf("unexpected categories %v", categories)
+	}
+
+	_, err = ParseDiffCategories("added,everything")
+	if err == nil {
+		t.Error("expected an unknown category to be rejected")
+	}
+}
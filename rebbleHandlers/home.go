@@ -1,7 +1,6 @@
 package rebbleHandlers
 
 import (
-	"fmt"
 	"io/ioutil"
 	"net/http"
 )
@@ -13,7 +12,8 @@ func HomeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (i
 		return http.StatusInternalServerError, err
 	}
 
-	fmt.Fprintf(w, string(data))
+	w.Header().Add("content-type", "text/html; charset=utf-8")
+	w.Write(data)
 
 	return http.StatusOK, nil
 }
@@ -0,0 +1,521 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+
+	"github.com/gorilla/mux"
+	"github.com/nu7hatch/gouuid"
+)
+
+// progress is told about the work done by a long running operation, and tells
+// it when to stop
+type progress interface {
+	// expect sets the total a counter will reach once the work is done
+	expect(counter string, total int)
+	// count adds n to a counter of the work done
+	count(counter string, n int)
+	// problem records an error that doesn't stop the operation
+	problem(description string)
+	// cancelled returns true once the operation should stop
+	cancelled() bool
+}
+
+// noProgress is the progress of the operations that don't run as jobs
+type noProgress struct{}
+
+func (noProgress) expect(counter string, total int) {}
+func (noProgress) count(counter string, n int)      {}
+func (noProgress) problem(description string)       {}
+func (noProgress) cancelled() bool                  { return false }
+
+// errCancelled is returned by the operations that stopped because they were
+// cancelled
+var errCancelled = errors.New("Cancelled")
+
+// errRebuildRunning is returned when a job can't start because a rebuild is
+// already running, and when the collections can't be changed because a
+// rebuild is about to replace the store (the changes would be lost)
+var errRebuildRunning = errors.New("A rebuild is already running")
+
+// The kinds of jobs
+const (
+	jobRebuildDB     = "rebuild-db"
+	jobRebuildImages = "rebuild-images"
+)
+
+// maxJobLogLines and maxJobErrors are the number of lines of log and of errors
+// kept for each job, the oldest lines and the newest errors are dropped
+const (
+	maxJobLogLines = 1000
+	maxJobErrors   = 100
+)
+
+// jobSaveInterval is how often the progress of a running job is saved
+var jobSaveInterval = time.Second
+
+// jobEventInterval is how often the progress of a running job is streamed
+var jobEventInterval = 500 * time.Millisecond
+
+// estimatedCounters are the counters the completion of a job is estimated
+// from, the first one with an expected total is used
+var estimatedCounters = []string{"bytes", "images"}
+
+// runningJob is a job running in the background, it is the progress of its
+// operation and the output of its logger
+type runningJob struct {
+	ctx  *HandlerContext
+	stop chan struct{}
+	once sync.Once
+
+	// lock protects job, expected and saved
+	lock sync.Mutex
+	job  db.Job
+	// expected are the totals the counters will reach, they aren't saved
+	expected map[string]int
+	// saved is when the job was last saved
+	saved time.Time
+}
+
+// expect sets the total a counter of the progress of the job will reach
+func (j *runningJob) expect(counter string, total int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.expected[counter] = total
+}
+
+// count adds n to a counter of the progress of the job
+func (j *runningJob) count(counter string, n int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.job.Progress[counter] += n
+	j.save(false)
+}
+
+// problem adds an error to the job
+func (j *runningJob) problem(description string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.job.Progress["errors"]++
+	if len(j.job.Errors) < maxJobErrors {
+		j.job.Errors = append(j.job.Errors, description)
+	}
+	j.save(false)
+}
+
+// cancelled returns true once the job was cancelled
+func (j *runningJob) cancelled() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancel asks the job to stop
+func (j *runningJob) cancel() {
+	j.once.Do(func() {
+		close(j.stop)
+	})
+}
+
+// Write adds lines to the log of the job, and to the admin log
+func (j *runningJob) Write(p []byte) (int, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		j.job.Log = append(j.job.Log, fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), line))
+		adminLogger.Printf("Job %s: %s", j.job.Id, line)
+	}
+	if len(j.job.Log) > maxJobLogLines {
+		j.job.Log = j.job.Log[len(j.job.Log)-maxJobLogLines:]
+	}
+	j.save(false)
+
+	return len(p), nil
+}
+
+// finish records the outcome of the job
+func (j *runningJob) finish(result interface{}, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.job.Finished = time.Now().UTC()
+	switch {
+	case err == errCancelled:
+		j.job.State = db.JobCancelled
+	case err != nil:
+		j.job.State = db.JobFailed
+		j.job.Errors = append(j.job.Errors, err.Error())
+	default:
+		j.job.State = db.JobDone
+		data, err := json.Marshal(result)
+		if err == nil {
+			j.job.Result = data
+		}
+	}
+	j.save(true)
+}
+
+// save writes the job to the current store, at most every jobSaveInterval
+// unless force is true. The lock must be held.
+func (j *runningJob) save(force bool) error {
+	if !force && time.Since(j.saved) < jobSaveInterval {
+		return nil
+	}
+
+	j.saved = time.Now()
+	err := j.ctx.Store().SaveJob(j.job)
+	if err != nil {
+		adminLogger.Printf("Could not save job %s: %v", j.job.Id, err)
+	}
+	return err
+}
+
+// snapshot returns a copy of the job
+func (j *runningJob) snapshot() db.Job {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job := j.job
+	job.Progress = make(map[string]int, len(j.job.Progress))
+	for counter, n := range j.job.Progress {
+		job.Progress[counter] = n
+	}
+	job.Errors = append([]string{}, j.job.Errors...)
+	job.Log = append([]string{}, j.job.Log...)
+	return job
+}
+
+// event returns the progress of the job as it is now
+func (j *runningJob) event() JobEvent {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return newJobEvent(j.job, j.expected, time.Now())
+}
+
+// JobEvent is the progress of a job, as streamed by AdminJobEventsHandler
+type JobEvent struct {
+	Id     string `json:"id"`
+	Kind   string `json:"kind"`
+	State  string `json:"state"`
+	Files  int    `json:"files"`
+	Apps   int    `json:"apps"`
+	Images int    `json:"images"`
+	// ImagesTotal is the number of images to download, 0 if it is unknown
+	ImagesTotal int    `json:"imagesTotal"`
+	Errors      int    `json:"errors"`
+	LastError   string `json:"lastError,omitempty"`
+	// Percent is how much of the work is done, and Eta the estimated number of
+	// seconds left, both are -1 when they are unknown
+	Percent float64 `json:"percent"`
+	Eta     float64 `json:"eta"`
+}
+
+// newJobEvent returns the progress of job at now, estimated from the expected
+// totals of its counters
+func newJobEvent(job db.Job, expected map[string]int, now time.Time) JobEvent {
+	event := JobEvent{
+		Id:          job.Id,
+		Kind:        job.Kind,
+		State:       job.State,
+		Files:       job.Progress["files"],
+		Apps:        job.Progress["apps"],
+		Images:      job.Progress["images"],
+		ImagesTotal: expected["images"],
+		Errors:      job.Progress["errors"],
+		Percent:     -1,
+		Eta:         -1,
+	}
+	if len(job.Errors) > 0 {
+		event.LastError = job.Errors[len(job.Errors)-1]
+	}
+
+	switch job.State {
+	case db.JobRunning:
+		for _, counter := range estimatedCounters {
+			if expected[counter] > 0 {
+				event.Percent, event.Eta = estimate(job.Progress[counter], expected[counter], now.Sub(job.Created))
+				break
+			}
+		}
+	case db.JobDone:
+		event.Percent, event.Eta = 100, 0
+	}
+
+	return event
+}
+
+// estimate returns the percentage of the work done, and the number of seconds
+// left at the same pace, once done out of total was done in elapsed. The
+// number of seconds is -1 until some work is done.
+func estimate(done int, total int, elapsed time.Duration) (float64, float64) {
+	if done >= total {
+		return 100, 0
+	}
+	percent := 100 * float64(done) / float64(total)
+	if done <= 0 {
+		return percent, -1
+	}
+
+	return percent, elapsed.Seconds() * float64(total-done) / float64(done)
+}
+
+// startJob runs run in the background as a job of the given kind, unless a
+// rebuild is already running (all jobs are rebuilds). run is given the job as
+// its progress, and a logger writing to the log of the job. It returns the
+// result of the job.
+func (ctx *HandlerContext) startJob(kind string, run func(j *runningJob, logger *log.Logger) (interface{}, error)) (db.Job, error) {
+	if !ctx.startRebuild() {
+		return db.Job{}, errRebuildRunning
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		ctx.endRebuild()
+		return db.Job{}, err
+	}
+	j := &runningJob{
+		ctx:  ctx,
+		stop: make(chan struct{}),
+		job: db.Job{
+			Id:       u.String(),
+			Kind:     kind,
+			State:    db.JobRunning,
+			Created:  time.Now().UTC(),
+			Progress: make(map[string]int),
+			Errors:   make([]string, 0),
+			Log:      make([]string, 0),
+		},
+		expected: make(map[string]int),
+	}
+	j.lock.Lock()
+	err = j.save(true)
+	j.lock.Unlock()
+	if err != nil {
+		ctx.endRebuild()
+		return db.Job{}, err
+	}
+
+	ctx.jobsLock.Lock()
+	if ctx.jobs == nil {
+		ctx.jobs = make(map[string]*runningJob)
+	}
+	ctx.jobs[j.job.Id] = j
+	ctx.jobsLock.Unlock()
+
+	go func() {
+		defer ctx.endRebuild()
+
+		result, err := run(j, log.New(j, "", 0))
+		j.finish(result, err)
+
+		ctx.jobsLock.Lock()
+		delete(ctx.jobs, j.job.Id)
+		ctx.jobsLock.Unlock()
+	}()
+
+	return j.snapshot(), nil
+}
+
+// runningJob returns the job with the given ID if it is running
+func (ctx *HandlerContext) runningJob(id string) (*runningJob, bool) {
+	ctx.jobsLock.Lock()
+	defer ctx.jobsLock.Unlock()
+
+	j, ok := ctx.jobs[id]
+	return j, ok
+}
+
+// getJob returns the job with the given ID, as it is now if it is running
+func (ctx *HandlerContext) getJob(id string) (db.Job, error) {
+	if j, ok := ctx.runningJob(id); ok {
+		return j.snapshot(), nil
+	}
+
+	return ctx.Store().GetJob(id)
+}
+
+// jobEvent returns the progress of the job with the given ID, it is called
+// while streaming, without holding the store
+func (ctx *HandlerContext) jobEvent(id string) (JobEvent, error) {
+	if j, ok := ctx.runningJob(id); ok {
+		return j.event(), nil
+	}
+
+	var job db.Job
+	err := ctx.withStore(func(store db.Store) error {
+		var err error
+		job, err = store.GetJob(id)
+		return err
+	})
+	if err != nil {
+		return JobEvent{}, err
+	}
+	return newJobEvent(job, nil, time.Now()), nil
+}
+
+// writeJob answers with a job as JSON
+func writeJob(w http.ResponseWriter, status int, job db.Job) (int, error) {
+	data, err := json.MarshalIndent(job, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Header().Add("location", "/admin/jobs/"+job.Id)
+	w.WriteHeader(status)
+	w.Write(data)
+	return status, nil
+}
+
+// startJobHandler starts a job, and answers with it (202), or 409 if a rebuild
+// is already running
+func startJobHandler(ctx *HandlerContext, w http.ResponseWriter, kind string, run func(j *runningJob, logger *log.Logger) (interface{}, error)) (int, error) {
+	job, err := ctx.startJob(kind, run)
+	if err == errRebuildRunning {
+		return http.StatusConflict, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJob(w, http.StatusAccepted, job)
+}
+
+// AdminJobsHandler lists the last 50 jobs, the most recent first
+func AdminJobsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	jobs, err := ctx.Store().GetJobs(50)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for i, job := range jobs {
+		if j, ok := ctx.runningJob(job.Id); ok {
+			jobs[i] = j.snapshot()
+		}
+	}
+
+	data, err := json.MarshalIndent(jobs, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AdminJobHandler returns the state, progress, errors and result of a job
+func AdminJobHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	job, err := ctx.getJob(mux.Vars(r)["id"])
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	return writeJob(w, http.StatusOK, job)
+}
+
+// AdminJobLogHandler returns the log of a job as text
+func AdminJobLogHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	job, err := ctx.getJob(mux.Vars(r)["id"])
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	w.Header().Add("content-type", "text/plain; charset=utf-8")
+	for _, line := range job.Log {
+		fmt.Fprintln(w, line)
+	}
+	return http.StatusOK, nil
+}
+
+// writeEvent sends a server-sent event with data as JSON
+func writeEvent(w http.ResponseWriter, name string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encoded)
+	if err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// AdminJobEventsHandler streams the progress of a job as server-sent events: a
+// "progress" event every jobEventInterval while it runs, then a "done" event
+// once it stopped, whatever its state
+func AdminJobEventsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	id := mux.Vars(r)["id"]
+	event, err := ctx.jobEvent(id)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		return http.StatusInternalServerError, errors.New("The response can't be streamed")
+	}
+
+	w.Header().Add("content-type", "text/event-stream")
+	w.Header().Add("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(jobEventInterval)
+	defer ticker.Stop()
+	for event.State == db.JobRunning {
+		err = writeEvent(w, "progress", event)
+		if err != nil {
+			adminLogger.Printf("Could not stream job %s: %v", id, err)
+			return http.StatusOK, nil
+		}
+
+		select {
+		case <-r.Context().Done():
+			return http.StatusOK, nil
+		case <-ticker.C:
+		}
+
+		event, err = ctx.jobEvent(id)
+		if err != nil {
+			adminLogger.Printf("Could not stream job %s: %v", id, err)
+			return http.StatusOK, nil
+		}
+	}
+
+	err = writeEvent(w, "done", event)
+	if err != nil {
+		adminLogger.Printf("Could not stream job %s: %v", id, err)
+	}
+	return http.StatusOK, nil
+}
+
+// AdminCancelJobHandler asks a running job to stop, and answers with the job
+// (202), or 409 if it is not running
+func AdminCancelJobHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	id := mux.Vars(r)["id"]
+	j, ok := ctx.runningJob(id)
+	if !ok {
+		_, err := ctx.Store().GetJob(id)
+		if err != nil {
+			return http.StatusNotFound, err
+		}
+		return http.StatusConflict, errors.New("The job is not running")
+	}
+
+	j.cancel()
+	return writeJob(w, http.StatusAccepted, j.snapshot())
+}
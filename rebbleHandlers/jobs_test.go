@@ -0,0 +1,259 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+
+	"github.com/gorilla/mux"
+)
+
+// adminRequest sends a request to the admin API, and decodes the JSON answer
+// into v if it is not nil
+func adminRequest(t *testing.T, r *mux.Router, method string, path string, v interface{}) *httptest.ResponseRecorder {
+	return adminRequestBody(t, r, method, path, "", v)
+}
+
+// adminRequestBody is adminRequest with a body
+func adminRequestBody(t *testing.T, r *mux.Router, method string, path string, body string, v interface{}) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest(method, "http://localhost"+path, strings.NewReader(body)))
+	if v != nil && res.Code < 400 {
+		err := json.Unmarshal(res.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	return res
+}
+
+// waitForJob waits until a job is no longer running, and returns it
+func waitForJob(t *testing.T, r *mux.Router, id string) db.Job {
+	for i := 0; i < 500; i++ {
+		var job db.Job
+		res := adminRequest(t, r, "GET", "/admin/jobs/"+id, &job)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected job %s, got %d", id, res.Code)
+		}
+		if job.State != db.JobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s is still running", id)
+	return db.Job{}
+}
+
+func TestRebuildJob(t *testing.T) {
+	defaultPaths := archivePaths
+	archivePaths = []string{testArchive}
+	defer func() {
+		archivePaths = defaultPaths
+	}()
+
+	ctx := &HandlerContext{Database: db.NewMemoryStore()}
+	r := Handlers(ctx)
+
+	var job db.Job
+	res := adminRequest(t, r, "POST", "/admin/rebuild/db", &job)
+	if res.Code != http.StatusAccepted || res.Header().Get("Location") != "/admin/jobs/"+job.Id || job.State != db.JobRunning {
+		t.Fatalf("expected the job to be started, got %d %s", res.Code, res.Body)
+	}
+
+	job = waitForJob(t, r, job.Id)
+	var report ImportReport
+	err := json.Unmarshal(job.Result, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != db.JobDone || job.Progress["files"] != 4 || job.Progress["apps"] != 3 || job.Progress["bytes"] == 0 || report.Imported != 3 || job.Finished.IsZero() {
+		t.Errorf("unexpected job %+v", job)
+	}
+
+	// The job is saved in the rebuilt database, along with its log
+	saved, err := ctx.Store().GetJob(job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.State != db.JobDone {
+		t.Errorf("expected the job to be saved as done, got %+v", saved)
+	}
+	res = adminRequest(t, r, "GET", "/admin/jobs/"+job.Id+"/log", nil)
+	if !strings.Contains(res.Body.String(), "Imported 3 apps") {
+		t.Errorf("unexpected log %s", res.Body)
+	}
+
+	var jobs []db.Job
+	adminRequest(t, r, "GET", "/admin/jobs", &jobs)
+	if len(jobs) != 1 || jobs[0].Id != job.Id {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx := &HandlerContext{Database: db.NewMemoryStore()}
+	r := Handlers(ctx)
+
+	started := make(chan struct{})
+	job, err := ctx.startJob("test", func(j *runningJob, logger *log.Logger) (interface{}, error) {
+		close(started)
+		for !j.cancelled() {
+			time.Sleep(time.Millisecond)
+		}
+		return nil, errCancelled
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// Only one rebuild runs at a time
+	res := adminRequest(t, r, "POST", "/admin/rebuild/images", nil)
+	if res.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", res.Code)
+	}
+
+	res = adminRequest(t, r, "POST", "/admin/jobs/"+job.Id+"/cancel", nil)
+	if res.Code != http.StatusAccepted {
+		t.Errorf("expected the job to be cancelled, got %d", res.Code)
+	}
+	job = waitForJob(t, r, job.Id)
+	if job.State != db.JobCancelled {
+		t.Errorf("expected the job to be cancelled, got %+v", job)
+	}
+
+	res = adminRequest(t, r, "POST", "/admin/jobs/"+job.Id+"/cancel", nil)
+	if res.Code != http.StatusConflict {
+		t.Errorf("expected a finished job not to be cancelled, got %d", res.Code)
+	}
+	res = adminRequest(t, r, "GET", "/admin/jobs/unknown", nil)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", res.Code)
+	}
+}
+
+// readEvents parses a stream of server-sent events into their names and data
+func readEvents(t *testing.T, stream string) ([]string, []JobEvent) {
+	names := make([]string, 0)
+	events := make([]JobEvent, 0)
+	for _, block := range strings.Split(strings.TrimSpace(stream), "\n\n") {
+		var name string
+		var event JobEvent
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		names = append(names, name)
+		events = append(events, event)
+	}
+
+	return names, events
+}
+
+func TestJobEvents(t *testing.T) {
+	defaultInterval := jobEventInterval
+	jobEventInterval = time.Millisecond
+	defer func() {
+		jobEventInterval = defaultInterval
+	}()
+
+	ctx := &HandlerContext{Database: db.NewMemoryStore()}
+	r := Handlers(ctx)
+
+	release := make(chan struct{})
+	job, err := ctx.startJob("test", func(j *runningJob, logger *log.Logger) (interface{}, error) {
+		j.expect("bytes", 4)
+		j.problem("1.json: No data")
+		j.count("files", 1)
+		j.count("bytes", 2)
+		<-release
+		j.count("bytes", 2)
+		j.count("files", 1)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+
+	// The stream ends once the job is done
+	res := adminRequest(t, r, "GET", "/admin/jobs/"+job.Id+"/events", nil)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected a stream of events, got %d %s", res.Code, res.Body)
+	}
+	names, events := readEvents(t, res.Body.String())
+	last := len(events) - 1
+	if last < 1 || names[last] != "done" {
+		t.Fatalf("expected progress events then a done event, got %s", res.Body)
+	}
+	// The job waits halfway for a while, so some events are sent meanwhile
+	halfway := false
+	for i, event := range events[:last] {
+		if names[i] != "progress" || event.State != db.JobRunning {
+			t.Errorf("unexpected event %s %+v", names[i], event)
+		}
+		if event.Percent == 50 {
+			halfway = true
+			if event.Files != 1 || event.Eta < 0 || event.Errors != 1 || event.LastError != "1.json: No data" {
+				t.Errorf("unexpected progress %+v", event)
+			}
+		}
+	}
+	if !halfway {
+		t.Errorf("expected the progress halfway, got %s", res.Body)
+	}
+	done := events[last]
+	if done.State != db.JobDone || done.Files != 2 || done.Percent != 100 || done.Eta != 0 {
+		t.Errorf("unexpected done event %+v", done)
+	}
+
+	// A finished job only gets the done event
+	res = adminRequest(t, r, "GET", "/admin/jobs/"+job.Id+"/events", nil)
+	names, _ = readEvents(t, res.Body.String())
+	if len(names) != 1 || names[0] != "done" {
+		t.Errorf("expected a single done event, got %s", res.Body)
+	}
+	res = adminRequest(t, r, "GET", "/admin/jobs/unknown/events", nil)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", res.Code)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		done    int
+		total   int
+		elapsed time.Duration
+		percent float64
+		eta     float64
+	}{
+		{0, 100, time.Second, 0, -1},
+		{25, 100, 10 * time.Second, 25, 30},
+		{100, 100, 10 * time.Second, 100, 0},
+		{120, 100, 10 * time.Second, 100, 0},
+	}
+	for _, test := range tests {
+		percent, eta := estimate(test.done, test.total, test.elapsed)
+		if percent != test.percent || eta != test.eta {
+			t.Errorf("%d/%d in %v: expected %v%% and %vs left, got %v%% and %vs", test.done, test.total, test.elapsed, test.percent, test.eta, percent, eta)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package rebbleHandlers
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pebble-dev/rebblestore-api/db"
+
+	"github.com/adams-sarah/test2doc/test"
+	"github.com/gorilla/mux"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of the handler tests")
+
+var server *test.Server
+
+// TestMain runs the handler tests against an in-memory store loaded with the
+// fixture catalog, so responses are always the same.
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	// Handlers use paths relative to the root of the project (static/,
+	// PebbleImages/), as the server is started from there.
+	err := os.Chdir("..")
+	if err != nil {
+		panic(err.Error())
+	}
+
+	store := db.NewMemoryStore()
+	err = db.LoadFixture(store, "db/testdata/catalog.json")
+	if err != nil {
+		panic("Could not load fixture: " + err.Error())
+	}
+
+	r := Handlers(&HandlerContext{Database: store})
+	r.KeepContext = true
+	test.RegisterURLVarExtractor(mux.Vars)
+
+	server, err = test.NewServer(r)
+	if err != nil {
+		panic(err.Error())
+	}
+	exitCode := m.Run()
+
+	server.Finish()
+	server.Close()
+	os.Exit(exitCode)
+}
+
+// checkGolden requests path from the test server, and compares the response to
+// the golden file testdata/<name>.golden.json. Run the tests with -update to
+// regenerate the golden files.
+func checkGolden(t *testing.T, path string, name string) {
+	res, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %v", path, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("rebbleHandlers", "testdata", name+".golden.json")
+	if *update {
+		err = ioutil.WriteFile(golden, body, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("%s: response does not match %s, got:\n%s", path, golden, body)
+	}
+}
+
+// checkStatus requests path from the test server, and checks the status code
+// of the response
+func checkStatus(t *testing.T, path string, status int) {
+	res, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != status {
+		t.Fatalf("%s: expected %v, got %v", path, status, res.StatusCode)
+	}
+}
+
+// Shortcuts to apps of the fixture
+const (
+	weatherNowId = "500047e81195154d21eb4f43"
+	bigTimeId    = "5003d94014e27459d032ab58"
+	toolsId      = "5261a8fb3b773043d500000c"
+	facesId      = "528d3ef2dc7b5f580700000a"
+)
+
+func TestAppsHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/get_apps/page/1", "apps")
+	checkGolden(t, "/dev/apps/get_apps/page/2?limit=5&sortby=popular&order=asc", "apps_popular_page2")
+	checkStatus(t, "/dev/apps/get_apps/page/1?limit=51", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/get_apps/page/1?limit=1&limit=2", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/get_apps/page/1?order=up", http.StatusBadRequest)
+}
+
+func TestAppHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/get_app/id/"+weatherNowId, "app")
+	checkStatus(t, "/dev/apps/get_app/id/doesnotexist", http.StatusInternalServerError)
+}
+
+func TestTagsHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/get_tags/id/"+bigTimeId, "tags")
+}
+
+func TestVersionsHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/get_versions/id/"+weatherNowId, "versions")
+}
+
+func TestCollectionHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/get_collection/id/"+toolsId, "collection")
+	checkGolden(t, fmt.Sprintf("/dev/apps/get_collection/id/%s?order=popular&platform=chalk", facesId), "collection_popular_chalk")
+	checkStatus(t, "/dev/apps/get_collection/id/"+toolsId+"?page=2", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/get_collection/id/"+toolsId+"?platform=emery", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/get_collection/id/doesnotexist", http.StatusInternalServerError)
+}
+
+func TestSearchHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/search/weather", "search")
+	checkGolden(t, "/dev/apps/search/nothing%20matches", "search_empty")
+	checkGolden(t, "/dev/apps/search/wether", "search_did_you_mean")
+	checkGolden(t, "/dev/apps/search/a?type=watchapp&platform=chalk&published_from=2015-01-01&published_to=2015-12-31", "search_filtered")
+	checkStatus(t, "/dev/apps/search/weather?type=app", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?platform=emery", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?author=abc", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?published_from=2015", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?category=a&category=b", http.StatusBadRequest)
+	checkGolden(t, "/dev/apps/search/a?page=2&limit=5&sortby=name", "search_page2_name")
+	checkStatus(t, "/dev/apps/search/weather?limit=51", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?limit=0", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?page=0", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?page=1&page=2", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?page=1001", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?page=9223372036854775807&limit=50", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather?sortby=hearts", http.StatusBadRequest)
+	checkGolden(t, "/dev/apps/search/type:watchface%20hearts:%3E100", "search_qualifiers")
+	checkGolden(t, "/dev/apps/search/wether%20type:watchapp", "search_qualifiers_did_you_mean")
+	checkStatus(t, "/dev/apps/search/type:app", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/author:%22Foo", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/hearts:%3C0", http.StatusBadRequest)
+	checkStatus(t, "/dev/apps/search/weather%20type:watchface?type=watchapp", http.StatusBadRequest)
+}
+
+func TestSuggestHandler(t *testing.T) {
+	checkGolden(t, "/dev/apps/suggest/t", "suggest")
+	checkGolden(t, "/dev/apps/suggest/big%20ti", "suggest_words")
+	checkGolden(t, "/dev/apps/suggest/%20", "suggest_empty")
+}
+
+func TestAuthorHandler(t *testing.T) {
+	checkGolden(t, "/dev/author/id/1", "author")
+	checkStatus(t, "/dev/author/id/abc", http.StatusBadRequest)
+	checkStatus(t, "/dev/author/id/42", http.StatusInternalServerError)
+}
+
+func TestImagesHandler(t *testing.T) {
+	checkStatus(t, "/images/..%2F..%2Fetc%2Fpasswd", http.StatusNotFound)
+}
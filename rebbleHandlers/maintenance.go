@@ -0,0 +1,147 @@
+package rebbleHandlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// CatalogStats counts the contents of the catalog
+type CatalogStats struct {
+	Apps        int `json:"apps"`
+	Watchapps   int `json:"watchapps"`
+	Watchfaces  int `json:"watchfaces"`
+	Authors     int `json:"authors"`
+	Collections int `json:"collections"`
+	Versions    int `json:"versions"`
+	Screenshots int `json:"screenshots"`
+	// LocalScreenshots are the screenshots downloaded to PebbleImages/ by
+	// RebuildImages
+	LocalScreenshots int `json:"local_screenshots"`
+	// Platforms is the number of apps supporting each platform
+	Platforms map[string]int `json:"platforms"`
+}
+
+// localImage returns the name of the image in PebbleImages/ that url points to,
+// if it points to one
+func localImage(url string) (string, bool) {
+	if !strings.HasPrefix(url, "/images/") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(url, "/images/"), true
+}
+
+// GetCatalogStats counts the apps, authors, collections, versions and
+// screenshots of the catalog
+func GetCatalogStats(store db.Store) (CatalogStats, error) {
+	catalog, err := store.ExportCatalog()
+	if err != nil {
+		return CatalogStats{}, err
+	}
+
+	stats := CatalogStats{
+		Apps:        len(catalog.Apps),
+		Authors:     len(catalog.Authors),
+		Collections: len(catalog.Collections),
+		Platforms:   make(map[string]int),
+	}
+	for _, app := range catalog.Apps {
+		switch app.Type {
+		case "watchapp":
+			stats.Watchapps++
+		case "watchface":
+			stats.Watchfaces++
+		}
+
+		for _, platform := range app.SupportedPlatforms {
+			stats.Platforms[platform]++
+		}
+
+		for _, platform := range *app.Assets.Screenshots {
+			for _, url := range platform.Screenshots {
+				stats.Screenshots++
+				if _, ok := localImage(url); ok {
+					stats.LocalScreenshots++
+				}
+			}
+		}
+	}
+	for _, versions := range catalog.Versions {
+		stats.Versions += len(versions)
+	}
+
+	return stats, nil
+}
+
+// CheckCatalog looks for inconsistencies in the catalog: apps that can't be
+// displayed properly, collections without any app, authors sharing the same
+// name, and downloaded screenshots missing from the images directory. It
+// returns a description of each problem found.
+func CheckCatalog(store db.Store, images string) ([]string, error) {
+	catalog, err := store.ExportCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]string, 0)
+
+	authors := make(map[string]int)
+	for _, author := range catalog.Authors {
+		if id, ok := authors[author.Name]; ok {
+			problems = append(problems, fmt.Sprintf("Authors %d and %d have the same name %q", id, author.Id, author.Name))
+		} else {
+			authors[author.Name] = author.Id
+		}
+	}
+
+	// Membership is what the collections list, apps can be added to and
+	// removed from collections by hand
+	collected := make(map[string]bool)
+	for _, appIds := range catalog.CollectionApps {
+		for _, id := range appIds {
+			collected[id] = true
+		}
+	}
+
+	for _, app := range catalog.Apps {
+		if app.Name == "" {
+			problems = append(problems, fmt.Sprintf("App %s has no title", app.Id))
+		}
+		if app.Type != "watchapp" && app.Type != "watchface" {
+			problems = append(problems, fmt.Sprintf("App %s has an unknown type %q", app.Id, app.Type))
+		}
+		if len(app.SupportedPlatforms) == 0 {
+			problems = append(problems, fmt.Sprintf("App %s supports no platform", app.Id))
+		}
+		if !collected[app.Id] {
+			problems = append(problems, fmt.Sprintf("App %s is in no collection", app.Id))
+		}
+
+		for _, platform := range *app.Assets.Screenshots {
+			for _, url := range platform.Screenshots {
+				image, ok := localImage(url)
+				if !ok {
+					continue
+				}
+				_, err := os.Stat(filepath.Join(images, image))
+				if os.IsNotExist(err) {
+					problems = append(problems, fmt.Sprintf("App %s has a missing screenshot %s", app.Id, url))
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, collection := range catalog.Collections {
+		if len(catalog.CollectionApps[collection.Id]) == 0 {
+			problems = append(problems, fmt.Sprintf("Collection %s (%s) has no app", collection.Id, collection.Name))
+		}
+	}
+
+	return problems, nil
+}
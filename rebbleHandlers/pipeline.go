@@ -0,0 +1,132 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// importWorkers is the number of goroutines decoding the files of the archive
+var importWorkers = runtime.NumCPU()
+
+// importWindow is the number of files that may be read ahead of the one being
+// merged, which bounds the memory used by an import
+var importWindow = 256
+
+// importBatchSize is the number of apps written to the database in each
+// transaction
+var importBatchSize = 500
+
+// decodedFile is a file of the archive, decoded by a worker
+type decodedFile struct {
+	name string
+	app  *PebbleApplication
+	// source is the original record of the app
+	source json.RawMessage
+	// err is the reason why the file can't be imported
+	err error
+	// size is the number of bytes of the archive read for the file
+	size int64
+}
+
+// decodeArchive reads the files of source and decodes them with workers
+// goroutines, then calls handle with each file in the order of source, so that
+// the result doesn't depend on the order in which the workers finish. At most
+// window files are read ahead of handle. The first error of handle, or of
+// source, stops the decoding and is returned.
+func decodeArchive(source fileSource, workers int, window int, handle func(file decodedFile) error) error {
+	type job struct {
+		index int
+		file  sourceFile
+	}
+	type result struct {
+		index int
+		file  decodedFile
+	}
+
+	jobs := make(chan job)
+	// Every file read takes a token, which is given back once it is handled
+	tokens := make(chan struct{}, window)
+	results := make(chan result, window)
+	done := make(chan struct{})
+
+	var readErr error
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		defer close(jobs)
+		for index := 0; ; index++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			file, err := source.Next()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				readErr = err
+				return
+			}
+
+			select {
+			case jobs <- job{index, file}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var decoding sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		decoding.Add(1)
+		go func() {
+			defer decoding.Done()
+			for j := range jobs {
+				decoded := decodedFile{name: j.file.Name, err: j.file.Err, size: j.file.Size}
+				if decoded.err == nil {
+					decoded.app, decoded.source, decoded.err = decodeApp(j.file.Data)
+				}
+				// There are never more results than tokens, this doesn't
+				// block
+				results <- result{j.index, decoded}
+			}
+		}()
+	}
+	go func() {
+		decoding.Wait()
+		close(results)
+	}()
+
+	// The source must not be read anymore once this returns
+	defer func() {
+		close(done)
+		<-reading
+		decoding.Wait()
+	}()
+
+	pending := make(map[int]decodedFile)
+	next := 0
+	for r := range results {
+		pending[r.index] = r.file
+		for {
+			file, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-tokens
+
+			err := handle(file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	<-reading
+	return readErr
+}
@@ -0,0 +1,238 @@
+package rebbleHandlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// withImportSettings runs f with the given number of workers and batch size
+func withImportSettings(workers int, batchSize int, f func()) {
+	defaultWorkers, defaultBatchSize := importWorkers, importBatchSize
+	importWorkers, importBatchSize = workers, batchSize
+	defer func() {
+		importWorkers, importBatchSize = defaultWorkers, defaultBatchSize
+	}()
+
+	f()
+}
+
+func TestImportArchiveBatches(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	var expected db.Fixture
+	withImportSettings(1, 1000, func() {
+		store := db.NewMemoryStore()
+		_, err := ImportArchive(store, testArchive, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err = store.ExportCatalog()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// With one app per batch, the second record of Tide Clock is merged into
+	// the app written with the previous batch
+	for _, workers := range []int{1, 2, 8} {
+		withImportSettings(workers, 1, func() {
+			store := db.NewMemoryStore()
+			report, err := ImportArchive(store, testArchive, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Files != 4 || report.Imported != 3 {
+				t.Errorf("%d workers: unexpected report %+v", workers, report)
+			}
+
+			catalog, err := store.ExportCatalog()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(catalog, expected) {
+				t.Errorf("%d workers: expected %+v, got %+v", workers, expected, catalog)
+			}
+		})
+	}
+}
+
+// memorySource is a fileSource of numbered files
+type memorySource struct {
+	files int
+	next  int
+}
+
+func (source *memorySource) Next() (sourceFile, error) {
+	if source.next == source.files {
+		return sourceFile{}, errors.New("No more files")
+	}
+	source.next++
+	return sourceFile{Name: fmt.Sprintf("%d.json", source.next), Data: []byte("{}"), Size: 2}, nil
+}
+
+func (source *memorySource) Size() int64 {
+	return int64(source.files * 2)
+}
+
+func (source *memorySource) Close() error {
+	return nil
+}
+
+func TestDecodeArchive(t *testing.T) {
+	// Files are handled in order, and errors of the source are returned
+	source := &memorySource{files: 100}
+	handled := 0
+	err := decodeArchive(source, 8, 4, func(file decodedFile) error {
+		handled++
+		if file.name != fmt.Sprintf("%d.json", handled) {
+			t.Fatalf("expected file %d, got %s", handled, file.name)
+		}
+		if file.err == nil {
+			t.Fatalf("expected %s to be rejected", file.name)
+		}
+		return nil
+	})
+	if err == nil || handled != 100 {
+		t.Errorf("expected the error of the source after 100 files, got %v after %d", err, handled)
+	}
+
+	// An error of handle stops the decoding
+	source = &memorySource{files: 100}
+	err = decodeArchive(source, 8, 4, func(file decodedFile) error {
+		if file.name == "10.json" {
+			return errors.New("Stop")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "Stop" {
+		t.Errorf("expected the error of handle, got %v", err)
+	}
+	if source.next > 10+4 {
+		t.Errorf("expected at most 4 files to be read ahead, %d were read", source.next)
+	}
+}
+
+// syntheticAppRecord is the record of an app of the synthetic archive
+const syntheticAppRecord = `{"data": [{
+	"id": "%024x",
+	"uuid": "00000000-0000-0000-0000-%012x",
+	"title": "Synthetic app %d",
+	"author": "Developer %d",
+	"developer_id": "%024x",
+	"category_id": "category%d",
+	"category_name": "Category %d",
+	"category_color": "ffffff",
+	"description": "A synthetic app to benchmark the import of the archive.",
+	"published_date": "2016-05-14T08:30:00.000Z",
+	"latest_release": {"id": "release%d", "pbw_file": "https://example.com/%d.pbw", "published_date": "2016-06-01T12:00:00.000Z", "version": "1.0"},
+	"screenshot_images": [{"144x168": "https://example.com/%d-%s.png"}],
+	"icon_image": {"48x48": "https://example.com/%d.png"},
+	"screenshot_hardware": "%s",
+	"header_images": "",
+	"hearts": %d,
+	"type": "watchface",
+	"compatibility": {"ios": {"supported": true}, "android": {"supported": true}, "aplite": {"supported": true}, "basalt": {"supported": true}},
+	"changelog": [{"version": "1.0", "release_notes": "Initial release", "published_date": "2016-06-01T12:00:00.000Z"}]
+}]}`
+
+// writeSyntheticArchive writes a .tar.gz archive of apps apps, each described
+// for two hardware platforms, into dir
+func writeSyntheticArchive(b *testing.B, dir string, apps int) string {
+	path := filepath.Join(dir, "synthetic.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+
+	for i := 0; i < apps; i++ {
+		for _, hardware := range []string{"aplite", "basalt"} {
+			data := fmt.Sprintf(syntheticAppRecord, i, i, i, i%100, i%100, i%10, i%10, i, i, i, hardware, i, hardware, i)
+			err = archive.WriteHeader(&tar.Header{Name: fmt.Sprintf("apps/%024x-%s.json", i, hardware), Mode: 0644, Size: int64(len(data))})
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = archive.Write([]byte(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return path
+}
+
+func BenchmarkImportArchive(b *testing.B) {
+	dir, err := ioutil.TempDir("", "rebblestore-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := writeSyntheticArchive(b, dir, 2000)
+	logger := log.New(ioutil.Discard, "", 0)
+
+	databases := 0
+	stores := map[string]func() db.Store{
+		"memory": func() db.Store {
+			return db.NewMemoryStore()
+		},
+		"sqlite": func() db.Store {
+			databases++
+			store, err := db.Open(filepath.Join(dir, fmt.Sprintf("bench%d.db", databases)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = store.Migrate()
+			if err != nil {
+				b.Fatal(err)
+			}
+			return store
+		},
+	}
+	workerCounts := []int{1}
+	if importWorkers > 1 {
+		workerCounts = append(workerCounts, importWorkers)
+	}
+	for _, name := range []string{"memory", "sqlite"} {
+		for _, workers := range workerCounts {
+			b.Run(fmt.Sprintf("%s/%d-workers", name, workers), func(b *testing.B) {
+				withImportSettings(workers, importBatchSize, func() {
+					for i := 0; i < b.N; i++ {
+						b.StopTimer()
+						store := stores[name]()
+						b.StartTimer()
+
+						report, err := ImportArchive(store, archive, logger)
+						if err != nil {
+							b.Fatal(err)
+						}
+						if report.Imported != 2000 {
+							b.Fatalf("expected 2000 apps, got %+v", report)
+						}
+						store.Close()
+					}
+				})
+			})
+		}
+	}
+}
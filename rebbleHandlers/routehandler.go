@@ -3,6 +3,8 @@ package rebbleHandlers
 import (
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"pebble-dev/rebblestore-api/db"
 )
@@ -10,7 +12,116 @@ import (
 // HandlerContext is our struct for storing the data we want to inject in to each handler
 // we can also add things like authorization level, user information, templates, etc.
 type HandlerContext struct {
-	Database *db.Handler
+	// Database is the store the context starts with, handlers use Store as
+	// it is replaced by rebuilds
+	Database db.Store
+	// SearchLog are the privacy settings of the log of the searches
+	SearchLog db.SearchLogOptions
+
+	// lock protects Database
+	lock sync.RWMutex
+	// swapLock is held for reading while a request runs, and for writing
+	// while the store is replaced, so that a store is never closed while it
+	// is used
+	swapLock sync.RWMutex
+	// rebuilding is 1 while a rebuild is running
+	rebuilding int32
+	// replacing is 1 from the moment the store is shadowed until the shadow
+	// replaces it or is dropped, collectionsLock is held for reading while
+	// the collections are changed and for writing while the store is
+	// shadowed, so that no change is missing from the shadow
+	replacing       int32
+	collectionsLock sync.RWMutex
+	// jobs are the jobs running in the background, by ID
+	jobs     map[string]*runningJob
+	jobsLock sync.Mutex
+	// searches are the searches waiting to be logged, written to the store
+	// by writeSearchLog until it closes searchLogDone
+	searches      chan db.SearchLogEntry
+	searchLogDone chan struct{}
+	searchLogLock sync.Mutex
+}
+
+// Store returns the current store
+func (ctx *HandlerContext) Store() db.Store {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+
+	return ctx.Database
+}
+
+// withStore calls f with the current store, which isn't replaced until f
+// returns. Requests don't need it, they hold the store while they run.
+func (ctx *HandlerContext) withStore(f func(store db.Store) error) error {
+	ctx.swapLock.RLock()
+	defer ctx.swapLock.RUnlock()
+
+	return f(ctx.Store())
+}
+
+// swapStore replaces live, the current store, with shadow (see
+// db.Store.Replace) once the requests using it are done. Requests wait for the
+// swap to start.
+func (ctx *HandlerContext) swapStore(live db.Store, shadow db.Store) error {
+	ctx.swapLock.Lock()
+	defer ctx.swapLock.Unlock()
+
+	store, err := live.Replace(shadow)
+	if store != nil {
+		ctx.lock.Lock()
+		ctx.Database = store
+		ctx.lock.Unlock()
+	}
+	return err
+}
+
+// startRebuild returns true if no other rebuild is running, in which case
+// endRebuild must be called once done
+func (ctx *HandlerContext) startRebuild() bool {
+	return atomic.CompareAndSwapInt32(&ctx.rebuilding, 0, 1)
+}
+
+// endRebuild allows other rebuilds to start
+func (ctx *HandlerContext) endRebuild() {
+	atomic.StoreInt32(&ctx.rebuilding, 0)
+}
+
+// shadowStore returns a shadow of live (see db.Store.Shadow) once the changes
+// to the collections being made are done. If it succeeds, the collections
+// can't be changed anymore until endReplace is called, as the changes would be
+// lost when the shadow replaces live.
+func (ctx *HandlerContext) shadowStore(live db.Store) (db.Store, error) {
+	ctx.collectionsLock.Lock()
+	defer ctx.collectionsLock.Unlock()
+
+	shadow, err := live.Shadow()
+	if err == nil {
+		atomic.StoreInt32(&ctx.replacing, 1)
+	}
+	return shadow, err
+}
+
+// endReplace allows the collections to be changed again, once the shadow
+// returned by shadowStore replaced the store or was dropped
+func (ctx *HandlerContext) endReplace() {
+	atomic.StoreInt32(&ctx.replacing, 0)
+}
+
+// lockCollections returns true if the collections can be changed, in which
+// case unlockCollections must be called once they are. They can't while a
+// rebuild replaces the store.
+func (ctx *HandlerContext) lockCollections() bool {
+	ctx.collectionsLock.RLock()
+	if atomic.LoadInt32(&ctx.replacing) == 1 {
+		ctx.collectionsLock.RUnlock()
+		return false
+	}
+	return true
+}
+
+// unlockCollections allows the store to be shadowed again
+func (ctx *HandlerContext) unlockCollections() {
+	ctx.collectionsLock.RUnlock()
 }
 
 // routeHandler is a struct that implements http.Handler, allowing us to inject a custom context
@@ -26,6 +137,23 @@ type routeHandler struct {
 var StoreUrl string
 
 func (rh routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.context.swapLock.RLock()
+	defer rh.context.swapLock.RUnlock()
+
+	rh.serve(w, r)
+}
+
+// streamHandler is a routeHandler whose responses last as long as a job runs.
+// They don't hold the store while they run, as the job may replace it, and use
+// withStore instead.
+type streamHandler routeHandler
+
+func (sh streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	routeHandler(sh).serve(w, r)
+}
+
+// serve calls the handler function, and answers with the error it returns
+func (rh routeHandler) serve(w http.ResponseWriter, r *http.Request) {
 	// Write common headers
 	// http://stackoverflow.com/a/24818638
 	w.Header().Add("Access-Control-Allow-Origin", StoreUrl)
@@ -39,12 +167,10 @@ func (rh routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// if the handler function returns an error, we log the error and send the appropriate error message
 	if err != nil {
 		log.Printf("HTTP %d: %q", status, err)
-		switch status {
-		case http.StatusNotFound:
-			http.NotFound(w, r)
-		case http.StatusInternalServerError:
-			http.Error(w, http.StatusText(status), status)
-		default:
+		if status >= 400 && status < 500 {
+			// The client can fix the request, tell it what is wrong
+			http.Error(w, err.Error(), status)
+		} else {
 			http.Error(w, http.StatusText(status), status)
 		}
 	}
@@ -25,9 +25,30 @@ func Handlers(context *HandlerContext) *mux.Router {
 	r.Handle("/dev/apps/get_versions/id/{id}", routeHandler{context, VersionsHandler}).Methods("GET")
 	r.Handle("/dev/apps/get_collection/id/{id}", routeHandler{context, CollectionHandler}).Methods("GET")
 	r.Handle("/dev/apps/search/{query}", routeHandler{context, SearchHandler}).Methods("GET")
+	r.Handle("/dev/apps/suggest/{prefix}", routeHandler{context, SuggestHandler}).Methods("GET")
 	r.Handle("/dev/author/id/{id}", routeHandler{context, AuthorHandler}).Methods("GET")
+	r.Handle("/1/indexes/{index}", routeHandler{context, AlgoliaQueryHandler}).Methods("GET")
+	r.Handle("/1/indexes/{index}/query", routeHandler{context, AlgoliaQueryHandler}).Methods("POST")
+	r.Handle("/1/indexes/*/queries", routeHandler{context, AlgoliaQueriesHandler}).Methods("POST")
 	r.Handle("/admin/rebuild/db", routeHandler{context, AdminRebuildDBHandler}).Host("localhost")
 	r.Handle("/admin/rebuild/images", routeHandler{context, AdminRebuildImagesHandler}).Host("localhost")
+	r.Handle("/admin/search/top", routeHandler{context, AdminTopSearchesHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/search/zero_results", routeHandler{context, AdminZeroResultSearchesHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/search/history", routeHandler{context, AdminSearchHistoryHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/jobs", routeHandler{context, AdminJobsHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/jobs/{id}", routeHandler{context, AdminJobHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/jobs/{id}/log", routeHandler{context, AdminJobLogHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/jobs/{id}/events", streamHandler{context, AdminJobEventsHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/jobs/{id}/cancel", routeHandler{context, AdminCancelJobHandler}).Host("localhost").Methods("POST")
+	r.Handle("/admin/collections", routeHandler{context, AdminCollectionsHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/collections", routeHandler{context, AdminCreateCollectionHandler}).Host("localhost").Methods("POST")
+	r.Handle("/admin/collections/order", routeHandler{context, AdminOrderCollectionsHandler}).Host("localhost").Methods("POST")
+	r.Handle("/admin/collections/{id}", routeHandler{context, AdminCollectionHandler}).Host("localhost").Methods("GET")
+	r.Handle("/admin/collections/{id}", routeHandler{context, AdminUpdateCollectionHandler}).Host("localhost").Methods("POST")
+	r.Handle("/admin/collections/{id}", routeHandler{context, AdminDeleteCollectionHandler}).Host("localhost").Methods("DELETE")
+	r.Handle("/admin/collections/{id}/apps", routeHandler{context, AdminAddCollectionAppsHandler}).Host("localhost").Methods("POST")
+	r.Handle("/admin/collections/{id}/apps/order", routeHandler{context, AdminOrderCollectionAppsHandler}).Host("localhost").Methods("POST")
+	r.Handle("/admin/collections/{id}/apps/{app}", routeHandler{context, AdminRemoveCollectionAppHandler}).Host("localhost").Methods("DELETE")
 	r.Handle("/admin/version", routeHandler{context, AdminVersionHandler})
 	//r.HandleFunc("/boot/{path:.*}", BootHandler).Methods("GET")
 	// Added OS parameter
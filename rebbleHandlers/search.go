@@ -4,21 +4,174 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
 
 	"github.com/gorilla/mux"
 )
 
-// SearchHandler is the search page
+// searchFilters reads the optional filters of a search from the URL query
+func searchFilters(urlquery url.Values) (db.SearchFilters, error) {
+	var filters db.SearchFilters
+	for _, parameter := range []string{"type", "platform", "category", "author", "published_from", "published_to"} {
+		if len(urlquery[parameter]) > 1 {
+			return db.SearchFilters{}, errors.New("Multiple '" + parameter + "' parameters are not allowed")
+		}
+	}
+
+	if o, ok := urlquery["type"]; ok {
+		if o[0] != "watchapp" && o[0] != "watchface" {
+			return db.SearchFilters{}, errors.New("Invalid 'type' parameter")
+		}
+		filters.Type = o[0]
+	}
+	if o, ok := urlquery["platform"]; ok {
+		if o[0] != "aplite" && o[0] != "basalt" && o[0] != "chalk" && o[0] != "diorite" {
+			return db.SearchFilters{}, errors.New("Invalid 'platform' parameter")
+		}
+		filters.Platform = o[0]
+	}
+	if o, ok := urlquery["category"]; ok {
+		if o[0] == "" {
+			return db.SearchFilters{}, errors.New("Invalid 'category' parameter")
+		}
+		filters.Category = o[0]
+	}
+	if o, ok := urlquery["author"]; ok {
+		author, err := strconv.Atoi(o[0])
+		if err != nil || author < 1 {
+			return db.SearchFilters{}, errors.New("Parameter 'author' should be a positive, non-nul integer")
+		}
+		filters.Author = author
+	}
+
+	// Both dates are days (YYYY-MM-DD) and are included in the range
+	if o, ok := urlquery["published_from"]; ok {
+		from, err := time.Parse("2006-01-02", o[0])
+		if err != nil {
+			return db.SearchFilters{}, errors.New("Parameter 'published_from' should be a date (YYYY-MM-DD)")
+		}
+		filters.PublishedFrom = from
+	}
+	if o, ok := urlquery["published_to"]; ok {
+		to, err := time.Parse("2006-01-02", o[0])
+		if err != nil {
+			return db.SearchFilters{}, errors.New("Parameter 'published_to' should be a date (YYYY-MM-DD)")
+		}
+		filters.PublishedUntil = to.AddDate(0, 0, 1)
+	}
+
+	return filters, nil
+}
+
+// searchLogFilters returns the filters and the order of a search as they are
+// recorded in the search log
+func searchLogFilters(urlquery url.Values) string {
+	filters := make(url.Values)
+	for _, parameter := range []string{"type", "platform", "category", "author", "published_from", "published_to", "sortby"} {
+		if value, ok := urlquery[parameter]; ok {
+			filters[parameter] = value
+		}
+	}
+
+	return filters.Encode()
+}
+
+// maxSearchPage is the last page of search results that can be requested, so
+// that the offset of a page can't overflow
+const maxSearchPage = 1000
+
+// SearchHandler is the search page. Results can be filtered by type, platform,
+// category, author and publication date, either in the URL query or with
+// qualifiers in the search query (see db.ParseSearchQuery), and come with the
+// number of matching apps for each value of these filters. They are paginated (`page` and
+// `limit`), and sorted according to `sortby` (relevance, popular, recent or
+// name). When the query seems to contain typos, a corrected query is suggested
+// in `did_you_mean`. Searches are recorded in the search log.
 func SearchHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
 	if _, ok := mux.Vars(r)["query"]; !ok {
 		return http.StatusBadRequest, errors.New("Invalid parameter 'query'")
 	}
 
-	cards, err := ctx.Database.Search(mux.Vars(r)["query"])
+	urlquery := r.URL.Query()
+
+	query, err := db.ParseSearchQuery(mux.Vars(r)["query"])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	filters, err := searchFilters(urlquery)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	filters, err = filters.Merge(query.Filters)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	page := 1
+	if p, ok := urlquery["page"]; ok {
+		if len(p) > 1 {
+			return http.StatusBadRequest, errors.New("Multiple 'page' parameters are not allowed")
+		}
+
+		page, err = strconv.Atoi(p[0])
+		if err != nil || page < 1 {
+			return http.StatusBadRequest, errors.New("Parameter 'page' should be a positive, non-nul integer")
+		} else if page > maxSearchPage {
+			return http.StatusBadRequest, errors.New("Parameter 'page' should be at most " + strconv.Itoa(maxSearchPage))
+		}
+	}
+
+	limit := 12
+	if l, ok := urlquery["limit"]; ok {
+		if len(l) > 1 {
+			return http.StatusBadRequest, errors.New("Multiple 'limit' parameters are not allowed")
+		}
+
+		limit, err = strconv.Atoi(l[0])
+		if err != nil {
+			return http.StatusBadRequest, errors.New("Specified 'limit' parameter is not a parsable integer")
+		}
+
+		if limit > 50 {
+			return http.StatusBadRequest, errors.New("Specified 'limit' parameter is above the maximum allowed")
+		} else if limit < 1 {
+			return http.StatusBadRequest, errors.New("Specified 'limit' parameter is below the minimum allowed")
+		}
+	}
+
+	sortby := "relevance"
+	if sb, ok := urlquery["sortby"]; ok {
+		if len(sb) > 1 {
+			return http.StatusBadRequest, errors.New("Multiple 'sortby' parameters are not allowed")
+		} else if sb[0] == "relevance" || sb[0] == "popular" || sb[0] == "recent" || sb[0] == "name" {
+			sortby = sb[0]
+		} else {
+			return http.StatusBadRequest, errors.New("Invalid 'sortby' parameter")
+		}
+	}
+
+	start := time.Now()
+	cards, err := ctx.Store().Search(query.Text, filters, sortby, (page-1)*limit, limit)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
+	ctx.logSearch(db.SearchLogEntry{
+		Query:   mux.Vars(r)["query"],
+		Time:    start,
+		Results: cards.Pagination.Total,
+		Filters: searchLogFilters(urlquery),
+		Latency: time.Since(start),
+	})
+	if cards.DidYouMean != "" {
+		cards.DidYouMean = query.WithText(cards.DidYouMean)
+	}
+
 	data, err := json.MarshalIndent(cards, "", "\t")
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -30,3 +183,26 @@ func SearchHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request)
 
 	return http.StatusOK, nil
 }
+
+// SuggestHandler returns the apps, authors and collections whose name matches
+// what the user is typing
+func SuggestHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	if _, ok := mux.Vars(r)["prefix"]; !ok {
+		return http.StatusBadRequest, errors.New("Invalid parameter 'prefix'")
+	}
+
+	suggestions, err := ctx.Store().Suggest(mux.Vars(r)["prefix"])
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	data, err := json.MarshalIndent(suggestions, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,253 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// searchLogDays is the number of days covered by the search log endpoints when
+// no range is given
+const searchLogDays = 30
+
+// searchIntervals are the lengths of the periods of the search history
+var searchIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// searchLogBuffer is the number of searches waiting to be logged, the searches
+// made while it is full aren't logged
+const searchLogBuffer = 1000
+
+// searchLogPruneInterval is how often the searches older than the retention
+// window are removed from the search log
+var searchLogPruneInterval = time.Hour
+
+// logSearch records a search in the search log in the background, so that
+// searches don't wait for it
+func (ctx *HandlerContext) logSearch(entry db.SearchLogEntry) {
+	ctx.searchLogLock.Lock()
+	defer ctx.searchLogLock.Unlock()
+
+	if ctx.searches == nil {
+		ctx.searches = make(chan db.SearchLogEntry, searchLogBuffer)
+		ctx.searchLogDone = make(chan struct{})
+		go ctx.writeSearchLog(ctx.searches, ctx.searchLogDone)
+	}
+
+	select {
+	case ctx.searches <- entry:
+	default:
+		log.Print("Could not log search: too many searches are waiting to be logged")
+	}
+}
+
+// writeSearchLog writes searches to the search log until it is closed, and
+// removes the searches older than the retention window when it starts and
+// every searchLogPruneInterval. Failing to log a search doesn't fail the search, the
+// error is only logged.
+func (ctx *HandlerContext) writeSearchLog(searches <-chan db.SearchLogEntry, done chan<- struct{}) {
+	defer close(done)
+
+	ctx.pruneSearchLog(time.Now())
+	prune := time.NewTicker(searchLogPruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case entry, ok := <-searches:
+			if !ok {
+				return
+			}
+			err := ctx.withStore(func(store db.Store) error {
+				return store.LogSearch(entry, ctx.SearchLog)
+			})
+			if err != nil {
+				log.Printf("Could not log search: %v", err)
+			}
+		case now := <-prune.C:
+			ctx.pruneSearchLog(now)
+		}
+	}
+}
+
+// pruneSearchLog removes the searches older than the retention window at now
+func (ctx *HandlerContext) pruneSearchLog(now time.Time) {
+	if ctx.SearchLog.Retention <= 0 {
+		return
+	}
+
+	err := ctx.withStore(func(store db.Store) error {
+		return store.PruneSearchLog(now.Add(-ctx.SearchLog.Retention))
+	})
+	if err != nil {
+		log.Printf("Could not prune the search log: %v", err)
+	}
+}
+
+// FlushSearchLog waits for the searches made so far to be logged. The next
+// search starts logging again.
+func (ctx *HandlerContext) FlushSearchLog() {
+	ctx.searchLogLock.Lock()
+	searches, done := ctx.searches, ctx.searchLogDone
+	ctx.searches, ctx.searchLogDone = nil, nil
+	ctx.searchLogLock.Unlock()
+
+	if searches != nil {
+		close(searches)
+		<-done
+	}
+}
+
+// SearchCountsResponse is the list of the top searches
+type SearchCountsResponse struct {
+	From     db.JSONTime      `json:"from"`
+	Until    db.JSONTime      `json:"until"`
+	Searches []db.SearchCount `json:"searches"`
+}
+
+// SearchHistoryResponse is the number of searches over time
+type SearchHistoryResponse struct {
+	From     db.JSONTime       `json:"from"`
+	Until    db.JSONTime       `json:"until"`
+	Interval string            `json:"interval"`
+	Periods  []db.SearchPeriod `json:"periods"`
+}
+
+// searchLogRange reads the range of days of the search log to look at. Both
+// `from` and `to` are days (YYYY-MM-DD) and are included in the range. The
+// range defaults to the last searchLogDays days.
+func searchLogRange(urlquery url.Values) (time.Time, time.Time, error) {
+	for _, parameter := range []string{"from", "to"} {
+		if len(urlquery[parameter]) > 1 {
+			return time.Time{}, time.Time{}, errors.New("Multiple '" + parameter + "' parameters are not allowed")
+		}
+	}
+
+	until := time.Now().UTC()
+	if o, ok := urlquery["to"]; ok {
+		to, err := time.Parse("2006-01-02", o[0])
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Parameter 'to' should be a date (YYYY-MM-DD)")
+		}
+		until = to.AddDate(0, 0, 1)
+	}
+
+	from := until.AddDate(0, 0, -searchLogDays)
+	if o, ok := urlquery["from"]; ok {
+		var err error
+		from, err = time.Parse("2006-01-02", o[0])
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Parameter 'from' should be a date (YYYY-MM-DD)")
+		}
+	}
+
+	if !from.Before(until) {
+		return time.Time{}, time.Time{}, errors.New("Parameter 'from' should be before 'to'")
+	}
+
+	return from, until, nil
+}
+
+// topSearches writes the queries searched the most, only the ones that had no
+// results if zeroResults is true
+func topSearches(ctx *HandlerContext, w http.ResponseWriter, r *http.Request, zeroResults bool) (int, error) {
+	urlquery := r.URL.Query()
+
+	from, until, err := searchLogRange(urlquery)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	limit := 20
+	if l, ok := urlquery["limit"]; ok {
+		if len(l) > 1 {
+			return http.StatusBadRequest, errors.New("Multiple 'limit' parameters are not allowed")
+		}
+
+		limit, err = strconv.Atoi(l[0])
+		if err != nil {
+			return http.StatusBadRequest, errors.New("Specified 'limit' parameter is not a parsable integer")
+		}
+
+		if limit > 100 {
+			return http.StatusBadRequest, errors.New("Specified 'limit' parameter is above the maximum allowed")
+		} else if limit < 1 {
+			return http.StatusBadRequest, errors.New("Specified 'limit' parameter is below the minimum allowed")
+		}
+	}
+
+	searches, err := ctx.Store().TopSearches(from, until, zeroResults, limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	data, err := json.MarshalIndent(SearchCountsResponse{db.JSONTime{Time: from}, db.JSONTime{Time: until}, searches}, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+
+	return http.StatusOK, nil
+}
+
+// AdminTopSearchesHandler lists the queries searched the most, between the
+// days `from` and `to` (the last 30 days by default)
+func AdminTopSearchesHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return topSearches(ctx, w, r, false)
+}
+
+// AdminZeroResultSearchesHandler lists the queries that had no results the
+// most often, between the days `from` and `to` (the last 30 days by default)
+func AdminZeroResultSearchesHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return topSearches(ctx, w, r, true)
+}
+
+// AdminSearchHistoryHandler gives the number of searches per hour or per day
+// (`interval`), between the days `from` and `to` (the last 30 days by
+// default)
+func AdminSearchHistoryHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	urlquery := r.URL.Query()
+
+	from, until, err := searchLogRange(urlquery)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	interval := "day"
+	if i, ok := urlquery["interval"]; ok {
+		if len(i) > 1 {
+			return http.StatusBadRequest, errors.New("Multiple 'interval' parameters are not allowed")
+		} else if _, ok := searchIntervals[i[0]]; !ok {
+			return http.StatusBadRequest, errors.New("Invalid 'interval' parameter")
+		}
+		interval = i[0]
+	}
+	if until.Sub(from)/searchIntervals[interval] >= db.MaxSearchPeriods {
+		return http.StatusBadRequest, errors.New("Too many periods, use a longer interval or a shorter range")
+	}
+
+	periods, err := ctx.Store().SearchHistory(from, until, searchIntervals[interval])
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	data, err := json.MarshalIndent(SearchHistoryResponse{db.JSONTime{Time: from}, db.JSONTime{Time: until}, interval, periods}, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+
+	return http.StatusOK, nil
+}
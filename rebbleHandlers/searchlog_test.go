@@ -0,0 +1,110 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pebble-dev/rebblestore-api/db"
+)
+
+// TestSearchLog checks the search log endpoints against their own store, as
+// the searches of the other tests are logged in the store of the test server
+func TestSearchLog(t *testing.T) {
+	store := db.NewMemoryStore()
+	err := db.LoadFixture(store, "db/testdata/catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &HandlerContext{Database: store}
+	r := Handlers(ctx)
+
+	get := func(path string, status int, v interface{}) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "localhost"
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+
+		if res.Code != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, res.Code)
+		}
+		if v != nil {
+			err := json.Unmarshal(res.Body.Bytes(), v)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+	}
+
+	get("/dev/apps/search/weather", http.StatusOK, nil)
+	get("/dev/apps/search/weather?type=watchapp", http.StatusOK, nil)
+	get("/dev/apps/search/nothing%20matches", http.StatusOK, nil)
+	get("/dev/apps/search/weather?type=app", http.StatusBadRequest, nil)
+	ctx.FlushSearchLog()
+
+	var top SearchCountsResponse
+	get("/admin/search/top", http.StatusOK, &top)
+	if len(top.Searches) != 2 || top.Searches[0].Query != "weather" || top.Searches[0].Count != 2 || top.Searches[1].Query != "nothing matches" {
+		t.Errorf("unexpected top searches %+v", top.Searches)
+	}
+
+	get("/admin/search/zero_results?limit=5", http.StatusOK, &top)
+	if len(top.Searches) != 1 || top.Searches[0].Query != "nothing matches" {
+		t.Errorf("unexpected zero result searches %+v", top.Searches)
+	}
+
+	var history SearchHistoryResponse
+	get("/admin/search/history?interval=hour&from=2017-03-01&to=2017-03-02", http.StatusOK, &history)
+	if len(history.Periods) != 48 || history.Interval != "hour" {
+		t.Errorf("expected 48 hours, got %d %ss", len(history.Periods), history.Interval)
+	}
+	get("/admin/search/history", http.StatusOK, &history)
+	searches := 0
+	for _, period := range history.Periods {
+		searches += period.Searches
+	}
+	if searches != 3 {
+		t.Errorf("expected 3 searches in the history, got %d", searches)
+	}
+
+	get("/admin/search/top?limit=0", http.StatusBadRequest, nil)
+	get("/admin/search/top?from=2017-13-01", http.StatusBadRequest, nil)
+	get("/admin/search/top?from=2017-03-02&to=2017-03-01", http.StatusBadRequest, nil)
+	get("/admin/search/history?interval=week", http.StatusBadRequest, nil)
+	get("/admin/search/history?interval=hour&from=2016-01-01&to=2017-01-01", http.StatusBadRequest, nil)
+}
+
+// TestSearchLogRetention checks that searches are logged in the background and
+// that the searches older than the retention window are removed
+func TestSearchLogRetention(t *testing.T) {
+	store := db.NewMemoryStore()
+	err := db.LoadFixture(store, "db/testdata/catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = store.LogSearch(db.SearchLogEntry{Query: "clock", Time: now.AddDate(0, 0, -10)}, db.SearchLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &HandlerContext{Database: store, SearchLog: db.SearchLogOptions{Retention: 7 * 24 * time.Hour}}
+	r := Handlers(ctx)
+
+	req := httptest.NewRequest("GET", "/dev/apps/search/weather", nil)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, res.Code)
+	}
+	ctx.FlushSearchLog()
+
+	top, err := store.TopSearches(now.AddDate(0, 0, -30), now.Add(time.Hour), false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].Query != "weather" {
+		t.Errorf("expected the recent search only, got %+v", top)
+	}
+}